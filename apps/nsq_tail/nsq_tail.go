@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/app"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/version"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	topic         = flag.String("topic", "", "NSQ topic")
+	channel       = flag.String("channel", "", "NSQ channel (defaults to a random #ephemeral channel)")
+	maxInFlight   = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
+	totalMessages = flag.Int("n", 0, "total messages to show (will wait if starved)")
+	printTopic    = flag.Bool("print-topic", false, "print topic name where message was received (raw output only)")
+	output        = flag.String("output", "raw", "output format: raw (message body) or json (with id, timestamp and attempts)")
+
+	nsqdTCPAddrs     = app.StringArray{}
+	lookupdHTTPAddrs = app.StringArray{}
+)
+
+func init() {
+	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
+	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+}
+
+// json输出的格式，每条消息一行
+type jsonMessage struct {
+	Topic     string            `json:"topic"`
+	ID        string            `json:"id"`
+	Timestamp string            `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body"`
+}
+
+type tailHandler struct {
+	topicName     string
+	totalMessages int
+	messagesShown int
+	format        string
+	printTopic    bool
+
+	// 多个Handler协程共用stdout
+	mtx  sync.Mutex
+	w    *bufio.Writer
+	done chan struct{}
+}
+
+func (th *tailHandler) HandleMessage(m *client.Message) error {
+	th.mtx.Lock()
+	defer th.mtx.Unlock()
+
+	// 已经显示够了，之后收到的消息不再输出
+	if th.totalMessages > 0 && th.messagesShown >= th.totalMessages {
+		return nil
+	}
+	th.messagesShown++
+
+	var err error
+	switch th.format {
+	case "json":
+		err = json.NewEncoder(th.w).Encode(&jsonMessage{
+			Topic:     th.topicName,
+			ID:        string(m.ID[:]),
+			Timestamp: time.Unix(0, m.Timestamp).Format(time.RFC3339Nano),
+			Attempts:  m.Attempts,
+			Headers:   m.Headers,
+			Body:      string(m.Body),
+		})
+	default:
+		if th.printTopic {
+			_, err = th.w.WriteString(th.topicName + " | ")
+		}
+		if err == nil {
+			_, err = th.w.Write(m.Body)
+		}
+		if err == nil {
+			err = th.w.WriteByte('\n')
+		}
+	}
+	if err == nil {
+		err = th.w.Flush()
+	}
+	if err != nil {
+		log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
+	}
+
+	if th.totalMessages > 0 && th.messagesShown == th.totalMessages {
+		close(th.done)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_tail v%s\n", version.Binary)
+		return
+	}
+
+	if *channel == "" {
+		rand.Seed(time.Now().UnixNano())
+		*channel = fmt.Sprintf("tail%06d#ephemeral", rand.Int()%999999)
+	}
+
+	if *topic == "" {
+		log.Fatal("--topic is required")
+	}
+
+	if len(nsqdTCPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--nsqd-tcp-address or --lookupd-http-address required")
+	}
+	if len(nsqdTCPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
+		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
+	}
+
+	if *output != "raw" && *output != "json" {
+		log.Fatalf("invalid --output %q, must be raw or json", *output)
+	}
+
+	// 不要一次拿太多消息
+	if *totalMessages > 0 && *totalMessages < *maxInFlight {
+		*maxInFlight = *totalMessages
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	cfg := client.NewConfig()
+	cfg.UserAgent = fmt.Sprintf("nsq_tail/%s", version.Binary)
+	cfg.MaxInFlight = *maxInFlight
+
+	consumer, err := client.NewConsumer(*topic, *channel, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	consumer.SetLogger(log.New(os.Stderr, "", log.Flags()), lg.WARN)
+
+	handler := &tailHandler{
+		topicName:     *topic,
+		totalMessages: *totalMessages,
+		format:        *output,
+		printTopic:    *printTopic,
+		w:             bufio.NewWriter(os.Stdout),
+		done:          make(chan struct{}),
+	}
+	consumer.AddHandler(handler)
+
+	err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = consumer.ConnectToNSQLookupds(lookupdHTTPAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case <-handler.done:
+	case <-sigChan:
+	case <-consumer.StopChan:
+		return
+	}
+	consumer.Stop()
+	<-consumer.StopChan
+}
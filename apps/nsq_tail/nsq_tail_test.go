@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"nsq-learn/nsqd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustStartNSQD(t *testing.T) (*nsqd.NSQD, *nsqd.Options) {
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		panic(err)
+	}
+	opts.DataPath = tmpDir
+	n := nsqd.New(opts)
+	n.Main()
+	return n, opts
+}
+
+// 用临时channel订阅topic，handler显示够-n条后停止
+func tail(t *testing.T, n *nsqd.NSQD, th *tailHandler) {
+	cfg := client.NewConfig()
+	cfg.MaxInFlight = 10
+	consumer, err := client.NewConsumer(th.topicName, "tail#ephemeral", cfg)
+	assert.Nil(t, err)
+	consumer.SetLogger(test.NewTestLogger(t), lg.WARN)
+	consumer.AddHandler(th)
+	assert.Nil(t, consumer.ConnectToNSQDs([]string{n.RealTCPAddr().String()}))
+
+	select {
+	case <-th.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+	consumer.Stop()
+	<-consumer.StopChan
+}
+
+func newTailHandler(topicName string, total int, format string, buf *bytes.Buffer) *tailHandler {
+	return &tailHandler{
+		topicName:     topicName,
+		totalMessages: total,
+		format:        format,
+		w:             bufio.NewWriter(buf),
+		done:          make(chan struct{}),
+	}
+}
+
+func TestTailRaw(t *testing.T) {
+	n, opts := mustStartNSQD(t)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	p, err := client.NewProducer(n.RealTCPAddr().String(), client.NewConfig())
+	assert.Nil(t, err)
+	p.SetLogger(nil, lg.INFO)
+	defer p.Stop()
+	// 先创建topic，临时channel订阅之前发布的消息会留在topic里
+	for _, body := range []string{"m0", "m1", "m2"} {
+		assert.Nil(t, p.Publish("tail_raw", []byte(body)))
+	}
+
+	var buf bytes.Buffer
+	th := newTailHandler("tail_raw", 2, "raw", &buf)
+	th.printTopic = true
+	tail(t, n, th)
+
+	// -n 2只显示前两条
+	assert.Equal(t, "tail_raw | m0\ntail_raw | m1\n", buf.String())
+	assert.Nil(t, th.HandleMessage(client.NewMessage(client.MessageID{}, []byte("m3"))))
+	assert.Equal(t, 2, th.messagesShown)
+	assert.Equal(t, "tail_raw | m0\ntail_raw | m1\n", buf.String())
+}
+
+func TestTailJSON(t *testing.T) {
+	n, opts := mustStartNSQD(t)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	p, err := client.NewProducer(n.RealTCPAddr().String(), client.NewConfig())
+	assert.Nil(t, err)
+	p.SetLogger(nil, lg.INFO)
+	defer p.Stop()
+	start := time.Now()
+	assert.Nil(t, p.PublishWithHeaders("tail_json", map[string]string{"trace-id": "abc"}, []byte("hello")))
+
+	var buf bytes.Buffer
+	th := newTailHandler("tail_json", 1, "json", &buf)
+	// json输出不受-print-topic影响
+	th.printTopic = true
+	tail(t, n, th)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var m jsonMessage
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &m))
+	assert.Equal(t, "tail_json", m.Topic)
+	assert.Equal(t, client.MsgIDLength, len(m.ID))
+	ts, err := time.Parse(time.RFC3339Nano, m.Timestamp)
+	assert.Nil(t, err)
+	assert.True(t, !ts.Before(start.Truncate(time.Second)) && ts.Before(time.Now()), m.Timestamp)
+	assert.Equal(t, uint16(1), m.Attempts)
+	assert.Equal(t, map[string]string{"trace-id": "abc"}, m.Headers)
+	assert.Equal(t, "hello", m.Body)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/lg"
+)
+
+// 把一个topic的消息按行写到文件，消息在写入并按fsync策略落盘后才FIN
+type FileLogger struct {
+	logf     lg.AppLogFunc
+	opts     *Options
+	topic    string
+	consumer *client.Consumer
+
+	out        *os.File
+	writer     *bufio.Writer
+	gzipWriter *gzip.Writer
+	// 当前文件的路径、打开时的<DATETIME>和时间，以及写入的字节数（压缩前）
+	filename string
+	datetime string
+	openTime time.Time
+	filesize int64
+	// 下一次打开文件时先尝试的<REV>，文件已经存在时加1
+	rev int
+
+	logChan  chan *client.Message
+	hupChan  chan bool
+	exitChan <-chan struct{}
+}
+
+func NewFileLogger(logf lg.AppLogFunc, opts *Options, topic string, cfg *client.Config,
+	exitChan <-chan struct{}) (*FileLogger, error) {
+	consumer, err := client.NewConsumer(topic, opts.Channel, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileLogger{
+		logf:     logf,
+		opts:     opts,
+		topic:    topic,
+		consumer: consumer,
+		logChan:  make(chan *client.Message, 1),
+		hupChan:  make(chan bool, 1),
+		exitChan: exitChan,
+	}
+	consumer.AddHandler(f)
+	return f, nil
+}
+
+// 消息交给router写文件，router负责FIN
+func (f *FileLogger) HandleMessage(m *client.Message) error {
+	m.DisableAutoResponse()
+	f.logChan <- m
+	return nil
+}
+
+// 写文件的主循环，exitChan关闭后停止消费，Consumer退出后关闭文件
+func (f *FileLogger) router() {
+	pending := make([]*client.Message, 0, f.opts.MaxInFlight)
+
+	// interval策略按SyncInterval落盘，其它策略只需要定时检查是否轮转
+	tickInterval := time.Second
+	if f.opts.FsyncPolicy == fsyncInterval {
+		tickInterval = f.opts.SyncInterval
+	}
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	exitChan := f.exitChan
+	closing := false
+	for {
+		select {
+		case <-f.consumer.StopChan:
+			f.commit(pending)
+			f.closeFile()
+			f.logf(lg.INFO, "[%s] exiting", f.topic)
+			return
+		case <-exitChan:
+			exitChan = nil
+			closing = true
+			f.consumer.Stop()
+			pending = f.commit(pending)
+		case <-f.hupChan:
+			// 收到SIGHUP时关闭当前文件，下一条消息写到新文件
+			pending = f.commit(pending)
+			f.closeFile()
+		case <-ticker.C:
+			if f.opts.FsyncPolicy == fsyncInterval {
+				pending = f.commit(pending)
+			}
+			if f.needsRotation() {
+				pending = f.commit(pending)
+				f.closeFile()
+			}
+		case m := <-f.logChan:
+			if f.needsRotation() {
+				pending = f.commit(pending)
+				f.closeFile()
+			}
+			err := f.write(m)
+			if err != nil {
+				// 写失败的消息重新入队，下一条消息重新打开文件
+				f.logf(lg.ERROR, "[%s] failed to write message - %s", f.topic, err)
+				m.Requeue(-1)
+				pending = f.requeue(pending)
+				f.closeFile()
+				continue
+			}
+			pending = append(pending, m)
+			if f.opts.FsyncPolicy != fsyncInterval || closing || len(pending) == cap(pending) {
+				pending = f.commit(pending)
+			}
+		}
+	}
+}
+
+// 文件名模板替换，<REV>为0时为空，否则为-000001这样的后缀
+func (f *FileLogger) makeFilename(datetime string, rev int) string {
+	revStr := ""
+	if rev > 0 {
+		revStr = fmt.Sprintf("-%06d", rev)
+	}
+	name := strings.NewReplacer(
+		"<TOPIC>", f.topic,
+		"<HOST>", f.opts.HostIdentifier,
+		"<DATETIME>", datetime,
+		"<PID>", strconv.Itoa(os.Getpid()),
+		"<REV>", revStr,
+	).Replace(f.opts.FilenameFormat)
+	if f.opts.GZIP && !strings.HasSuffix(name, ".gz") {
+		name += ".gz"
+	}
+	return filepath.Join(f.opts.OutputDir, name)
+}
+
+func (f *FileLogger) needsRotation() bool {
+	if f.out == nil {
+		return false
+	}
+	if strings.Contains(f.opts.FilenameFormat, "<DATETIME>") &&
+		strftime(f.opts.DatetimeFormat, time.Now()) != f.datetime {
+		return true
+	}
+	if f.opts.RotateSize > 0 && f.filesize >= f.opts.RotateSize {
+		return true
+	}
+	if f.opts.RotateInterval > 0 && time.Since(f.openTime) >= f.opts.RotateInterval {
+		return true
+	}
+	return false
+}
+
+// 打开新文件，已经存在的文件不会覆盖也不会追加（gzip不能追加），而是增加<REV>
+func (f *FileLogger) openFile() error {
+	now := time.Now()
+	datetime := strftime(f.opts.DatetimeFormat, now)
+	if datetime != f.datetime {
+		f.rev = 0
+	}
+
+	for {
+		filename := f.makeFilename(datetime, f.rev)
+		err := os.MkdirAll(filepath.Dir(filename), 0770)
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			f.rev++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		f.logf(lg.INFO, "[%s] opening %s", f.topic, filename)
+		f.out = out
+		f.filename = filename
+		f.datetime = datetime
+		f.openTime = now
+		f.filesize = 0
+		if f.opts.GZIP {
+			f.gzipWriter, _ = gzip.NewWriterLevel(out, f.opts.GZIPLevel)
+			f.writer = bufio.NewWriter(f.gzipWriter)
+		} else {
+			f.writer = bufio.NewWriter(out)
+		}
+		return nil
+	}
+}
+
+// 写一行，文件没有打开时先打开
+func (f *FileLogger) write(m *client.Message) error {
+	if f.out == nil {
+		err := f.openFile()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := f.writer.Write(m.Body)
+	f.filesize += int64(n)
+	if err != nil {
+		return err
+	}
+	err = f.writer.WriteByte('\n')
+	if err != nil {
+		return err
+	}
+	f.filesize++
+	return nil
+}
+
+// 按fsync策略把缓冲写到文件，成功后FIN，失败时重新入队并关闭文件
+func (f *FileLogger) commit(pending []*client.Message) []*client.Message {
+	if len(pending) == 0 {
+		return pending
+	}
+
+	err := f.flush(f.opts.FsyncPolicy != fsyncNever)
+	if err != nil {
+		f.logf(lg.ERROR, "[%s] failed to sync %s - %s", f.topic, f.filename, err)
+		pending = f.requeue(pending)
+		f.closeFile()
+		return pending
+	}
+
+	for _, m := range pending {
+		m.Finish()
+	}
+	return pending[:0]
+}
+
+func (f *FileLogger) requeue(pending []*client.Message) []*client.Message {
+	for _, m := range pending {
+		m.Requeue(-1)
+	}
+	return pending[:0]
+}
+
+func (f *FileLogger) flush(sync bool) error {
+	if f.out == nil {
+		return nil
+	}
+	err := f.writer.Flush()
+	if err != nil {
+		return err
+	}
+	if f.gzipWriter != nil {
+		err = f.gzipWriter.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if sync {
+		return f.out.Sync()
+	}
+	return nil
+}
+
+// 关闭当前文件，gzip写入结尾，总是fsync
+func (f *FileLogger) closeFile() {
+	if f.out == nil {
+		return
+	}
+	err := f.writer.Flush()
+	if err == nil && f.gzipWriter != nil {
+		err = f.gzipWriter.Close()
+	}
+	if err == nil {
+		err = f.out.Sync()
+	}
+	if err != nil {
+		f.logf(lg.ERROR, "[%s] failed to finish %s - %s", f.topic, f.filename, err)
+	}
+	f.out.Close()
+	f.logf(lg.INFO, "[%s] closing %s", f.topic, f.filename)
+
+	f.out = nil
+	f.writer = nil
+	f.gzipWriter = nil
+}
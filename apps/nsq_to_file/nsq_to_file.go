@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/app"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/version"
+)
+
+func flagSet(opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet("nsq_to_file", flag.ExitOnError)
+
+	fs.Bool("version", false, "print version string")
+	fs.String("log-level", "info", "set log verbosity: debug, info, warn, error, or fatal")
+
+	fs.Var((*app.StringArray)(&opts.Topics), "topic", "nsq topic (may be given multiple times)")
+	fs.StringVar(&opts.TopicPattern, "topic-pattern", opts.TopicPattern, "only log topics matching the following pattern (discovered through lookupd)")
+	fs.DurationVar(&opts.TopicRefreshInterval, "topic-refresh", opts.TopicRefreshInterval, "how frequently the topic list should be refreshed")
+	fs.StringVar(&opts.Channel, "channel", opts.Channel, "nsq channel")
+	fs.IntVar(&opts.MaxInFlight, "max-in-flight", opts.MaxInFlight, "max number of messages to allow in flight (also the fsync batch size)")
+
+	fs.Var((*app.StringArray)(&opts.NSQDTCPAddrs), "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
+	fs.Var((*app.StringArray)(&opts.NSQLookupdHTTPAddrs), "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+
+	fs.StringVar(&opts.OutputDir, "output-dir", opts.OutputDir, "directory to write output files to")
+	fs.StringVar(&opts.DatetimeFormat, "datetime-format", opts.DatetimeFormat, "strftime compatible format for <DATETIME> in filename format")
+	fs.StringVar(&opts.FilenameFormat, "filename-format", opts.FilenameFormat, "output filename format (<TOPIC>, <HOST>, <PID>, <DATETIME>, <REV> are replaced. <REV> is increased when file already exists)")
+	fs.StringVar(&opts.HostIdentifier, "host-identifier", opts.HostIdentifier, "value to output in log filename in place of <HOST>")
+
+	fs.BoolVar(&opts.GZIP, "gzip", false, "gzip output files")
+	fs.IntVar(&opts.GZIPLevel, "gzip-level", opts.GZIPLevel, "gzip compression level (1-9, 1=BestSpeed, 9=BestCompression)")
+
+	fs.Int64Var(&opts.RotateSize, "rotate-size", opts.RotateSize, "rotate the file when it grows bigger than `rotate-size` bytes (before compression)")
+	fs.DurationVar(&opts.RotateInterval, "rotate-interval", opts.RotateInterval, "rotate the file every duration")
+
+	fs.StringVar(&opts.FsyncPolicy, "fsync", opts.FsyncPolicy, "when to fsync before FIN: always, interval or never")
+	fs.DurationVar(&opts.SyncInterval, "sync-interval", opts.SyncInterval, "sync file to disk every interval (fsync=interval)")
+
+	return fs
+}
+
+func main() {
+	opts := NewOptions()
+	fs := flagSet(opts)
+	fs.Parse(os.Args[1:])
+
+	if fs.Lookup("version").Value.(flag.Getter).Get().(bool) {
+		fmt.Printf("nsq_to_file v%s\n", version.Binary)
+		return
+	}
+
+	logLevel, err := lg.ParseLogLevel(fs.Lookup("log-level").Value.String(), false)
+	if err != nil {
+		log.Fatal("--log-level is invalid")
+	}
+	opts.LogLevel = logLevel
+
+	err = opts.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := client.NewConfig()
+	cfg.UserAgent = fmt.Sprintf("nsq_to_file/%s", version.Binary)
+	cfg.MaxInFlight = opts.MaxInFlight
+
+	hupChan := make(chan os.Signal, 1)
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+
+	logger := log.New(os.Stderr, "[nsq_to_file] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	discoverer := newTopicDiscoverer(logger, opts, cfg, hupChan, termChan)
+	discoverer.run()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"nsq-learn/nsqd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustStartNSQD(t *testing.T) (*nsqd.NSQD, *nsqd.Options) {
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		panic(err)
+	}
+	opts.DataPath = tmpDir
+	n := nsqd.New(opts)
+	n.Main()
+	return n, opts
+}
+
+func publish(t *testing.T, n *nsqd.NSQD, topic string, bodies ...string) {
+	p, err := client.NewProducer(n.RealTCPAddr().String(), client.NewConfig())
+	assert.Nil(t, err)
+	p.SetLogger(nil, lg.INFO)
+	defer p.Stop()
+	for _, body := range bodies {
+		assert.Nil(t, p.Publish(topic, []byte(body)))
+	}
+}
+
+// 等channel里的消息都FIN
+func waitForDrained(t *testing.T, n *nsqd.NSQD, topic string, channel string, count uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := n.GetStats(topic, channel)
+		if len(stats) == 1 && len(stats[0].Channels) == 1 {
+			c := stats[0].Channels[0]
+			if c.MessageCount == count && c.Depth == 0 && c.InFlightCount == 0 && c.DeferredCount == 0 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("channel %s/%s not drained", topic, channel)
+}
+
+// 启动TopicDiscoverer，返回的函数发送SIGTERM并等待退出
+func startDiscoverer(t *testing.T, opts *Options) func() {
+	assert.Nil(t, opts.Validate())
+	cfg := client.NewConfig()
+	cfg.MaxInFlight = opts.MaxInFlight
+	cfg.LookupdPollInterval = 100 * time.Millisecond
+
+	termChan := make(chan os.Signal, 1)
+	discoverer := newTopicDiscoverer(test.NewTestLogger(t), opts, cfg, make(chan os.Signal, 1), termChan)
+	done := make(chan struct{})
+	go func() {
+		discoverer.run()
+		close(done)
+	}()
+	return func() {
+		termChan <- syscall.SIGTERM
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("nsq_to_file did not exit")
+		}
+	}
+}
+
+func readLines(t *testing.T, filename string) []string {
+	f, err := os.Open(filename)
+	assert.Nil(t, err)
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gr, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		r = gr
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Nil(t, scanner.Err())
+	return lines
+}
+
+func TestNsqToFileRotateGzip(t *testing.T) {
+	n, nsqdOpts := mustStartNSQD(t)
+	defer os.RemoveAll(nsqdOpts.DataPath)
+	defer n.Exit()
+
+	outputDir, err := ioutil.TempDir("", "nsq_to_file-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outputDir)
+
+	var bodies []string
+	for i := 0; i < 20; i++ {
+		bodies = append(bodies, fmt.Sprintf("message-%02d", i))
+	}
+	publish(t, n, "archive", bodies...)
+
+	opts := NewOptions()
+	opts.Topics = []string{"archive"}
+	opts.NSQDTCPAddrs = []string{n.RealTCPAddr().String()}
+	opts.OutputDir = outputDir
+	opts.HostIdentifier = "testhost"
+	opts.GZIP = true
+	opts.RotateSize = 50
+	opts.SyncInterval = 50 * time.Millisecond
+	stop := startDiscoverer(t, opts)
+
+	waitForDrained(t, n, "archive", opts.Channel, 20)
+	stop()
+
+	files, err := filepath.Glob(filepath.Join(outputDir, "archive.testhost*.log.gz"))
+	assert.Nil(t, err)
+	sort.Strings(files)
+	// 每个文件超过50字节后轮转，同一个<DATETIME>内<REV>递增
+	assert.True(t, len(files) > 1, "files: %v", files)
+	datetime := strftime(opts.DatetimeFormat, time.Now())
+	assert.Equal(t, filepath.Join(outputDir, "archive.testhost."+datetime+".log.gz"), files[len(files)-1])
+	assert.Equal(t, filepath.Join(outputDir, "archive.testhost-000001."+datetime+".log.gz"), files[0])
+
+	var lines []string
+	for _, f := range files {
+		lines = append(lines, readLines(t, f)...)
+	}
+	sort.Strings(lines)
+	assert.Equal(t, bodies, lines)
+}
+
+func TestNsqToFileTopicPattern(t *testing.T) {
+	n, nsqdOpts := mustStartNSQD(t)
+	defer os.RemoveAll(nsqdOpts.DataPath)
+	defer n.Exit()
+
+	outputDir, err := ioutil.TempDir("", "nsq_to_file-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outputDir)
+
+	publish(t, n, "pattern_a", "a1", "a2", "a3")
+	publish(t, n, "other_b", "b1")
+
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/topics":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"topics": []string{"other_b", "pattern_a"},
+			})
+		case "/lookup":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"channels": []string{},
+				"producers": []map[string]interface{}{{
+					"broadcast_address": "127.0.0.1",
+					"tcp_port":          n.RealTCPAddr().Port,
+				}},
+			})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer lookupd.Close()
+
+	opts := NewOptions()
+	opts.TopicPattern = "^pattern_"
+	opts.NSQLookupdHTTPAddrs = []string{lookupd.Listener.Addr().String()}
+	opts.OutputDir = outputDir
+	opts.HostIdentifier = "testhost"
+	opts.FilenameFormat = "<TOPIC>/<HOST><REV>.log"
+	opts.FsyncPolicy = fsyncAlways
+	stop := startDiscoverer(t, opts)
+
+	waitForDrained(t, n, "pattern_a", opts.Channel, 3)
+	stop()
+
+	assert.Equal(t, []string{"a1", "a2", "a3"}, readLines(t, filepath.Join(outputDir, "pattern_a", "testhost.log")))
+	// 不匹配的topic没有订阅
+	_, err = os.Stat(filepath.Join(outputDir, "other_b"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, len(n.GetStats("other_b", "")[0].Channels))
+}
+
+func TestOptionsValidate(t *testing.T) {
+	opts := NewOptions()
+	opts.Topics = []string{"t"}
+	opts.NSQDTCPAddrs = []string{"127.0.0.1:4150"}
+	assert.Nil(t, opts.Validate())
+
+	opts.FilenameFormat = "<TOPIC>.log"
+	assert.NotNil(t, opts.Validate())
+
+	opts = NewOptions()
+	opts.TopicPattern = "^a"
+	opts.NSQDTCPAddrs = []string{"127.0.0.1:4150"}
+	assert.NotNil(t, opts.Validate())
+
+	opts = NewOptions()
+	opts.Topics = []string{"t"}
+	opts.NSQDTCPAddrs = []string{"127.0.0.1:4150"}
+	opts.FsyncPolicy = "sometimes"
+	assert.NotNil(t, opts.Validate())
+}
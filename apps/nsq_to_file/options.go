@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"nsq-learn/internal/lg"
+)
+
+// 写文件后什么时候fsync，fsync之后才FIN消息
+const (
+	fsyncAlways   = "always"   // 每条消息都fsync
+	fsyncInterval = "interval" // 每隔SyncInterval或者攒够MaxInFlight条消息fsync一次
+	fsyncNever    = "never"    // 只写到操作系统，写完就FIN，关闭文件时才fsync
+)
+
+type Options struct {
+	Topics               []string
+	TopicPattern         string
+	TopicRefreshInterval time.Duration
+	Channel              string
+	MaxInFlight          int
+
+	NSQDTCPAddrs        []string
+	NSQLookupdHTTPAddrs []string
+
+	OutputDir      string
+	DatetimeFormat string // 文件名中<DATETIME>的格式，strftime格式，变化时轮转文件
+	FilenameFormat string // 文件名模板，支持<TOPIC> <HOST> <REV> <DATETIME> <PID>
+	HostIdentifier string // 文件名中的<HOST>，默认为短主机名
+
+	GZIP      bool
+	GZIPLevel int
+
+	RotateSize     int64         // 写入的字节数（压缩前）超过后轮转，0表示不按大小轮转
+	RotateInterval time.Duration // 文件打开超过这个时间后轮转，0表示不按时间轮转
+
+	FsyncPolicy  string
+	SyncInterval time.Duration
+
+	LogLevel lg.LogLevel
+
+	topicRegexp *regexp.Regexp
+}
+
+func NewOptions() *Options {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &Options{
+		TopicRefreshInterval: time.Minute,
+		Channel:              "nsq_to_file",
+		MaxInFlight:          200,
+
+		OutputDir:      "/tmp",
+		DatetimeFormat: "%Y-%m-%d_%H",
+		FilenameFormat: "<TOPIC>.<HOST><REV>.<DATETIME>.log",
+		HostIdentifier: strings.Split(hostname, ".")[0],
+
+		GZIPLevel: 6,
+
+		FsyncPolicy:  fsyncInterval,
+		SyncInterval: 30 * time.Second,
+
+		LogLevel: lg.INFO,
+	}
+}
+
+// 检查参数，编译topic的正则
+func (o *Options) Validate() error {
+	if len(o.Topics) == 0 && o.TopicPattern == "" {
+		return errors.New("--topic or --topic-pattern required")
+	}
+	if len(o.Topics) > 0 && o.TopicPattern != "" {
+		return errors.New("use --topic or --topic-pattern not both")
+	}
+	if o.TopicPattern != "" {
+		if len(o.NSQLookupdHTTPAddrs) == 0 {
+			return errors.New("--topic-pattern requires --lookupd-http-address")
+		}
+		re, err := regexp.Compile(o.TopicPattern)
+		if err != nil {
+			return fmt.Errorf("invalid --topic-pattern - %s", err)
+		}
+		o.topicRegexp = re
+	}
+
+	if len(o.NSQDTCPAddrs) == 0 && len(o.NSQLookupdHTTPAddrs) == 0 {
+		return errors.New("--nsqd-tcp-address or --lookupd-http-address required")
+	}
+	if len(o.NSQDTCPAddrs) > 0 && len(o.NSQLookupdHTTPAddrs) > 0 {
+		return errors.New("use --nsqd-tcp-address or --lookupd-http-address not both")
+	}
+
+	if o.MaxInFlight <= 0 {
+		return errors.New("--max-in-flight must be positive")
+	}
+
+	// 每个topic一个文件，轮转或者重启后用<REV>区分
+	if !strings.Contains(o.FilenameFormat, "<TOPIC>") {
+		return errors.New("--filename-format must contain <TOPIC>")
+	}
+	if !strings.Contains(o.FilenameFormat, "<REV>") {
+		return errors.New("--filename-format must contain <REV>")
+	}
+
+	if o.GZIP && (o.GZIPLevel < 1 || o.GZIPLevel > 9) {
+		return fmt.Errorf("invalid --gzip-level %d, must be 1-9", o.GZIPLevel)
+	}
+	if o.RotateSize < 0 || o.RotateInterval < 0 {
+		return errors.New("--rotate-size and --rotate-interval must not be negative")
+	}
+
+	switch o.FsyncPolicy {
+	case fsyncAlways, fsyncNever:
+	case fsyncInterval:
+		if o.SyncInterval <= 0 {
+			return errors.New("--sync-interval must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid --fsync %q, must be always, interval or never", o.FsyncPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// strftime格式转换成Go的时间格式，只支持文件名常用的几个
+var strftimeReplacer = strings.NewReplacer(
+	"%Y", "2006",
+	"%y", "06",
+	"%m", "01",
+	"%d", "02",
+	"%H", "15",
+	"%M", "04",
+	"%S", "05",
+	"%%", "%",
+)
+
+func strftime(format string, t time.Time) string {
+	return t.Format(strftimeReplacer.Replace(format))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/http_api"
+	"nsq-learn/internal/lg"
+)
+
+// 给每个topic启动一个FileLogger，指定了--topic-pattern时定时从lookupd发现新的topic
+type TopicDiscoverer struct {
+	logger     lg.Logger
+	logf       lg.AppLogFunc
+	opts       *Options
+	cfg        *client.Config
+	httpClient *http_api.Client
+
+	topics   map[string]*FileLogger
+	hupChan  chan os.Signal
+	termChan chan os.Signal
+	// 收到termChan后关闭，通知所有FileLogger退出
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newTopicDiscoverer(logger lg.Logger, opts *Options, cfg *client.Config,
+	hupChan chan os.Signal, termChan chan os.Signal) *TopicDiscoverer {
+	return &TopicDiscoverer{
+		logger: logger,
+		logf: func(lvl lg.LogLevel, f string, args ...interface{}) {
+			lg.Logf(logger, opts.LogLevel, lvl, f, args...)
+		},
+		opts:       opts,
+		cfg:        cfg,
+		httpClient: http_api.NewClient(nil, cfg.DialTimeout, cfg.HTTPTimeout),
+		topics:     make(map[string]*FileLogger),
+		hupChan:    hupChan,
+		termChan:   termChan,
+		exitChan:   make(chan struct{}),
+	}
+}
+
+func (t *TopicDiscoverer) isTopicAllowed(topic string) bool {
+	if t.opts.topicRegexp == nil {
+		return true
+	}
+	return t.opts.topicRegexp.MatchString(topic)
+}
+
+// 给新出现的topic启动FileLogger
+func (t *TopicDiscoverer) updateTopics(topics []string) {
+	for _, topic := range topics {
+		if _, ok := t.topics[topic]; ok {
+			continue
+		}
+
+		if !t.isTopicAllowed(topic) {
+			t.logf(lg.DEBUG, "skipping topic %s (doesn't match pattern %s)", topic, t.opts.TopicPattern)
+			continue
+		}
+
+		fl, err := NewFileLogger(t.logf, t.opts, topic, t.cfg, t.exitChan)
+		if err != nil {
+			t.logf(lg.ERROR, "couldn't create logger for new topic %s - %s", topic, err)
+			continue
+		}
+		fl.consumer.SetLogger(t.logger, t.opts.LogLevel)
+		t.topics[topic] = fl
+
+		t.wg.Add(1)
+		go func(fl *FileLogger) {
+			fl.router()
+			t.wg.Done()
+		}(fl)
+
+		err = fl.consumer.ConnectToNSQDs(t.opts.NSQDTCPAddrs)
+		if err == nil {
+			err = fl.consumer.ConnectToNSQLookupds(t.opts.NSQLookupdHTTPAddrs)
+		}
+		if err != nil {
+			// 连接失败时Consumer会重连
+			t.logf(lg.ERROR, "[%s] error connecting - %s", topic, err)
+		}
+	}
+}
+
+// 查询所有lookupd，返回所有topic的并集
+func (t *TopicDiscoverer) queryTopics() ([]string, error) {
+	set := make(map[string]bool)
+	var lastErr error
+	success := false
+	for _, addr := range t.opts.NSQLookupdHTTPAddrs {
+		endpoint, err := lookupdEndpoint(addr, "/topics")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var resp struct {
+			Topics []string `json:"topics"`
+		}
+		err = t.httpClient.GETV1(endpoint, &resp)
+		if err != nil {
+			t.logf(lg.ERROR, "error querying nsqlookupd (%s) - %s", endpoint, err)
+			lastErr = err
+			continue
+		}
+		success = true
+		for _, topic := range resp.Topics {
+			set[topic] = true
+		}
+	}
+	if !success && lastErr != nil {
+		return nil, lastErr
+	}
+
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// lookupd的地址可以是host:port，也可以是带http(s)://的完整地址
+func lookupdEndpoint(addr string, path string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid lookupd address %q - %s", addr, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u.String(), nil
+}
+
+func (t *TopicDiscoverer) run() {
+	var refreshChan <-chan time.Time
+	if t.opts.TopicPattern != "" {
+		ticker := time.NewTicker(t.opts.TopicRefreshInterval)
+		defer ticker.Stop()
+		refreshChan = ticker.C
+
+		t.refresh()
+	} else {
+		t.updateTopics(t.opts.Topics)
+	}
+
+	for {
+		select {
+		case <-refreshChan:
+			t.refresh()
+		case <-t.hupChan:
+			for _, fl := range t.topics {
+				select {
+				case fl.hupChan <- true:
+				default:
+				}
+			}
+		case <-t.termChan:
+			close(t.exitChan)
+			t.wg.Wait()
+			return
+		}
+	}
+}
+
+func (t *TopicDiscoverer) refresh() {
+	topics, err := t.queryTopics()
+	if err != nil {
+		t.logf(lg.ERROR, "could not retrieve topic list - %s", err)
+		return
+	}
+	t.updateTopics(topics)
+}
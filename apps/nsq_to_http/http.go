@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/http_api"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/version"
+)
+
+var userAgent = fmt.Sprintf("nsq_to_http/%s", version.Binary)
+
+// 把一条消息发到一个地址
+type Publisher interface {
+	Publish(addr string, body []byte) error
+}
+
+func newHTTPClient(opts *Options) *http.Client {
+	return &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPConnectTimeout, opts.HTTPRequestTimeout),
+		Timeout:   opts.HTTPRequestTimeout,
+	}
+}
+
+// 消息体作为POST的请求体
+type PostPublisher struct {
+	client      *http.Client
+	contentType string
+	header      http.Header
+}
+
+func (p *PostPublisher) Publish(addr string, body []byte) error {
+	req, err := http.NewRequest("POST", addr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setHeaders(req, p.header)
+	req.Header.Set("Content-Type", p.contentType)
+	return do(p.client, req)
+}
+
+// 地址中的%s替换成URL编码后的消息体，没有%s时直接GET
+type GetPublisher struct {
+	client *http.Client
+	header http.Header
+}
+
+func (p *GetPublisher) Publish(addr string, body []byte) error {
+	endpoint := strings.Replace(addr, "%s", url.QueryEscape(string(body)), -1)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req, p.header)
+	return do(p.client, req)
+}
+
+func setHeaders(req *http.Request, header http.Header) {
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+}
+
+// 非2xx的响应返回错误，消息会重新入队
+func do(c *http.Client, req *http.Request) error {
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	// 读完响应体才能复用连接
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Consumer的Handler，按mode把消息发到一个或所有地址，返回错误时Consumer重新入队并backoff
+type PublishHandler struct {
+	logf      lg.AppLogFunc
+	publisher Publisher
+	addresses []string
+	mode      string
+	counter   uint64
+}
+
+func newPublishHandler(logf lg.AppLogFunc, opts *Options) *PublishHandler {
+	httpClient := newHTTPClient(opts)
+	ph := &PublishHandler{
+		logf: logf,
+		mode: opts.Mode,
+	}
+	if len(opts.PostAddrs) > 0 {
+		ph.publisher = &PostPublisher{client: httpClient, contentType: opts.ContentType, header: opts.header}
+		ph.addresses = opts.PostAddrs
+	} else {
+		ph.publisher = &GetPublisher{client: httpClient, header: opts.header}
+		ph.addresses = opts.GetAddrs
+	}
+	return ph
+}
+
+func (ph *PublishHandler) HandleMessage(m *client.Message) error {
+	switch ph.mode {
+	case modeFanout:
+		// 有一个地址失败就整条消息重新入队，已经成功的地址会重复收到
+		for _, addr := range ph.addresses {
+			err := ph.publisher.Publish(addr, m.Body)
+			if err != nil {
+				ph.logf(lg.ERROR, "(%s) failed to send msg %s - %s", addr, m.ID, err)
+				return err
+			}
+		}
+	default:
+		idx := atomic.AddUint64(&ph.counter, 1) % uint64(len(ph.addresses))
+		addr := ph.addresses[idx]
+		err := ph.publisher.Publish(addr, m.Body)
+		if err != nil {
+			ph.logf(lg.ERROR, "(%s) failed to send msg %s - %s", addr, m.ID, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/app"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/version"
+)
+
+func flagSet(opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet("nsq_to_http", flag.ExitOnError)
+
+	fs.Bool("version", false, "print version string")
+	fs.String("log-level", "info", "set log verbosity: debug, info, warn, error, or fatal")
+
+	fs.StringVar(&opts.Topic, "topic", opts.Topic, "nsq topic")
+	fs.StringVar(&opts.Channel, "channel", opts.Channel, "nsq channel")
+	fs.IntVar(&opts.MaxInFlight, "max-in-flight", opts.MaxInFlight, "max number of messages to allow in flight")
+	fs.IntVar(&opts.Concurrency, "n", opts.Concurrency, "number of concurrent publishers")
+
+	fs.Var((*app.StringArray)(&opts.NSQDTCPAddrs), "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
+	fs.Var((*app.StringArray)(&opts.NSQLookupdHTTPAddrs), "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+
+	fs.Var((*app.StringArray)(&opts.PostAddrs), "post", "HTTP address to make a POST request to, the message is the request body (may be given multiple times)")
+	fs.Var((*app.StringArray)(&opts.GetAddrs), "get", "HTTP address to make a GET request to, '%s' will be replaced with the url escaped message (may be given multiple times)")
+	fs.StringVar(&opts.Mode, "mode", opts.Mode, "the upstream request mode options: round-robin or fanout")
+	fs.StringVar(&opts.ContentType, "content-type", opts.ContentType, "the Content-Type used for POST requests")
+	fs.Var((*app.StringArray)(&opts.Headers), "header", "custom HTTP header to add to requests, \"Name: value\" (may be given multiple times)")
+
+	fs.DurationVar(&opts.HTTPConnectTimeout, "http-client-connect-timeout", opts.HTTPConnectTimeout, "timeout for HTTP connect")
+	fs.DurationVar(&opts.HTTPRequestTimeout, "http-client-request-timeout", opts.HTTPRequestTimeout, "timeout for HTTP request")
+
+	return fs
+}
+
+func main() {
+	opts := NewOptions()
+	fs := flagSet(opts)
+	fs.Parse(os.Args[1:])
+
+	if fs.Lookup("version").Value.(flag.Getter).Get().(bool) {
+		fmt.Printf("nsq_to_http v%s\n", version.Binary)
+		return
+	}
+
+	logLevel, err := lg.ParseLogLevel(fs.Lookup("log-level").Value.String(), false)
+	if err != nil {
+		log.Fatal("--log-level is invalid")
+	}
+	opts.LogLevel = logLevel
+
+	err = opts.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+
+	cfg := client.NewConfig()
+	cfg.UserAgent = userAgent
+	cfg.MaxInFlight = opts.MaxInFlight
+
+	logger := log.New(os.Stderr, "[nsq_to_http] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	consumer, err := newConsumer(logger, opts, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case <-consumer.StopChan:
+		return
+	case <-termChan:
+	}
+	consumer.Stop()
+	<-consumer.StopChan
+}
+
+// 创建Consumer并添加opts.Concurrency个发送协程，连接nsqd或lookupd
+func newConsumer(logger lg.Logger, opts *Options, cfg *client.Config) (*client.Consumer, error) {
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		lg.Logf(logger, opts.LogLevel, lvl, f, args...)
+	}
+
+	consumer, err := client.NewConsumer(opts.Topic, opts.Channel, cfg)
+	if err != nil {
+		return nil, err
+	}
+	consumer.SetLogger(logger, opts.LogLevel)
+	consumer.AddConcurrentHandlers(newPublishHandler(logf, opts), opts.Concurrency)
+
+	err = consumer.ConnectToNSQDs(opts.NSQDTCPAddrs)
+	if err == nil {
+		err = consumer.ConnectToNSQLookupds(opts.NSQLookupdHTTPAddrs)
+	}
+	if err != nil {
+		consumer.Stop()
+		return nil, err
+	}
+	return consumer, nil
+}
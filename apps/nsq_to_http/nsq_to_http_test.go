@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"nsq-learn/client"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"nsq-learn/nsqd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustStartNSQD(t *testing.T) (*nsqd.NSQD, *nsqd.Options) {
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		panic(err)
+	}
+	opts.DataPath = tmpDir
+	n := nsqd.New(opts)
+	n.Main()
+	return n, opts
+}
+
+func publish(t *testing.T, n *nsqd.NSQD, topic string, bodies ...string) {
+	p, err := client.NewProducer(n.RealTCPAddr().String(), client.NewConfig())
+	assert.Nil(t, err)
+	p.SetLogger(nil, lg.INFO)
+	defer p.Stop()
+	for _, body := range bodies {
+		assert.Nil(t, p.Publish(topic, []byte(body)))
+	}
+}
+
+// 等channel里的消息都FIN
+func waitForDrained(t *testing.T, n *nsqd.NSQD, topic string, channel string, count uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := n.GetStats(topic, channel)
+		if len(stats) == 1 && len(stats[0].Channels) == 1 {
+			c := stats[0].Channels[0]
+			if c.MessageCount == count && c.Depth == 0 && c.InFlightCount == 0 && c.DeferredCount == 0 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("channel %s/%s not drained", topic, channel)
+}
+
+// 记录收到的请求，status为nil时返回200
+type destination struct {
+	sync.Mutex
+	server   *httptest.Server
+	requests []*http.Request
+	bodies   []string
+	status   func(body string) int
+}
+
+func newDestination() *destination {
+	d := &destination{}
+	d.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method == "GET" {
+			body = []byte(req.URL.Query().Get("msg"))
+		}
+		d.Lock()
+		d.requests = append(d.requests, req)
+		d.bodies = append(d.bodies, string(body))
+		status := d.status
+		d.Unlock()
+		if status != nil {
+			w.WriteHeader(status(string(body)))
+		}
+	}))
+	return d
+}
+
+func (d *destination) received() []string {
+	d.Lock()
+	defer d.Unlock()
+	bodies := append([]string(nil), d.bodies...)
+	sort.Strings(bodies)
+	return bodies
+}
+
+func startConsumer(t *testing.T, opts *Options) *client.Consumer {
+	assert.Nil(t, opts.Validate())
+	cfg := client.NewConfig()
+	cfg.MaxInFlight = opts.MaxInFlight
+	cfg.DefaultRequeueDelay = 0
+	cfg.BackoffMultiplier = 10 * time.Millisecond
+	cfg.MaxBackoffDuration = 50 * time.Millisecond
+	consumer, err := newConsumer(test.NewTestLogger(t), opts, cfg)
+	assert.Nil(t, err)
+	return consumer
+}
+
+func stopConsumer(t *testing.T, consumer *client.Consumer) {
+	consumer.Stop()
+	select {
+	case <-consumer.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+}
+
+func TestNsqToHTTPRoundRobin(t *testing.T) {
+	n, nsqdOpts := mustStartNSQD(t)
+	defer os.RemoveAll(nsqdOpts.DataPath)
+	defer n.Exit()
+
+	d1, d2 := newDestination(), newDestination()
+	defer d1.server.Close()
+	defer d2.server.Close()
+
+	bodies := []string{"m0", "m1", "m2", "m3", "m4", "m5"}
+	publish(t, n, "forward", bodies...)
+
+	opts := NewOptions()
+	opts.Topic = "forward"
+	opts.NSQDTCPAddrs = []string{n.RealTCPAddr().String()}
+	opts.PostAddrs = []string{d1.server.URL, d2.server.URL}
+	opts.ContentType = "application/json"
+	opts.Headers = []string{"X-Test: yes"}
+	opts.Concurrency = 1
+	consumer := startConsumer(t, opts)
+
+	waitForDrained(t, n, "forward", opts.Channel, 6)
+	stopConsumer(t, consumer)
+
+	// 单个协程轮流发送，每个地址各一半
+	assert.Equal(t, 3, len(d1.received()))
+	assert.Equal(t, 3, len(d2.received()))
+	all := append(d1.received(), d2.received()...)
+	sort.Strings(all)
+	assert.Equal(t, bodies, all)
+
+	req := d1.requests[0]
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "yes", req.Header.Get("X-Test"))
+	assert.Equal(t, userAgent, req.Header.Get("User-Agent"))
+}
+
+func TestNsqToHTTPFanoutGet(t *testing.T) {
+	n, nsqdOpts := mustStartNSQD(t)
+	defer os.RemoveAll(nsqdOpts.DataPath)
+	defer n.Exit()
+
+	d1, d2 := newDestination(), newDestination()
+	defer d1.server.Close()
+	defer d2.server.Close()
+
+	bodies := []string{"a b", "c&d", "e=f"}
+	publish(t, n, "fanout", bodies...)
+
+	opts := NewOptions()
+	opts.Topic = "fanout"
+	opts.NSQDTCPAddrs = []string{n.RealTCPAddr().String()}
+	opts.GetAddrs = []string{d1.server.URL + "/?msg=%s", d2.server.URL + "/?msg=%s"}
+	opts.Mode = modeFanout
+	consumer := startConsumer(t, opts)
+
+	waitForDrained(t, n, "fanout", opts.Channel, 3)
+	stopConsumer(t, consumer)
+
+	// 每个地址都收到所有消息，消息体经过URL编码
+	assert.Equal(t, []string{"a b", "c&d", "e=f"}, d1.received())
+	assert.Equal(t, []string{"a b", "c&d", "e=f"}, d2.received())
+	assert.Equal(t, "GET", d1.requests[0].Method)
+}
+
+func TestNsqToHTTPRequeue(t *testing.T) {
+	n, nsqdOpts := mustStartNSQD(t)
+	defer os.RemoveAll(nsqdOpts.DataPath)
+	defer n.Exit()
+
+	d := newDestination()
+	defer d.server.Close()
+	// 第一次返回500，第二次成功
+	var calls int
+	d.status = func(body string) int {
+		calls++
+		if calls == 1 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}
+
+	publish(t, n, "requeue", "retry")
+
+	opts := NewOptions()
+	opts.Topic = "requeue"
+	opts.NSQDTCPAddrs = []string{n.RealTCPAddr().String()}
+	opts.PostAddrs = []string{d.server.URL}
+	consumer := startConsumer(t, opts)
+
+	waitForDrained(t, n, "requeue", opts.Channel, 1)
+	stopConsumer(t, consumer)
+
+	assert.Equal(t, []string{"retry", "retry"}, d.received())
+	stats := n.GetStats("requeue", opts.Channel)
+	assert.Equal(t, uint64(1), stats[0].Channels[0].RequeueCount)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	opts := NewOptions()
+	opts.Topic = "t"
+	opts.NSQDTCPAddrs = []string{"127.0.0.1:4150"}
+	opts.PostAddrs = []string{"http://127.0.0.1:8080/"}
+	assert.Nil(t, opts.Validate())
+
+	opts.GetAddrs = []string{"http://127.0.0.1:8080/?msg=%s"}
+	assert.NotNil(t, opts.Validate())
+
+	opts.GetAddrs = nil
+	opts.Mode = "broadcast"
+	assert.NotNil(t, opts.Validate())
+
+	opts.Mode = modeFanout
+	opts.Headers = []string{"no-colon"}
+	assert.NotNil(t, opts.Validate())
+
+	opts.Headers = []string{"X-A: 1"}
+	assert.Nil(t, opts.Validate())
+	assert.Equal(t, "1", opts.header.Get("X-A"))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"nsq-learn/internal/lg"
+)
+
+// 有多个目标地址时的发送方式
+const (
+	modeRoundRobin = "round-robin" // 每条消息轮流发给一个地址
+	modeFanout     = "fanout"      // 每条消息发给所有地址，全部成功才FIN
+)
+
+type Options struct {
+	Topic       string
+	Channel     string
+	MaxInFlight int
+	Concurrency int // 同时发送HTTP请求的协程数
+
+	NSQDTCPAddrs        []string
+	NSQLookupdHTTPAddrs []string
+
+	PostAddrs   []string
+	GetAddrs    []string
+	Mode        string
+	ContentType string
+	Headers     []string // 额外的请求头，格式为"Name: value"
+
+	HTTPConnectTimeout time.Duration
+	HTTPRequestTimeout time.Duration
+
+	LogLevel lg.LogLevel
+
+	header http.Header
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Channel:     "nsq_to_http",
+		MaxInFlight: 200,
+		Concurrency: 100,
+
+		Mode:        modeRoundRobin,
+		ContentType: "application/octet-stream",
+
+		HTTPConnectTimeout: 2 * time.Second,
+		HTTPRequestTimeout: 20 * time.Second,
+
+		LogLevel: lg.INFO,
+	}
+}
+
+// 检查参数，解析请求头
+func (o *Options) Validate() error {
+	if o.Topic == "" {
+		return errors.New("--topic is required")
+	}
+
+	if len(o.NSQDTCPAddrs) == 0 && len(o.NSQLookupdHTTPAddrs) == 0 {
+		return errors.New("--nsqd-tcp-address or --lookupd-http-address required")
+	}
+	if len(o.NSQDTCPAddrs) > 0 && len(o.NSQLookupdHTTPAddrs) > 0 {
+		return errors.New("use --nsqd-tcp-address or --lookupd-http-address not both")
+	}
+
+	if len(o.PostAddrs) == 0 && len(o.GetAddrs) == 0 {
+		return errors.New("--post or --get required")
+	}
+	if len(o.PostAddrs) > 0 && len(o.GetAddrs) > 0 {
+		return errors.New("use --post or --get not both")
+	}
+
+	if o.Mode != modeRoundRobin && o.Mode != modeFanout {
+		return fmt.Errorf("invalid --mode %q, must be round-robin or fanout", o.Mode)
+	}
+
+	if o.Concurrency <= 0 || o.MaxInFlight <= 0 {
+		return errors.New("--n and --max-in-flight must be positive")
+	}
+
+	if o.HTTPConnectTimeout <= 0 || o.HTTPRequestTimeout <= 0 {
+		return errors.New("--http-client-connect-timeout and --http-client-request-timeout must be positive")
+	}
+
+	o.header = make(http.Header)
+	for _, h := range o.Headers {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid --header %q, must be \"Name: value\"", h)
+		}
+		o.header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return nil
+}
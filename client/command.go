@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var byteSpace = []byte(" ")
+var byteNewLine = []byte("\n")
+
+// header块（含2字节长度）的最大长度，和nsqd一致
+const maxHeaderSize = 4096
+
+var errHeadersTooLarge = errors.New("message headers too large")
+
+// 发给nsqd的命令: <Name> <Params...>\n[4-byte 长度][Body]
+type Command struct {
+	Name   []byte
+	Params [][]byte
+	Body   []byte
+}
+
+func (c *Command) String() string {
+	if len(c.Params) > 0 {
+		return fmt.Sprintf("%s %s", c.Name, string(bytes.Join(c.Params, byteSpace)))
+	}
+	return string(c.Name)
+}
+
+func (c *Command) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	var buf [4]byte
+
+	n, err := w.Write(c.Name)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, param := range c.Params {
+		n, err := w.Write(byteSpace)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		n, err = w.Write(param)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(byteNewLine)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	if c.Body != nil {
+		bufs := buf[:]
+		binary.BigEndian.PutUint32(bufs, uint32(len(c.Body)))
+		n, err := w.Write(bufs)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		n, err = w.Write(c.Body)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// IDENTIFY命令，js为客户端信息，见nsqd的identifyDataV2
+func Identify(js map[string]interface{}) (*Command, error) {
+	body, err := json.Marshal(js)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{[]byte("IDENTIFY"), nil, body}, nil
+}
+
+// 回复心跳
+func Nop() *Command {
+	return &Command{[]byte("NOP"), nil, nil}
+}
+
+// 发布一条消息
+func Publish(topic string, body []byte) *Command {
+	return &Command{[]byte("PUB"), [][]byte{[]byte(topic)}, body}
+}
+
+// 带幂等key发布一条消息，nsqd在去重时间窗口内只会写入一次
+func PublishWithKey(topic string, key string, body []byte) *Command {
+	return &Command{[]byte("PUB"), [][]byte{[]byte(topic), []byte(key)}, body}
+}
+
+// 延时发布一条消息
+func DeferredPublish(topic string, delay time.Duration, body []byte) *Command {
+	params := [][]byte{[]byte(topic), []byte(strconv.Itoa(int(delay / time.Millisecond)))}
+	return &Command{[]byte("DPUB"), params, body}
+}
+
+// 发布一条带header的消息
+func HeaderPublish(topic string, headers map[string]string, body []byte) (*Command, error) {
+	hdrs, err := encodeHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{[]byte("HPUB"), [][]byte{[]byte(topic)}, append(hdrs, body...)}, nil
+}
+
+// 一次发布多条消息: [4-byte 消息数][4-byte 长度][消息体]...
+func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
+	var body bytes.Buffer
+	err := binary.Write(&body, binary.BigEndian, int32(len(bodies)))
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bodies {
+		err = binary.Write(&body, binary.BigEndian, int32(len(b)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = body.Write(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Command{[]byte("MPUB"), [][]byte{[]byte(topic)}, body.Bytes()}, nil
+}
+
+// 订阅topic的channel，每个连接只能订阅一次
+func Subscribe(topic string, channel string) *Command {
+	return &Command{[]byte("SUB"), [][]byte{[]byte(topic), []byte(channel)}, nil}
+}
+
+// 设置这个连接最多同时投递多少条消息
+func Ready(count int) *Command {
+	return &Command{[]byte("RDY"), [][]byte{[]byte(strconv.Itoa(count))}, nil}
+}
+
+// 确认消息处理成功
+func Finish(id MessageID) *Command {
+	return &Command{[]byte("FIN"), [][]byte{id[:]}, nil}
+}
+
+// 消息重新入队，delay之后再投递
+func Requeue(id MessageID, delay time.Duration) *Command {
+	params := [][]byte{id[:], []byte(strconv.Itoa(int(delay / time.Millisecond)))}
+	return &Command{[]byte("REQ"), params, nil}
+}
+
+// 重置消息的超时时间
+func Touch(id MessageID) *Command {
+	return &Command{[]byte("TOUCH"), [][]byte{id[:]}, nil}
+}
+
+// 通知nsqd不再投递新消息，nsqd返回CLOSE_WAIT
+func StartClose() *Command {
+	return &Command{[]byte("CLS"), nil, nil}
+}
+
+// 按key排序编码header块，格式见nsqd的message.go:
+// [2-byte 长度][2-byte key长度][key][2-byte value长度][value]...
+func encodeHeaders(headers map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if k == "" {
+			return nil, errors.New("empty message header key")
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	size := 2
+	for _, k := range keys {
+		size += 2 + len(k) + 2 + len(headers[k])
+	}
+	if size > maxHeaderSize {
+		return nil, errHeadersTooLarge
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	var l [2]byte
+	writeString := func(str string) {
+		binary.BigEndian.PutUint16(l[:], uint16(len(str)))
+		buf.Write(l[:])
+		buf.WriteString(str)
+	}
+	binary.BigEndian.PutUint16(l[:], uint16(size-2))
+	buf.Write(l[:])
+	for _, k := range keys {
+		writeString(k)
+		writeString(headers[k])
+	}
+	return buf.Bytes(), nil
+}
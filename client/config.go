@@ -0,0 +1,106 @@
+// nsqd的客户端，使用V2 TCP协议发布和消费消息
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"nsq-learn/internal/version"
+)
+
+// 客户端的配置，用NewConfig创建后再修改需要的字段
+type Config struct {
+	DialTimeout  time.Duration // 建立连接的超时时间
+	ReadTimeout  time.Duration // 读取的超时时间，必须大于心跳间隔
+	WriteTimeout time.Duration // 写入的超时时间
+
+	ClientID          string        // IDENTIFY时发送的客户端ID，默认为短主机名
+	Hostname          string        // IDENTIFY时发送的主机名
+	UserAgent         string        // IDENTIFY时发送的客户端名称和版本
+	HeartbeatInterval time.Duration // nsqd发送心跳的间隔，-1表示关闭心跳
+	MsgTimeout        time.Duration // 消息投递后等待确认的超时时间，0表示使用nsqd的默认值
+	// nsqd投递消息时缓冲的最长时间，0表示使用nsqd的默认值，-1表示每条消息都立即发送
+	OutputBufferTimeout time.Duration
+
+	HTTPTimeout time.Duration // 回退到HTTP发布时每个请求的超时时间，也用于查询lookupd
+
+	// 以下为Consumer的配置
+	MaxInFlight             int           // 所有连接加起来最多同时处理的消息数，按连接数平均分配RDY
+	MaxAttempts             uint16        // 超过这个尝试次数的消息直接确认，0表示不限制
+	LookupdPollInterval     time.Duration // 查询lookupd的间隔，也是直连的nsqd断开后重连的间隔
+	RDYRedistributeInterval time.Duration // MaxInFlight不能被连接数整除时，多出来的RDY轮流分配的间隔
+	DefaultRequeueDelay     time.Duration // Requeue(-1)时的延时，乘以尝试次数
+	MaxRequeueDelay         time.Duration // Requeue(-1)时的最长延时
+	BackoffMultiplier       time.Duration // backoff的时长为BackoffMultiplier * 2^(级别-1)
+	MaxBackoffDuration      time.Duration // backoff的最长时间，0表示不backoff
+}
+
+func NewConfig() *Config {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	clientID := hostname
+	for i, c := range hostname {
+		if c == '.' {
+			clientID = hostname[:i]
+			break
+		}
+	}
+	return &Config{
+		DialTimeout:  time.Second,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: time.Second,
+
+		ClientID:          clientID,
+		Hostname:          hostname,
+		UserAgent:         fmt.Sprintf("nsq-learn-client/%s", version.Binary),
+		HeartbeatInterval: 30 * time.Second,
+
+		HTTPTimeout: 5 * time.Second,
+
+		MaxInFlight:             1,
+		MaxAttempts:             5,
+		LookupdPollInterval:     60 * time.Second,
+		RDYRedistributeInterval: 5 * time.Second,
+		DefaultRequeueDelay:     90 * time.Second,
+		MaxRequeueDelay:         15 * time.Minute,
+		BackoffMultiplier:       time.Second,
+		MaxBackoffDuration:      2 * time.Minute,
+	}
+}
+
+// 检查配置项的取值范围
+func (c *Config) Validate() error {
+	if c.DialTimeout <= 0 || c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.HTTPTimeout <= 0 {
+		return errors.New("timeouts must be positive")
+	}
+	if c.HeartbeatInterval != -1 && c.HeartbeatInterval < time.Second {
+		return fmt.Errorf("heartbeat interval (%s) must be -1 or at least 1s", c.HeartbeatInterval)
+	}
+	if c.HeartbeatInterval > 0 && c.ReadTimeout <= c.HeartbeatInterval {
+		return fmt.Errorf("read timeout (%s) must be greater than heartbeat interval (%s)",
+			c.ReadTimeout, c.HeartbeatInterval)
+	}
+	if c.MsgTimeout != 0 && c.MsgTimeout < time.Second {
+		return fmt.Errorf("msg timeout (%s) must be 0 or at least 1s", c.MsgTimeout)
+	}
+	if c.OutputBufferTimeout < -1 || c.OutputBufferTimeout > 0 && c.OutputBufferTimeout < time.Millisecond {
+		return fmt.Errorf("output buffer timeout (%s) must be -1, 0 or at least 1ms", c.OutputBufferTimeout)
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("max in flight (%d) must not be negative", c.MaxInFlight)
+	}
+	if c.LookupdPollInterval <= 0 || c.RDYRedistributeInterval <= 0 {
+		return errors.New("lookupd poll and RDY redistribute intervals must be positive")
+	}
+	if c.DefaultRequeueDelay < 0 || c.MaxRequeueDelay < 0 || c.MaxBackoffDuration < 0 {
+		return errors.New("requeue and backoff durations must not be negative")
+	}
+	if c.MaxBackoffDuration > 0 && c.BackoffMultiplier <= 0 {
+		return fmt.Errorf("backoff multiplier (%s) must be positive", c.BackoffMultiplier)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nsq-learn/internal/lg"
+)
+
+// Conn收到数据或者出错时的回调，都在Conn的读协程里调用
+type ConnDelegate interface {
+	// 收到FrameTypeResponse（心跳除外）
+	OnResponse(*Conn, []byte)
+	// 收到FrameTypeError
+	OnError(*Conn, []byte)
+	// 收到心跳，Conn会自动回复NOP
+	OnHeartbeat(*Conn)
+	// 读写出错，之后连接会关闭
+	OnIOError(*Conn, error)
+	// 连接关闭，只会调用一次
+	OnClose(*Conn)
+
+	// 收到消息，处理完后通过Message的Finish或Requeue确认
+	OnMessage(*Conn, *Message)
+	// 已经发送FIN
+	OnMessageFinished(*Conn, *Message)
+	// 已经发送REQ，backoff表示是否需要backoff
+	OnMessageRequeued(c *Conn, m *Message, backoff bool)
+}
+
+// IDENTIFY时nsqd返回的配置
+type IdentifyResponse struct {
+	Version           string `json:"version"`
+	MaxMsgTimeout     int64  `json:"max_msg_timeout"`
+	MsgTimeout        int64  `json:"msg_timeout"`
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+	MaxMsgSize        int64  `json:"max_msg_size"`
+	MaxBodySize       int64  `json:"max_body_size"`
+	MaxRdyCount       int64  `json:"max_rdy_count"`
+	Headers           bool   `json:"headers"`
+}
+
+// 到一个nsqd的TCP连接，负责握手、回复心跳，收到的数据交给delegate处理
+type Conn struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	messagesInFlight int64
+	rdyCount         int64
+	maxRdyCount      int64
+
+	// 写连接的锁，使用者和回复心跳的读协程都会写
+	mtx sync.Mutex
+
+	config *Config
+	addr   string
+
+	conn *net.TCPConn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	delegate ConnDelegate
+
+	logger lg.Logger
+	logLvl lg.LogLevel
+	logFmt string
+
+	closeFlag int32
+	// 已经收到CLOSE_WAIT，in-flight的消息都确认后关闭连接
+	closeWait int32
+}
+
+func NewConn(addr string, config *Config, delegate ConnDelegate) *Conn {
+	return &Conn{
+		config:   config,
+		addr:     addr,
+		delegate: delegate,
+		logLvl:   lg.INFO,
+	}
+}
+
+// 设置日志，format用来给每条日志加前缀，参数为连接地址
+func (c *Conn) SetLogger(l lg.Logger, lvl lg.LogLevel, format string) {
+	c.logger = l
+	c.logLvl = lvl
+	c.logFmt = format
+}
+
+func (c *Conn) String() string {
+	return c.addr
+}
+
+// 建立连接，发送协议版本号和IDENTIFY，成功后启动读协程
+func (c *Conn) Connect() (*IdentifyResponse, error) {
+	dialer := &net.Dialer{Timeout: c.config.DialTimeout}
+	conn, err := dialer.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn.(*net.TCPConn)
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+
+	c.mtx.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	_, err = c.w.Write(MagicV2)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.mtx.Unlock()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("[%s] failed to write magic - %s", c.addr, err)
+	}
+
+	resp, err := c.identify()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	atomic.StoreInt64(&c.maxRdyCount, resp.MaxRdyCount)
+
+	go c.readLoop()
+	return resp, nil
+}
+
+// 关闭连接，读协程退出后调用delegate的OnClose
+func (c *Conn) Close() error {
+	atomic.StoreInt32(&c.closeFlag, 1)
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) IsClosing() bool {
+	return atomic.LoadInt32(&c.closeFlag) == 1
+}
+
+// 已经投递还没有确认的消息数
+func (c *Conn) InFlight() int64 {
+	return atomic.LoadInt64(&c.messagesInFlight)
+}
+
+// 最近一次发送的RDY
+func (c *Conn) RDY() int64 {
+	return atomic.LoadInt64(&c.rdyCount)
+}
+
+// nsqd允许的最大RDY
+func (c *Conn) MaxRDY() int64 {
+	return atomic.LoadInt64(&c.maxRdyCount)
+}
+
+// 发送RDY，count超过nsqd允许的最大值时截断
+func (c *Conn) SetRDY(count int64) error {
+	if maxRdy := c.MaxRDY(); count > maxRdy {
+		count = maxRdy
+	}
+	err := c.WriteCommand(Ready(int(count)))
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.rdyCount, count)
+	return nil
+}
+
+// 发送命令并立即flush
+func (c *Conn) WriteCommand(cmd *Command) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	_, err := cmd.WriteTo(c.w)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		c.log(lg.ERROR, "IO error - %s", err)
+	}
+	return err
+}
+
+func (c *Conn) readResponse() (int32, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	return ReadUnpackedResponse(c.r)
+}
+
+func (c *Conn) identify() (*IdentifyResponse, error) {
+	ci := make(map[string]interface{})
+	ci["client_id"] = c.config.ClientID
+	ci["hostname"] = c.config.Hostname
+	ci["user_agent"] = c.config.UserAgent
+	ci["feature_negotiation"] = true
+	ci["headers"] = true
+	if c.config.HeartbeatInterval == -1 {
+		ci["heartbeat_interval"] = -1
+	} else {
+		ci["heartbeat_interval"] = int64(c.config.HeartbeatInterval / time.Millisecond)
+	}
+	ci["msg_timeout"] = int64(c.config.MsgTimeout / time.Millisecond)
+	if c.config.OutputBufferTimeout == -1 {
+		ci["output_buffer_timeout"] = -1
+	} else {
+		ci["output_buffer_timeout"] = int64(c.config.OutputBufferTimeout / time.Millisecond)
+	}
+
+	cmd, err := Identify(ci)
+	if err != nil {
+		return nil, ErrIdentify{err.Error()}
+	}
+
+	err = c.WriteCommand(cmd)
+	if err != nil {
+		return nil, ErrIdentify{err.Error()}
+	}
+
+	frameType, data, err := c.readResponse()
+	if err != nil {
+		return nil, ErrIdentify{err.Error()}
+	}
+
+	if frameType == FrameTypeError {
+		return nil, ErrIdentify{string(data)}
+	}
+
+	resp := &IdentifyResponse{}
+	err = json.Unmarshal(data, resp)
+	if err != nil {
+		return nil, ErrIdentify{err.Error()}
+	}
+
+	c.log(lg.DEBUG, "IDENTIFY response: %+v", resp)
+	return resp, nil
+}
+
+func (c *Conn) readLoop() {
+	for {
+		if c.IsClosing() {
+			goto exit
+		}
+
+		frameType, data, err := c.readResponse()
+		if err != nil {
+			if !c.IsClosing() {
+				c.log(lg.ERROR, "IO error - %s", err)
+				c.delegate.OnIOError(c, err)
+			}
+			goto exit
+		}
+
+		if frameType == FrameTypeResponse && bytes.Equal(data, []byte("_heartbeat_")) {
+			c.log(lg.DEBUG, "heartbeat received")
+			c.delegate.OnHeartbeat(c)
+			err := c.WriteCommand(Nop())
+			if err != nil {
+				c.delegate.OnIOError(c, err)
+				goto exit
+			}
+			continue
+		}
+
+		switch frameType {
+		case FrameTypeMessage:
+			msg, err := DecodeMessage(data)
+			if err != nil {
+				c.log(lg.ERROR, "IO error - %s", err)
+				c.delegate.OnIOError(c, err)
+				goto exit
+			}
+			msg.Delegate = &connMessageDelegate{c}
+			msg.NSQDAddress = c.String()
+			atomic.AddInt64(&c.messagesInFlight, 1)
+			c.delegate.OnMessage(c, msg)
+		case FrameTypeResponse:
+			if bytes.Equal(data, []byte("CLOSE_WAIT")) {
+				// nsqd不再投递新消息，等in-flight的消息都确认后关闭
+				c.log(lg.INFO, "received CLOSE_WAIT from nsqd")
+				atomic.StoreInt32(&c.closeWait, 1)
+				if c.InFlight() == 0 {
+					c.Close()
+				}
+			}
+			c.delegate.OnResponse(c, data)
+		case FrameTypeError:
+			c.log(lg.ERROR, "protocol error - %s", data)
+			c.delegate.OnError(c, data)
+		default:
+			c.log(lg.ERROR, "unknown frame type %d", frameType)
+			c.delegate.OnIOError(c, fmt.Errorf("unknown frame type %d", frameType))
+			goto exit
+		}
+	}
+
+exit:
+	c.Close()
+	c.log(lg.INFO, "readLoop exiting")
+	c.delegate.OnClose(c)
+}
+
+func (c *Conn) onMessageFinish(m *Message) {
+	err := c.WriteCommand(Finish(m.ID))
+	if err != nil {
+		c.log(lg.ERROR, "failed to FIN %s - %s", m.ID, err)
+	}
+	c.msgResponded()
+	c.delegate.OnMessageFinished(c, m)
+}
+
+func (c *Conn) onMessageRequeue(m *Message, delay time.Duration, backoff bool) {
+	if delay == -1 {
+		// 按尝试次数线性增加延时
+		delay = c.config.DefaultRequeueDelay * time.Duration(m.Attempts)
+		if delay > c.config.MaxRequeueDelay {
+			delay = c.config.MaxRequeueDelay
+		}
+	}
+	err := c.WriteCommand(Requeue(m.ID, delay))
+	if err != nil {
+		c.log(lg.ERROR, "failed to REQ %s - %s", m.ID, err)
+	}
+	c.msgResponded()
+	c.delegate.OnMessageRequeued(c, m, backoff)
+}
+
+func (c *Conn) onMessageTouch(m *Message) {
+	err := c.WriteCommand(Touch(m.ID))
+	if err != nil {
+		c.log(lg.ERROR, "failed to TOUCH %s - %s", m.ID, err)
+	}
+}
+
+func (c *Conn) msgResponded() {
+	if atomic.AddInt64(&c.messagesInFlight, -1) == 0 && atomic.LoadInt32(&c.closeWait) == 1 {
+		c.log(lg.INFO, "no messages in flight, closing")
+		c.Close()
+	}
+}
+
+func (c *Conn) log(lvl lg.LogLevel, line string, args ...interface{}) {
+	if c.logger == nil {
+		return
+	}
+	lg.Logf(c.logger, c.logLvl, lvl, "%s %s", fmt.Sprintf(c.logFmt, c.addr), fmt.Sprintf(line, args...))
+}
+
+type connMessageDelegate struct {
+	c *Conn
+}
+
+func (d *connMessageDelegate) OnFinish(m *Message) { d.c.onMessageFinish(m) }
+func (d *connMessageDelegate) OnRequeue(m *Message, delay time.Duration, backoff bool) {
+	d.c.onMessageRequeue(m, delay, backoff)
+}
+func (d *connMessageDelegate) OnTouch(m *Message) { d.c.onMessageTouch(m) }
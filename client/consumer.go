@@ -0,0 +1,793 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nsq-learn/internal/http_api"
+	"nsq-learn/internal/lg"
+)
+
+// 已经连接了这个nsqd
+var ErrAlreadyConnected = errors.New("already connected")
+
+// 处理消息，返回错误时消息会Requeue(-1)并触发backoff
+type Handler interface {
+	HandleMessage(message *Message) error
+}
+
+type HandlerFunc func(message *Message) error
+
+func (h HandlerFunc) HandleMessage(m *Message) error {
+	return h(m)
+}
+
+// Handler可以实现这个接口，尝试次数超过MaxAttempts的消息确认之前会交给它处理
+type FailedMessageLogger interface {
+	LogFailedMessage(message *Message)
+}
+
+// Consumer的统计
+type ConsumerStats struct {
+	MessagesReceived uint64
+	MessagesFinished uint64
+	MessagesRequeued uint64
+	Connections      int
+}
+
+type backoffSignal int
+
+const (
+	backoffFlag backoffSignal = iota
+	continueFlag
+	resumeFlag
+)
+
+// 从一个或多个nsqd订阅topic的channel，nsqd可以直接指定，也可以通过lookupd的/lookup发现
+// MaxInFlight平均分配到各个连接的RDY，处理失败时所有连接进入指数backoff
+type Consumer struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	messagesReceived uint64
+	messagesFinished uint64
+	messagesRequeued uint64
+	// 正在等待backoff计时器的时长，为0表示不在等待
+	backoffDuration int64
+
+	id      int64
+	topic   string
+	channel string
+	config  Config
+
+	logger lg.Logger
+	logLvl lg.LogLevel
+	logMtx sync.RWMutex
+
+	maxInFlight    int32
+	backoffCounter int32
+	// 保护所有RDY的修改，backoff和重新分配RDY不能交叉
+	rdyMtx sync.Mutex
+	// 多出来的RDY从第几个连接开始分配
+	rdyOffset int
+
+	incomingMessages chan *Message
+
+	mtx                sync.RWMutex
+	pendingConnections map[string]*Conn
+	connections        map[string]*Conn
+	nsqdTCPAddrs       []string
+
+	lookupdHTTPAddrs   []string
+	lookupdQueryIndex  int
+	lookupdRecheckChan chan int
+	httpClient         *http_api.Client
+
+	runningHandlers int32
+	stopFlag        int32
+	exitHandler     sync.Once
+	wg              sync.WaitGroup
+
+	// 所有连接关闭、Handler都退出后关闭
+	StopChan chan int
+	exitChan chan int
+}
+
+// 创建Consumer，config会复制一份，之后修改不影响Consumer
+func NewConsumer(topic string, channel string, config *Config) (*Consumer, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if topic == "" || strings.ContainsAny(topic, " \n") {
+		return nil, fmt.Errorf("invalid topic name %q", topic)
+	}
+	if channel == "" || strings.ContainsAny(channel, " \n") {
+		return nil, fmt.Errorf("invalid channel name %q", channel)
+	}
+
+	r := &Consumer{
+		id: atomic.AddInt64(&instCount, 1),
+
+		topic:   topic,
+		channel: channel,
+		config:  *config,
+
+		logger: log.New(os.Stderr, "", log.Flags()),
+		logLvl: lg.INFO,
+
+		maxInFlight: int32(config.MaxInFlight),
+
+		incomingMessages: make(chan *Message),
+
+		pendingConnections: make(map[string]*Conn),
+		connections:        make(map[string]*Conn),
+
+		lookupdRecheckChan: make(chan int, 1),
+		httpClient:         http_api.NewClient(nil, config.DialTimeout, config.HTTPTimeout),
+
+		StopChan: make(chan int),
+		exitChan: make(chan int),
+	}
+	r.wg.Add(1)
+	go r.rdyLoop()
+	return r, nil
+}
+
+// 设置日志，l为nil时不输出日志
+func (r *Consumer) SetLogger(l lg.Logger, lvl lg.LogLevel) {
+	r.logMtx.Lock()
+	defer r.logMtx.Unlock()
+	r.logger = l
+	r.logLvl = lvl
+}
+
+func (r *Consumer) getLogger() (lg.Logger, lg.LogLevel) {
+	r.logMtx.RLock()
+	defer r.logMtx.RUnlock()
+	return r.logger, r.logLvl
+}
+
+func (r *Consumer) Stats() *ConsumerStats {
+	return &ConsumerStats{
+		MessagesReceived: atomic.LoadUint64(&r.messagesReceived),
+		MessagesFinished: atomic.LoadUint64(&r.messagesFinished),
+		MessagesRequeued: atomic.LoadUint64(&r.messagesRequeued),
+		Connections:      len(r.conns()),
+	}
+}
+
+// 按地址排序的连接，RDY按这个顺序分配
+func (r *Consumer) conns() []*Conn {
+	r.mtx.RLock()
+	conns := make([]*Conn, 0, len(r.connections))
+	for _, c := range r.connections {
+		conns = append(conns, c)
+	}
+	r.mtx.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].String() < conns[j].String() })
+	return conns
+}
+
+func (r *Consumer) getMaxInFlight() int32 {
+	return atomic.LoadInt32(&r.maxInFlight)
+}
+
+// 修改MaxInFlight，重新分配所有连接的RDY
+func (r *Consumer) ChangeMaxInFlight(maxInFlight int) {
+	if r.getMaxInFlight() == int32(maxInFlight) {
+		return
+	}
+	atomic.StoreInt32(&r.maxInFlight, int32(maxInFlight))
+
+	r.rdyMtx.Lock()
+	r.updateAllRDY()
+	r.rdyMtx.Unlock()
+}
+
+// 添加一个Handler，在单独的协程里处理消息，必须在连接之前调用
+func (r *Consumer) AddHandler(handler Handler) {
+	r.AddConcurrentHandlers(handler, 1)
+}
+
+// 添加concurrency个协程用同一个Handler并发处理消息，必须在连接之前调用
+func (r *Consumer) AddConcurrentHandlers(handler Handler, concurrency int) {
+	atomic.AddInt32(&r.runningHandlers, int32(concurrency))
+	r.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go r.handlerLoop(handler)
+	}
+}
+
+func (r *Consumer) handlerLoop(handler Handler) {
+	r.log(lg.DEBUG, "starting Handler")
+	defer r.wg.Done()
+	defer atomic.AddInt32(&r.runningHandlers, -1)
+
+	for {
+		var message *Message
+		select {
+		case message = <-r.incomingMessages:
+		case <-r.exitChan:
+			r.log(lg.DEBUG, "stopping Handler")
+			return
+		}
+
+		if r.shouldFailMessage(message, handler) {
+			message.Finish()
+			continue
+		}
+
+		err := handler.HandleMessage(message)
+		if err != nil {
+			r.log(lg.ERROR, "Handler returned error (%s) for msg %s", err, message.ID)
+			if !message.IsAutoResponseDisabled() {
+				message.Requeue(-1)
+			}
+			continue
+		}
+
+		if !message.IsAutoResponseDisabled() {
+			message.Finish()
+		}
+	}
+}
+
+func (r *Consumer) shouldFailMessage(message *Message, handler Handler) bool {
+	if r.config.MaxAttempts > 0 && message.Attempts > r.config.MaxAttempts {
+		r.log(lg.WARN, "msg %s attempted %d times, giving up", message.ID, message.Attempts)
+		if logger, ok := handler.(FailedMessageLogger); ok {
+			logger.LogFailedMessage(message)
+		}
+		return true
+	}
+	return false
+}
+
+// 添加一个lookupd的HTTP地址，立即查询一次，之后每隔LookupdPollInterval查询一次
+// 有多个lookupd时轮流查询
+func (r *Consumer) ConnectToNSQLookupd(addr string) error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return ErrStopped
+	}
+	if atomic.LoadInt32(&r.runningHandlers) == 0 {
+		return errors.New("no handlers")
+	}
+	if err := validateLookupdAddr(addr); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	for _, x := range r.lookupdHTTPAddrs {
+		if x == addr {
+			r.mtx.Unlock()
+			return nil
+		}
+	}
+	r.lookupdHTTPAddrs = append(r.lookupdHTTPAddrs, addr)
+	numLookupd := len(r.lookupdHTTPAddrs)
+	r.mtx.Unlock()
+
+	// 第一个lookupd启动轮询
+	if numLookupd == 1 {
+		r.queryLookupd()
+		r.wg.Add(1)
+		go r.lookupdLoop()
+	}
+
+	return nil
+}
+
+func (r *Consumer) ConnectToNSQLookupds(addrs []string) error {
+	for _, addr := range addrs {
+		err := r.ConnectToNSQLookupd(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 地址可以是host:port，也可以是带http(s)://的完整地址
+func validateLookupdAddr(addr string) error {
+	if strings.Contains(addr, "/") {
+		_, err := url.Parse(addr)
+		return err
+	}
+	if !strings.Contains(addr, ":") {
+		return fmt.Errorf("invalid lookupd address %q", addr)
+	}
+	return nil
+}
+
+func (r *Consumer) lookupdLoop() {
+	ticker := time.NewTicker(r.config.LookupdPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.queryLookupd()
+		case <-r.lookupdRecheckChan:
+			r.queryLookupd()
+		case <-r.exitChan:
+			r.wg.Done()
+			r.log(lg.INFO, "exiting lookupdLoop")
+			return
+		}
+	}
+}
+
+func (r *Consumer) nextLookupdEndpoint() string {
+	r.mtx.Lock()
+	if r.lookupdQueryIndex >= len(r.lookupdHTTPAddrs) {
+		r.lookupdQueryIndex = 0
+	}
+	addr := r.lookupdHTTPAddrs[r.lookupdQueryIndex]
+	r.lookupdQueryIndex = (r.lookupdQueryIndex + 1) % len(r.lookupdHTTPAddrs)
+	r.mtx.Unlock()
+
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	if u.Path == "/" || u.Path == "" {
+		u.Path = "/lookup"
+	}
+	v := u.Query()
+	v.Set("topic", r.topic)
+	u.RawQuery = v.Encode()
+	return u.String()
+}
+
+// lookupd /lookup返回的nsqd
+type peerInfo struct {
+	RemoteAddress    string `json:"remote_address"`
+	Hostname         string `json:"hostname"`
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+	HTTPPort         int    `json:"http_port"`
+	Version          string `json:"version"`
+}
+
+type lookupResp struct {
+	Channels  []string    `json:"channels"`
+	Producers []*peerInfo `json:"producers"`
+}
+
+// 查询一个lookupd，连接所有发布了这个topic的nsqd
+func (r *Consumer) queryLookupd() {
+	endpoint := r.nextLookupdEndpoint()
+
+	r.log(lg.INFO, "querying nsqlookupd %s", endpoint)
+
+	var data lookupResp
+	err := r.httpClient.GETV1(endpoint, &data)
+	if err != nil {
+		r.log(lg.ERROR, "error querying nsqlookupd (%s) - %s", endpoint, err)
+		return
+	}
+
+	for _, producer := range data.Producers {
+		addr := net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.TCPPort))
+		err = r.ConnectToNSQD(addr)
+		if err != nil && err != ErrAlreadyConnected {
+			r.log(lg.ERROR, "(%s) error connecting to nsqd - %s", addr, err)
+		}
+	}
+}
+
+// 直接连接一个nsqd并订阅，断开后每隔LookupdPollInterval重连（使用lookupd时由轮询重连）
+func (r *Consumer) ConnectToNSQD(addr string) error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return ErrStopped
+	}
+	if atomic.LoadInt32(&r.runningHandlers) == 0 {
+		return errors.New("no handlers")
+	}
+
+	logger, logLvl := r.getLogger()
+	conn := NewConn(addr, &r.config, &consumerConnDelegate{r})
+	conn.SetLogger(logger, logLvl, fmt.Sprintf("%3d [%s/%s] (%%s)", r.id, r.topic, r.channel))
+
+	r.mtx.Lock()
+	_, pendingOk := r.pendingConnections[addr]
+	_, ok := r.connections[addr]
+	if ok || pendingOk {
+		r.mtx.Unlock()
+		return ErrAlreadyConnected
+	}
+	r.pendingConnections[addr] = conn
+	if idx := indexOf(addr, r.nsqdTCPAddrs); idx == -1 {
+		r.nsqdTCPAddrs = append(r.nsqdTCPAddrs, addr)
+	}
+	r.mtx.Unlock()
+
+	r.log(lg.INFO, "(%s) connecting to nsqd", addr)
+
+	cleanupConnection := func() {
+		r.mtx.Lock()
+		delete(r.pendingConnections, addr)
+		r.mtx.Unlock()
+		conn.Close()
+	}
+
+	resp, err := conn.Connect()
+	if err != nil {
+		cleanupConnection()
+		return err
+	}
+	if resp.MaxRdyCount < int64(r.getMaxInFlight()) {
+		r.log(lg.WARN, "(%s) max RDY count %d < consumer max in flight %d, truncation possible",
+			conn, resp.MaxRdyCount, r.getMaxInFlight())
+	}
+
+	// SUB的响应由读协程收到，失败时nsqd会关闭连接
+	err = conn.WriteCommand(Subscribe(r.topic, r.channel))
+	if err != nil {
+		cleanupConnection()
+		return fmt.Errorf("[%s] failed to subscribe to %s:%s - %s", conn, r.topic, r.channel, err)
+	}
+
+	r.mtx.Lock()
+	delete(r.pendingConnections, addr)
+	r.connections[addr] = conn
+	r.mtx.Unlock()
+
+	// 连接数变了，重新分配RDY
+	r.rdyMtx.Lock()
+	r.updateAllRDY()
+	r.rdyMtx.Unlock()
+
+	return nil
+}
+
+func (r *Consumer) ConnectToNSQDs(addrs []string) error {
+	for _, addr := range addrs {
+		err := r.ConnectToNSQD(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexOf(n string, h []string) int {
+	for i, a := range h {
+		if n == a {
+			return i
+		}
+	}
+	return -1
+}
+
+// 断开一个直连的nsqd，使用lookupd时不能调用
+func (r *Consumer) DisconnectFromNSQD(addr string) error {
+	r.mtx.Lock()
+	idx := indexOf(addr, r.nsqdTCPAddrs)
+	if idx == -1 {
+		r.mtx.Unlock()
+		return errors.New("not connected")
+	}
+	r.nsqdTCPAddrs = append(r.nsqdTCPAddrs[:idx], r.nsqdTCPAddrs[idx+1:]...)
+	conn, ok := r.connections[addr]
+	pendingConn, pendingOk := r.pendingConnections[addr]
+	r.mtx.Unlock()
+
+	if ok {
+		conn.Close()
+	} else if pendingOk {
+		pendingConn.Close()
+	}
+	return nil
+}
+
+func (r *Consumer) inBackoff() bool {
+	return atomic.LoadInt32(&r.backoffCounter) > 0
+}
+
+func (r *Consumer) inBackoffTimeout() bool {
+	return atomic.LoadInt64(&r.backoffDuration) > 0
+}
+
+// 按MaxInFlight给所有连接分配RDY，调用时需要持有rdyMtx
+// 每个连接分到MaxInFlight/连接数，余数从rdyOffset开始每个连接多分1个
+func (r *Consumer) updateAllRDY() {
+	if r.inBackoff() || r.inBackoffTimeout() || atomic.LoadInt32(&r.stopFlag) == 1 {
+		return
+	}
+
+	conns := r.conns()
+	if len(conns) == 0 {
+		return
+	}
+	maxInFlight := int(r.getMaxInFlight())
+	base := maxInFlight / len(conns)
+	remainder := maxInFlight % len(conns)
+	for i, c := range conns {
+		count := base
+		if (i-r.rdyOffset%len(conns)+len(conns))%len(conns) < remainder {
+			count++
+		}
+		r.updateRDY(c, int64(count))
+	}
+}
+
+func (r *Consumer) updateRDY(c *Conn, count int64) {
+	if c.IsClosing() || c.RDY() == count {
+		return
+	}
+	r.log(lg.DEBUG, "(%s) sending RDY %d", c, count)
+	err := c.SetRDY(count)
+	if err != nil {
+		r.log(lg.ERROR, "(%s) error sending RDY %d - %s", c, count, err)
+	}
+}
+
+// MaxInFlight不能被连接数整除时，定时把多出来的RDY轮流分给其它连接，避免有的连接一直分不到
+func (r *Consumer) rdyLoop() {
+	ticker := time.NewTicker(r.config.RDYRedistributeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.rdyMtx.Lock()
+			if n := len(r.conns()); n > 0 && int(r.getMaxInFlight())%n != 0 {
+				r.rdyOffset++
+				r.updateAllRDY()
+			}
+			r.rdyMtx.Unlock()
+		case <-r.exitChan:
+			r.wg.Done()
+			r.log(lg.INFO, "exiting rdyLoop")
+			return
+		}
+	}
+}
+
+func (r *Consumer) backoffDurationForCount(count int32) time.Duration {
+	d := r.config.BackoffMultiplier * time.Duration(int64(1)<<uint(count-1))
+	if d > r.config.MaxBackoffDuration || d <= 0 {
+		d = r.config.MaxBackoffDuration
+	}
+	return d
+}
+
+// 处理失败时提高backoff级别，所有连接RDY 0，到时间后在一个连接上RDY 1试探
+// 试探成功时降低级别，降到0时恢复所有连接的RDY；继续失败时提高级别再等待
+func (r *Consumer) startStopContinueBackoff(signal backoffSignal) {
+	if r.config.MaxBackoffDuration == 0 {
+		return
+	}
+
+	r.rdyMtx.Lock()
+	defer r.rdyMtx.Unlock()
+
+	// 等待backoff计时器期间确认的都是backoff之前投递的消息，不改变状态
+	if r.inBackoffTimeout() {
+		return
+	}
+
+	backoffUpdated := false
+	backoffCounter := atomic.LoadInt32(&r.backoffCounter)
+	switch {
+	case signal == resumeFlag && backoffCounter > 0:
+		backoffCounter--
+		backoffUpdated = true
+	case signal == backoffFlag:
+		// 已经到最长时间后不再提高级别
+		if backoffCounter == 0 || r.backoffDurationForCount(backoffCounter) < r.config.MaxBackoffDuration {
+			backoffCounter++
+			backoffUpdated = true
+		}
+	}
+	atomic.StoreInt32(&r.backoffCounter, backoffCounter)
+
+	if backoffCounter == 0 && backoffUpdated {
+		r.log(lg.WARN, "exiting backoff, returning all to RDY")
+		r.updateAllRDY()
+	} else if backoffCounter > 0 {
+		backoffDuration := r.backoffDurationForCount(backoffCounter)
+		atomic.StoreInt64(&r.backoffDuration, int64(backoffDuration))
+		r.log(lg.WARN, "backing off for %s (backoff level %d), setting all to RDY 0",
+			backoffDuration, backoffCounter)
+		for _, c := range r.conns() {
+			r.updateRDY(c, 0)
+		}
+		time.AfterFunc(backoffDuration, r.resume)
+	}
+}
+
+// backoff计时器到期，随机选一个连接RDY 1试探
+func (r *Consumer) resume() {
+	r.rdyMtx.Lock()
+	defer r.rdyMtx.Unlock()
+
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		atomic.StoreInt64(&r.backoffDuration, 0)
+		return
+	}
+
+	conns := r.conns()
+	if len(conns) == 0 {
+		r.log(lg.WARN, "no connection available to resume, trying again in 1s")
+		time.AfterFunc(time.Second, r.resume)
+		return
+	}
+
+	choice := conns[rand.Intn(len(conns))]
+	r.log(lg.WARN, "(%s) backoff timeout expired, sending RDY 1", choice)
+	atomic.StoreInt64(&r.backoffDuration, 0)
+	r.updateRDY(choice, 1)
+}
+
+// 发送CLS，等in-flight的消息都确认、连接都关闭后关闭StopChan，30秒后强制关闭
+func (r *Consumer) Stop() {
+	if !atomic.CompareAndSwapInt32(&r.stopFlag, 0, 1) {
+		return
+	}
+
+	r.log(lg.INFO, "stopping...")
+
+	conns := r.conns()
+	if len(conns) == 0 {
+		r.exit()
+		return
+	}
+	for _, c := range conns {
+		err := c.WriteCommand(StartClose())
+		if err != nil {
+			r.log(lg.ERROR, "(%s) error sending CLS - %s", c, err)
+		}
+	}
+	time.AfterFunc(30*time.Second, r.exit)
+}
+
+func (r *Consumer) exit() {
+	r.exitHandler.Do(func() {
+		close(r.exitChan)
+		r.mtx.RLock()
+		for _, c := range r.connections {
+			c.Close()
+		}
+		for _, c := range r.pendingConnections {
+			c.Close()
+		}
+		r.mtx.RUnlock()
+		r.wg.Wait()
+		close(r.StopChan)
+	})
+}
+
+func (r *Consumer) log(lvl lg.LogLevel, line string, args ...interface{}) {
+	logger, logLvl := r.getLogger()
+	if logger == nil {
+		return
+	}
+	lg.Logf(logger, logLvl, lvl, "%3d [%s/%s] %s", r.id, r.topic, r.channel, fmt.Sprintf(line, args...))
+}
+
+func (r *Consumer) onConnMessage(c *Conn, msg *Message) {
+	atomic.AddUint64(&r.messagesReceived, 1)
+	select {
+	case r.incomingMessages <- msg:
+	case <-r.exitChan:
+		// 已经退出，消息超时后由nsqd重新投递
+	}
+}
+
+func (r *Consumer) onConnMessageFinished(c *Conn, msg *Message) {
+	atomic.AddUint64(&r.messagesFinished, 1)
+	r.startStopContinueBackoff(resumeFlag)
+}
+
+func (r *Consumer) onConnMessageRequeued(c *Conn, msg *Message, backoff bool) {
+	atomic.AddUint64(&r.messagesRequeued, 1)
+	if backoff {
+		r.startStopContinueBackoff(backoffFlag)
+	} else {
+		r.startStopContinueBackoff(continueFlag)
+	}
+}
+
+func (r *Consumer) onConnResponse(c *Conn, data []byte) {
+	if string(data) == "CLOSE_WAIT" {
+		r.log(lg.INFO, "(%s) received CLOSE_WAIT", c)
+	}
+}
+
+func (r *Consumer) onConnError(c *Conn, data []byte) {}
+
+func (r *Consumer) onConnIOError(c *Conn, err error) {
+	c.Close()
+}
+
+func (r *Consumer) onConnClose(c *Conn) {
+	addr := c.String()
+	r.mtx.Lock()
+	delete(r.connections, addr)
+	left := len(r.connections)
+	numLookupd := len(r.lookupdHTTPAddrs)
+	reconnect := indexOf(addr, r.nsqdTCPAddrs) >= 0
+	r.mtx.Unlock()
+
+	r.log(lg.WARN, "(%s) connection closed, there are %d connections left alive", c, left)
+
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		if left == 0 {
+			go r.exit()
+		}
+		return
+	}
+
+	// 连接数变了，重新分配RDY
+	r.rdyMtx.Lock()
+	r.updateAllRDY()
+	r.rdyMtx.Unlock()
+
+	if numLookupd > 0 {
+		// 使用lookupd时立即查询一次，nsqd还在就会重连
+		select {
+		case r.lookupdRecheckChan <- 1:
+		default:
+		}
+	} else if reconnect {
+		go r.reconnect(addr)
+	}
+}
+
+// 直连的nsqd断开后每隔LookupdPollInterval重连，直到成功或者被DisconnectFromNSQD移除
+func (r *Consumer) reconnect(addr string) {
+	for {
+		r.log(lg.INFO, "(%s) re-connecting in %s", addr, r.config.LookupdPollInterval)
+		select {
+		case <-time.After(r.config.LookupdPollInterval):
+		case <-r.exitChan:
+			return
+		}
+
+		r.mtx.RLock()
+		removed := indexOf(addr, r.nsqdTCPAddrs) == -1
+		r.mtx.RUnlock()
+		if removed || atomic.LoadInt32(&r.stopFlag) == 1 {
+			return
+		}
+
+		err := r.ConnectToNSQD(addr)
+		if err != nil && err != ErrAlreadyConnected {
+			r.log(lg.ERROR, "(%s) error connecting to nsqd - %s", addr, err)
+			continue
+		}
+		return
+	}
+}
+
+type consumerConnDelegate struct {
+	r *Consumer
+}
+
+func (d *consumerConnDelegate) OnResponse(c *Conn, data []byte) { d.r.onConnResponse(c, data) }
+func (d *consumerConnDelegate) OnError(c *Conn, data []byte)    { d.r.onConnError(c, data) }
+func (d *consumerConnDelegate) OnHeartbeat(c *Conn)             {}
+func (d *consumerConnDelegate) OnIOError(c *Conn, err error)    { d.r.onConnIOError(c, err) }
+func (d *consumerConnDelegate) OnClose(c *Conn)                 { d.r.onConnClose(c) }
+func (d *consumerConnDelegate) OnMessage(c *Conn, m *Message)   { d.r.onConnMessage(c, m) }
+func (d *consumerConnDelegate) OnMessageFinished(c *Conn, m *Message) {
+	d.r.onConnMessageFinished(c, m)
+}
+func (d *consumerConnDelegate) OnMessageRequeued(c *Conn, m *Message, backoff bool) {
+	d.r.onConnMessageRequeued(c, m, backoff)
+}
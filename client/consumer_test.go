@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nsq-learn/internal/lg"
+	"nsq-learn/nsqd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestConsumer(t *testing.T, topic string, channel string, config *Config) *Consumer {
+	c, err := NewConsumer(topic, channel, config)
+	assert.Nil(t, err)
+	// 协程可能在测试结束后才退出，不能用t.Log
+	c.SetLogger(nil, lg.INFO)
+	return c
+}
+
+// 测试用的配置，失败的消息立即重新投递，backoff时间很短
+func newTestConsumerConfig() *Config {
+	config := NewConfig()
+	config.DefaultRequeueDelay = 0
+	config.BackoffMultiplier = 10 * time.Millisecond
+	config.MaxBackoffDuration = 50 * time.Millisecond
+	config.LookupdPollInterval = 100 * time.Millisecond
+	return config
+}
+
+func channelClientCount(n *nsqd.NSQD, topic string, channel string) int {
+	stats := n.GetStats(topic, channel)
+	if len(stats) == 0 || len(stats[0].Channels) == 0 {
+		return 0
+	}
+	return stats[0].Channels[0].ClientCount
+}
+
+func publishN(t *testing.T, n *nsqd.NSQD, topic string, count int) {
+	p := newTestProducer(t, n.RealTCPAddr().String())
+	defer p.Stop()
+	for i := 0; i < count; i++ {
+		assert.Nil(t, p.Publish(topic, []byte(strconv.Itoa(i))))
+	}
+}
+
+func TestConsumerDirect(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	publishN(t, n, "consumer_test", 10)
+
+	config := newTestConsumerConfig()
+	config.MaxInFlight = 5
+	c := newTestConsumer(t, "consumer_test", "ch", config)
+
+	var mtx sync.Mutex
+	received := make(map[string]uint16)
+	c.AddConcurrentHandlers(HandlerFunc(func(m *Message) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		received[string(m.Body)] = m.Attempts
+		// 第一次处理"0"时失败，重新投递后成功
+		if string(m.Body) == "0" && m.Attempts == 1 {
+			return errors.New("fail once")
+		}
+		return nil
+	}), 3)
+
+	// 没有Handler时不能连接
+	noHandler := newTestConsumer(t, "consumer_test", "ch", config)
+	assert.NotNil(t, noHandler.ConnectToNSQD(n.RealTCPAddr().String()))
+	noHandler.Stop()
+
+	assert.Nil(t, c.ConnectToNSQD(n.RealTCPAddr().String()))
+	assert.Equal(t, ErrAlreadyConnected, c.ConnectToNSQD(n.RealTCPAddr().String()))
+
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		return c.Stats().MessagesFinished == 10
+	}))
+	stats := c.Stats()
+	assert.Equal(t, uint64(11), stats.MessagesReceived)
+	assert.Equal(t, uint64(1), stats.MessagesRequeued)
+	mtx.Lock()
+	assert.Equal(t, 10, len(received))
+	assert.Equal(t, uint16(2), received["0"])
+	mtx.Unlock()
+	assert.Equal(t, 1, channelClientCount(n, "consumer_test", "ch"))
+
+	// CLS后连接关闭，StopChan关闭
+	c.Stop()
+	select {
+	case <-c.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return channelClientCount(n, "consumer_test", "ch") == 0
+	}))
+	assert.Equal(t, ErrStopped, c.ConnectToNSQD(n.RealTCPAddr().String()))
+}
+
+func TestConsumerLookupd(t *testing.T) {
+	opts1 := nsqd.NewOptions()
+	n1 := mustStartNSQD(t, opts1)
+	defer os.RemoveAll(opts1.DataPath)
+	defer n1.Exit()
+	opts2 := nsqd.NewOptions()
+	n2 := mustStartNSQD(t, opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer n2.Exit()
+
+	publishN(t, n1, "lookupd_test", 5)
+	publishN(t, n2, "lookupd_test", 5)
+
+	var queries int32
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		assert.Equal(t, "/lookup", req.URL.Path)
+		assert.Equal(t, "lookupd_test", req.URL.Query().Get("topic"))
+		var producers []map[string]interface{}
+		for _, n := range []*nsqd.NSQD{n1, n2} {
+			producers = append(producers, map[string]interface{}{
+				"broadcast_address": "127.0.0.1",
+				"tcp_port":          n.RealTCPAddr().Port,
+				"http_port":         n.RealHTTPAddr().Port,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"channels":  []string{},
+			"producers": producers,
+		})
+	}))
+	defer lookupd.Close()
+
+	config := newTestConsumerConfig()
+	config.MaxInFlight = 3
+	config.RDYRedistributeInterval = 50 * time.Millisecond
+	c := newTestConsumer(t, "lookupd_test", "ch", config)
+	defer c.Stop()
+
+	var count int32
+	c.AddHandler(HandlerFunc(func(m *Message) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	}))
+	assert.Nil(t, c.ConnectToNSQLookupd(lookupd.Listener.Addr().String()))
+
+	assert.Equal(t, 2, c.Stats().Connections)
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		return atomic.LoadInt32(&count) == 10
+	}))
+
+	// MaxInFlight不能被2整除，多出来的1个RDY轮流分配
+	rdys := make(map[int64]bool)
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		conns := c.conns()
+		first := conns[0].RDY()
+		rdys[first] = true
+		assert.Equal(t, int64(3), first+conns[1].RDY())
+		return rdys[1] && rdys[2]
+	}))
+
+	// 一直在轮询lookupd
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return atomic.LoadInt32(&queries) > 2
+	}))
+}
+
+func TestConsumerBackoff(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	publishN(t, n, "backoff_test", 5)
+
+	config := newTestConsumerConfig()
+	config.MaxInFlight = 5
+	c := newTestConsumer(t, "backoff_test", "ch", config)
+	defer c.Stop()
+
+	var failures int32
+	var maxBackoff int32
+	c.AddHandler(HandlerFunc(func(m *Message) error {
+		if level := atomic.LoadInt32(&c.backoffCounter); level > atomic.LoadInt32(&maxBackoff) {
+			atomic.StoreInt32(&maxBackoff, level)
+		}
+		if atomic.AddInt32(&failures, 1) <= 3 {
+			return errors.New("fail")
+		}
+		return nil
+	}))
+	assert.Nil(t, c.ConnectToNSQD(n.RealTCPAddr().String()))
+
+	// 失败进入backoff，成功后退出backoff，恢复RDY
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		conns := c.conns()
+		return c.Stats().MessagesFinished == 5 && !c.inBackoff() && !c.inBackoffTimeout() &&
+			len(conns) == 1 && conns[0].RDY() == 5
+	}))
+	assert.True(t, atomic.LoadInt32(&maxBackoff) > 0)
+	assert.Equal(t, uint64(3), c.Stats().MessagesRequeued)
+}
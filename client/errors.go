@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 连接已经断开或者正在断开
+var ErrNotConnected = errors.New("not connected")
+
+// Producer已经Stop
+var ErrStopped = errors.New("stopped")
+
+// nsqd返回的错误，Reason为E_开头的错误码和描述，如 E_BAD_TOPIC PUB topic name "a b" is not valid
+type ErrProtocol struct {
+	Reason string
+}
+
+func (e ErrProtocol) Error() string {
+	return e.Reason
+}
+
+// MPUB回退到HTTP时只能逐条/pub，中途失败时前Published条已经发布，整批重试会重复发布这些消息
+type ErrPartialPublish struct {
+	Published int
+	Total     int
+	Err       error
+}
+
+func (e ErrPartialPublish) Error() string {
+	return fmt.Sprintf("published %d of %d messages via HTTP - %s", e.Published, e.Total, e.Err)
+}
+
+// IDENTIFY失败
+type ErrIdentify struct {
+	Reason string
+}
+
+func (e ErrIdentify) Error() string {
+	return fmt.Sprintf("failed to IDENTIFY - %s", e.Reason)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MsgIDLength = 16
+	// 最小的消息合法长度
+	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
+
+	// Attempts字段的最高位表示消息带有header块，和nsqd一致
+	msgFlagHeaders  = uint16(0x8000)
+	msgAttemptsMask = ^msgFlagHeaders
+)
+
+type MessageID [MsgIDLength]byte
+
+// 消息处理完后的确认，由收到消息的Conn实现
+type MessageDelegate interface {
+	// 消息处理成功
+	OnFinish(*Message)
+	// 消息重新入队，backoff表示是否触发Consumer的backoff
+	OnRequeue(m *Message, delay time.Duration, backoff bool)
+	// 重置消息的超时时间
+	OnTouch(*Message)
+}
+
+// 从nsqd收到的消息
+type Message struct {
+	ID        MessageID
+	Body      []byte
+	Timestamp int64
+	Attempts  uint16
+	Headers   map[string]string
+
+	// 投递这条消息的nsqd地址
+	NSQDAddress string
+
+	Delegate MessageDelegate
+
+	autoResponseDisabled int32
+	responded            int32
+}
+
+func NewMessage(id MessageID, body []byte) *Message {
+	return &Message{
+		ID:        id,
+		Body:      body,
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+// 关闭自动确认，Handler返回后不会自动FIN或者REQ，需要自己调用Finish或者Requeue
+// 用于异步处理消息
+func (m *Message) DisableAutoResponse() {
+	atomic.StoreInt32(&m.autoResponseDisabled, 1)
+}
+
+func (m *Message) IsAutoResponseDisabled() bool {
+	return atomic.LoadInt32(&m.autoResponseDisabled) == 1
+}
+
+// 是否已经Finish或者Requeue
+func (m *Message) HasResponded() bool {
+	return atomic.LoadInt32(&m.responded) == 1
+}
+
+// 确认消息处理成功，只有第一次调用有效
+func (m *Message) Finish() {
+	if !atomic.CompareAndSwapInt32(&m.responded, 0, 1) {
+		return
+	}
+	m.Delegate.OnFinish(m)
+}
+
+// 处理时间较长时重置超时时间，避免nsqd重新投递
+func (m *Message) Touch() {
+	if m.HasResponded() {
+		return
+	}
+	m.Delegate.OnTouch(m)
+}
+
+// 消息重新入队并触发backoff，delay为-1时按尝试次数计算延时
+func (m *Message) Requeue(delay time.Duration) {
+	m.doRequeue(delay, true)
+}
+
+// 消息重新入队，不触发backoff
+func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
+	m.doRequeue(delay, false)
+}
+
+func (m *Message) doRequeue(delay time.Duration, backoff bool) {
+	if !atomic.CompareAndSwapInt32(&m.responded, 0, 1) {
+		return
+	}
+	m.Delegate.OnRequeue(m, delay, backoff)
+}
+
+// 解析消息帧的数据，格式见nsqd的message.go
+func DecodeMessage(b []byte) (*Message, error) {
+	var msg Message
+
+	if len(b) < minValidMsgLength {
+		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+	}
+
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	attempts := binary.BigEndian.Uint16(b[8:10])
+	msg.Attempts = attempts & msgAttemptsMask
+	copy(msg.ID[:], b[10:10+MsgIDLength])
+	msg.Body = b[10+MsgIDLength:]
+
+	if attempts&msgFlagHeaders != 0 {
+		headers, n, err := decodeHeaders(msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		msg.Headers = headers
+		msg.Body = msg.Body[n:]
+	}
+
+	return &msg, nil
+}
+
+var errInvalidHeaders = errors.New("invalid message header block")
+
+// 解析header块，返回header和header块占用的字节数
+func decodeHeaders(b []byte) (map[string]string, int, error) {
+	if len(b) < 2 {
+		return nil, 0, errInvalidHeaders
+	}
+	size := int(binary.BigEndian.Uint16(b[:2]))
+	if len(b) < 2+size {
+		return nil, 0, fmt.Errorf("invalid message header block size (%d)", size)
+	}
+
+	headers := make(map[string]string)
+	p := b[2 : 2+size]
+	for len(p) > 0 {
+		var kv [2]string
+		for i := range kv {
+			if len(p) < 2 {
+				return nil, 0, errInvalidHeaders
+			}
+			l := int(binary.BigEndian.Uint16(p[:2]))
+			if len(p) < 2+l {
+				return nil, 0, errInvalidHeaders
+			}
+			kv[i] = string(p[2 : 2+l])
+			p = p[2+l:]
+		}
+		headers[kv[0]] = kv[1]
+	}
+	return headers, 2 + size, nil
+}
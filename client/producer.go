@@ -0,0 +1,471 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nsq-learn/internal/http_api"
+	"nsq-learn/internal/lg"
+)
+
+// Producer的连接状态
+const (
+	StateInit = iota
+	StateDisconnected
+	StateConnected
+)
+
+var instCount int64
+
+// 一次异步发布，完成后发送到doneChan
+type ProducerTransaction struct {
+	cmd      *Command
+	doneChan chan *ProducerTransaction
+	Error    error         // nsqd返回的错误，为nil表示发布成功
+	Args     []interface{} // 调用PublishAsync时传入的参数
+}
+
+func (t *ProducerTransaction) finish() {
+	if t.doneChan != nil {
+		t.doneChan <- t
+	}
+}
+
+// 向一个nsqd发布消息，并发安全
+// 第一次发布时建立连接，连接断开后下一次发布时重连
+// nsqd按收到的顺序处理命令并返回响应，所以响应按顺序对应到等待中的发布
+type Producer struct {
+	id     int64
+	addr   string
+	conn   *Conn
+	config Config
+
+	logger lg.Logger
+	logLvl lg.LogLevel
+	logMtx sync.RWMutex
+
+	// 连不上nsqd时通过HTTP /pub发布，为空表示不回退
+	httpAddr   string
+	httpClient *http_api.Client
+
+	responseChan chan []byte
+	errorChan    chan []byte
+	closeChan    chan int
+
+	transactionChan chan *ProducerTransaction
+	transactions    []*ProducerTransaction
+	state           int32
+
+	concurrentProducers int32
+	stopFlag            int32
+	exitChan            chan int
+	wg                  sync.WaitGroup
+	guard               sync.Mutex
+}
+
+// 创建Producer，addr为nsqd的TCP地址，config会复制一份，之后修改不影响Producer
+func NewProducer(addr string, config *Config) (*Producer, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Producer{
+		id: atomic.AddInt64(&instCount, 1),
+
+		addr:   addr,
+		config: *config,
+
+		logger: log.New(os.Stderr, "", log.Flags()),
+		logLvl: lg.INFO,
+
+		transactionChan: make(chan *ProducerTransaction),
+		exitChan:        make(chan int),
+		responseChan:    make(chan []byte),
+		errorChan:       make(chan []byte),
+	}
+	return p, nil
+}
+
+// 设置日志，l为nil时不输出日志
+func (w *Producer) SetLogger(l lg.Logger, lvl lg.LogLevel) {
+	w.logMtx.Lock()
+	defer w.logMtx.Unlock()
+	w.logger = l
+	w.logLvl = lvl
+}
+
+func (w *Producer) getLogger() (lg.Logger, lg.LogLevel) {
+	w.logMtx.RLock()
+	defer w.logMtx.RUnlock()
+	return w.logger, w.logLvl
+}
+
+// 连不上nsqd的TCP端口时通过httpAddr（nsqd的HTTP地址）的/pub发布，需要在发布之前设置
+// MultiPublish回退时逐条发布，中途失败时已经发布的消息不会撤回
+func (w *Producer) SetHTTPFallback(httpAddr string) {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+	w.httpAddr = httpAddr
+	w.httpClient = http_api.NewClient(nil, w.config.DialTimeout, w.config.HTTPTimeout)
+}
+
+func (w *Producer) String() string {
+	return w.addr
+}
+
+// 发送NOP检查连接是否可用
+func (w *Producer) Ping() error {
+	if atomic.LoadInt32(&w.state) != StateConnected {
+		err := w.connect()
+		if err != nil {
+			return err
+		}
+	}
+	return w.conn.WriteCommand(Nop())
+}
+
+// 关闭连接，等待中的发布返回ErrNotConnected，之后的发布返回ErrStopped
+func (w *Producer) Stop() {
+	w.guard.Lock()
+	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
+		w.guard.Unlock()
+		return
+	}
+	w.log(lg.INFO, "stopping")
+	close(w.exitChan)
+	w.close()
+	w.guard.Unlock()
+	w.wg.Wait()
+}
+
+// 异步发布，完成后ProducerTransaction发送到doneChan，args原样带回
+func (w *Producer) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return w.sendCommandAsync(Publish(topic, body), func() error {
+		return w.httpPublish(topic, "", 0, nil, body)
+	}, doneChan, args)
+}
+
+// 同步发布，等到nsqd返回后才返回
+func (w *Producer) Publish(topic string, body []byte) error {
+	return w.sendCommand(Publish(topic, body), func() error {
+		return w.httpPublish(topic, "", 0, nil, body)
+	})
+}
+
+// 带幂等key同步发布，nsqd在去重时间窗口内收到同样的key时不再写入，也返回成功
+func (w *Producer) PublishWithKey(topic string, key string, body []byte) error {
+	return w.sendCommand(PublishWithKey(topic, key, body), func() error {
+		return w.httpPublish(topic, key, 0, nil, body)
+	})
+}
+
+// 同步发布一条带header的消息
+// 回退到HTTP时header作为X-NSQ-Attr-<key>请求头发送，nsqd会把key转成小写
+func (w *Producer) PublishWithHeaders(topic string, headers map[string]string, body []byte) error {
+	cmd, err := HeaderPublish(topic, headers, body)
+	if err != nil {
+		return err
+	}
+	return w.sendCommand(cmd, func() error {
+		return w.httpPublish(topic, "", 0, headers, body)
+	})
+}
+
+// 异步发布多条消息，回退到HTTP时部分发布失败返回ErrPartialPublish
+func (w *Producer) MultiPublishAsync(topic string, body [][]byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	cmd, err := MultiPublish(topic, body)
+	if err != nil {
+		return err
+	}
+	return w.sendCommandAsync(cmd, func() error {
+		return w.httpMultiPublish(topic, body)
+	}, doneChan, args)
+}
+
+// 同步发布多条消息，nsqd一次写入
+// 回退到HTTP时逐条发布，不能保证一次写入，部分发布失败返回ErrPartialPublish
+func (w *Producer) MultiPublish(topic string, body [][]byte) error {
+	cmd, err := MultiPublish(topic, body)
+	if err != nil {
+		return err
+	}
+	return w.sendCommand(cmd, func() error {
+		return w.httpMultiPublish(topic, body)
+	})
+}
+
+// 异步延时发布
+func (w *Producer) DeferredPublishAsync(topic string, delay time.Duration, body []byte,
+	doneChan chan *ProducerTransaction, args ...interface{}) error {
+	return w.sendCommandAsync(DeferredPublish(topic, delay, body), func() error {
+		return w.httpPublish(topic, "", delay, nil, body)
+	}, doneChan, args)
+}
+
+// 同步延时发布
+func (w *Producer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return w.sendCommand(DeferredPublish(topic, delay, body), func() error {
+		return w.httpPublish(topic, "", delay, nil, body)
+	})
+}
+
+func (w *Producer) sendCommand(cmd *Command, fallback func() error) error {
+	doneChan := make(chan *ProducerTransaction, 1)
+	err := w.sendCommandAsync(cmd, fallback, doneChan, nil)
+	if err != nil {
+		return err
+	}
+	t := <-doneChan
+	return t.Error
+}
+
+// 连不上nsqd且设置了HTTP回退时，在当前协程里通过HTTP发布，结果同样发送到doneChan
+func (w *Producer) sendCommandAsync(cmd *Command, fallback func() error, doneChan chan *ProducerTransaction,
+	args []interface{}) error {
+	// 记录有多少个协程在发布，transactionCleanup要等它们都返回
+	atomic.AddInt32(&w.concurrentProducers, 1)
+	defer atomic.AddInt32(&w.concurrentProducers, -1)
+
+	t := &ProducerTransaction{
+		cmd:      cmd,
+		doneChan: doneChan,
+		Args:     args,
+	}
+
+	if atomic.LoadInt32(&w.state) != StateConnected {
+		err := w.connect()
+		if err != nil {
+			if err == ErrStopped || !w.hasHTTPFallback() {
+				return err
+			}
+			w.log(lg.WARN, "(%s) falling back to HTTP - %s", w.addr, err)
+			t.Error = fallback()
+			// doneChan可能没有缓冲，调用者要等这里返回后才会读
+			go t.finish()
+			return nil
+		}
+	}
+
+	select {
+	case w.transactionChan <- t:
+	case <-w.exitChan:
+		return ErrStopped
+	}
+
+	return nil
+}
+
+func (w *Producer) hasHTTPFallback() bool {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+	return w.httpAddr != ""
+}
+
+func (w *Producer) httpPublish(topic string, key string, delay time.Duration, headers map[string]string,
+	body []byte) error {
+	params := url.Values{}
+	params.Set("topic", topic)
+	if key != "" {
+		params.Set("idempotency_key", key)
+	}
+	if delay > 0 {
+		params.Set("defer", strconv.FormatInt(int64(delay/time.Millisecond), 10))
+	}
+	var header http.Header
+	if len(headers) > 0 {
+		header = make(http.Header)
+		for k, v := range headers {
+			header.Set("X-NSQ-Attr-"+k, v)
+		}
+	}
+
+	w.guard.Lock()
+	endpoint := fmt.Sprintf("http://%s/pub?%s", w.httpAddr, params.Encode())
+	client := w.httpClient
+	w.guard.Unlock()
+
+	return client.POSTV1WithBody(endpoint, header, body)
+}
+
+// 一条都没有发布成功时返回原来的错误
+func (w *Producer) httpMultiPublish(topic string, body [][]byte) error {
+	for i, b := range body {
+		err := w.httpPublish(topic, "", 0, nil, b)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			return ErrPartialPublish{Published: i, Total: len(body), Err: err}
+		}
+	}
+	return nil
+}
+
+func (w *Producer) connect() error {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return ErrStopped
+	}
+
+	switch state := atomic.LoadInt32(&w.state); state {
+	case StateInit:
+	case StateConnected:
+		return nil
+	default:
+		// 上一个连接还没有清理完
+		return ErrNotConnected
+	}
+
+	w.log(lg.INFO, "(%s) connecting to nsqd", w.addr)
+
+	logger, logLvl := w.getLogger()
+	w.conn = NewConn(w.addr, &w.config, &producerConnDelegate{w})
+	w.conn.SetLogger(logger, logLvl, fmt.Sprintf("%3d (%%s)", w.id))
+
+	_, err := w.conn.Connect()
+	if err != nil {
+		w.conn.Close()
+		w.log(lg.ERROR, "(%s) error connecting to nsqd - %s", w.addr, err)
+		return err
+	}
+	atomic.StoreInt32(&w.state, StateConnected)
+	w.closeChan = make(chan int)
+	w.wg.Add(1)
+	go w.router()
+
+	return nil
+}
+
+func (w *Producer) close() {
+	if !atomic.CompareAndSwapInt32(&w.state, StateConnected, StateDisconnected) {
+		return
+	}
+	w.conn.Close()
+	go func() {
+		// 等router退出、等待中的发布都返回后才能重连
+		w.wg.Wait()
+		atomic.StoreInt32(&w.state, StateInit)
+	}()
+}
+
+// 按顺序发送命令，收到响应时完成最早的一个发布
+func (w *Producer) router() {
+	for {
+		select {
+		case t := <-w.transactionChan:
+			w.transactions = append(w.transactions, t)
+			err := w.conn.WriteCommand(t.cmd)
+			if err != nil {
+				w.log(lg.ERROR, "(%s) sending command - %s", w.conn, err)
+				w.close()
+			}
+		case data := <-w.responseChan:
+			w.popTransaction(FrameTypeResponse, data)
+		case data := <-w.errorChan:
+			w.popTransaction(FrameTypeError, data)
+		case <-w.closeChan:
+			goto exit
+		case <-w.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	w.transactionCleanup()
+	w.wg.Done()
+	w.log(lg.INFO, "exiting router")
+}
+
+func (w *Producer) popTransaction(frameType int32, data []byte) {
+	if len(w.transactions) == 0 {
+		w.log(lg.ERROR, "(%s) unexpected response %s", w.conn, data)
+		w.close()
+		return
+	}
+	t := w.transactions[0]
+	w.transactions = w.transactions[1:]
+	if frameType == FrameTypeError {
+		t.Error = ErrProtocol{string(data)}
+	}
+	t.finish()
+}
+
+func (w *Producer) transactionCleanup() {
+	// 已经发出去的命令不知道nsqd有没有处理，都返回ErrNotConnected
+	for _, t := range w.transactions {
+		t.Error = ErrNotConnected
+		t.finish()
+	}
+	w.transactions = w.transactions[:0]
+
+	// 还在等着进transactionChan的发布也返回ErrNotConnected，直到没有协程在发布
+	for {
+		select {
+		case t := <-w.transactionChan:
+			t.Error = ErrNotConnected
+			t.finish()
+		default:
+			if atomic.LoadInt32(&w.concurrentProducers) == 0 {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func (w *Producer) log(lvl lg.LogLevel, line string, args ...interface{}) {
+	logger, logLvl := w.getLogger()
+	if logger == nil {
+		return
+	}
+	lg.Logf(logger, logLvl, lvl, "%3d %s", w.id, fmt.Sprintf(line, args...))
+}
+
+func (w *Producer) onConnResponse(c *Conn, data []byte) {
+	select {
+	case w.responseChan <- data:
+	case <-w.exitChan:
+	}
+}
+
+func (w *Producer) onConnError(c *Conn, data []byte) {
+	select {
+	case w.errorChan <- data:
+	case <-w.exitChan:
+	}
+}
+
+func (w *Producer) onConnIOError(c *Conn, err error) {
+	w.close()
+}
+
+func (w *Producer) onConnClose(c *Conn) {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+	close(w.closeChan)
+}
+
+type producerConnDelegate struct {
+	w *Producer
+}
+
+func (d *producerConnDelegate) OnResponse(c *Conn, data []byte)                     { d.w.onConnResponse(c, data) }
+func (d *producerConnDelegate) OnError(c *Conn, data []byte)                        { d.w.onConnError(c, data) }
+func (d *producerConnDelegate) OnHeartbeat(c *Conn)                                 {}
+func (d *producerConnDelegate) OnIOError(c *Conn, err error)                        { d.w.onConnIOError(c, err) }
+func (d *producerConnDelegate) OnClose(c *Conn)                                     { d.w.onConnClose(c) }
+func (d *producerConnDelegate) OnMessage(c *Conn, m *Message)                       {}
+func (d *producerConnDelegate) OnMessageFinished(c *Conn, m *Message)               {}
+func (d *producerConnDelegate) OnMessageRequeued(c *Conn, m *Message, backoff bool) {}
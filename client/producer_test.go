@@ -0,0 +1,179 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"nsq-learn/nsqd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustStartNSQD(t *testing.T, opts *nsqd.Options) *nsqd.NSQD {
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.Logger = test.NewTestLogger(t)
+	if opts.DataPath == "" {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-")
+		if err != nil {
+			panic(err)
+		}
+		opts.DataPath = tmpDir
+	}
+	n := nsqd.New(opts)
+	n.Main()
+	return n
+}
+
+func newTestProducer(t *testing.T, addr string) *Producer {
+	p, err := NewProducer(addr, NewConfig())
+	assert.Nil(t, err)
+	// 协程可能在测试结束后才退出，不能用t.Log
+	p.SetLogger(nil, lg.INFO)
+	return p
+}
+
+func topicMessageCount(n *nsqd.NSQD, topic string) uint64 {
+	stats := n.GetStats(topic, "")
+	if len(stats) == 0 {
+		return 0
+	}
+	return stats[0].MessageCount
+}
+
+// 等待条件成立，超时返回false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestProducerPublish(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	p := newTestProducer(t, n.RealTCPAddr().String())
+	defer p.Stop()
+
+	assert.Nil(t, p.Publish("pub_test", []byte("hello")))
+	assert.Nil(t, p.MultiPublish("pub_test", [][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+	assert.Nil(t, p.DeferredPublish("pub_test", time.Second, []byte("later")))
+	assert.Nil(t, p.PublishWithHeaders("pub_test", map[string]string{"trace-id": "abc"}, []byte("hdr")))
+	assert.Equal(t, uint64(6), topicMessageCount(n, "pub_test"))
+
+	// 同一个幂等key只写入一次
+	assert.Nil(t, p.PublishWithKey("pub_test", "key-1", []byte("once")))
+	assert.Nil(t, p.PublishWithKey("pub_test", "key-1", []byte("once")))
+	assert.Equal(t, uint64(7), topicMessageCount(n, "pub_test"))
+	assert.Equal(t, uint64(1), n.GetStats("pub_test", "")[0].DedupeHits)
+}
+
+func TestProducerPublishAsync(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	p := newTestProducer(t, n.RealTCPAddr().String())
+	defer p.Stop()
+
+	count := 100
+	doneChan := make(chan *ProducerTransaction, count)
+	for i := 0; i < count; i++ {
+		assert.Nil(t, p.PublishAsync("async_test", []byte("test"), doneChan, i))
+	}
+	// 响应按发送的顺序返回
+	for i := 0; i < count; i++ {
+		trans := <-doneChan
+		assert.Nil(t, trans.Error)
+		assert.Equal(t, []interface{}{i}, trans.Args)
+	}
+	assert.Equal(t, uint64(count), topicMessageCount(n, "async_test"))
+}
+
+func TestProducerErrorAndReconnect(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	p := newTestProducer(t, n.RealTCPAddr().String())
+	defer p.Stop()
+
+	// 不合法的topic名是致命错误，nsqd会关闭连接
+	err := p.Publish("bad!topic", []byte("test"))
+	assert.IsType(t, ErrProtocol{}, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "E_BAD_TOPIC"), err.Error())
+
+	// 旧连接清理完后下一次发布会重连
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		return p.Publish("reconnect_test", []byte("test")) == nil
+	}))
+	assert.Equal(t, uint64(1), topicMessageCount(n, "reconnect_test"))
+
+	p.Stop()
+	assert.Equal(t, ErrStopped, p.Publish("reconnect_test", []byte("test")))
+}
+
+func TestProducerHTTPFallback(t *testing.T) {
+	opts := nsqd.NewOptions()
+	n := mustStartNSQD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer n.Exit()
+
+	// 找一个没有监听的端口
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	p := newTestProducer(t, deadAddr)
+	defer p.Stop()
+
+	err = p.Publish("fallback_test", []byte("test"))
+	assert.NotNil(t, err)
+
+	p.SetHTTPFallback(n.RealHTTPAddr().String())
+	assert.Nil(t, p.Publish("fallback_test", []byte("test")))
+	assert.Nil(t, p.MultiPublish("fallback_test", [][]byte{[]byte("a"), []byte("b")}))
+	assert.Nil(t, p.PublishWithHeaders("fallback_test", map[string]string{"trace-id": "abc"}, []byte("hdr")))
+
+	doneChan := make(chan *ProducerTransaction)
+	assert.Nil(t, p.DeferredPublishAsync("fallback_test", time.Second, []byte("later"), doneChan, "arg"))
+	trans := <-doneChan
+	assert.Nil(t, trans.Error)
+	assert.Equal(t, []interface{}{"arg"}, trans.Args)
+
+	assert.Equal(t, uint64(5), topicMessageCount(n, "fallback_test"))
+
+	// nsqd返回的错误原样返回
+	err = p.Publish("bad!topic", []byte("test"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "INVALID_TOPIC")
+
+	// MPUB中途失败时返回已经发布的条数
+	tooBig := make([]byte, opts.MaxMsgSize+1)
+	err = p.MultiPublish("fallback_test", [][]byte{[]byte("a"), tooBig, []byte("c")})
+	partial, ok := err.(ErrPartialPublish)
+	assert.True(t, ok, "%v", err)
+	assert.Equal(t, 1, partial.Published)
+	assert.Equal(t, 3, partial.Total)
+	assert.Contains(t, partial.Err.Error(), "MSG_TOO_BIG")
+	assert.Equal(t, uint64(6), topicMessageCount(n, "fallback_test"))
+	err = p.MultiPublish("fallback_test", [][]byte{tooBig})
+	_, ok = err.(ErrPartialPublish)
+	assert.False(t, ok)
+}
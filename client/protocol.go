@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 连接建立后首先发送的协议版本号
+var MagicV2 = []byte("  V2")
+
+// nsqd发来的帧类型
+const (
+	FrameTypeResponse int32 = 0
+	FrameTypeError    int32 = 1
+	FrameTypeMessage  int32 = 2
+)
+
+// 读取一帧数据: [4-byte 大小][4-byte 帧类型][N-byte 数据]
+func ReadResponse(r io.Reader) ([]byte, error) {
+	var msgSize int32
+
+	err := binary.Read(r, binary.BigEndian, &msgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgSize < 4 {
+		return nil, fmt.Errorf("invalid response size %d", msgSize)
+	}
+
+	buf := make([]byte, msgSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// 拆出帧类型和数据
+func UnpackResponse(response []byte) (int32, []byte, error) {
+	if len(response) < 4 {
+		return -1, nil, errors.New("length of response is too small")
+	}
+
+	return int32(binary.BigEndian.Uint32(response)), response[4:], nil
+}
+
+func ReadUnpackedResponse(r io.Reader) (int32, []byte, error) {
+	resp, err := ReadResponse(r)
+	if err != nil {
+		return -1, nil, err
+	}
+	return UnpackResponse(resp)
+}
@@ -0,0 +1,20 @@
+// 命令行工具共用的代码
+package app
+
+import (
+	"strings"
+)
+
+// 可以重复指定的命令行参数，如 --nsqd-tcp-address=a --nsqd-tcp-address=b
+type StringArray []string
+
+func (a *StringArray) Get() interface{} { return []string(*a) }
+
+func (a *StringArray) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+func (a *StringArray) String() string {
+	return strings.Join(*a, ",")
+}
@@ -0,0 +1,139 @@
+package http_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// access log的格式
+const (
+	AccessLogCommon   = "common"   // Common Log Format
+	AccessLogCombined = "combined" // Common Log Format加上Referer和User-Agent
+	AccessLogJSON     = "json"     // 每个请求一行JSON对象
+)
+
+// HTTP请求的访问日志，和应用日志分开写
+// samplePaths中的请求（如健康检查的/ping和/stats）只按sampleRate的比例记录
+type AccessLogger struct {
+	sync.Mutex
+	w           io.Writer
+	format      string
+	samplePaths map[string]bool
+	sampleRate  float64
+}
+
+func NewAccessLogger(w io.Writer, format string, samplePaths []string, sampleRate float64) (*AccessLogger, error) {
+	switch format {
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid access log sample rate %v", sampleRate)
+	}
+	l := &AccessLogger{
+		w:           w,
+		format:      format,
+		samplePaths: make(map[string]bool, len(samplePaths)),
+		sampleRate:  sampleRate,
+	}
+	for _, p := range samplePaths {
+		l.samplePaths[p] = true
+	}
+	return l, nil
+}
+
+// 记录响应的状态码和字节数
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// 包装handler，请求处理完后写一条访问日志
+func (l *AccessLogger) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := &accessLogResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, req)
+		if l.samplePaths[req.URL.Path] && rand.Float64() >= l.sampleRate {
+			return
+		}
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		l.write(start, time.Since(start), req, rw.status, rw.bytes)
+	})
+}
+
+func (l *AccessLogger) write(start time.Time, elapsed time.Duration, req *http.Request, status int, bytes int64) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	var line []byte
+	if l.format == AccessLogJSON {
+		line, _ = json.Marshal(struct {
+			Time       string  `json:"time"`
+			RemoteAddr string  `json:"remote_addr"`
+			Method     string  `json:"method"`
+			URI        string  `json:"uri"`
+			Proto      string  `json:"proto"`
+			Status     int     `json:"status"`
+			Bytes      int64   `json:"bytes"`
+			LatencyMs  float64 `json:"latency_ms"`
+			Referer    string  `json:"referer,omitempty"`
+			UserAgent  string  `json:"user_agent,omitempty"`
+		}{
+			Time:       start.Format(time.RFC3339Nano),
+			RemoteAddr: host,
+			Method:     req.Method,
+			URI:        req.URL.RequestURI(),
+			Proto:      req.Proto,
+			Status:     status,
+			Bytes:      bytes,
+			LatencyMs:  float64(elapsed) / float64(time.Millisecond),
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+		})
+	} else {
+		// host ident authuser [date] "request" status bytes
+		size := "-"
+		if bytes > 0 {
+			size = fmt.Sprint(bytes)
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %s", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method+" "+req.URL.RequestURI()+" "+req.Proto, status, size))
+		if l.format == AccessLogCombined {
+			line = append(line, fmt.Sprintf(" %q %q", req.Referer(), req.UserAgent())...)
+		}
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	l.w.Write(line)
+	l.Unlock()
+}
@@ -1,9 +1,11 @@
 package http_api
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -87,12 +89,25 @@ retry:
 // PostV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) POSTV1(endpoint string) error {
+	return c.POSTV1WithBody(endpoint, nil, nil)
+}
+
+// POSTV1WithBody is POSTV1 with extra request headers and a request body,
+// e.g. for publishing to /pub.
+func (c *Client) POSTV1WithBody(endpoint string, header http.Header, body []byte) error {
 retry:
-	req, err := http.NewRequest("POST", endpoint, nil)
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest("POST", endpoint, bodyReader)
 	if err != nil {
 		return err
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
 
 	resp, err := c.c.Do(req)
@@ -100,20 +115,20 @@ retry:
 		return err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
-			endpoint, err = httpsEndpoint(endpoint, body)
+			endpoint, err = httpsEndpoint(endpoint, respBody)
 			if err != nil {
 				return err
 			}
 			goto retry
 		}
-		return fmt.Errorf("got response %s %q", resp.Status, body)
+		return fmt.Errorf("got response %s %q", resp.Status, respBody)
 	}
 
 	return nil
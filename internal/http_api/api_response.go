@@ -113,7 +113,8 @@ func Decorate(f APIHandler, ds ...Decorator) httprouter.Handle {
 	}
 }
 
-func Log(logf lg.AppLogFunc) Decorator {
+// 请求日志，JSON格式时状态码、方法、URI、远端地址和耗时作为单独的字段输出
+func Log(logf lg.AppLogFieldsFunc) Decorator {
 	return func(f APIHandler) APIHandler {
 		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			start := time.Now()
@@ -123,23 +124,30 @@ func Log(logf lg.AppLogFunc) Decorator {
 			if e, ok := err.(Err); ok {
 				status = e.Code
 			}
-			logf(lg.INFO, "%d %s %s (%s) %s",
+			fields := lg.Fields{
+				"status":      status,
+				"method":      req.Method,
+				"uri":         req.URL.RequestURI(),
+				"remote_addr": req.RemoteAddr,
+				"latency_ms":  elapsed,
+			}
+			logf(lg.INFO, fields, "%d %s %s (%s) %s",
 				status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed)
 			return response, err
 		}
 	}
 }
 
-func LogPanicHandler(logf lg.AppLogFunc) func(w http.ResponseWriter, req *http.Request, p interface{}) {
+func LogPanicHandler(logf lg.AppLogFieldsFunc) func(w http.ResponseWriter, req *http.Request, p interface{}) {
 	return func(w http.ResponseWriter, req *http.Request, p interface{}) {
-		logf(lg.ERROR, "panic in HTTP handler - %s", p)
+		logf(lg.ERROR, nil, "panic in HTTP handler - %s", p)
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Err{500, "INTERNAL_ERROR"}
 		}, Log(logf), V1)(w, req, nil)
 	}
 }
 
-func LogNotFoundHandler(logf lg.AppLogFunc) http.Handler {
+func LogNotFoundHandler(logf lg.AppLogFieldsFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Err{404, "NOT_FOUND"}
@@ -147,7 +155,7 @@ func LogNotFoundHandler(logf lg.AppLogFunc) http.Handler {
 	})
 }
 
-func LogMethodNotAllowedHandler(logf lg.AppLogFunc) http.Handler {
+func LogMethodNotAllowedHandler(logf lg.AppLogFieldsFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Err{405, "METHOD_NOT_ALLOWED"}
@@ -10,14 +10,15 @@ type getter interface {
 	Get(key string) (string, error)
 }
 
-func GetTopicChannelArgs(rp getter) (string, string, error) {
+// 取出topic和channel参数并按规则校验，名字不合法时错误码以没通过的规则结尾，如INVALID_ARG_TOPIC_TOO_LONG
+func GetTopicChannelArgs(rp getter, topicPolicy *protocol.NamePolicy, channelPolicy *protocol.NamePolicy) (string, string, error) {
 	topicName, err := rp.Get("topic")
 	if err != nil {
 		return "", "", errors.New("MISSING_ARG_TOPIC")
 	}
 
-	if !protocol.IsValidTopicName(topicName) {
-		return "", "", errors.New("INVALID_ARG_TOPIC")
+	if err := topicPolicy.Validate(topicName); err != nil {
+		return "", "", errors.New("INVALID_ARG_TOPIC_" + protocol.NameErrorRule(err))
 	}
 
 	channelName, err := rp.Get("channel")
@@ -25,8 +26,8 @@ func GetTopicChannelArgs(rp getter) (string, string, error) {
 		return "", "", errors.New("MISSING_ARG_CHANNEL")
 	}
 
-	if !protocol.IsValidChannelName(channelName) {
-		return "", "", errors.New("INVALID_ARG_CHANNEL")
+	if err := channelPolicy.Validate(channelName); err != nil {
+		return "", "", errors.New("INVALID_ARG_CHANNEL_" + protocol.NameErrorRule(err))
 	}
 
 	return topicName, channelName, nil
@@ -2,8 +2,10 @@
 package lg
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type LogLevel int
@@ -16,8 +18,22 @@ const (
 	FATAL = LogLevel(5)
 )
 
+// 日志的输出格式
+type LogFormat int
+
+const (
+	TEXT = LogFormat(0) // INFO: xxx
+	JSON = LogFormat(1) // 每条日志一行JSON对象
+)
+
+// 结构化字段，如topic、channel、client、remote_addr等，JSON格式时单独输出
+type Fields map[string]interface{}
+
 type AppLogFunc func(lvl LogLevel, f string, args ...interface{})
 
+// 带结构化字段的日志函数
+type AppLogFieldsFunc func(lvl LogLevel, fields Fields, f string, args ...interface{})
+
 type Logger interface {
 	Output(maxdepth int, s string) error
 }
@@ -64,6 +80,17 @@ func ParseLogLevel(levelstr string, verbose bool) (LogLevel, error) {
 	return lvl, nil
 }
 
+func ParseLogFormat(formatstr string) (LogFormat, error) {
+	switch strings.ToLower(formatstr) {
+	case "", "text":
+		return TEXT, nil
+	case "json":
+		return JSON, nil
+	default:
+		return TEXT, fmt.Errorf("不合法的日志格式 '%s'", formatstr)
+	}
+}
+
 func Logf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, f string, args ...interface{}) {
 	// 判断下日志等级，如果当前日志等级msgLevel小于配置日志等级cfgLevel，则不打印到日志上
 	if cfgLevel > msgLevel {
@@ -71,3 +98,46 @@ func Logf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, f string, args ..
 	}
 	logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
 }
+
+// 带结构化字段输出日志，TEXT格式时和Logf完全一样（字段已经包含在消息里，不再输出）
+// JSON格式时每条日志输出一行JSON对象，字段和time、level、msg平级:
+// {"level":"INFO","msg":"...","time":"2006-01-02T15:04:05.999999999Z07:00","topic":"test"}
+func LogfWithFields(logger Logger, format LogFormat, cfgLevel LogLevel, msgLevel LogLevel, fields Fields, f string, args ...interface{}) {
+	if cfgLevel > msgLevel {
+		return
+	}
+	if format != JSON {
+		logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
+		return
+	}
+	logger.Output(3, formatJSON(time.Now(), msgLevel, fields, fmt.Sprintf(f, args...)))
+}
+
+func formatJSON(now time.Time, lvl LogLevel, fields Fields, msg string) string {
+	obj := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		switch v := v.(type) {
+		case error:
+			obj[k] = v.Error()
+		case time.Duration:
+			// 时长统一输出为毫秒
+			obj[k] = float64(v) / float64(time.Millisecond)
+		default:
+			obj[k] = v
+		}
+	}
+	// 固定字段不能被覆盖
+	obj["time"] = now.Format(time.RFC3339Nano)
+	obj["level"] = lvl.String()
+	obj["msg"] = strings.TrimRight(msg, "\n")
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		// 字段无法编码时都转成字符串
+		for k, v := range obj {
+			obj[k] = fmt.Sprint(v)
+		}
+		data, _ = json.Marshal(obj)
+	}
+	return string(data)
+}
@@ -1,8 +1,10 @@
 package lg
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -49,3 +51,44 @@ func TestLogfFail(t *testing.T) {
 	}
 	assert.Equal(t, 0, logger.Count)
 }
+
+type captureLogger struct {
+	lines []string
+}
+
+func (l *captureLogger) Output(maxdepth int, s string) error {
+	l.lines = append(l.lines, s)
+	return nil
+}
+
+func TestParseLogFormat(t *testing.T) {
+	res, err := ParseLogFormat("JSON")
+	assert.Nil(t, err)
+	assert.Equal(t, JSON, res)
+	res, _ = ParseLogFormat("text")
+	assert.Equal(t, TEXT, res)
+	_, err = ParseLogFormat("xml")
+	assert.NotNil(t, err)
+}
+
+func TestLogfWithFields(t *testing.T) {
+	logger := new(captureLogger)
+	fields := Fields{"topic": "test", "latency_ms": 1500 * time.Microsecond, "msg": "ignored"}
+
+	// TEXT格式和Logf的输出一样
+	LogfWithFields(logger, TEXT, INFO, INFO, fields, "hello %s", "world")
+	assert.Equal(t, "INFO: hello world", logger.lines[0])
+
+	LogfWithFields(logger, JSON, INFO, WARN, fields, "hello %s\n", "world")
+	var obj map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(logger.lines[1]), &obj))
+	assert.Equal(t, "WARN", obj["level"])
+	assert.Equal(t, "hello world", obj["msg"])
+	assert.Equal(t, "test", obj["topic"])
+	assert.Equal(t, 1.5, obj["latency_ms"])
+	assert.NotEmpty(t, obj["time"])
+
+	// 低于配置等级的不输出
+	LogfWithFields(logger, JSON, INFO, DEBUG, fields, "debug")
+	assert.Equal(t, 2, len(logger.lines))
+}
@@ -0,0 +1,44 @@
+package protocol
+
+// 带原始错误的错误，记日志时用来输出底层原因
+type ChildErr interface {
+	Parent() error
+}
+
+// 返回给客户端的错误，客户端收到后连接继续可用
+type ClientErr struct {
+	ParentErr error
+	Code      string
+	Desc      string
+}
+
+func (e *ClientErr) Error() string {
+	return e.Code + " " + e.Desc
+}
+
+func (e *ClientErr) Parent() error {
+	return e.ParentErr
+}
+
+func NewClientErr(parent error, code string, description string) *ClientErr {
+	return &ClientErr{parent, code, description}
+}
+
+// 返回给客户端后需要关闭连接的错误
+type FatalClientErr struct {
+	ParentErr error
+	Code      string
+	Desc      string
+}
+
+func (e *FatalClientErr) Error() string {
+	return e.Code + " " + e.Desc
+}
+
+func (e *FatalClientErr) Parent() error {
+	return e.ParentErr
+}
+
+func NewFatalClientErr(parent error, code string, description string) *FatalClientErr {
+	return &FatalClientErr{parent, code, description}
+}
@@ -1,22 +1,92 @@
 package protocol
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
-var validTopicChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+const ephemeralSuffix = "#ephemeral"
 
-// TopicName是否合法
-func IsValidTopicName(name string) bool {
-	return isValidName(name)
+// 名字不合法的原因，HTTP和TCP返回的错误码以此结尾，如INVALID_TOPIC_TOO_LONG
+const (
+	NameRuleEmpty    = "EMPTY"
+	NameRuleTooLong  = "TOO_LONG"
+	NameRuleCharset  = "BAD_CHARSET"
+	NameRulePrefix   = "MISSING_PREFIX"
+	NameRuleReserved = "RESERVED"
+)
+
+// 名字不满足NamePolicy时返回的错误，Rule是没有通过的规则
+type NameError struct {
+	Name string
+	Rule string
 }
 
-// ChannelName是否合法
-func IsValidChannelName(name string) bool {
-	return isValidName(name)
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid name %q (%s)", e.Name, e.Rule)
+}
+
+// topic和channel名的校验规则
+type NamePolicy struct {
+	// 包括#ephemeral后缀在内的最大长度
+	MaxLength int
+	// 去掉#ephemeral后缀后需要匹配的正则
+	Charset *regexp.Regexp
+	// 不为空时名字必须以其中一个前缀开头
+	RequiredPrefixes []string
+	// 以这些前缀开头的名字不能使用
+	ReservedPrefixes []string
+}
+
+// 默认规则，最长64个字符，只能包含字母、数字和.-_
+var DefaultNamePolicy = &NamePolicy{
+	MaxLength: 64,
+	Charset:   regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`),
+}
+
+// 检查名字，不合法时返回*NameError
+func (p *NamePolicy) Validate(name string) error {
+	base := strings.TrimSuffix(name, ephemeralSuffix)
+	if len(base) < 1 {
+		return &NameError{name, NameRuleEmpty}
+	}
+	if len(name) > p.MaxLength {
+		return &NameError{name, NameRuleTooLong}
+	}
+	if !p.Charset.MatchString(base) {
+		return &NameError{name, NameRuleCharset}
+	}
+	for _, prefix := range p.ReservedPrefixes {
+		if strings.HasPrefix(base, prefix) {
+			return &NameError{name, NameRuleReserved}
+		}
+	}
+	if len(p.RequiredPrefixes) > 0 {
+		for _, prefix := range p.RequiredPrefixes {
+			if strings.HasPrefix(base, prefix) {
+				return nil
+			}
+		}
+		return &NameError{name, NameRulePrefix}
+	}
+	return nil
 }
 
-func isValidName(name string) bool {
-	if len(name) > 64 || len(name) < 1 {
-		return false
+// 名字不合法的原因，不是*NameError时返回空
+func NameErrorRule(err error) string {
+	if e, ok := err.(*NameError); ok {
+		return e.Rule
 	}
-	return validTopicChannelNameRegex.MatchString(name)
+	return ""
+}
+
+// TopicName是否合法（默认规则）
+func IsValidTopicName(name string) bool {
+	return DefaultNamePolicy.Validate(name) == nil
+}
+
+// ChannelName是否合法（默认规则）
+func IsValidChannelName(name string) bool {
+	return DefaultNamePolicy.Validate(name) == nil
 }
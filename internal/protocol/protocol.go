@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// TCP协议的实现，连接建立并读完4字节的版本号之后由IOLoop处理
+type Protocol interface {
+	IOLoop(conn net.Conn) error
+}
+
+// 帧类型，服务端发给客户端的数据格式:
+// [4-byte 大小(帧类型 + 数据)][4-byte 帧类型][N-byte 数据]
+const (
+	FrameTypeResponse int32 = 0
+	FrameTypeError    int32 = 1
+	FrameTypeMessage  int32 = 2
+)
+
+// 发送带帧类型的数据，返回写入的字节数
+func SendFramedResponse(w io.Writer, frameType int32, data []byte) (int, error) {
+	beBuf := make([]byte, 4)
+	size := uint32(len(data)) + 4
+
+	binary.BigEndian.PutUint32(beBuf, size)
+	n, err := w.Write(beBuf)
+	if err != nil {
+		return n, err
+	}
+
+	binary.BigEndian.PutUint32(beBuf, uint32(frameType))
+	n, err = w.Write(beBuf)
+	if err != nil {
+		return n + 4, err
+	}
+
+	n, err = w.Write(data)
+	return n + 8, err
+}
+
+// 读取4字节大端的长度
+func ReadLen(r io.Reader, tmp []byte) (int32, error) {
+	_, err := io.ReadFull(r, tmp)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(tmp)), nil
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+
+	"nsq-learn/internal/lg"
+)
+
+type TCPHandler interface {
+	Handle(net.Conn)
+}
+
+// 接受TCP连接，每个连接一个协程交给handler处理，listener关闭后等所有连接处理完再返回
+func TCPServer(listener net.Listener, handler TCPHandler, logf lg.AppLogFunc) error {
+	logf(lg.INFO, "TCP: listening on %s", listener.Addr())
+
+	var wg sync.WaitGroup
+
+	for {
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				logf(lg.WARN, "temporary Accept() failure - %s", err)
+				runtime.Gosched()
+				continue
+			}
+			// theres no direct way to detect this error because it is not exposed
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				return fmt.Errorf("listener.Accept() error - %s", err)
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			handler.Handle(clientConn)
+			wg.Done()
+		}()
+	}
+
+	// 等待所有连接处理完
+	wg.Wait()
+
+	logf(lg.INFO, "TCP: closing %s", listener.Addr())
+
+	return nil
+}
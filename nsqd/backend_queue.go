@@ -1,5 +1,11 @@
 package nsqd
 
+import (
+	"nsq-learn/internal/lg"
+
+	diskqueue "github.com/nsqio/go-diskqueue"
+)
+
 // 消息持久化队列接口
 type BackendQueue interface {
 	Put([]byte) error
@@ -9,3 +15,78 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// 磁盘队列的实现（BackendType配置）
+const (
+	// github.com/nsqio/go-diskqueue
+	BackendTypeDiskQueue = "diskqueue"
+	// 带CRC32校验的分段日志，见segment_backend_queue.go
+	BackendTypeSegment = "segment"
+)
+
+// topic是否只使用内存队列（由MemOnlyTopics配置）
+func isMemOnlyTopic(opts *Options, topicName string) bool {
+	return opts.memOnlyTopicsRegex != nil && opts.memOnlyTopicsRegex.MatchString(topicName)
+}
+
+// topic的消息是否压缩后再写入磁盘（由CompressTopics配置）
+func isCompressTopic(opts *Options, topicName string) bool {
+	return opts.compressTopicsRegex != nil && opts.compressTopicsRegex.MatchString(topicName)
+}
+
+// 根据配置为topic或channel创建持久化队列，backendName在DataPath下唯一
+func newBackendQueue(ctx *context, topicName string, backendName string) BackendQueue {
+	opts := ctx.nsqd.getOpts()
+	if isMemOnlyTopic(opts, topicName) {
+		return newMemoryBackendQueue(backendName, opts.MemOnlyMaxDepth)
+	}
+
+	// 先按topic再按diskqueue组件取日志等级
+	components := []string{logComponentTopicPrefix + topicName, logComponentDiskQueue}
+	fields := lg.Fields{"topic": topicName, "queue": backendName}
+	logf := func(level lg.LogLevel, f string, args ...interface{}) {
+		ctx.nsqd.logfFor(components, level, fields, f, args...)
+	}
+	backend := newDiskBackendQueue(ctx, backendName, logf)
+	// 先压缩再加密，加密后的数据没法压缩
+	if ctx.nsqd.keyring != nil {
+		backend = newEncryptedBackendQueue(backendName, opts.DataPath, backend, ctx.nsqd.keyring, logf)
+	}
+	if isCompressTopic(opts, topicName) {
+		backend = newCompressedBackendQueue(backendName, opts.DataPath, backend, opts.CompressionLevel, minValidMsgLength, logf)
+	}
+	return backend
+}
+
+// 按BackendType创建磁盘队列
+func newDiskBackendQueue(ctx *context, backendName string, logf lg.AppLogFunc) BackendQueue {
+	opts := ctx.nsqd.getOpts()
+	// 一条记录最长为消息体加上消息头、header块和加密的开销
+	maxMsgSize := int32(opts.MaxMsgSize) + minValidMsgLength + maxMsgHeaderSize + encryptMaxOverhead
+	if opts.BackendType == BackendTypeSegment {
+		return newSegmentBackendQueue(
+			backendName,
+			opts.DataPath,
+			opts.MaxBytesPerFile,
+			int32(minValidMsgLength),
+			maxMsgSize,
+			opts.SyncEvery,
+			opts.SyncTimeout,
+			logf,
+		)
+	}
+
+	dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
+		logf(lg.LogLevel(level), f, args...)
+	}
+	return diskqueue.New(
+		backendName,
+		opts.DataPath,
+		opts.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		maxMsgSize,
+		opts.SyncEvery,
+		opts.SyncTimeout,
+		dqLogf,
+	)
+}
@@ -0,0 +1,23 @@
+package nsqd
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 复用序列化消息时用到的buffer，减少内存分配
+var bp sync.Pool
+
+func init() {
+	bp.New = func() interface{} {
+		return &bytes.Buffer{}
+	}
+}
+
+func bufferPoolGet() *bytes.Buffer {
+	return bp.Get().(*bytes.Buffer)
+}
+
+func bufferPoolPut(b *bytes.Buffer) {
+	bp.Put(b)
+}
@@ -1,25 +1,80 @@
 package nsqd
 
 import (
-	"nsq-learn/internal/lg"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"nsq-learn/internal/pqueue"
+	"nsq-learn/internal/util"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
-
-	diskqueue "github.com/nsqio/go-diskqueue"
+	"time"
 )
 
 type Channel struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	requeueCount uint64
+	messageCount uint64
+	timeoutCount uint64
+	expiredCount uint64
+	// 超过最大尝试次数进了死信topic的消息数
+	deadLetterCount uint64
+	// 不匹配过滤条件，没有进入channel的消息数
+	filteredCount uint64
+	// 消息的存活时间（纳秒），和topic的一致
+	ttl int64
+
 	sync.RWMutex
 	topicName      string
 	name           string
 	ctx            *context
 	deleteCallback func(*Channel)
+	deleter        sync.Once
 	paused         int32
+	// 订阅了channel的客户端
+	clients map[int64]Consumer
+	// 最大尝试次数，0表示不限制，maxAttemptsInherit表示使用全局的MaxAttempts
+	maxAttempts int32
 	// 是否为测试队列
 	ephemeral bool
+	// 是否只使用内存队列
+	memOnly bool
+	// 消息过滤条件，创建后不再修改
+	filter *channelFilter
+	// 顺序投递模式，见channel_ordered.go
+	ordered          bool
+	orderedMsgChan   chan *Message
+	orderedAckChan   chan orderedAck
+	orderedExitChan  chan int
+	orderedWaitGroup util.WaitGroupWrapper
+	// 队头消息，只在orderedLoop里访问，退出后由Close保存
+	orderedHead *Message
+	// 队头消息已经读出来但还没投递，算在Depth里
+	orderedPending int32
 	// 持久化
 	backend BackendQueue
+
+	memoryMsgChan chan *Message
+	exitFlag      int32
+	exitMutex     sync.RWMutex
+
+	// 延时消息，按到期时间排序
+	deferredMessages map[MessageID]*pqueue.Item
+	deferredPQ       pqueue.PriorityQueue
+	deferredMutex    sync.Mutex
+	// 已经投递但还没有确认的消息，按超时时间排序
+	inFlightMessages map[MessageID]*Message
+	inFlightPQ       inFlightPqueue
+	inFlightMutex    sync.Mutex
 }
 
 // 创建一个新的channel
@@ -29,36 +84,701 @@ func NewChannel(topicName string, channelName string, ctx *context, deleteCallba
 		name:           channelName,
 		ctx:            ctx,
 		deleteCallback: deleteCallback,
+		clients:        make(map[int64]Consumer),
+		memoryMsgChan:  make(chan *Message, ctx.nsqd.getOpts().MemQueueSize),
+		maxAttempts:    maxAttemptsInherit,
 	}
 
-	//这里会设置优先队列和消息相关（先不处理）
+	c.initPQ()
+
 	//持久化channel
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeral = true
 		c.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := ctx.nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.logLevel, lg.LogLevel(level), f, args...)
-		}
 		// 每个topic都唯一
 		backendName := getBackendName(topicName, channelName)
-		c.backend = diskqueue.New(
-			backendName,
-			ctx.nsqd.getOpts().DataPath,
-			ctx.nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			ctx.nsqd.getOpts().SyncEvery,
-			ctx.nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		c.backend = newBackendQueue(ctx, topicName, backendName)
+		c.memOnly = isMemOnlyTopic(ctx.nsqd.getOpts(), topicName)
+		// 恢复上次关闭时保存的延时消息
+		if !c.memOnly {
+			err := c.loadDeferred()
+			if err != nil {
+				c.logf(LOG_ERROR, "CHANNEL(%s): failed to load deferred messages - %s", c.name, err)
+			}
+		}
 	}
 	// 持久化channel
 	c.ctx.nsqd.Notify(c)
 	return c
 }
 
+func (c *Channel) initPQ() {
+	// 优先队列的初始容量取内存队列大小的十分之一
+	pqSize := int(math.Max(1, float64(c.ctx.nsqd.getOpts().MemQueueSize)/10))
+
+	c.inFlightMutex.Lock()
+	c.inFlightMessages = make(map[MessageID]*Message)
+	c.inFlightPQ = newInFlightPqueue(pqSize)
+	c.inFlightMutex.Unlock()
+
+	c.deferredMutex.Lock()
+	c.deferredMessages = make(map[MessageID]*pqueue.Item)
+	c.deferredPQ = pqueue.New(pqSize)
+	c.deferredMutex.Unlock()
+}
+
+// 清空还没投递的消息（内存、持久化队列和延时消息），in-flight的消息不受影响
+func (c *Channel) Empty() error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return errors.New("exiting")
+	}
+
+	c.deferredMutex.Lock()
+	pqSize := int(math.Max(1, float64(c.ctx.nsqd.getOpts().MemQueueSize)/10))
+	c.deferredMessages = make(map[MessageID]*pqueue.Item)
+	c.deferredPQ = pqueue.New(pqSize)
+	c.deferredMutex.Unlock()
+
+	for {
+		select {
+		case <-c.memoryMsgChan:
+		default:
+			goto finish
+		}
+	}
+
+finish:
+	return c.backend.Empty()
+}
+
+// 是否正在退出
+func (c *Channel) Exiting() bool {
+	return atomic.LoadInt32(&c.exitFlag) == 1
+}
+
+// 关闭channel，内存、in-flight和延时消息都会保存下来，重启后可以恢复
+func (c *Channel) Close() error {
+	return c.exit(false)
+}
+
+// 删除channel，断开所有客户端，丢弃所有消息并删除持久化队列
+func (c *Channel) Delete() error {
+	return c.exit(true)
+}
+
+func (c *Channel) exit(deleted bool) error {
+	c.exitMutex.Lock()
+	defer c.exitMutex.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&c.exitFlag, 0, 1) {
+		return errors.New("exiting")
+	}
+
+	if deleted {
+		c.logf(LOG_INFO, "CHANNEL(%s): deleting", c.name)
+	} else {
+		c.logf(LOG_INFO, "CHANNEL(%s): closing", c.name)
+	}
+
+	// 断开客户端，IOLoop退出时会调用RemoveClient
+	c.RLock()
+	for _, client := range c.clients {
+		client.Close()
+	}
+	c.RUnlock()
+
+	if c.ordered {
+		c.stopOrdered()
+	}
+
+	if deleted {
+		for {
+			select {
+			case <-c.memoryMsgChan:
+			default:
+				return c.backend.Delete()
+			}
+		}
+	}
+
+	c.flush()
+	return c.backend.Close()
+}
+
+func (c *Channel) flush() error {
+	var msgBuf bytes.Buffer
+
+	if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
+		c.logf(LOG_INFO, "CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
+			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
+	}
+
+	for {
+		select {
+		case msg := <-c.memoryMsgChan:
+			err := writeMessageToBackend(&msgBuf, msg, c.backend)
+			if err != nil {
+				c.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+			}
+		default:
+			goto finish
+		}
+	}
+
+finish:
+	// in-flight的消息还没有被确认，重启后需要重新投递
+	// 顺序投递模式下in-flight的只有队头消息，单独保存，保证重启后仍然第一个投递
+	if !c.ordered {
+		c.inFlightMutex.Lock()
+		for _, msg := range c.inFlightMessages {
+			err := writeMessageToBackend(&msgBuf, msg, c.backend)
+			if err != nil {
+				c.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+			}
+		}
+		c.inFlightMutex.Unlock()
+	}
+
+	// 延时消息单独保存，保留到期时间
+	if c.ephemeral || c.memOnly {
+		return nil
+	}
+	if c.ordered {
+		err := c.persistOrderedHead()
+		if err != nil {
+			c.logf(LOG_ERROR, "CHANNEL(%s): failed to persist ordered head message - %s", c.name, err)
+		}
+	}
+	err := c.persistDeferred()
+	if err != nil {
+		c.logf(LOG_ERROR, "CHANNEL(%s): failed to persist deferred messages - %s", c.name, err)
+	}
+	return err
+}
+
+// 延时消息文件的路径
+func (c *Channel) deferredFileName() string {
+	return path.Join(c.ctx.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name)+".deferred.dat")
+}
+
+func (c *Channel) deferredKeyIDsFileName() string {
+	return keyIDsFileName(c.ctx.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name)+".deferred")
+}
+
+// 延时消息文件的格式，每条消息:
+// [8-byte 到期时间(纳秒)][4-byte 消息长度][N-byte 消息(同Message.WriteTo，配置了密钥时是加密后的记录)]
+func (c *Channel) persistDeferred() error {
+	fileName := c.deferredFileName()
+
+	c.deferredMutex.Lock()
+	if len(c.deferredMessages) == 0 {
+		c.deferredMutex.Unlock()
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return removeKeyIDs(c.deferredKeyIDsFileName())
+	}
+	var data bytes.Buffer
+	var msgBuf bytes.Buffer
+	var hdr [12]byte
+	for _, item := range c.deferredMessages {
+		msg := item.Value.(*Message)
+		msgBuf.Reset()
+		_, err := msg.WriteTo(&msgBuf)
+		if err != nil {
+			c.deferredMutex.Unlock()
+			return err
+		}
+		record := msgBuf.Bytes()
+		// 配置了密钥时延时消息也加密保存
+		if c.ctx.nsqd.keyring != nil {
+			record, err = c.ctx.nsqd.keyring.seal(record)
+			if err != nil {
+				c.deferredMutex.Unlock()
+				return err
+			}
+		}
+		binary.BigEndian.PutUint64(hdr[:8], uint64(item.Priority))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(len(record)))
+		data.Write(hdr[:])
+		data.Write(record)
+	}
+	c.deferredMutex.Unlock()
+
+	// 文件整个重写，所有记录都用当前密钥加密
+	var err error
+	if c.ctx.nsqd.keyring != nil {
+		err = recordKeyID(c.deferredKeyIDsFileName(), c.ctx.nsqd.keyring.activeID, true)
+	} else {
+		err = removeKeyIDs(c.deferredKeyIDsFileName())
+	}
+	if err != nil {
+		return err
+	}
+
+	// 和nsqd.dat一样先写临时文件再改名
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = writeSyncFile(tmpFileName, data.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// 读取延时消息文件，按原来的到期时间放回延时队列
+func (c *Channel) loadDeferred() error {
+	fileName := c.deferredFileName()
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	r := bytes.NewReader(data)
+	var hdr [12]byte
+	count := 0
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt deferred file %s - %s", fileName, err)
+		}
+		absTs := int64(binary.BigEndian.Uint64(hdr[:8]))
+		buf := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return fmt.Errorf("corrupt deferred file %s - %s", fileName, err)
+		}
+		if c.ctx.nsqd.keyring != nil {
+			buf, err = c.ctx.nsqd.keyring.open(buf)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt deferred file %s - %s", fileName, err)
+			}
+		}
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return err
+		}
+		err = c.deferMessageUntil(msg, absTs)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	c.logf(LOG_INFO, "CHANNEL(%s): loaded %d deferred messages", c.name, count)
+	return os.Remove(fileName)
+}
+
+func (c *Channel) setTTL(ttl time.Duration) {
+	atomic.StoreInt64(&c.ttl, int64(ttl))
+}
+
+// 从内存或持久化队列读出消息后、投递之前调用
+// 消息超过存活时间就丢弃并计数，返回true表示消息已经丢弃，不应该再投递
+func (c *Channel) dropIfExpired(msg *Message) bool {
+	ttl := atomic.LoadInt64(&c.ttl)
+	if ttl <= 0 || time.Now().UnixNano()-msg.Timestamp <= ttl {
+		return false
+	}
+	atomic.AddUint64(&c.expiredCount, 1)
+	return true
+}
+
+// channel的消息数量（内存 + 持久化队列）
+func (c *Channel) Depth() int64 {
+	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + int64(atomic.LoadInt32(&c.orderedPending))
+}
+
+// 添加订阅的客户端
+func (c *Channel) AddClient(clientID int64, client Consumer) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return errors.New("exiting")
+	}
+
+	c.Lock()
+	c.clients[clientID] = client
+	c.Unlock()
+	return nil
+}
+
+// 移除客户端，临时channel的最后一个客户端断开后删除channel
+func (c *Channel) RemoveClient(clientID int64) {
+	c.Lock()
+	_, ok := c.clients[clientID]
+	if !ok {
+		c.Unlock()
+		return
+	}
+	delete(c.clients, clientID)
+	numClients := len(c.clients)
+	c.Unlock()
+
+	if numClients == 0 && c.ephemeral {
+		// RemoveClient在客户端的IOLoop里调用，删除放到nsqd的waitGroup里，退出时等它完成
+		c.ctx.nsqd.waitGroup.Wrap(func() {
+			c.deleter.Do(func() { c.deleteCallback(c) })
+		})
+	}
+}
+
+// 订阅的客户端数
+func (c *Channel) ClientCount() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.clients)
+}
+
 func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
+
+// 写入一条消息
+func (c *Channel) PutMessage(m *Message) error {
+	// 和exit互斥，flush之后不会再有消息写进内存队列
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return errors.New("exiting")
+	}
+	err := c.put(m)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.messageCount, 1)
+	return nil
+}
+
+func (c *Channel) put(m *Message) error {
+	// 顺序投递模式只写持久化队列，保证读取顺序和写入顺序一致
+	memoryMsgChan := c.memoryMsgChan
+	if c.ordered {
+		memoryMsgChan = nil
+	}
+	select {
+	case memoryMsgChan <- m:
+	default:
+		b := bufferPoolGet()
+		err := writeMessageToBackend(b, m, c.backend)
+		bufferPoolPut(b)
+		if err != nil {
+			c.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s", c.name, err)
+			if err != ErrBackendFull {
+				c.ctx.nsqd.setHealth(healthBackend, err)
+			}
+			return err
+		}
+		c.ctx.nsqd.clearHealth(healthBackend)
+	}
+	return nil
+}
+
+// 写入一条延时消息
+func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
+	atomic.AddUint64(&c.messageCount, 1)
+	c.StartDeferredTimeout(msg, timeout)
+}
+
+// 消息投递给客户端后，开始计算超时时间
+func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout time.Duration) error {
+	now := time.Now()
+	msg.clientID = clientID
+	msg.deliveryTS = now
+	msg.pri = now.Add(timeout).UnixNano()
+	err := c.pushInFlightMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.addToInFlightPQ(msg)
+	return nil
+}
+
+// 客户端确认消息已经处理完成
+func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
+	msg, err := c.popInFlightMessage(clientID, id)
+	if err != nil {
+		return err
+	}
+	c.removeFromInFlightPQ(msg)
+	if c.ordered {
+		c.ackOrdered(orderedAck{})
+	}
+	return nil
+}
+
+// 客户端要求重新投递消息，timeout大于0时作为延时消息
+// 尝试次数达到上限的消息放进死信topic
+func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Duration) error {
+	msg, err := c.popInFlightMessage(clientID, id)
+	if err != nil {
+		return err
+	}
+	c.removeFromInFlightPQ(msg)
+	atomic.AddUint64(&c.requeueCount, 1)
+
+	if c.shouldDeadLetter(msg) {
+		err := c.deadLetter(msg, requeuedReason(clientID))
+		if err == nil {
+			if c.ordered {
+				c.ackOrdered(orderedAck{})
+			}
+			return nil
+		}
+		c.logf(LOG_ERROR, "CHANNEL(%s): failed to dead letter msg(%s), requeueing - %s", c.name, msg.ID, err)
+	}
+
+	// 顺序投递模式下回到队头，延时也由orderedLoop处理
+	if c.ordered {
+		c.ackOrdered(orderedAck{requeue: true, timeout: timeout})
+		return nil
+	}
+
+	if timeout == 0 {
+		c.exitMutex.RLock()
+		if c.Exiting() {
+			c.exitMutex.RUnlock()
+			return errors.New("exiting")
+		}
+		err := c.put(msg)
+		c.exitMutex.RUnlock()
+		return err
+	}
+
+	return c.StartDeferredTimeout(msg, timeout)
+}
+
+// 客户端还在处理消息，重新计算超时时间，从投递开始算起不超过MaxMsgTimeout
+func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout time.Duration) error {
+	msg, err := c.popInFlightMessage(clientID, id)
+	if err != nil {
+		return err
+	}
+	c.removeFromInFlightPQ(msg)
+
+	newTimeout := time.Now().Add(clientMsgTimeout)
+	maxMsgTimeout := c.ctx.nsqd.getOpts().MaxMsgTimeout
+	if newTimeout.Sub(msg.deliveryTS) >= maxMsgTimeout {
+		newTimeout = msg.deliveryTS.Add(maxMsgTimeout)
+	}
+
+	msg.pri = newTimeout.UnixNano()
+	err = c.pushInFlightMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.addToInFlightPQ(msg)
+	return nil
+}
+
+func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) error {
+	absTs := time.Now().Add(timeout).UnixNano()
+	return c.deferMessageUntil(msg, absTs)
+}
+
+// 放入延时队列，absTs为到期的绝对时间
+func (c *Channel) deferMessageUntil(msg *Message, absTs int64) error {
+	item := &pqueue.Item{Value: msg, Priority: absTs}
+	err := c.pushDeferredMessage(item)
+	if err != nil {
+		return err
+	}
+	c.addToDeferredPQ(item)
+	return nil
+}
+
+func (c *Channel) pushInFlightMessage(msg *Message) error {
+	c.inFlightMutex.Lock()
+	_, ok := c.inFlightMessages[msg.ID]
+	if ok {
+		c.inFlightMutex.Unlock()
+		return errors.New("ID already in flight")
+	}
+	c.inFlightMessages[msg.ID] = msg
+	c.inFlightMutex.Unlock()
+	return nil
+}
+
+func (c *Channel) popInFlightMessage(clientID int64, id MessageID) (*Message, error) {
+	c.inFlightMutex.Lock()
+	msg, ok := c.inFlightMessages[id]
+	if !ok {
+		c.inFlightMutex.Unlock()
+		return nil, errors.New("ID not in flight")
+	}
+	if msg.clientID != clientID {
+		c.inFlightMutex.Unlock()
+		return nil, errors.New("client does not own message")
+	}
+	delete(c.inFlightMessages, id)
+	c.inFlightMutex.Unlock()
+	return msg, nil
+}
+
+func (c *Channel) addToInFlightPQ(msg *Message) {
+	c.inFlightMutex.Lock()
+	c.inFlightPQ.Push(msg)
+	c.inFlightMutex.Unlock()
+}
+
+func (c *Channel) removeFromInFlightPQ(msg *Message) {
+	c.inFlightMutex.Lock()
+	if msg.index == -1 {
+		// 已经被processInFlightQueue弹出了
+		c.inFlightMutex.Unlock()
+		return
+	}
+	c.inFlightPQ.Remove(msg.index)
+	c.inFlightMutex.Unlock()
+}
+
+func (c *Channel) pushDeferredMessage(item *pqueue.Item) error {
+	c.deferredMutex.Lock()
+	id := item.Value.(*Message).ID
+	_, ok := c.deferredMessages[id]
+	if ok {
+		c.deferredMutex.Unlock()
+		return errors.New("ID already deferred")
+	}
+	c.deferredMessages[id] = item
+	c.deferredMutex.Unlock()
+	return nil
+}
+
+func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
+	c.deferredMutex.Lock()
+	item, ok := c.deferredMessages[id]
+	if !ok {
+		c.deferredMutex.Unlock()
+		return nil, errors.New("ID not deferred")
+	}
+	delete(c.deferredMessages, id)
+	c.deferredMutex.Unlock()
+	return item, nil
+}
+
+func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
+	c.deferredMutex.Lock()
+	heap.Push(&c.deferredPQ, item)
+	c.deferredMutex.Unlock()
+}
+
+// 将到期的延时消息放回消息队列，返回是否处理了消息
+func (c *Channel) processDeferredQueue(t int64) bool {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+
+	if c.Exiting() {
+		return false
+	}
+
+	dirty := false
+	for {
+		c.deferredMutex.Lock()
+		item, _ := c.deferredPQ.PeekAndShift(t)
+		c.deferredMutex.Unlock()
+
+		if item == nil {
+			goto exit
+		}
+		dirty = true
+
+		msg := item.Value.(*Message)
+		_, err := c.popDeferredMessage(msg.ID)
+		if err != nil {
+			goto exit
+		}
+		c.put(msg)
+	}
+
+exit:
+	return dirty
+}
+
+// 将超时未确认的消息放回消息队列，返回是否处理了消息
+func (c *Channel) processInFlightQueue(t int64) bool {
+	// 要放进死信topic的消息，释放exitMutex之后再发布，避免和nsqd退出时的锁顺序冲突
+	var dead []*Message
+	defer func() {
+		for _, msg := range dead {
+			c.deadLetterTimedOut(msg)
+		}
+	}()
+
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+
+	if c.Exiting() {
+		return false
+	}
+
+	dirty := false
+	for {
+		c.inFlightMutex.Lock()
+		msg, _ := c.inFlightPQ.PeekAndShift(t)
+		c.inFlightMutex.Unlock()
+
+		if msg == nil {
+			goto exit
+		}
+		dirty = true
+
+		_, err := c.popInFlightMessage(msg.clientID, msg.ID)
+		if err != nil {
+			goto exit
+		}
+		atomic.AddUint64(&c.timeoutCount, 1)
+		// 客户端的in-flight计数要减掉，否则RDY会被占满
+		c.RLock()
+		client, ok := c.clients[msg.clientID]
+		c.RUnlock()
+		if ok {
+			client.TimedOutMessage()
+		}
+		if c.shouldDeadLetter(msg) {
+			dead = append(dead, msg)
+			continue
+		}
+		if c.ordered {
+			c.ackOrdered(orderedAck{requeue: true})
+			continue
+		}
+		c.put(msg)
+	}
+
+exit:
+	return dirty
+}
+
+// 超时的消息放进死信topic，失败时按原来的方式重新投递
+func (c *Channel) deadLetterTimedOut(msg *Message) {
+	err := c.deadLetter(msg, timedOutReason(msg))
+	if err == nil {
+		if c.ordered {
+			c.ackOrdered(orderedAck{})
+		}
+		return
+	}
+	c.logf(LOG_ERROR, "CHANNEL(%s): failed to dead letter msg(%s), requeueing - %s", c.name, msg.ID, err)
+
+	if c.ordered {
+		c.ackOrdered(orderedAck{requeue: true})
+		return
+	}
+
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		c.logf(LOG_ERROR, "CHANNEL(%s): dropping msg(%s) while exiting", c.name, msg.ID)
+		return
+	}
+	c.put(msg)
+}
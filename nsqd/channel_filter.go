@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// channel的消息过滤条件，在topic分发消息时判断，不匹配的消息不会进入channel
+// 支持两种格式:
+// prefix:<字符串> 消息体以这个字符串开头
+// json:<字段路径>=<值> 消息体是JSON对象，字段（用.分隔多层）等于这个值，
+// 字符串字段直接比较，其它类型和JSON编码后的结果比较（如 json:count=3）
+type channelFilter struct {
+	expr   string
+	prefix []byte
+	path   []string
+	value  string
+}
+
+func parseChannelFilter(expr string) (*channelFilter, error) {
+	idx := strings.Index(expr, ":")
+	if idx == -1 {
+		return nil, fmt.Errorf("invalid filter %q, expected prefix:<str> or json:<path>=<value>", expr)
+	}
+	kind, arg := expr[:idx], expr[idx+1:]
+
+	f := &channelFilter{expr: expr}
+	switch kind {
+	case "prefix":
+		if arg == "" {
+			return nil, errors.New("empty filter prefix")
+		}
+		f.prefix = []byte(arg)
+	case "json":
+		eq := strings.Index(arg, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid json filter %q, expected json:<path>=<value>", expr)
+		}
+		f.path = strings.Split(arg[:eq], ".")
+		for _, p := range f.path {
+			if p == "" {
+				return nil, fmt.Errorf("invalid json filter path %q", arg[:eq])
+			}
+		}
+		f.value = arg[eq+1:]
+	default:
+		return nil, fmt.Errorf("unknown filter type %q", kind)
+	}
+	return f, nil
+}
+
+func (f *channelFilter) match(body []byte) bool {
+	if f.prefix != nil {
+		return bytes.HasPrefix(body, f.prefix)
+	}
+
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return false
+	}
+	for _, p := range f.path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		v, ok = obj[p]
+		if !ok {
+			return false
+		}
+	}
+	if s, ok := v.(string); ok {
+		return s == f.value
+	}
+	data, err := json.Marshal(v)
+	return err == nil && string(data) == f.value
+}
+
+// 创建channel时的过滤条件，没有时为空
+func (c *Channel) FilterExpr() string {
+	if c.filter == nil {
+		return ""
+	}
+	return c.filter.expr
+}
+
+// topic分发消息时判断消息是否要进入这个channel，被过滤掉的消息计数
+func (c *Channel) matchFilter(msg *Message) bool {
+	if c.filter == nil || c.filter.match(msg.Body) {
+		return true
+	}
+	atomic.AddUint64(&c.filteredCount, 1)
+	return false
+}
@@ -0,0 +1,36 @@
+package nsqd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelFilter(t *testing.T) {
+	tests := []struct {
+		expr  string
+		body  string
+		match bool
+	}{
+		{"prefix:order.", "order.created", true},
+		{"prefix:order.", "user.created", false},
+		{"json:type=premium", `{"type":"premium"}`, true},
+		{"json:type=premium", `{"type":"free"}`, false},
+		{"json:user.tier=gold", `{"user":{"tier":"gold"}}`, true},
+		{"json:user.tier=gold", `{"user":"gold"}`, false},
+		{"json:count=3", `{"count":3}`, true},
+		{"json:ok=true", `{"ok":true}`, true},
+		{"json:type=premium", `not json`, false},
+		{"json:type=premium", `{}`, false},
+	}
+	for _, tt := range tests {
+		f, err := parseChannelFilter(tt.expr)
+		assert.Nil(t, err, tt.expr)
+		assert.Equal(t, tt.match, f.match([]byte(tt.body)), "%s %s", tt.expr, tt.body)
+	}
+
+	for _, expr := range []string{"", "prefix:", "json:=x", "json:a..b=x", "json:noequals", "regex:.*"} {
+		_, err := parseChannelFilter(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
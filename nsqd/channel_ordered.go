@@ -0,0 +1,184 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// 顺序投递模式:
+// 同一时间整个channel只有一条消息在投递中（不管有多少个客户端），确认之后才投递下一条。
+// 消息只写持久化队列并按顺序读取，重新投递（REQ或超时）的消息回到队头，不进延时队列。
+// 客户端从orderedMsgChan读取消息，代替memoryMsgChan和backend.ReadChan()。
+
+// 客户端对队头消息的处理结果
+type orderedAck struct {
+	requeue bool
+	timeout time.Duration
+}
+
+// 创建channel后、开始投递之前调用，之后channel进入顺序投递模式
+func (c *Channel) startOrdered() {
+	c.ordered = true
+	c.orderedMsgChan = make(chan *Message)
+	c.orderedAckChan = make(chan orderedAck)
+	c.orderedExitChan = make(chan int)
+
+	// 顺序投递模式不用memoryMsgChan，临时channel的dummy队列会丢掉所有消息，换成内存队列
+	if c.ephemeral {
+		c.backend.Close()
+		c.backend = newMemoryBackendQueue(getBackendName(c.topicName, c.name), int64(c.ctx.nsqd.getOpts().MemQueueSize))
+	}
+	if !c.ephemeral && !c.memOnly {
+		err := c.loadOrderedHead()
+		if err != nil {
+			c.logf(LOG_ERROR, "CHANNEL(%s): failed to load ordered head message - %s", c.name, err)
+		}
+	}
+	c.orderedWaitGroup.Wrap(c.orderedLoop)
+}
+
+// 是否为顺序投递模式
+func (c *Channel) IsOrdered() bool {
+	return c.ordered
+}
+
+// 按顺序取出消息交给客户端，等待处理结果后再取下一条
+func (c *Channel) orderedLoop() {
+	var delay <-chan time.Time
+	for {
+		if c.orderedHead == nil {
+			select {
+			case buf := <-c.backend.ReadChan():
+				msg, err := decodeMessage(buf)
+				if err != nil {
+					c.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message - %s", c.name, err)
+					continue
+				}
+				c.orderedHead = msg
+			case <-c.orderedExitChan:
+				return
+			}
+		}
+		atomic.StoreInt32(&c.orderedPending, 1)
+
+		// 带延时的重新投递，等到时间再投递同一条消息
+		if delay != nil {
+			select {
+			case <-delay:
+			case <-c.orderedExitChan:
+				return
+			}
+			delay = nil
+		}
+
+		select {
+		case c.orderedMsgChan <- c.orderedHead:
+		case <-c.orderedExitChan:
+			return
+		}
+		atomic.StoreInt32(&c.orderedPending, 0)
+
+		select {
+		case ack := <-c.orderedAckChan:
+			if !ack.requeue {
+				c.orderedHead = nil
+			} else if ack.timeout > 0 {
+				delay = time.After(ack.timeout)
+			}
+		case <-c.orderedExitChan:
+			return
+		}
+	}
+}
+
+// 通知orderedLoop队头消息已经处理（确认、重新投递或超时）
+func (c *Channel) ackOrdered(ack orderedAck) {
+	select {
+	case c.orderedAckChan <- ack:
+	case <-c.orderedExitChan:
+	}
+}
+
+// 停止orderedLoop，Close时调用
+func (c *Channel) stopOrdered() {
+	close(c.orderedExitChan)
+	c.orderedWaitGroup.Wait()
+}
+
+// 队头消息文件，关闭时还没确认的队头消息保存在这里，重启后仍然第一个投递
+// 格式同Message.WriteTo，配置了密钥时是加密后的记录
+func (c *Channel) orderedHeadFileName() string {
+	return path.Join(c.ctx.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name)+".head.dat")
+}
+
+func (c *Channel) orderedHeadKeyIDsFileName() string {
+	return keyIDsFileName(c.ctx.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name)+".head")
+}
+
+func (c *Channel) persistOrderedHead() error {
+	fileName := c.orderedHeadFileName()
+	if c.orderedHead == nil {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return removeKeyIDs(c.orderedHeadKeyIDsFileName())
+	}
+
+	var buf bytes.Buffer
+	_, err := c.orderedHead.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if c.ctx.nsqd.keyring != nil {
+		data, err = c.ctx.nsqd.keyring.seal(data)
+		if err == nil {
+			err = recordKeyID(c.orderedHeadKeyIDsFileName(), c.ctx.nsqd.keyring.activeID, true)
+		}
+	} else {
+		err = removeKeyIDs(c.orderedHeadKeyIDsFileName())
+	}
+	if err != nil {
+		return err
+	}
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = writeSyncFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (c *Channel) loadOrderedHead() error {
+	fileName := c.orderedHeadFileName()
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if c.ctx.nsqd.keyring != nil {
+		data, err = c.ctx.nsqd.keyring.open(data)
+		if err != nil {
+			return err
+		}
+	}
+	msg, err := decodeMessage(data)
+	if err != nil {
+		return err
+	}
+	c.orderedHead = msg
+	err = os.Remove(fileName)
+	if err != nil {
+		return err
+	}
+	return removeKeyIDs(c.orderedHeadKeyIDsFileName())
+}
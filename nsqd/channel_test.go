@@ -0,0 +1,237 @@
+package nsqd
+
+import (
+	"nsq-learn/internal/test"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelDropExpired(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("ttl_test")
+	channel := topic.GetChannel("ch")
+	topic.SetTTL(time.Minute)
+	// 设置TTL之后创建的channel也会使用topic的TTL
+	channel2 := topic.GetChannel("ch2")
+
+	fresh := NewMessage(topic.GenerateID(), []byte("fresh"))
+	stale := NewMessage(topic.GenerateID(), []byte("stale"))
+	stale.Timestamp = time.Now().Add(-2 * time.Minute).UnixNano()
+
+	assert.False(t, channel.dropIfExpired(fresh))
+	assert.True(t, channel.dropIfExpired(stale))
+	assert.True(t, channel2.dropIfExpired(stale))
+
+	stats := nsqd.GetStats("ttl_test", "ch")
+	assert.Equal(t, int64(60000), stats[0].TTL)
+	assert.Equal(t, uint64(1), stats[0].Channels[0].ExpiredCount)
+
+	// TTL为0时不过期
+	topic.SetTTL(0)
+	assert.False(t, channel.dropIfExpired(stale))
+}
+
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 3
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("dlq_test")
+	channel := topic.GetChannel("ch")
+
+	// 没到上限的消息正常重新投递
+	msg := NewMessage(topic.GenerateID(), []byte("retry"))
+	msg.Attempts = 2
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.Nil(t, channel.RequeueMessage(1, msg.ID, 0))
+	assert.Equal(t, int64(1), channel.Depth())
+	<-channel.memoryMsgChan
+
+	msg = NewMessage(topic.GenerateID(), []byte("poison"))
+	msg.Attempts = 3
+	msg.Headers = map[string]string{"trace-id": "abc"}
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.Nil(t, channel.RequeueMessage(1, msg.ID, 0))
+	assert.Equal(t, int64(0), channel.Depth())
+
+	dlq, err := nsqd.GetExistingTopic("dlq_test.dlq")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), dlq.Depth())
+	dlqMsg := <-dlq.memoryMsgChan
+	assert.Equal(t, msg.ID, dlqMsg.ID)
+	assert.Equal(t, []byte("poison"), dlqMsg.Body)
+	assert.Equal(t, uint16(0), dlqMsg.Attempts)
+	assert.Equal(t, "abc", dlqMsg.Headers["trace-id"])
+	assert.Equal(t, "dlq_test", dlqMsg.Headers[dlqHeaderTopic])
+	assert.Equal(t, "ch", dlqMsg.Headers[dlqHeaderChannel])
+	assert.Equal(t, "3", dlqMsg.Headers[dlqHeaderAttempts])
+	assert.Equal(t, "REQ from client 1", dlqMsg.Headers[dlqHeaderLastError])
+
+	// 超时的消息也一样
+	msg = NewMessage(topic.GenerateID(), []byte("timeout"))
+	msg.Attempts = 3
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 2, 100*time.Millisecond))
+	channel.processInFlightQueue(time.Now().Add(time.Second).UnixNano())
+	assert.Equal(t, int64(1), dlq.Depth())
+	dlqMsg = <-dlq.memoryMsgChan
+	assert.Equal(t, "timed out after 100ms on client 2", dlqMsg.Headers[dlqHeaderLastError])
+
+	stats := nsqd.GetStats("dlq_test", "ch")
+	assert.Equal(t, uint64(2), stats[0].Channels[0].DeadLetterCount)
+}
+
+func TestChannelDeadLetterExiting(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 1
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("dlq_exiting")
+	channel := topic.GetChannel("ch")
+
+	// Exit已经在关闭topic，不再创建死信topic，消息留在原channel里
+	atomic.StoreInt32(&nsqd.isExiting, 1)
+	msg := NewMessage(topic.GenerateID(), []byte("poison"))
+	msg.Attempts = 1
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.Nil(t, channel.RequeueMessage(1, msg.ID, 0))
+	_, err := nsqd.GetExistingTopic("dlq_exiting.dlq")
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), channel.Depth())
+	assert.Equal(t, uint64(0), nsqd.GetStats("dlq_exiting", "ch")[0].Channels[0].DeadLetterCount)
+}
+
+func TestChannelMaxAttemptsOverride(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 3
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("dlq_override")
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, uint16(3), channel.MaxAttempts())
+
+	// 单独设置为0时不限制，不使用全局配置
+	channel.SetMaxAttempts(0)
+	assert.Equal(t, uint16(0), channel.MaxAttempts())
+	msg := NewMessage(topic.GenerateID(), []byte("unlimited"))
+	msg.Attempts = 5
+	assert.False(t, channel.shouldDeadLetter(msg))
+	channel.SetMaxAttempts(maxAttemptsInherit)
+	assert.Equal(t, uint16(3), channel.MaxAttempts())
+	assert.True(t, channel.shouldDeadLetter(msg))
+
+	channel.SetMaxAttempts(1)
+	msg = NewMessage(topic.GenerateID(), []byte("poison"))
+	msg.Attempts = 1
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.Nil(t, channel.RequeueMessage(1, msg.ID, 0))
+	dlq, err := nsqd.GetExistingTopic("dlq_override.dlq")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), dlq.Depth())
+
+	// 死信topic自己的消息不会再进死信topic
+	dlqChannel := dlq.GetChannel("ch")
+	dlqChannel.SetMaxAttempts(1)
+	msg = NewMessage(dlq.GenerateID(), []byte("poison"))
+	msg.Attempts = 5
+	assert.False(t, dlqChannel.shouldDeadLetter(msg))
+}
+
+func TestChannelOrdered(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("ordered_test")
+	channel, err := topic.GetChannelWithOptions("ch", ChannelOptions{Ordered: true})
+	assert.Nil(t, err)
+	_, err = topic.GetChannelWithOptions("ch", ChannelOptions{})
+	assert.Equal(t, errOrderedConflict, err)
+
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body))))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 3 }))
+	assert.Equal(t, 0, len(channel.memoryMsgChan))
+
+	recv := func() *Message {
+		select {
+		case msg := <-channel.orderedMsgChan:
+			return msg
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	// 同一时间只有一条消息在投递中
+	msg := recv()
+	assert.Equal(t, "1", string(msg.Body))
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.Nil(t, recv())
+
+	// 重新投递回到队头
+	assert.Nil(t, channel.RequeueMessage(1, msg.ID, 0))
+	msg = recv()
+	assert.Equal(t, "1", string(msg.Body))
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 2, time.Minute))
+
+	// 超时也回到队头
+	channel.processInFlightQueue(time.Now().Add(2 * time.Minute).UnixNano())
+	msg = recv()
+	assert.Equal(t, "1", string(msg.Body))
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+
+	// 确认之后投递下一条
+	assert.Nil(t, channel.FinishMessage(1, msg.ID))
+	msg = recv()
+	assert.Equal(t, "2", string(msg.Body))
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 1 }))
+}
+
+func TestChannelOrderedEphemeral(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// 临时channel在顺序投递模式下用内存队列，消息不会被丢掉
+	topic := nsqd.GetTopic("ordered_ephemeral")
+	channel, err := topic.GetChannelWithOptions("ch#ephemeral", ChannelOptions{Ordered: true})
+	assert.Nil(t, err)
+	for _, body := range []string{"1", "2"} {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body))))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 2 }))
+
+	for _, body := range []string{"1", "2"} {
+		select {
+		case msg := <-channel.orderedMsgChan:
+			assert.Equal(t, body, string(msg.Body))
+			assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+			assert.Nil(t, channel.FinishMessage(1, msg.ID))
+		case <-time.After(time.Second):
+			t.Fatalf("message %s not delivered", body)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package nsqd
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBufferSize = 16 * 1024
+
+// 客户端连接的状态
+const (
+	stateInit = iota
+	stateSubscribed
+	stateClosing
+)
+
+// 订阅channel的客户端，channel通过它通知消息超时和断开客户端
+type Consumer interface {
+	TimedOutMessage()
+	Close() error
+}
+
+// IDENTIFY命令的JSON数据
+type identifyDataV2 struct {
+	ClientID            string `json:"client_id"`
+	Hostname            string `json:"hostname"`
+	UserAgent           string `json:"user_agent"`
+	HeartbeatInterval   int    `json:"heartbeat_interval"`    // 毫秒，-1表示关闭心跳，0表示使用默认值
+	MsgTimeout          int    `json:"msg_timeout"`           // 毫秒，0表示使用默认值
+	OutputBufferTimeout int    `json:"output_buffer_timeout"` // 毫秒，-1表示每条消息都立即flush，0表示使用默认值
+	Headers             bool   `json:"headers"`               // 客户端能否解析带header块的消息
+	MaxAttempts         *int   `json:"max_attempts"`          // SUB时设置channel的最大尝试次数，0表示不限制，-1表示使用全局配置，不传时不修改
+	FeatureNegotiation  bool   `json:"feature_negotiation"`
+}
+
+// IDENTIFY之后通知messagePump更新配置
+type identifyEvent struct {
+	HeartbeatInterval   time.Duration
+	MsgTimeout          time.Duration
+	OutputBufferTimeout time.Duration
+}
+
+type clientV2 struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	// RDY，同时在投递中（没有FIN/REQ/超时）的消息数上限
+	ReadyCount    int64
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID  int64
+	ctx *context
+
+	net.Conn
+	// 写连接的锁，IOLoop和messagePump都会写
+	writeLock sync.Mutex
+	// 客户端信息的锁
+	metaLock sync.RWMutex
+
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+
+	// 只在IOLoop协程里读写
+	HeartbeatInterval   time.Duration
+	MsgTimeout          time.Duration
+	OutputBufferTimeout time.Duration
+	// IDENTIFY指定的channel最大尝试次数，nil表示不修改
+	MaxAttempts *int32
+	// 订阅的channel，SUB之后不再改变
+	Channel *Channel
+
+	State          int32
+	headersEnabled int32
+
+	ClientID  string
+	Hostname  string
+	UserAgent string
+
+	IdentifyEventChan chan identifyEvent
+	SubEventChan      chan *Channel
+	// RDY或in-flight数变化时通知messagePump
+	ReadyStateChan chan int
+	ExitChan       chan int
+
+	// 读取4字节长度的缓冲
+	lenBuf   [4]byte
+	lenSlice []byte
+}
+
+func newClientV2(id int64, conn net.Conn, ctx *context) *clientV2 {
+	var identifier string
+	if conn != nil {
+		identifier, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+
+	c := &clientV2{
+		ID:  id,
+		ctx: ctx,
+
+		Conn: conn,
+
+		Reader: bufio.NewReaderSize(conn, defaultBufferSize),
+		Writer: bufio.NewWriterSize(conn, defaultBufferSize),
+
+		// 心跳间隔默认为超时时间的一半，保证连接空闲时不会被当成超时
+		HeartbeatInterval: ctx.nsqd.getOpts().ClientTimeout / 2,
+		MsgTimeout:        ctx.nsqd.getOpts().MsgTimeout,
+		// 消息先写到缓冲里，最多等这么久再flush，减少系统调用
+		OutputBufferTimeout: ctx.nsqd.getOpts().OutputBufferTimeout,
+
+		ClientID: identifier,
+		Hostname: identifier,
+
+		IdentifyEventChan: make(chan identifyEvent, 1),
+		SubEventChan:      make(chan *Channel, 1),
+		ReadyStateChan:    make(chan int, 1),
+		ExitChan:          make(chan int),
+	}
+	c.lenSlice = c.lenBuf[:]
+	return c
+}
+
+func (c *clientV2) String() string {
+	return c.RemoteAddr().String()
+}
+
+// 按IDENTIFY的数据更新客户端配置
+func (c *clientV2) Identify(data identifyDataV2) error {
+	c.logf(LOG_INFO, "[%s] IDENTIFY: %+v", c, data)
+
+	c.metaLock.Lock()
+	c.ClientID = data.ClientID
+	c.Hostname = data.Hostname
+	c.UserAgent = data.UserAgent
+	c.metaLock.Unlock()
+
+	err := c.SetHeartbeatInterval(data.HeartbeatInterval)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetMsgTimeout(data.MsgTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetOutputBufferTimeout(data.OutputBufferTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetMaxAttempts(data.MaxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if data.Headers {
+		atomic.StoreInt32(&c.headersEnabled, 1)
+	}
+
+	ie := identifyEvent{
+		HeartbeatInterval:   c.HeartbeatInterval,
+		MsgTimeout:          c.MsgTimeout,
+		OutputBufferTimeout: c.OutputBufferTimeout,
+	}
+
+	// 只会发送一次，不会阻塞
+	select {
+	case c.IdentifyEventChan <- ie:
+	default:
+	}
+
+	return nil
+}
+
+// 发给客户端的消息是否带header块
+func (c *clientV2) HeadersEnabled() bool {
+	return atomic.LoadInt32(&c.headersEnabled) == 1
+}
+
+// SUB时设置到channel上，和HTTP的/channel/config一样
+func (c *clientV2) SetMaxAttempts(maxAttempts *int) error {
+	if maxAttempts == nil {
+		return nil
+	}
+	if *maxAttempts < maxAttemptsInherit || *maxAttempts > math.MaxUint16 {
+		return fmt.Errorf("max attempts (%d) is invalid", *maxAttempts)
+	}
+	n := int32(*maxAttempts)
+	c.MaxAttempts = &n
+	return nil
+}
+
+func (c *clientV2) SetHeartbeatInterval(desiredInterval int) error {
+	switch {
+	case desiredInterval == -1:
+		c.HeartbeatInterval = 0
+	case desiredInterval == 0:
+		// 使用默认值
+	case desiredInterval >= 1000 &&
+		desiredInterval <= int(c.ctx.nsqd.getOpts().MaxHeartbeatInterval/time.Millisecond):
+		c.HeartbeatInterval = time.Duration(desiredInterval) * time.Millisecond
+	default:
+		return fmt.Errorf("heartbeat interval (%d) is invalid", desiredInterval)
+	}
+	return nil
+}
+
+func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
+	switch {
+	case msgTimeout == 0:
+		// 使用默认值
+	case msgTimeout >= 1000 &&
+		msgTimeout <= int(c.ctx.nsqd.getOpts().MaxMsgTimeout/time.Millisecond):
+		c.MsgTimeout = time.Duration(msgTimeout) * time.Millisecond
+	default:
+		return fmt.Errorf("msg timeout (%d) is invalid", msgTimeout)
+	}
+	return nil
+}
+
+func (c *clientV2) SetOutputBufferTimeout(desiredTimeout int) error {
+	switch {
+	case desiredTimeout == -1:
+		c.OutputBufferTimeout = 0
+	case desiredTimeout == 0:
+		// 使用默认值
+	case desiredTimeout >= 1 &&
+		desiredTimeout <= int(c.ctx.nsqd.getOpts().MaxOutputBufferTimeout/time.Millisecond):
+		c.OutputBufferTimeout = time.Duration(desiredTimeout) * time.Millisecond
+	default:
+		return fmt.Errorf("output buffer timeout (%d) is invalid", desiredTimeout)
+	}
+	return nil
+}
+
+// 是否可以再投递消息，in-flight数达到RDY之后等FIN/REQ/超时
+func (c *clientV2) IsReadyForMessages() bool {
+	readyCount := atomic.LoadInt64(&c.ReadyCount)
+	inFlightCount := atomic.LoadInt64(&c.InFlightCount)
+
+	c.logf(LOG_DEBUG, "[%s] state rdy: %4d inflt: %4d", c, readyCount, inFlightCount)
+
+	if inFlightCount >= readyCount || readyCount <= 0 {
+		return false
+	}
+	return true
+}
+
+func (c *clientV2) SetReadyCount(count int64) {
+	oldCount := atomic.SwapInt64(&c.ReadyCount, count)
+	if oldCount != count {
+		c.tryUpdateReadyState()
+	}
+}
+
+// 通知messagePump重新检查是否可以投递，已经有通知在等待时不重复发送
+func (c *clientV2) tryUpdateReadyState() {
+	select {
+	case c.ReadyStateChan <- 1:
+	default:
+	}
+}
+
+func (c *clientV2) SendingMessage() {
+	atomic.AddInt64(&c.InFlightCount, 1)
+	atomic.AddUint64(&c.MessageCount, 1)
+}
+
+func (c *clientV2) FinishedMessage() {
+	atomic.AddUint64(&c.FinishCount, 1)
+	atomic.AddInt64(&c.InFlightCount, -1)
+	c.tryUpdateReadyState()
+}
+
+func (c *clientV2) RequeuedMessage() {
+	atomic.AddUint64(&c.RequeueCount, 1)
+	atomic.AddInt64(&c.InFlightCount, -1)
+	c.tryUpdateReadyState()
+}
+
+func (c *clientV2) TimedOutMessage() {
+	atomic.AddInt64(&c.InFlightCount, -1)
+	c.tryUpdateReadyState()
+}
+
+// CLS之后不再投递新的消息，已经投递的消息还可以FIN/REQ
+func (c *clientV2) StartClose() {
+	c.SetReadyCount(0)
+	atomic.StoreInt32(&c.State, stateClosing)
+}
+
+func (c *clientV2) Flush() error {
+	// IOLoop和messagePump都会调用，不能用只在IOLoop里读写的HeartbeatInterval
+	c.SetWriteDeadline(time.Now().Add(c.ctx.nsqd.getOpts().ClientTimeout))
+	return c.Writer.Flush()
+}
@@ -0,0 +1,94 @@
+package nsqd
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"nsq-learn/internal/lg"
+	"sync/atomic"
+)
+
+// 压缩过的记录以这两个字节开头，第二个字节表示压缩算法
+// 没有这个前缀的记录原样返回，所以对已有数据的topic开启或关闭压缩都不影响读取
+// (消息以8字节的纳秒时间戳开头，第一个字节不会是0xff)
+const (
+	compressMagic      = byte(0xff)
+	compressCodecFlate = byte(0x01)
+	compressHdrSize    = 2
+)
+
+// 压缩消息的持久化队列包装，写入前压缩，读取时解压
+type compressedBackendQueue struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	// 写入前的字节数和实际写入的字节数，用来计算压缩率
+	rawBytes    int64
+	storedBytes int64
+
+	*transformBackendQueue
+	level      int
+	minMsgSize int
+}
+
+// level为flate的压缩级别，需要调用方保证合法
+func newCompressedBackendQueue(name string, dataPath string, backend BackendQueue, level int, minMsgSize int, logf lg.AppLogFunc) BackendQueue {
+	c := &compressedBackendQueue{
+		level:      level,
+		minMsgSize: minMsgSize,
+	}
+	c.transformBackendQueue = newTransformBackendQueue(name, "compressed", dataPath, backend, c.compress, decompress, logf)
+	c.start()
+	return c
+}
+
+func (c *compressedBackendQueue) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(compressMagic)
+	buf.WriteByte(compressCodecFlate)
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	// 压缩后没有变小，或者短于底层队列允许的最小长度，就存原始数据
+	if buf.Len() >= len(data) || buf.Len() < c.minMsgSize {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) < compressHdrSize || data[0] != compressMagic {
+		return data, nil
+	}
+	switch data[1] {
+	case compressCodecFlate:
+		r := flate.NewReader(bytes.NewReader(data[compressHdrSize:]))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", data[1])
+	}
+}
+
+func (c *compressedBackendQueue) Put(data []byte) error {
+	stored, err := c.put(data)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.rawBytes, int64(len(data)))
+	atomic.AddInt64(&c.storedBytes, int64(len(stored)))
+	return nil
+}
+
+// 启动以来写入的原始字节数和压缩后的字节数
+func (c *compressedBackendQueue) CompressionStats() (int64, int64) {
+	return atomic.LoadInt64(&c.rawBytes), atomic.LoadInt64(&c.storedBytes)
+}
@@ -0,0 +1,126 @@
+package nsqd
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCompressedQueue(t *testing.T, dataPath string, backend BackendQueue) *compressedBackendQueue {
+	logf := func(level lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(level.String()+": "+f, args...)
+	}
+	return newCompressedBackendQueue("test", dataPath, backend, flate.DefaultCompression, minValidMsgLength, logf).(*compressedBackendQueue)
+}
+
+func TestCompressedBackendQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	inner := newMemoryBackendQueue("test", 100)
+	q := newTestCompressedQueue(t, tmpDir, inner)
+	defer q.Close()
+
+	body := bytes.Repeat([]byte("compressible "), 100)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, q.Put(append([]byte(fmt.Sprintf("%d", i)), body...)))
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, append([]byte(fmt.Sprintf("%d", i)), body...), <-q.ReadChan())
+	}
+
+	raw, stored := q.CompressionStats()
+	assert.Equal(t, int64(5*(len(body)+1)), raw)
+	assert.True(t, stored < raw/4, "stored %d raw %d", stored, raw)
+}
+
+func TestCompressedBackendQueueRawPassthrough(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	inner := newMemoryBackendQueue("test", 100)
+	// 开启压缩之前写入的数据
+	assert.Nil(t, inner.Put([]byte("uncompressed message")))
+	q := newTestCompressedQueue(t, tmpDir, inner)
+	defer q.Close()
+
+	// 太短或者压缩后没有变小的数据原样存储
+	short := []byte("short")
+	assert.Nil(t, q.Put(short))
+	raw, stored := q.CompressionStats()
+	assert.Equal(t, raw, stored)
+
+	assert.Equal(t, []byte("uncompressed message"), <-q.ReadChan())
+	assert.Equal(t, short, <-q.ReadChan())
+}
+
+func TestCompressedBackendQueueCloseKeepsHeldAtHead(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	inner := newTestSegmentQueue(t, tmpDir, 1<<20)
+	q := newTestCompressedQueue(t, tmpDir, inner)
+	body := bytes.Repeat([]byte("held "), 100)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Put(append([]byte(fmt.Sprintf("%d", i)), body...)))
+	}
+	// readLoop读出第一条后一直拿在手上，Depth仍然算上这条
+	assert.True(t, waitFor(time.Second, func() bool { return inner.Depth() == 2 && q.Depth() == 3 }))
+	assert.Nil(t, q.Close())
+
+	// 重启后手上的那条仍然第一个读到
+	q = newTestCompressedQueue(t, tmpDir, newTestSegmentQueue(t, tmpDir, 1<<20))
+	assert.Equal(t, int64(3), q.Depth())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, append([]byte(fmt.Sprintf("%d", i)), body...), <-q.ReadChan())
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return q.Depth() == 0 }))
+	assert.Nil(t, q.Close())
+	_, err = os.Stat(q.heldFileName())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCompressedTopicStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.CompressTopics = "^zip_"
+	opts.MemQueueSize = 0
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("zip_test")
+	_, ok := topic.backend.(*compressedBackendQueue)
+	assert.True(t, ok)
+	body := bytes.Repeat([]byte("compressible "), 100)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), body)))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats?topic=zip_test", httpAddr(nsqd)))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	var stats struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &stats))
+	assert.Equal(t, 1, len(stats.Topics))
+	assert.Equal(t, int64(3), stats.Topics[0].Depth)
+	assert.Equal(t, uint64(3), stats.Topics[0].MessageCount)
+	assert.True(t, stats.Topics[0].CompressionRatio > 0)
+	assert.True(t, stats.Topics[0].CompressionRatio < 0.5)
+}
@@ -0,0 +1,98 @@
+package nsqd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 死信消息带上的header，记录消息从哪里来、为什么进了死信topic
+const (
+	dlqHeaderTopic     = "dlq-origin-topic"
+	dlqHeaderChannel   = "dlq-origin-channel"
+	dlqHeaderAttempts  = "dlq-attempts"
+	dlqHeaderLastError = "dlq-last-error"
+)
+
+// channel没有单独设置最大尝试次数，使用全局的MaxAttempts
+const maxAttemptsInherit = -1
+
+// 放进死信topic的原因：客户端REQ
+func requeuedReason(clientID int64) string {
+	return fmt.Sprintf("REQ from client %d", clientID)
+}
+
+// 放进死信topic的原因：超时没有FIN，时间从投递开始算起
+func timedOutReason(msg *Message) string {
+	return fmt.Sprintf("timed out after %s on client %d",
+		time.Duration(msg.pri-msg.deliveryTS.UnixNano()), msg.clientID)
+}
+
+// channel的最大尝试次数，没有单独设置时使用全局的MaxAttempts，0表示不限制
+func (c *Channel) MaxAttempts() uint16 {
+	if n := atomic.LoadInt32(&c.maxAttempts); n != maxAttemptsInherit {
+		return uint16(n)
+	}
+	return c.ctx.nsqd.getOpts().MaxAttempts
+}
+
+// 单独设置channel的最大尝试次数，0表示不限制（全局设置了也不限制），maxAttemptsInherit表示使用全局配置
+func (c *Channel) SetMaxAttempts(n int32) {
+	atomic.StoreInt32(&c.maxAttempts, int32(n))
+	c.ctx.nsqd.Notify(c)
+}
+
+// 死信topic的名字
+func deadLetterTopicName(opts *Options, topicName string) string {
+	return topicName + opts.DeadLetterTopicSuffix
+}
+
+// 消息的尝试次数达到上限，应该放进死信topic而不是重新投递
+// 死信topic自己的消息不会再进死信topic
+func (c *Channel) shouldDeadLetter(msg *Message) bool {
+	max := c.MaxAttempts()
+	if max == 0 || msg.Attempts < max {
+		return false
+	}
+	suffix := c.ctx.nsqd.getOpts().DeadLetterTopicSuffix
+	return suffix != "" && !strings.HasSuffix(c.topicName, suffix)
+}
+
+// 把消息发布到死信topic，保留消息ID、时间戳和header，尝试次数重新计算
+// 调用时不能持有channel的锁，getTopic可能会创建topic
+func (c *Channel) deadLetter(msg *Message, reason string) error {
+	opts := c.ctx.nsqd.getOpts()
+	topicName := deadLetterTopicName(opts, c.topicName)
+	if err := c.ctx.nsqd.validateTopicName(topicName); err != nil {
+		return fmt.Errorf("invalid dead letter topic name - %s", err)
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+4)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[dlqHeaderTopic] = c.topicName
+	headers[dlqHeaderChannel] = c.name
+	headers[dlqHeaderAttempts] = strconv.Itoa(int(msg.Attempts))
+	headers[dlqHeaderLastError] = reason
+
+	dlqMsg := NewMessage(msg.ID, msg.Body)
+	dlqMsg.Timestamp = msg.Timestamp
+	dlqMsg.Headers = headers
+
+	// 退出过程中不再创建死信topic，消息留在原channel里
+	topic, err := c.ctx.nsqd.getTopic(topicName, true)
+	if err != nil {
+		return err
+	}
+	err = topic.PutMessage(dlqMsg)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	c.logf(LOG_WARN, "CHANNEL(%s): msg(%s) %s after %d attempts, moved to %s",
+		c.name, msg.ID, reason, msg.Attempts, topicName)
+	return nil
+}
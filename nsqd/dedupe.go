@@ -0,0 +1,205 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 发布时的幂等key的最大长度
+const maxIdempotencyKeyLength = 256
+
+var errInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+func validateIdempotencyKey(key string) error {
+	if len(key) == 0 || len(key) > maxIdempotencyKeyLength {
+		return errInvalidIdempotencyKey
+	}
+	return nil
+}
+
+type dedupeEntry struct {
+	key    string
+	expire int64
+}
+
+// topic的去重索引，记录时间窗口内发布过的幂等key
+// 时间窗口固定，所以按加入顺序就是按过期时间排序，过期的key从队头清理
+type dedupeIndex struct {
+	sync.Mutex
+	window  time.Duration
+	maxKeys int
+	keys    map[string]int64
+	order   []dedupeEntry
+	// 正在发布、还不知道结果的key，发布结束时关闭chan
+	pending map[string]chan struct{}
+}
+
+func newDedupeIndex(window time.Duration, maxKeys int) *dedupeIndex {
+	return &dedupeIndex{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[string]int64),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// 开始发布一个key，返回false表示key在时间窗口内已经发布成功（重复发布）
+// 同一个key正在发布时等它结束再判断；返回true时key记为pending，发布后必须调用finish
+func (d *dedupeIndex) begin(key string, now int64) bool {
+	for {
+		d.Lock()
+		d.prune(now)
+		if _, ok := d.keys[key]; ok {
+			d.Unlock()
+			return false
+		}
+		done, ok := d.pending[key]
+		if !ok {
+			d.pending[key] = make(chan struct{})
+			d.Unlock()
+			return true
+		}
+		d.Unlock()
+		<-done
+	}
+}
+
+// 发布结束，成功时key才加入索引，失败时等待中的重复发布会自己发布
+func (d *dedupeIndex) finish(key string, ok bool, now int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	if ok {
+		d.commit(key, now)
+	}
+	close(d.pending[key])
+	delete(d.pending, key)
+}
+
+// 记录一个key，调用时需要持有锁
+func (d *dedupeIndex) commit(key string, now int64) {
+	// 超过上限时淘汰最早的key
+	for d.maxKeys > 0 && len(d.keys) >= d.maxKeys {
+		d.removeFirst()
+	}
+	expire := now + int64(d.window)
+	d.keys[key] = expire
+	d.order = append(d.order, dedupeEntry{key, expire})
+}
+
+func (d *dedupeIndex) len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.keys)
+}
+
+func (d *dedupeIndex) prune(now int64) {
+	for len(d.order) > 0 && d.order[0].expire <= now {
+		d.removeFirst()
+	}
+}
+
+func (d *dedupeIndex) removeFirst() {
+	e := d.order[0]
+	d.order = d.order[1:]
+	// remove过的key或者重新加入的key，map里的过期时间和队列里的不一样
+	if expire, ok := d.keys[e.key]; ok && expire == e.expire {
+		delete(d.keys, e.key)
+	}
+}
+
+// 去重索引文件的格式，每个key:
+// [8-byte 过期时间(纳秒)][2-byte key长度][N-byte key]
+func (d *dedupeIndex) persist(fileName string) error {
+	d.Lock()
+	d.prune(time.Now().UnixNano())
+	if len(d.keys) == 0 {
+		d.Unlock()
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var data bytes.Buffer
+	var hdr [10]byte
+	for _, e := range d.order {
+		if expire, ok := d.keys[e.key]; !ok || expire != e.expire {
+			continue
+		}
+		binary.BigEndian.PutUint64(hdr[:8], uint64(e.expire))
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(e.key)))
+		data.Write(hdr[:])
+		data.WriteString(e.key)
+	}
+	d.Unlock()
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err := writeSyncFile(tmpFileName, data.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (d *dedupeIndex) load(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now().UnixNano()
+	for len(data) > 0 {
+		if len(data) < 10 {
+			return errors.New("invalid dedupe index file")
+		}
+		expire := int64(binary.BigEndian.Uint64(data[:8]))
+		l := int(binary.BigEndian.Uint16(data[8:10]))
+		if len(data) < 10+l {
+			return errors.New("invalid dedupe index file")
+		}
+		key := string(data[10 : 10+l])
+		data = data[10+l:]
+		if expire <= now {
+			continue
+		}
+		d.keys[key] = expire
+		d.order = append(d.order, dedupeEntry{key, expire})
+	}
+	return nil
+}
+
+// 去重索引文件的路径
+func (t *Topic) dedupeFileName() string {
+	return path.Join(t.ctx.nsqd.getOpts().DataPath, t.name+".dedupe.dat")
+}
+
+// 带幂等key发布消息，key在时间窗口内已经发布成功过时不写入，返回true
+// 同一个key正在发布时等待它的结果，失败时由这次发布重试，保证确认过的重复发布一定有一条写入了
+// key为空或者没有开启去重时和PutMessage一样
+func (t *Topic) PutMessageWithKey(m *Message, key string) (bool, error) {
+	if key == "" || t.dedupe == nil {
+		return false, t.PutMessage(m)
+	}
+	if !t.dedupe.begin(key, time.Now().UnixNano()) {
+		atomic.AddUint64(&t.dedupeHits, 1)
+		return true, nil
+	}
+	err := t.PutMessage(m)
+	t.dedupe.finish(key, err == nil, time.Now().UnixNano())
+	return false, err
+}
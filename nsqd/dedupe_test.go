@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"nsq-learn/internal/test"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeIndex(t *testing.T) {
+	d := newDedupeIndex(time.Second, 2)
+	// 发布成功的key
+	add := func(key string, now int64) bool {
+		if !d.begin(key, now) {
+			return false
+		}
+		d.finish(key, true, now)
+		return true
+	}
+	now := time.Now().UnixNano()
+	assert.True(t, add("a", now))
+	assert.False(t, add("a", now))
+	assert.True(t, add("b", now))
+
+	// 超过上限时淘汰最早的key
+	assert.True(t, add("c", now))
+	assert.Equal(t, 2, d.len())
+	assert.True(t, add("a", now))
+
+	// 过期之后可以重新发布
+	later := now + int64(2*time.Second)
+	assert.True(t, add("c", later))
+	assert.Equal(t, 1, d.len())
+}
+
+func TestDedupeIndexPending(t *testing.T) {
+	d := newDedupeIndex(time.Second, 0)
+	now := time.Now().UnixNano()
+	assert.True(t, d.begin("a", now))
+
+	// 同一个key正在发布时，重复的发布等待结果
+	result := make(chan bool, 1)
+	go func() {
+		result <- d.begin("a", now)
+	}()
+	select {
+	case <-result:
+		t.Fatal("begin did not wait for the pending publish")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 第一次发布失败，等待的发布自己发布
+	d.finish("a", false, now)
+	assert.True(t, <-result)
+	assert.Equal(t, 0, d.len())
+
+	// 成功之后才算重复
+	d.finish("a", true, now)
+	assert.Equal(t, 1, d.len())
+	assert.False(t, d.begin("a", now))
+}
+
+func TestTopicDedupe(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DedupePersist = true
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("dedupe_test")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 3; i++ {
+		dup, err := topic.PutMessageWithKey(NewMessage(topic.GenerateID(), []byte("test")), "key1")
+		assert.Nil(t, err)
+		assert.Equal(t, i > 0, dup)
+	}
+	_, err := topic.PutMessageWithKey(NewMessage(topic.GenerateID(), []byte("test")), "")
+	assert.Nil(t, err)
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 2 }))
+	stats := nsqd.GetStats("dedupe_test", "")
+	assert.Equal(t, uint64(2), stats[0].DedupeHits)
+	assert.Equal(t, 1, stats[0].DedupeKeys)
+
+	// 去重索引持久化，重启后继续去重
+	nsqd.Exit()
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic = nsqd.GetTopic("dedupe_test")
+	dup, err := topic.PutMessageWithKey(NewMessage(topic.GenerateID(), []byte("test")), "key1")
+	assert.Nil(t, err)
+	assert.True(t, dup)
+}
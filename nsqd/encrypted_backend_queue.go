@@ -0,0 +1,240 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"nsq-learn/internal/lg"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 加密过的记录格式:
+// [1-byte encryptMagic][4-byte key ID][12-byte nonce][N-byte 密文(含16-byte tag)]
+// 没有这个前缀的记录是开启加密之前写入的明文，原样返回
+const (
+	encryptMagic   = byte(0xfe)
+	encryptHdrSize = 1 + 4
+	// 加密后最多增加的字节数（头部、12字节nonce、16字节tag）
+	encryptMaxOverhead = encryptHdrSize + 12 + 16
+)
+
+// 加密密钥，由EncryptionKeyFile加载
+// 文件每行一个密钥: <key ID> <hex编码的16/24/32字节密钥>，空行和#开头的行忽略
+// 最后一行的密钥用来加密新消息，前面的只用来解密旧数据
+type keyring struct {
+	activeID uint32
+	aeads    map[uint32]cipher.AEAD
+}
+
+func loadKeyring(fileName string) (*keyring, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{aeads: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<key id> <hex key>\"", fileName, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key id - %s", fileName, line, err)
+		}
+		if _, ok := k.aeads[uint32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %d", fileName, line, id)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key - %s", fileName, line, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key - %s", fileName, line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[uint32(id)] = aead
+		k.activeID = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.aeads) == 0 {
+		return nil, fmt.Errorf("%s: no keys", fileName)
+	}
+	return k, nil
+}
+
+func (k *keyring) has(id uint32) bool {
+	_, ok := k.aeads[id]
+	return ok
+}
+
+// 用当前密钥加密，magic和key ID作为附加数据参与认证
+func (k *keyring) seal(data []byte) ([]byte, error) {
+	aead := k.aeads[k.activeID]
+	out := make([]byte, encryptHdrSize+aead.NonceSize(), encryptHdrSize+aead.NonceSize()+len(data)+aead.Overhead())
+	out[0] = encryptMagic
+	binary.BigEndian.PutUint32(out[1:encryptHdrSize], k.activeID)
+	nonce := out[encryptHdrSize:]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, out[:encryptHdrSize]), nil
+}
+
+// 按记录里的key ID解密，明文记录原样返回
+func (k *keyring) open(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != encryptMagic {
+		return data, nil
+	}
+	if len(data) < encryptHdrSize {
+		return nil, errors.New("encrypted record too short")
+	}
+	id := binary.BigEndian.Uint32(data[1:encryptHdrSize])
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("no key with id %d", id)
+	}
+	if len(data) < encryptHdrSize+aead.NonceSize() {
+		return nil, errors.New("encrypted record too short")
+	}
+	nonce := data[encryptHdrSize : encryptHdrSize+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[encryptHdrSize+aead.NonceSize():], data[:encryptHdrSize])
+}
+
+// 记录加密数据用到了哪些key ID的文件，启动时用来检查密钥是否齐全
+// 持久化队列、延时消息、队头消息和保留日志都有各自的文件
+const keyIDsFileSuffix = ".keyids.dat"
+
+func keyIDsFileName(dataPath string, name string) string {
+	return path.Join(dataPath, name+keyIDsFileSuffix)
+}
+
+// 文件格式为每行一个key ID，文件不存在时返回空
+func readKeyIDs(fileName string) ([]uint32, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []uint32
+	for _, field := range strings.Fields(string(data)) {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt key id file %s - %s", fileName, err)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+func writeKeyIDs(fileName string, ids []uint32) error {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var buf bytes.Buffer
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "%d\n", id)
+	}
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, mrand.Int())
+	err := writeSyncFile(tmpFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// 把id加到key ID文件里，reset为true表示数据里已经没有其他密钥加密的记录
+func recordKeyID(fileName string, id uint32, reset bool) error {
+	var ids []uint32
+	if !reset {
+		var err error
+		ids, err = readKeyIDs(fileName)
+		if err != nil {
+			return err
+		}
+		for _, existing := range ids {
+			if existing == id {
+				return nil
+			}
+		}
+	}
+	return writeKeyIDs(fileName, append(ids, id))
+}
+
+// 数据文件删除或者改为明文保存后，对应的key ID文件也要删除
+func removeKeyIDs(fileName string) error {
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 检查DataPath下已经加密的数据是否都有对应的密钥，kr为nil表示没有配置密钥
+func checkEncryptionKeys(dataPath string, kr *keyring) error {
+	files, err := filepath.Glob(path.Join(dataPath, "*"+keyIDsFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		ids, err := readKeyIDs(fileName)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path.Base(fileName), keyIDsFileSuffix)
+		for _, id := range ids {
+			if kr == nil {
+				return fmt.Errorf("%s has encrypted data but no --encryption-key-file is configured", name)
+			}
+			if !kr.has(id) {
+				return fmt.Errorf("%s has data encrypted with key id %d which is not in the key file", name, id)
+			}
+		}
+	}
+	return nil
+}
+
+// 加密消息的持久化队列包装，写入前加密，读取时解密
+type encryptedBackendQueue struct {
+	*transformBackendQueue
+}
+
+func newEncryptedBackendQueue(name string, dataPath string, backend BackendQueue, kr *keyring, logf lg.AppLogFunc) BackendQueue {
+	e := &encryptedBackendQueue{
+		transformBackendQueue: newTransformBackendQueue(name, "encrypted", dataPath, backend, kr.seal, kr.open, logf),
+	}
+	// 记录当前密钥，队列为空时旧的key ID就不再需要了
+	err := recordKeyID(keyIDsFileName(dataPath, name), kr.activeID, e.Depth() == 0)
+	if err != nil {
+		logf(LOG_ERROR, "ENCRYPTEDQUEUE(%s) failed to record key id - %s", name, err)
+	}
+	e.start()
+	return e
+}
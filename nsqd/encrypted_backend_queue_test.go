@@ -0,0 +1,239 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/test"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testKey2 = "0f0e0d0c0b0a09080706050403020100"
+)
+
+func writeTestKeyFile(t *testing.T, dir string, lines ...string) string {
+	fileName := path.Join(dir, "keys.txt")
+	data := "# test keys\n"
+	for _, line := range lines {
+		data += line + "\n"
+	}
+	assert.Nil(t, ioutil.WriteFile(fileName, []byte(data), 0600))
+	return fileName
+}
+
+func newTestEncryptedQueue(t *testing.T, dataPath string, kr *keyring, backend BackendQueue) *encryptedBackendQueue {
+	logf := func(level lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(level.String()+": "+f, args...)
+	}
+	return newEncryptedBackendQueue("test", dataPath, backend, kr, logf).(*encryptedBackendQueue)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	kr1, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1))
+	assert.Nil(t, err)
+	sealed, err := kr1.seal([]byte("secret"))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("secret")))
+
+	// 新密钥放在最后，旧密钥仍然能解密
+	kr2, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1, "2 "+testKey2))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), kr2.activeID)
+	data, err := kr2.open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), data)
+
+	// 去掉旧密钥后无法解密
+	kr3, err := loadKeyring(writeTestKeyFile(t, tmpDir, "2 "+testKey2))
+	assert.Nil(t, err)
+	_, err = kr3.open(sealed)
+	assert.NotNil(t, err)
+
+	// 开启加密之前的明文原样返回
+	data, err = kr3.open([]byte("plain"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain"), data)
+
+	_, err = loadKeyring(writeTestKeyFile(t, tmpDir, "1 abcd"))
+	assert.NotNil(t, err)
+	_, err = loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1, "1 "+testKey2))
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedBackendQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	kr, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1))
+	assert.Nil(t, err)
+	q := newTestEncryptedQueue(t, tmpDir, kr, newTestSegmentQueue(t, tmpDir, 1<<20))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, q.Put([]byte(fmt.Sprintf("secret-%d", i))))
+	}
+	assert.Nil(t, q.Close())
+
+	// 磁盘上找不到明文
+	files, err := ioutil.ReadDir(tmpDir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(path.Join(tmpDir, f.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, []byte("secret-")), f.Name())
+	}
+
+	q = newTestEncryptedQueue(t, tmpDir, kr, newTestSegmentQueue(t, tmpDir, 1<<20))
+	defer q.Close()
+	// 关闭时readLoop手上的一条保存在单独的文件里，重启后仍然排在最前面
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("secret-%d", i)), <-q.ReadChan())
+	}
+}
+
+func TestCompressedEncryptedCloseKeepsOrder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	kr, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1))
+	assert.Nil(t, err)
+	open := func() (*compressedBackendQueue, *segmentBackendQueue) {
+		inner := newTestSegmentQueue(t, tmpDir, 1<<20)
+		return newTestCompressedQueue(t, tmpDir, newTestEncryptedQueue(t, tmpDir, kr, inner)), inner
+	}
+
+	body := bytes.Repeat([]byte("secret "), 20)
+	q, inner := open()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, q.Put(append([]byte(fmt.Sprintf("%d", i)), body...)))
+	}
+	// 压缩和加密两层各拿着一条
+	assert.True(t, waitFor(time.Second, func() bool { return inner.Depth() == 2 && q.Depth() == 4 }))
+	assert.Nil(t, q.Close())
+
+	// 两层手上的消息都由最里面的加密层保存，磁盘上没有明文
+	files, err := ioutil.ReadDir(tmpDir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(path.Join(tmpDir, f.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, []byte("secret")), f.Name())
+	}
+
+	q, _ = open()
+	defer q.Close()
+	assert.Equal(t, int64(4), q.Depth())
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, append([]byte(fmt.Sprintf("%d", i)), body...), <-q.ReadChan())
+	}
+}
+
+func TestCheckEncryptionKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	kr1, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1))
+	assert.Nil(t, err)
+	q := newTestEncryptedQueue(t, tmpDir, kr1, newTestSegmentQueue(t, tmpDir, 1<<20))
+	assert.Nil(t, q.Put([]byte("secret")))
+	assert.Nil(t, q.Close())
+
+	assert.Nil(t, checkEncryptionKeys(tmpDir, kr1))
+	assert.NotNil(t, checkEncryptionKeys(tmpDir, nil))
+	kr2, err := loadKeyring(writeTestKeyFile(t, tmpDir, "2 "+testKey2))
+	assert.Nil(t, err)
+	assert.NotNil(t, checkEncryptionKeys(tmpDir, kr2))
+
+	// 轮换密钥后旧数据还在，两个key ID都需要
+	kr12, err := loadKeyring(writeTestKeyFile(t, tmpDir, "1 "+testKey1, "2 "+testKey2))
+	assert.Nil(t, err)
+	q = newTestEncryptedQueue(t, tmpDir, kr12, newTestSegmentQueue(t, tmpDir, 1<<20))
+	assert.Nil(t, q.Put([]byte("secret")))
+	assert.NotNil(t, checkEncryptionKeys(tmpDir, kr1))
+	assert.NotNil(t, checkEncryptionKeys(tmpDir, kr2))
+
+	// 旧数据都读完之后，重新打开时只记录当前密钥
+	<-q.ReadChan()
+	<-q.ReadChan()
+	assert.True(t, waitFor(time.Second, func() bool { return q.Depth() == 0 }))
+	assert.Nil(t, q.Close())
+	q = newTestEncryptedQueue(t, tmpDir, kr12, newTestSegmentQueue(t, tmpDir, 1<<20))
+	assert.Nil(t, q.Close())
+	assert.Nil(t, checkEncryptionKeys(tmpDir, kr2))
+}
+
+func TestEncryptedTopicAndChannel(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(keyDir)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EncryptionKeyFile = writeTestKeyFile(t, keyDir, "1 "+testKey1)
+	opts.MemQueueSize = 0
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("enc_test")
+	_, ok := topic.backend.(*encryptedBackendQueue)
+	assert.True(t, ok)
+	channel := topic.GetChannel("ch")
+	_, ok = channel.backend.(*encryptedBackendQueue)
+	assert.True(t, ok)
+
+	assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("secret body"))))
+	topic.Start()
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 1 }))
+}
+
+func TestCheckEncryptionKeysAllFiles(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(keyDir)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EncryptionKeyFile = writeTestKeyFile(t, keyDir, "1 "+testKey1)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	// 延时消息和保留日志也是加密保存的，队列本身是空的
+	topic := nsqd.GetTopic("enc_files")
+	assert.Nil(t, topic.SetRetention(time.Hour))
+	channel := topic.GetChannel("ch")
+	topic.Start()
+	assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("retained"))))
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 1 }))
+	<-channel.memoryMsgChan
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("deferred")), time.Hour)
+	nsqd.Exit()
+
+	kr1, err := loadKeyring(opts.EncryptionKeyFile)
+	assert.Nil(t, err)
+	kr2, err := loadKeyring(writeTestKeyFile(t, keyDir, "2 "+testKey2))
+	assert.Nil(t, err)
+	// 去掉队列自己的key ID文件，只靠延时消息和保留日志的记录也能发现缺少密钥
+	assert.Nil(t, os.Remove(keyIDsFileName(opts.DataPath, "enc_files")))
+	assert.Nil(t, os.Remove(keyIDsFileName(opts.DataPath, getBackendName("enc_files", "ch"))))
+	assert.Nil(t, checkEncryptionKeys(opts.DataPath, kr1))
+	assert.NotNil(t, checkEncryptionKeys(opts.DataPath, kr2))
+
+	assert.Nil(t, os.Remove(keyIDsFileName(opts.DataPath, getBackendName("enc_files", "ch")+".deferred")))
+	assert.NotNil(t, checkEncryptionKeys(opts.DataPath, kr2))
+	assert.Nil(t, os.Remove(keyIDsFileName(opts.DataPath, "enc_files.retention")))
+	assert.Nil(t, checkEncryptionKeys(opts.DataPath, kr2))
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+// 消息ID生成算法参考了twitter的snowflake:
+// 时间戳(伪毫秒) + 节点ID + 序列号，保证同一个nsqd内生成的ID单调递增
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	nodeIDBits     = uint64(10)
+	sequenceBits   = uint64(12)
+	nodeIDShift    = sequenceBits
+	timestampShift = sequenceBits + nodeIDBits
+	sequenceMask   = int64(-1) ^ (int64(-1) << sequenceBits)
+
+	// ( 2012-10-28 16:23:42 UTC ).UnixNano() >> 20
+	twepoch = int64(1288834974288)
+)
+
+var ErrTimeBackwards = errors.New("time has gone backwards")
+var ErrSequenceExpired = errors.New("sequence expired")
+var ErrIDBackwards = errors.New("ID went backward")
+
+type guid int64
+
+type guidFactory struct {
+	sync.Mutex
+
+	nodeID        int64
+	sequence      int64
+	lastTimestamp int64
+	lastID        guid
+}
+
+func NewGUIDFactory(nodeID int64) *guidFactory {
+	return &guidFactory{
+		nodeID: nodeID,
+	}
+}
+
+func (f *guidFactory) NewGUID() (guid, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	// 除以1048576, 得到伪毫秒
+	ts := time.Now().UnixNano() >> 20
+
+	if ts < f.lastTimestamp {
+		return 0, ErrTimeBackwards
+	}
+
+	if f.lastTimestamp == ts {
+		f.sequence = (f.sequence + 1) & sequenceMask
+		// 同一个伪毫秒内序列号用完了
+		if f.sequence == 0 {
+			return 0, ErrSequenceExpired
+		}
+	} else {
+		f.sequence = 0
+	}
+
+	f.lastTimestamp = ts
+
+	id := guid(((ts - twepoch) << timestampShift) |
+		(f.nodeID << nodeIDShift) |
+		f.sequence)
+
+	if id <= f.lastID {
+		return 0, ErrIDBackwards
+	}
+
+	f.lastID = id
+
+	return id, nil
+}
+
+// 转成16个字节的十六进制MessageID
+func (g guid) Hex() MessageID {
+	var h MessageID
+	var b [8]byte
+
+	b[0] = byte(g >> 56)
+	b[1] = byte(g >> 48)
+	b[2] = byte(g >> 40)
+	b[3] = byte(g >> 32)
+	b[4] = byte(g >> 24)
+	b[5] = byte(g >> 16)
+	b[6] = byte(g >> 8)
+	b[7] = byte(g)
+
+	hex.Encode(h[:], b[:])
+	return h
+}
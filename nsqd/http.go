@@ -1,12 +1,20 @@
 package nsqd
 
 import (
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"nsq-learn/internal/http_api"
+	"nsq-learn/internal/lg"
 	"nsq-learn/internal/protocol"
 	"nsq-learn/internal/version"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -19,13 +27,22 @@ type httpServer struct {
 }
 
 func NewHttpServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer {
-	log := http_api.Log(ctx.nsqd.logf)
+	// 请求日志使用http组件的日志等级
+	logf := func(level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
+		ctx.nsqd.logfFor([]string{logComponentHTTP}, level, fields, f, args...)
+	}
+	requestLogf := logf
+	if ctx.nsqd.accessLog != nil {
+		// 请求已经写到访问日志里，不再写应用日志
+		requestLogf = func(lg.LogLevel, lg.Fields, string, ...interface{}) {}
+	}
+	log := http_api.Log(requestLogf)
 	router := httprouter.New()
 	// 如果没有对用的路由 返回405
 	router.HandleMethodNotAllowed = true
-	router.PanicHandler = http_api.LogPanicHandler(ctx.nsqd.logf)
-	router.NotFound = http_api.LogNotFoundHandler(ctx.nsqd.logf)
-	router.MethodNotAllowed = http_api.LogMethodNotAllowedHandler(ctx.nsqd.logf)
+	router.PanicHandler = http_api.LogPanicHandler(logf)
+	router.NotFound = http_api.LogNotFoundHandler(requestLogf)
+	router.MethodNotAllowed = http_api.LogMethodNotAllowedHandler(requestLogf)
 	s := &httpServer{
 		ctx:         ctx,
 		router:      router,
@@ -34,10 +51,27 @@ func NewHttpServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	}
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
+	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	// 发布消息
+	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, log, http_api.V1))
 	// 创建topic
 	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
+	// 查看和修改topic的配置
+	router.Handle("GET", "/topic/config", http_api.Decorate(s.doTopicConfig, log, http_api.V1))
+	router.Handle("POST", "/topic/config", http_api.Decorate(s.doTopicConfig, log, http_api.V1))
 	// 创建channel
 	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
+	// 查看和修改channel的配置
+	router.Handle("GET", "/channel/config", http_api.Decorate(s.doChannelConfig, log, http_api.V1))
+	router.Handle("POST", "/channel/config", http_api.Decorate(s.doChannelConfig, log, http_api.V1))
+	// 把channel回退到某个时间点，重新投递保留的消息
+	router.Handle("POST", "/channel/rewind", http_api.Decorate(s.doRewindChannel, log, http_api.V1))
+	// 查看和修改全局或组件的日志等级
+	router.Handle("GET", "/config/log_level", http_api.Decorate(s.doLogLevel, log, http_api.V1))
+	router.Handle("PUT", "/config/log_level", http_api.Decorate(s.doLogLevel, log, http_api.V1))
+	if ctx.nsqd.accessLog != nil {
+		s.router = ctx.nsqd.accessLog.Handler(router)
+	}
 	return s
 }
 
@@ -55,11 +89,134 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, http_api.Err{Code: 500, Text: err.Error()}
 	}
 	return struct {
-		Version  string `json:"version"`
-		Hostname string `json:"hostname"`
+		Version       string `json:"version"`
+		Hostname      string `json:"hostname"`
+		LastPersisted int64  `json:"last_persisted"`
 	}{
-		Version:  version.Binary,
-		Hostname: hostname,
+		Version:       version.Binary,
+		Hostname:      hostname,
+		LastPersisted: atomic.LoadInt64(&s.ctx.nsqd.lastPersisted),
+	}, nil
+}
+
+func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if req.ContentLength > s.ctx.nsqd.getOpts().MaxMsgSize {
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+
+	// 多读一个字节，读满了说明消息超过了最大长度（LimitReader读到上限会返回EOF）
+	readMax := s.ctx.nsqd.getOpts().MaxMsgSize + 1
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+	if len(body) == 0 {
+		return nil, http_api.Err{Code: 400, Text: "MSG_EMPTY"}
+	}
+
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var deferred time.Duration
+	if ds, ok := reqParams["defer"]; ok {
+		di, err := strconv.ParseInt(ds[0], 10, 64)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
+		}
+		deferred = time.Duration(di) * time.Millisecond
+		if deferred < 0 || deferred > s.ctx.nsqd.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
+		}
+	}
+
+	// 磁盘写入失败后nsqd处于不健康状态，直接拒绝，避免消息写进去又丢掉
+	if s.ctx.nsqd.rejectPublish(topic) {
+		return nil, http_api.Err{Code: 500, Text: "E_PUT_FAILED"}
+	}
+
+	headers, err := getMessageHeaders(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 可选的幂等key，去重时间窗口内重复发布的消息直接返回成功，不再写入
+	var idempotencyKey string
+	if ks, ok := reqParams["idempotency_key"]; ok {
+		idempotencyKey = ks[0]
+		if err := validateIdempotencyKey(idempotencyKey); err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_IDEMPOTENCY_KEY"}
+		}
+	}
+
+	msg := NewMessage(topic.GenerateID(), body)
+	msg.deferred = deferred
+	msg.Headers = headers
+	_, err = topic.PutMessageWithKey(msg, idempotencyKey)
+	if err != nil {
+		if topic.Exiting() {
+			return nil, http_api.Err{Code: 503, Text: "EXITING"}
+		}
+		if err == ErrQuotaExceeded {
+			return nil, http_api.Err{Code: 507, Text: "E_QUOTA_EXCEEDED"}
+		}
+		return nil, http_api.Err{Code: 500, Text: "E_PUT_FAILED"}
+	}
+
+	return "OK", nil
+}
+
+// 消息header的HTTP请求头前缀，X-NSQ-Attr-Trace-Id对应header trace-id
+const httpHeaderAttrPrefix = "X-Nsq-Attr-"
+
+// 从请求头里取出消息的header，key统一为小写
+func getMessageHeaders(req *http.Request) (map[string]string, error) {
+	var headers map[string]string
+	for k, v := range req.Header {
+		if !strings.HasPrefix(k, httpHeaderAttrPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.ToLower(k[len(httpHeaderAttrPrefix):])] = v[0]
+	}
+	err := validateHeaders(headers)
+	if err == errHeadersTooLarge {
+		return nil, http_api.Err{Code: 413, Text: "HEADERS_TOO_BIG"}
+	}
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_HEADERS"}
+	}
+	return headers, nil
+}
+
+func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+	topicName, _ := reqParams.Get("topic")
+	channelName, _ := reqParams.Get("channel")
+
+	stats := s.ctx.nsqd.GetStats(topicName, channelName)
+	return struct {
+		Version       string       `json:"version"`
+		Health        string       `json:"health"`
+		StartTime     int64        `json:"start_time"`
+		DataPathBytes int64        `json:"data_path_bytes"`
+		Topics        []TopicStats `json:"topics"`
+	}{
+		Version:       version.Binary,
+		Health:        s.ctx.nsqd.getHealth(),
+		StartTime:     s.ctx.nsqd.startTime.Unix(),
+		DataPathBytes: atomic.LoadInt64(&s.ctx.nsqd.dataPathBytes),
+		Topics:        stats,
 	}, nil
 }
 
@@ -74,14 +231,192 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 }
 
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+	// 可选的过滤条件和顺序投递模式，只能在创建时设置
+	var opts ChannelOptions
+	opts.Filter, _ = reqParams.Get("filter")
+	if orderedStr, err := reqParams.Get("ordered"); err == nil {
+		opts.Ordered, err = strconv.ParseBool(orderedStr)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_ORDERED"}
+		}
+	}
+	_, err = topic.GetChannelWithOptions(channelName, opts)
+	if err == errFilterConflict {
+		return nil, http_api.Err{Code: 409, Text: "FILTER_CONFLICT"}
+	}
+	if err == errOrderedConflict {
+		return nil, http_api.Err{Code: 409, Text: "ORDERED_CONFLICT"}
+	}
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_FILTER"}
+	}
 	return nil, nil
 }
 
+// topic的配置，POST时按参数修改后返回
+// ttl: 消息的存活时间（毫秒），0表示不过期
+func (s *httpServer) doTopicConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	if req.Method == "POST" {
+		if ttlStr, err := reqParams.Get("ttl"); err == nil {
+			ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+			if err != nil || ttl < 0 {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_TTL"}
+			}
+			topic.SetTTL(time.Duration(ttl) * time.Millisecond)
+		}
+		if retentionStr, err := reqParams.Get("retention"); err == nil {
+			retention, err := strconv.ParseInt(retentionStr, 10, 64)
+			if err != nil || retention < 0 {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_RETENTION"}
+			}
+			err = topic.SetRetention(time.Duration(retention) * time.Millisecond)
+			if err != nil {
+				return nil, http_api.Err{Code: 400, Text: "RETENTION_NOT_SUPPORTED"}
+			}
+		}
+	}
+
+	return struct {
+		TTL       int64 `json:"ttl"`
+		Retention int64 `json:"retention"`
+	}{
+		TTL:       int64(topic.TTL() / time.Millisecond),
+		Retention: int64(topic.Retention() / time.Millisecond),
+	}, nil
+}
+
+// 把channel回退到since（unix时间戳，秒），重新投递since之后保留的消息，需要topic开启保留模式，不支持顺序投递的channel
+// channel里还没投递的消息和延时消息保留不动，since之后还没消费的消息会重复投递一次，重新投递的消息使用新的消息ID
+func (s *httpServer) doRewindChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	sinceStr, err := reqParams.Get("since")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_SINCE"}
+	}
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil || since < 0 {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_SINCE"}
+	}
+	if topic.Retention() <= 0 {
+		return nil, http_api.Err{Code: 400, Text: "RETENTION_DISABLED"}
+	}
+	if _, err := topic.GetExistingChannel(channelName); err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	count, err := topic.RewindChannel(channelName, time.Unix(since, 0))
+	switch err {
+	case nil:
+	case errRewindOrdered:
+		return nil, http_api.Err{Code: 400, Text: "REWIND_ORDERED_UNSUPPORTED"}
+	case errRetentionDisabled:
+		return nil, http_api.Err{Code: 400, Text: "RETENTION_DISABLED"}
+	default:
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to rewind channel %s - %s", channelName, err)
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+	return struct {
+		Replayed int `json:"replayed"`
+	}{
+		Replayed: count,
+	}, nil
+}
+
+// channel的配置，POST时按参数修改后返回
+// max_attempts: 最大尝试次数，0表示不限制，-1表示使用全局配置
+func (s *httpServer) doChannelConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	if req.Method == "POST" {
+		if maStr, err := reqParams.Get("max_attempts"); err == nil {
+			ma, err := strconv.ParseInt(maStr, 10, 32)
+			if err != nil || ma < maxAttemptsInherit || ma > math.MaxUint16 {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_MAX_ATTEMPTS"}
+			}
+			channel.SetMaxAttempts(int32(ma))
+		}
+	}
+
+	return struct {
+		MaxAttempts uint16 `json:"max_attempts"`
+	}{
+		MaxAttempts: channel.MaxAttempts(),
+	}, nil
+}
+
+// 日志等级，PUT时按参数修改后返回
+// level: 日志等级（debug/info/warn/error/fatal），component不为空时可以用default删除组件的单独设置
+// component: 组件（http、tcp、diskqueue、topic:<topic名>），为空表示全局等级
+func (s *httpServer) doLogLevel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	if req.Method == "PUT" {
+		levelStr, err := reqParams.Get("level")
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_LEVEL"}
+		}
+		component, _ := reqParams.Get("component")
+		if component != "" && !s.ctx.nsqd.isValidLogComponent(component) {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_COMPONENT"}
+		}
+		reset := component != "" && strings.ToLower(levelStr) == "default"
+		var level lg.LogLevel
+		if !reset {
+			level, err = lg.ParseLogLevel(levelStr, false)
+			if err != nil {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_LEVEL"}
+			}
+		}
+		s.ctx.nsqd.setLogLevel(component, level, reset)
+		s.ctx.nsqd.logf(LOG_INFO, "log level of %q set to %s", component, levelStr)
+	}
+
+	levels := s.ctx.nsqd.getLogLevels()
+	components := make(map[string]string, len(levels.components))
+	for k, v := range levels.components {
+		components[k] = strings.ToLower(v.String())
+	}
+	return struct {
+		Level      string            `json:"level"`
+		Components map[string]string `json:"components"`
+	}{
+		Level:      strings.ToLower(levels.global.String()),
+		Components: components,
+	}, nil
+}
+
 func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -94,14 +429,10 @@ func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, e
 		return nil, nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 	topicName := topicNames[0]
-	if !protocol.IsValidTopicName(topicName) {
-		return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
+	if err := s.ctx.nsqd.validateTopicName(topicName); err != nil {
+		return nil, nil, http_api.Err{400, "INVALID_TOPIC_" + protocol.NameErrorRule(err)}
 	}
 
-	// if !protocol.IsValidTopicName(topicName) {
-	// 	return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
-	// }
-
 	return reqParams, s.ctx.nsqd.GetTopic(topicName), nil
 }
 
@@ -112,7 +443,8 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.Req
 		return nil, nil, "", http_api.Err{400, "INVALID_REQUEST"}
 	}
 
-	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	opts := s.ctx.nsqd.getOpts()
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams, opts.topicNamePolicy, opts.channelNamePolicy)
 	if err != nil {
 		return nil, nil, "", http_api.Err{400, err.Error()}
 	}
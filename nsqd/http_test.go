@@ -0,0 +1,522 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"nsq-learn/internal/test"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 写入总是失败的持久化队列，用来模拟磁盘故障
+type errorBackendQueue struct {
+	dummyBackendQueue
+}
+
+func (d *errorBackendQueue) Put([]byte) error {
+	return errors.New("disk failure")
+}
+
+func httpAddr(n *NSQD) string {
+	return n.httpListener.Addr().String()
+}
+
+func httpPub(t *testing.T, n *NSQD, topicName string, body []byte) (int, string) {
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr(n), topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func httpPing(t *testing.T, n *NSQD) (int, string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/ping", httpAddr(n)))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestHTTPpub(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	code, body := httpPub(t, nsqd, "http_pub", []byte("test message"))
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "OK", body)
+
+	topic, err := nsqd.GetExistingTopic("http_pub")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), topic.Depth())
+
+	code, body = httpPub(t, nsqd, "http_pub", nil)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, body, "MSG_EMPTY")
+}
+
+func TestHTTPpubUnhealthy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// 内存队列为0，消息直接写到持久化队列
+	opts.MemQueueSize = 0
+	opts.MetadataPersistWindow = 10 * time.Millisecond
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	code, body := httpPing(t, nsqd)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "OK", body)
+
+	topic := nsqd.GetTopic("http_unhealthy")
+	backend := topic.backend
+	topic.backend = &errorBackendQueue{}
+
+	code, body = httpPub(t, nsqd, "http_unhealthy", []byte("test message"))
+	assert.Equal(t, 500, code)
+	assert.Contains(t, body, "E_PUT_FAILED")
+
+	code, body = httpPing(t, nsqd)
+	assert.Equal(t, 500, code)
+	assert.Equal(t, "NOK - disk failure", body)
+
+	// 磁盘恢复后先拒绝一段时间，之后放行的发布写入成功会恢复健康
+	// metadata持久化成功不会清除写持久化队列的错误
+	topic.backend = backend
+	code, _ = httpPub(t, nsqd, "http_unhealthy", []byte("test message"))
+	assert.Equal(t, 500, code)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, nsqd.isHealth())
+
+	assert.True(t, waitFor(2*backendRetryInterval, func() bool {
+		code, _ := httpPub(t, nsqd, "http_unhealthy", []byte("test message"))
+		return code == 200
+	}))
+	assert.True(t, nsqd.isHealth())
+	code, _ = httpPing(t, nsqd)
+	assert.Equal(t, 200, code)
+}
+
+func TestHTTPTopicConfig(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("config_test")
+	topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/topic/config?topic=config_test&ttl=30000", httpAddr(nsqd))
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, `{"ttl":30000,"retention":0}`, string(body))
+	assert.Equal(t, 30*time.Second, topic.TTL())
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=config_test&ttl=-1", httpAddr(nsqd))
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/topic/config?topic=missing", httpAddr(nsqd)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// TTL持久化在metadata里，重启后恢复
+	nsqd.Exit()
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err = nsqd.GetExistingTopic("config_test")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, topic.TTL())
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, int64(30*time.Second), channel.ttl)
+}
+
+func TestHTTPChannelConfig(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 3
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	nsqd.GetTopic("config_test").GetChannel("ch")
+	nsqd.GetTopic("config_test").GetChannel("unlimited")
+	nsqd.GetTopic("config_test").GetChannel("global")
+
+	url := fmt.Sprintf("http://%s/channel/config?topic=config_test&channel=ch&max_attempts=5", httpAddr(nsqd))
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, `{"max_attempts":5}`, string(body))
+
+	// 0表示不限制，-1表示使用全局配置
+	for _, kv := range [][2]string{{"unlimited", "0"}, {"global", "-1"}} {
+		url = fmt.Sprintf("http://%s/channel/config?topic=config_test&channel=%s&max_attempts=%s", httpAddr(nsqd), kv[0], kv[1])
+		resp, err = http.Post(url, "application/octet-stream", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	for _, ma := range []string{"x", "-2", "65536"} {
+		url = fmt.Sprintf("http://%s/channel/config?topic=config_test&channel=ch&max_attempts=%s", httpAddr(nsqd), ma)
+		resp, err = http.Post(url, "application/octet-stream", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode, ma)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/channel/config?topic=config_test&channel=missing", httpAddr(nsqd)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// 持久化在metadata里，重启后恢复
+	nsqd.Exit()
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err := nsqd.GetExistingTopic("config_test")
+	assert.Nil(t, err)
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(5), channel.MaxAttempts())
+	channel, err = topic.GetExistingChannel("unlimited")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), channel.MaxAttempts())
+	channel, err = topic.GetExistingChannel("global")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(3), channel.MaxAttempts())
+}
+
+func TestHTTPCreateFilteredChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	nsqd.GetTopic("filter_test")
+	post := func(query string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s/channel/create?%s", httpAddr(nsqd), query),
+			"application/octet-stream", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 200, post("topic=filter_test&channel=premium&filter=json:user.tier%3Dgold"))
+	assert.Equal(t, 409, post("topic=filter_test&channel=premium&filter=prefix:x"))
+	assert.Equal(t, 400, post("topic=filter_test&channel=bad&filter=bogus"))
+
+	// 过滤条件持久化在metadata里，重启后恢复
+	nsqd.Exit()
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err := nsqd.GetExistingTopic("filter_test")
+	assert.Nil(t, err)
+	channel, err := topic.GetExistingChannel("premium")
+	assert.Nil(t, err)
+	assert.Equal(t, "json:user.tier=gold", channel.FilterExpr())
+	_, err = topic.GetExistingChannel("bad")
+	assert.NotNil(t, err)
+}
+
+func TestHTTPCreateOrderedChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("ordered_test")
+	post := func(query string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s/channel/create?%s", httpAddr(nsqd), query),
+			"application/octet-stream", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 200, post("topic=ordered_test&channel=ch&ordered=true"))
+	assert.Equal(t, 409, post("topic=ordered_test&channel=ch"))
+	assert.Equal(t, 400, post("topic=ordered_test&channel=bad&ordered=maybe"))
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Nil(t, err)
+	for _, body := range []string{"1", "2"} {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body))))
+	}
+	// 投递中还没确认的队头消息在重启后仍然第一个投递
+	msg := <-channel.orderedMsgChan
+	assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+
+	nsqd.Exit()
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err = nsqd.GetExistingTopic("ordered_test")
+	assert.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	assert.Nil(t, err)
+	assert.True(t, channel.IsOrdered())
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 2 }))
+	assert.Equal(t, "1", string((<-channel.orderedMsgChan).Body))
+}
+
+func TestHTTPpubIdempotencyKey(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("dedupe_test")
+	channel := topic.GetChannel("ch")
+	pub := func(query string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=dedupe_test&%s", httpAddr(nsqd), query),
+			"application/octet-stream", strings.NewReader("test"))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// 重复发布同样返回成功，但只写入一次
+	assert.Equal(t, 200, pub("idempotency_key=order-1"))
+	assert.Equal(t, 200, pub("idempotency_key=order-1"))
+	assert.Equal(t, 200, pub("idempotency_key=order-2"))
+	assert.Equal(t, 400, pub("idempotency_key="))
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 2 }))
+}
+
+func TestHTTPRewindChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("rewind_test")
+	channel := topic.GetChannel("ch")
+	post := func(uri string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr(nsqd), uri), "application/octet-stream", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	since := time.Now().Add(-time.Minute).Unix()
+	rewind := fmt.Sprintf("/channel/rewind?topic=rewind_test&channel=ch&since=%d", since)
+	assert.Equal(t, 400, post(rewind))
+	assert.Equal(t, 200, post("/topic/config?topic=rewind_test&retention=3600000"))
+	assert.Equal(t, time.Hour, topic.Retention())
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 3 }))
+	// 模拟消息已经被消费
+	assert.Nil(t, channel.Empty())
+	assert.Equal(t, int64(0), channel.Depth())
+
+	assert.Equal(t, 200, post(rewind))
+	assert.Equal(t, int64(3), channel.Depth())
+	assert.Equal(t, 404, post(fmt.Sprintf("/channel/rewind?topic=rewind_test&channel=none&since=%d", since)))
+	assert.Equal(t, 400, post("/channel/rewind?topic=rewind_test&channel=ch&since=x"))
+
+	// since之后没有消息，channel里已有的消息不受影响
+	assert.Equal(t, 200, post(fmt.Sprintf("/channel/rewind?topic=rewind_test&channel=ch&since=%d", time.Now().Add(time.Minute).Unix())))
+	assert.Equal(t, int64(3), channel.Depth())
+
+	// 还没消费的消息不会跳过，再回退一次会重复投递
+	assert.Equal(t, 200, post(rewind))
+	assert.Equal(t, int64(6), channel.Depth())
+
+	// 顺序投递的channel不支持回退，是调用方的错误
+	_, err := topic.GetChannelWithOptions("ordered", ChannelOptions{Ordered: true})
+	assert.Nil(t, err)
+	resp, err := http.Post(fmt.Sprintf("http://%s/channel/rewind?topic=rewind_test&channel=ordered&since=%d", httpAddr(nsqd), since), "application/octet-stream", nil)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, string(body), "REWIND_ORDERED_UNSUPPORTED")
+}
+
+func TestHTTPNamePolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NameMaxLength = 20
+	opts.TopicNamePrefixes = []string{"team_a.", "team_b."}
+	opts.ReservedNamePrefixes = []string{"__internal"}
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	post := func(uri string) (int, string) {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr(nsqd), uri), "application/octet-stream", nil)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	for _, tc := range []struct {
+		uri  string
+		code int
+		text string
+	}{
+		{"/topic/create?topic=team_a.orders", 200, ""},
+		{"/topic/create?topic=team_a.x%23ephemeral", 200, ""},
+		{"/topic/create?topic=orders", 400, "INVALID_TOPIC_MISSING_PREFIX"},
+		{"/topic/create?topic=team_a.much_too_long_name", 400, "INVALID_TOPIC_TOO_LONG"},
+		{"/topic/create?topic=team_a.a%24b", 400, "INVALID_TOPIC_BAD_CHARSET"},
+		{"/topic/create?topic=__internal.x", 400, "INVALID_TOPIC_RESERVED"},
+		{"/topic/create?topic=", 400, "INVALID_TOPIC_EMPTY"},
+		{"/channel/create?topic=team_a.orders&channel=ch", 200, ""},
+		{"/channel/create?topic=team_a.orders&channel=__internal", 400, "INVALID_ARG_CHANNEL_RESERVED"},
+		{"/channel/create?topic=orders&channel=ch", 400, "INVALID_ARG_TOPIC_MISSING_PREFIX"},
+	} {
+		code, body := post(tc.uri)
+		assert.Equal(t, tc.code, code, tc.uri)
+		assert.Contains(t, body, tc.text, tc.uri)
+	}
+	_, err := nsqd.GetExistingTopic("orders")
+	assert.NotNil(t, err)
+}
+
+func TestHTTPLogLevel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	put := func(query string) (int, string) {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/config/log_level?%s", httpAddr(nsqd), query), nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	code, body := put("component=topic:orders&level=debug")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"level":"info","components":{"topic:orders":"debug"}}`, body)
+	code, body = put("level=warn")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"level":"warn","components":{"topic:orders":"debug"}}`, body)
+	code, body = put("component=topic:orders&level=default")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"level":"warn","components":{}}`, body)
+
+	code, _ = put("component=bogus&level=debug")
+	assert.Equal(t, 400, code)
+	code, _ = put("level=loud")
+	assert.Equal(t, 400, code)
+	code, _ = put("level=default")
+	assert.Equal(t, 400, code)
+	code, _ = put("")
+	assert.Equal(t, 400, code)
+}
+
+func TestHTTPAccessLog(t *testing.T) {
+	for _, format := range []string{"common", "combined", "json"} {
+		opts := NewOptions()
+		logger := new(captureLogger)
+		opts.Logger = logger
+		opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+		opts.AccessLogPath = filepath.Join(opts.DataPath, "access.log")
+		opts.AccessLogFormat = format
+		opts.AccessLogSampleRate = 0
+		nsqd := testStartNSQD(opts)
+
+		resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=access_test", httpAddr(nsqd)),
+			"application/octet-stream", strings.NewReader("test"))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		for i := 0; i < 10; i++ {
+			resp, err = http.Get(fmt.Sprintf("http://%s/ping", httpAddr(nsqd)))
+			assert.Nil(t, err)
+			resp.Body.Close()
+		}
+		nsqd.Exit()
+
+		data, err := ioutil.ReadFile(opts.AccessLogPath)
+		assert.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		// 采样比例为0，/ping不会记录
+		assert.Equal(t, 1, len(lines), format)
+		switch format {
+		case "json":
+			var entry map[string]interface{}
+			assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+			assert.Equal(t, "/pub?topic=access_test", entry["uri"])
+			assert.Equal(t, float64(200), entry["status"])
+			assert.Equal(t, float64(2), entry["bytes"])
+		case "combined":
+			assert.Contains(t, lines[0], `"POST /pub?topic=access_test HTTP/1.1" 200 2 "" "Go-http-client/1.1"`)
+		default:
+			assert.True(t, strings.HasSuffix(lines[0], `"POST /pub?topic=access_test HTTP/1.1" 200 2`), lines[0])
+		}
+		// 请求不再写到应用日志里
+		assert.False(t, logger.contains("POST /pub"))
+		os.RemoveAll(opts.DataPath)
+	}
+}
+
+func TestHTTPpubHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	pub := func(headers map[string]string) int {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/pub?topic=http_headers", httpAddr(nsqd)),
+			bytes.NewBufferString("test message"))
+		assert.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 200, pub(map[string]string{
+		"X-NSQ-Attr-Trace-Id":     "abc123",
+		"X-NSQ-Attr-Content-Type": "application/json",
+		"X-Other":                 "ignored",
+	}))
+	topic, err := nsqd.GetExistingTopic("http_headers")
+	assert.Nil(t, err)
+	msg := <-topic.memoryMsgChan
+	assert.Equal(t, map[string]string{"trace-id": "abc123", "content-type": "application/json"}, msg.Headers)
+
+	assert.Equal(t, 413, pub(map[string]string{"X-NSQ-Attr-Big": strings.Repeat("x", maxMsgHeaderSize)}))
+}
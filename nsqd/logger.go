@@ -1,6 +1,11 @@
 package nsqd
 
-import "nsq-learn/internal/lg"
+import (
+	"errors"
+	"fmt"
+	"nsq-learn/internal/lg"
+	"strings"
+)
 
 type Logger lg.Logger
 
@@ -12,11 +17,129 @@ const (
 	LOG_FATAL = lg.FATAL
 )
 
+// 可以单独设置日志等级的组件
+const (
+	logComponentHTTP        = "http"
+	logComponentTCP         = "tcp"
+	logComponentDiskQueue   = "diskqueue"
+	logComponentTopicPrefix = "topic:"
+)
+
+// 全局和各组件的日志等级，修改时整体替换
+type logLevels struct {
+	global     lg.LogLevel
+	components map[string]lg.LogLevel
+}
+
+// topic组件的名字按配置的topic名规则校验
+func (n *NSQD) isValidLogComponent(component string) bool {
+	switch component {
+	case logComponentHTTP, logComponentTCP, logComponentDiskQueue:
+		return true
+	}
+	return strings.HasPrefix(component, logComponentTopicPrefix) &&
+		n.validateTopicName(component[len(logComponentTopicPrefix):]) == nil
+}
+
+// 解析ComponentLogLevels配置，格式为 组件=等级,组件=等级
+func (n *NSQD) parseComponentLogLevels(str string) (map[string]lg.LogLevel, error) {
+	components := make(map[string]lg.LogLevel)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid component log level %q", item)
+		}
+		if !n.isValidLogComponent(kv[0]) {
+			return nil, fmt.Errorf("invalid log component %q", kv[0])
+		}
+		level, err := lg.ParseLogLevel(kv[1], false)
+		if err != nil {
+			return nil, err
+		}
+		components[kv[0]] = level
+	}
+	return components, nil
+}
+
+func (n *NSQD) getLogLevels() *logLevels {
+	return n.logLevels.Load().(*logLevels)
+}
+
+// 修改日志等级，component为空时修改全局等级，reset为true时删除组件的单独设置
+func (n *NSQD) setLogLevel(component string, level lg.LogLevel, reset bool) error {
+	if component != "" && !n.isValidLogComponent(component) {
+		return errors.New("invalid log component")
+	}
+	n.logLevelsMutex.Lock()
+	defer n.logLevelsMutex.Unlock()
+
+	old := n.getLogLevels()
+	levels := &logLevels{
+		global:     old.global,
+		components: make(map[string]lg.LogLevel, len(old.components)+1),
+	}
+	for k, v := range old.components {
+		levels.components[k] = v
+	}
+	switch {
+	case component == "":
+		levels.global = level
+	case reset:
+		delete(levels.components, component)
+	default:
+		levels.components[component] = level
+	}
+	n.logLevels.Store(levels)
+	return nil
+}
+
+// 按顺序查找组件的日志等级，都没有单独设置时使用全局等级
+func (n *NSQD) logLevelFor(components ...string) lg.LogLevel {
+	levels := n.getLogLevels()
+	for _, c := range components {
+		if level, ok := levels.components[c]; ok {
+			return level
+		}
+	}
+	return levels.global
+}
+
 func (n *NSQD) logf(level lg.LogLevel, f string, args ...interface{}) {
+	n.logfFor(nil, level, nil, f, args...)
+}
+
+// 带结构化字段输出日志，JSON格式时字段单独输出，见lg.LogfWithFields
+func (n *NSQD) logfWithFields(level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
+	n.logfFor(nil, level, fields, f, args...)
+}
+
+// 按组件的日志等级输出日志
+func (n *NSQD) logfFor(components []string, level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
 	opts := n.getOpts()
-	lg.Logf(opts.Logger, opts.logLevel, level, f, args...)
+	lg.LogfWithFields(opts.Logger, opts.logFormat, n.logLevelFor(components...), level, fields, f, args...)
 }
 
 func (n *NSQD) logln(level lg.LogLevel, args ...interface{}) {
 	n.logf(level, "%s\n", args...)
 }
+
+// topic相关的日志，带上topic字段
+func (t *Topic) logf(level lg.LogLevel, f string, args ...interface{}) {
+	t.ctx.nsqd.logfFor([]string{logComponentTopicPrefix + t.name}, level, lg.Fields{"topic": t.name}, f, args...)
+}
+
+// channel相关的日志，带上topic和channel字段，日志等级跟随topic
+func (c *Channel) logf(level lg.LogLevel, f string, args ...interface{}) {
+	c.ctx.nsqd.logfFor([]string{logComponentTopicPrefix + c.topicName}, level,
+		lg.Fields{"topic": c.topicName, "channel": c.name}, f, args...)
+}
+
+// 客户端连接相关的日志，带上client和remote_addr字段，使用tcp组件的日志等级
+func (c *clientV2) logf(level lg.LogLevel, f string, args ...interface{}) {
+	c.ctx.nsqd.logfFor([]string{logComponentTCP}, level,
+		lg.Fields{"client": c.ID, "remote_addr": c.RemoteAddr().String()}, f, args...)
+}
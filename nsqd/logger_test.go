@@ -0,0 +1,96 @@
+package nsqd
+
+import (
+	"nsq-learn/internal/lg"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type captureLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Output(maxdepth int, s string) error {
+	l.Lock()
+	l.lines = append(l.lines, s)
+	l.Unlock()
+	return nil
+}
+
+func (l *captureLogger) contains(substr string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParseComponentLogLevels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = new(captureLogger)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	components, err := nsqd.parseComponentLogLevels("http=warn, topic:orders=debug,")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]lg.LogLevel{"http": lg.WARN, "topic:orders": lg.DEBUG}, components)
+
+	for _, str := range []string{"http", "foo=debug", "http=loud", "topic:a$b=debug"} {
+		_, err = nsqd.parseComponentLogLevels(str)
+		assert.NotNil(t, err, str)
+	}
+}
+
+func TestComponentLogLevelsNamePolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = new(captureLogger)
+	opts.NameMaxLength = 20
+	opts.NameCharset = `^[a-z_.:]+$`
+	opts.TopicNamePrefixes = []string{"team_a."}
+	opts.ComponentLogLevels = "topic:team_a.a:b=debug"
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// topic组件按配置的名字规则校验，而不是默认规则
+	assert.Equal(t, lg.DEBUG, nsqd.logLevelFor("topic:team_a.a:b"))
+	assert.Nil(t, nsqd.setLogLevel("topic:team_a.orders", lg.DEBUG, false))
+	for _, component := range []string{"topic:orders", "topic:team_a.order_1", "topic:team_a.very.long.name"} {
+		assert.NotNil(t, nsqd.setLogLevel(component, lg.DEBUG, false), component)
+	}
+}
+
+func TestComponentLogLevels(t *testing.T) {
+	logger := new(captureLogger)
+	opts := NewOptions()
+	opts.Logger = logger
+	opts.LogLevel = "warn"
+	opts.ComponentLogLevels = "topic:debug_test=debug"
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// 只有单独设置了等级的topic输出INFO日志
+	nsqd.GetTopic("debug_test").GetChannel("ch")
+	nsqd.GetTopic("quiet_test").GetChannel("ch")
+	assert.True(t, logger.contains("TOPIC(debug_test): new channel(ch)"))
+	assert.False(t, logger.contains("TOPIC(quiet_test): new channel(ch)"))
+
+	assert.Equal(t, lg.DEBUG, nsqd.logLevelFor("topic:debug_test", logComponentDiskQueue))
+	assert.Nil(t, nsqd.setLogLevel(logComponentDiskQueue, lg.ERROR, false))
+	assert.Equal(t, lg.ERROR, nsqd.logLevelFor("topic:quiet_test", logComponentDiskQueue))
+	assert.Nil(t, nsqd.setLogLevel("topic:debug_test", 0, true))
+	assert.Equal(t, lg.ERROR, nsqd.logLevelFor("topic:debug_test", logComponentDiskQueue))
+	assert.Nil(t, nsqd.setLogLevel("", lg.INFO, false))
+	assert.Equal(t, lg.INFO, nsqd.logLevelFor(logComponentHTTP))
+	assert.NotNil(t, nsqd.setLogLevel("bogus", lg.INFO, false))
+}
@@ -0,0 +1,145 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// 队列满了，这个错误不代表磁盘有问题，不会影响nsqd的健康状态
+var ErrBackendFull = errors.New("backend queue full")
+
+// 纯内存的消息存储队列，用于测试和不需要持久化的topic，重启后数据会丢失
+type memoryBackendQueue struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	depth int64
+
+	sync.RWMutex
+	name     string
+	maxDepth int64
+	exitFlag int32
+
+	readChan          chan []byte
+	writeChan         chan []byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	exitChan          chan int
+	exitSyncChan      chan int
+}
+
+func newMemoryBackendQueue(name string, maxDepth int64) BackendQueue {
+	m := &memoryBackendQueue{
+		name:              name,
+		maxDepth:          maxDepth,
+		readChan:          make(chan []byte),
+		writeChan:         make(chan []byte),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+	}
+	go m.ioLoop()
+	return m
+}
+
+func (m *memoryBackendQueue) Put(data []byte) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	// 调用方会复用data的内存，这里需要复制一份
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	m.writeChan <- buf
+	return <-m.writeResponseChan
+}
+
+func (m *memoryBackendQueue) ReadChan() chan []byte {
+	return m.readChan
+}
+
+func (m *memoryBackendQueue) Close() error {
+	return m.exit()
+}
+
+func (m *memoryBackendQueue) Delete() error {
+	return m.exit()
+}
+
+func (m *memoryBackendQueue) exit() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	m.exitFlag = 1
+
+	close(m.exitChan)
+	<-m.exitSyncChan
+	return nil
+}
+
+func (m *memoryBackendQueue) Depth() int64 {
+	return atomic.LoadInt64(&m.depth)
+}
+
+// 清空队列
+func (m *memoryBackendQueue) Empty() error {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	m.emptyChan <- 1
+	return <-m.emptyResponseChan
+}
+
+// 队列的数据只在这个协程里访问，不需要加锁
+func (m *memoryBackendQueue) ioLoop() {
+	var queue [][]byte
+	var r chan []byte
+	var head []byte
+
+	for {
+		// 有数据的时候才往readChan里发
+		if len(queue) > 0 {
+			r = m.readChan
+			head = queue[0]
+		} else {
+			r = nil
+			head = nil
+		}
+
+		select {
+		case r <- head:
+			queue[0] = nil
+			queue = queue[1:]
+			atomic.AddInt64(&m.depth, -1)
+		case data := <-m.writeChan:
+			if int64(len(queue)) >= m.maxDepth {
+				m.writeResponseChan <- ErrBackendFull
+				continue
+			}
+			queue = append(queue, data)
+			atomic.AddInt64(&m.depth, 1)
+			m.writeResponseChan <- nil
+		case <-m.emptyChan:
+			queue = nil
+			atomic.StoreInt64(&m.depth, 0)
+			m.emptyResponseChan <- nil
+		case <-m.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	m.exitSyncChan <- 1
+}
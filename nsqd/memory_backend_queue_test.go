@@ -0,0 +1,60 @@
+package nsqd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackendQueue(t *testing.T) {
+	bq := newMemoryBackendQueue("test", 10)
+	defer bq.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, bq.Put([]byte(fmt.Sprintf("msg%d", i))))
+	}
+	assert.Equal(t, int64(5), bq.Depth())
+
+	// 按写入顺序读出
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("msg%d", i)), <-bq.ReadChan())
+	}
+	assert.Equal(t, int64(2), bq.Depth())
+
+	assert.Nil(t, bq.Empty())
+	assert.Equal(t, int64(0), bq.Depth())
+	select {
+	case <-bq.ReadChan():
+		t.Fatal("empty queue should not be readable")
+	default:
+	}
+}
+
+func TestMemoryBackendQueueFull(t *testing.T) {
+	bq := newMemoryBackendQueue("test", 2)
+	defer bq.Close()
+
+	assert.Nil(t, bq.Put([]byte("msg0")))
+	assert.Nil(t, bq.Put([]byte("msg1")))
+	assert.Equal(t, ErrBackendFull, bq.Put([]byte("msg2")))
+	assert.Equal(t, int64(2), bq.Depth())
+}
+
+func TestMemoryBackendQueueCopiesData(t *testing.T) {
+	bq := newMemoryBackendQueue("test", 10)
+	defer bq.Close()
+
+	buf := []byte("msg0")
+	assert.Nil(t, bq.Put(buf))
+	buf[0] = 'x'
+	assert.Equal(t, []byte("msg0"), <-bq.ReadChan())
+}
+
+func TestMemoryBackendQueueDelete(t *testing.T) {
+	bq := newMemoryBackendQueue("test", 10)
+	assert.Nil(t, bq.Put([]byte("msg0")))
+	assert.Nil(t, bq.Delete())
+	assert.NotNil(t, bq.Put([]byte("msg1")))
+	assert.NotNil(t, bq.Close())
+}
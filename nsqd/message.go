@@ -1,7 +1,217 @@
 package nsqd
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
 const (
 	MsgIDLength = 16
 	// 最小的消息合法长度
 	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
+
+	// Attempts字段的最高位表示消息带有header块，旧格式的消息这一位都是0
+	msgFlagHeaders   = uint16(0x8000)
+	msgAttemptsMask  = ^msgFlagHeaders
+	maxMsgHeaderSize = 4096 // header块（含2字节长度）的最大长度
 )
+
+var errHeadersTooLarge = errors.New("message headers too large")
+
+// 检查header能否编码，发布时调用，避免写入时才失败
+func validateHeaders(headers map[string]string) error {
+	for k := range headers {
+		if k == "" {
+			return errors.New("empty message header key")
+		}
+	}
+	_, err := encodeHeaders(headers)
+	return err
+}
+
+type MessageID [MsgIDLength]byte
+
+type Message struct {
+	ID        MessageID
+	Body      []byte
+	Timestamp int64
+	Attempts  uint16
+	// 可选的key/value属性
+	Headers map[string]string
+
+	// 以下字段只在内存中使用，不会写到磁盘上
+	deliveryTS time.Time
+	clientID   int64
+	// 优先队列中的优先级（in-flight为超时时间，deferred为到期时间）和下标
+	pri   int64
+	index int
+	// 延时投递的时长
+	deferred time.Duration
+}
+
+func NewMessage(id MessageID, body []byte) *Message {
+	return &Message{
+		ID:        id,
+		Body:      body,
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+// 消息的二进制格式:
+// [8-byte 时间戳(纳秒)][2-byte 尝试次数][16-byte 消息ID(十六进制ASCII)][header块(可选)][N-byte 消息体]
+// 有header时尝试次数的最高位为1，header块的格式:
+// [2-byte 长度][2-byte key长度][key][2-byte value长度][value]...
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return m.writeTo(w, true)
+}
+
+// withHeaders为false时不写header块，格式和旧版本完全一样，给没有在IDENTIFY时声明支持header的客户端使用
+func (m *Message) writeTo(w io.Writer, withHeaders bool) (int64, error) {
+	var buf [10]byte
+	var total int64
+
+	var hdrs []byte
+	attempts := m.Attempts & msgAttemptsMask
+	if withHeaders && len(m.Headers) > 0 {
+		var err error
+		hdrs, err = encodeHeaders(m.Headers)
+		if err != nil {
+			return 0, err
+		}
+		attempts |= msgFlagHeaders
+	}
+
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint16(buf[8:10], attempts)
+
+	n, err := w.Write(buf[:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(m.ID[:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	if hdrs != nil {
+		n, err = w.Write(hdrs)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(m.Body)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
+// 将二进制数据解析成消息
+func decodeMessage(b []byte) (*Message, error) {
+	var msg Message
+
+	if len(b) < minValidMsgLength {
+		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+	}
+
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	attempts := binary.BigEndian.Uint16(b[8:10])
+	msg.Attempts = attempts & msgAttemptsMask
+	copy(msg.ID[:], b[10:10+MsgIDLength])
+	msg.Body = b[10+MsgIDLength:]
+
+	if attempts&msgFlagHeaders != 0 {
+		headers, n, err := decodeHeaders(msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		msg.Headers = headers
+		msg.Body = msg.Body[n:]
+	}
+
+	return &msg, nil
+}
+
+// 按key排序编码header块，保证同样的header编码结果一样
+func encodeHeaders(headers map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	size := 2
+	for _, k := range keys {
+		size += 2 + len(k) + 2 + len(headers[k])
+	}
+	if size > maxMsgHeaderSize {
+		return nil, errHeadersTooLarge
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	var l [2]byte
+	writeString := func(str string) {
+		binary.BigEndian.PutUint16(l[:], uint16(len(str)))
+		buf.Write(l[:])
+		buf.WriteString(str)
+	}
+	binary.BigEndian.PutUint16(l[:], uint16(size-2))
+	buf.Write(l[:])
+	for _, k := range keys {
+		writeString(k)
+		writeString(headers[k])
+	}
+	return buf.Bytes(), nil
+}
+
+// 解析header块，返回header和header块占用的字节数
+func decodeHeaders(b []byte) (map[string]string, int, error) {
+	if len(b) < 2 {
+		return nil, 0, errors.New("invalid message header block")
+	}
+	size := int(binary.BigEndian.Uint16(b[:2]))
+	if len(b) < 2+size {
+		return nil, 0, fmt.Errorf("invalid message header block size (%d)", size)
+	}
+
+	headers := make(map[string]string)
+	p := b[2 : 2+size]
+	for len(p) > 0 {
+		var kv [2]string
+		for i := range kv {
+			if len(p) < 2 {
+				return nil, 0, errors.New("invalid message header block")
+			}
+			l := int(binary.BigEndian.Uint16(p[:2]))
+			if len(p) < 2+l {
+				return nil, 0, errors.New("invalid message header block")
+			}
+			kv[i] = string(p[2 : 2+l])
+			p = p[2+l:]
+		}
+		headers[kv[0]] = kv[1]
+	}
+	return headers, 2 + size, nil
+}
+
+// 将消息序列化后写入持久化队列
+func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue) error {
+	buf.Reset()
+	_, err := msg.WriteTo(buf)
+	if err != nil {
+		return err
+	}
+	return bq.Put(buf.Bytes())
+}
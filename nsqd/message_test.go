@@ -0,0 +1,84 @@
+package nsqd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHeadersRoundTrip(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := NewMessage(id, []byte("body"))
+	msg.Attempts = 3
+	msg.Headers = map[string]string{"trace-id": "abc", "content-type": "text/plain"}
+
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	assert.Nil(t, err)
+
+	decoded, err := decodeMessage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ID, decoded.ID)
+	assert.Equal(t, msg.Timestamp, decoded.Timestamp)
+	assert.Equal(t, uint16(3), decoded.Attempts)
+	assert.Equal(t, msg.Headers, decoded.Headers)
+	assert.Equal(t, []byte("body"), decoded.Body)
+}
+
+func TestMessageWithoutHeaders(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := NewMessage(id, []byte("body"))
+	msg.Attempts = 1
+
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	assert.Nil(t, err)
+	// 没有header时和旧格式完全一样
+	assert.Equal(t, minValidMsgLength+4, buf.Len())
+
+	decoded, err := decodeMessage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Nil(t, decoded.Headers)
+	assert.Equal(t, uint16(1), decoded.Attempts)
+	assert.Equal(t, []byte("body"), decoded.Body)
+}
+
+func TestMessageHeadersInvalid(t *testing.T) {
+	var id MessageID
+	msg := NewMessage(id, []byte("body"))
+	msg.Headers = map[string]string{"big": strings.Repeat("x", maxMsgHeaderSize)}
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	assert.Equal(t, errHeadersTooLarge, err)
+
+	// header块长度超过数据长度
+	msg.Headers = map[string]string{"k": "v"}
+	buf.Reset()
+	_, err = msg.WriteTo(&buf)
+	assert.Nil(t, err)
+	_, err = decodeMessage(buf.Bytes()[:minValidMsgLength+3])
+	assert.NotNil(t, err)
+}
+
+func TestMessageWriteWithoutHeaders(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := NewMessage(id, []byte("body"))
+	msg.Attempts = 2
+	msg.Headers = map[string]string{"trace-id": "abc"}
+
+	// 不支持header的客户端收到的还是旧格式
+	var buf bytes.Buffer
+	_, err := msg.writeTo(&buf, false)
+	assert.Nil(t, err)
+	assert.Equal(t, minValidMsgLength+4, buf.Len())
+	decoded, err := decodeMessage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Nil(t, decoded.Headers)
+	assert.Equal(t, uint16(2), decoded.Attempts)
+	assert.Equal(t, []byte("body"), decoded.Body)
+}
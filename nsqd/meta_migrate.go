@@ -0,0 +1,105 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// nsqd.dat当前的格式版本，格式有变化时加一，并在metadataMigrations里加上从上一个版本升级的方法
+const metadataSchemaVersion = 7
+
+// 升级方法，key为升级前的版本，每个方法只负责升级一个版本
+var metadataMigrations = map[int]func(js map[string]interface{}) error{
+	1: migrateMetadataV1,
+	// 版本3: topic加上ttl
+	2: migrateMetadataOptionalFields,
+	// 版本4: channel加上max_attempts
+	3: migrateMetadataOptionalFields,
+	// 版本5: channel加上filter
+	4: migrateMetadataOptionalFields,
+	// 版本6: channel加上ordered
+	5: migrateMetadataOptionalFields,
+	// 版本7: topic加上retention
+	6: migrateMetadataOptionalFields,
+}
+
+// 官方早期版本的metadata文件名带有nsqd的ID
+func oldMetadataFile(opts *Options) string {
+	return path.Join(opts.DataPath, fmt.Sprintf("nsqd.%d.dat", opts.ID))
+}
+
+// 解析metadata，旧版本的格式会依次执行升级方法，比当前支持的版本新则报错
+func decodeMetadata(data []byte) (*meta, error) {
+	var js map[string]interface{}
+	err := json.Unmarshal(data, &js)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有schema_version字段的是版本1（包括官方的nsqd.dat格式）
+	schemaVersion := 1
+	if v, ok := js["schema_version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 {
+			return nil, fmt.Errorf("invalid schema_version %v", v)
+		}
+		schemaVersion = int(f)
+	}
+	if schemaVersion > metadataSchemaVersion {
+		return nil, fmt.Errorf("schema_version %d is newer than supported version %d (written by nsqd %v)",
+			schemaVersion, metadataSchemaVersion, js["version"])
+	}
+
+	for v := schemaVersion; v < metadataSchemaVersion; v++ {
+		migrate, ok := metadataMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from schema_version %d", v)
+		}
+		err = migrate(js)
+		if err != nil {
+			return nil, fmt.Errorf("migration from schema_version %d failed - %s", v, err)
+		}
+		js["schema_version"] = v + 1
+	}
+
+	data, err = json.Marshal(js)
+	if err != nil {
+		return nil, err
+	}
+	var m meta
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// 版本1 -> 2: 加上schema_version，topic没有channels字段时补上空列表
+func migrateMetadataV1(js map[string]interface{}) error {
+	topics, ok := js["topics"]
+	if !ok || topics == nil {
+		js["topics"] = []interface{}{}
+		return nil
+	}
+	list, ok := topics.([]interface{})
+	if !ok {
+		return fmt.Errorf("topics is %T, expected list", topics)
+	}
+	for _, t := range list {
+		topic, ok := t.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("topic is %T, expected object", t)
+		}
+		if topic["channels"] == nil {
+			topic["channels"] = []interface{}{}
+		}
+	}
+	return nil
+}
+
+// 新版本只加了可选字段，旧文件里没有这些字段时按默认值处理，不需要修改
+// 版本号仍然要加一，旧版本的nsqd读到新文件时报错，而不是丢掉不认识的字段
+func migrateMetadataOptionalFields(js map[string]interface{}) error {
+	return nil
+}
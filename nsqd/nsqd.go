@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"compress/flate"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,14 +17,30 @@ import (
 	"nsq-learn/internal/version"
 	"os"
 	"path"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// nsqd正在退出
+var errExiting = errors.New("exiting")
+
 type NSQD struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	// 最后一次成功持久化metadata的时间（unix秒）
+	lastPersisted int64
+	// 成功写入metadata的次数
+	persistCount int64
+	// 最近一次统计的DataPath磁盘用量
+	dataPathBytes int64
+	// 分配TCP客户端ID
+	clientIDSequence int64
+
 	startTime    time.Time
+	tcpListener  net.Listener
 	httpListener net.Listener
+	tcpServer    *tcpServer
 	// 配置项
 	opts atomic.Value
 	// 路径锁
@@ -33,9 +50,23 @@ type NSQD struct {
 	topicMap map[string]*Topic
 	// 是否在load metadata, 使用int32的原因是为了方便做原子操作
 	isLoading int32
+	// 是否正在退出，在Exit持有写锁时设置，之后不再创建新的topic
+	isExiting int32
 	// 退出chan
 	exitChan   chan int
 	notifyChan chan interface{}
+	// 通知persistLoop持久化metadata
+	persistChan chan int
+	// 各来源最近一次的错误，用来判断nsqd是否健康
+	errValues [numHealthSources]atomic.Value
+	// 磁盘数据的加密密钥，没有配置EncryptionKeyFile时为nil
+	keyring *keyring
+	// 全局和各组件的日志等级（*logLevels），运行时可以修改
+	logLevels      atomic.Value
+	logLevelsMutex sync.Mutex
+	// HTTP访问日志，没有配置AccessLogPath时为nil
+	accessLog     *http_api.AccessLogger
+	accessLogFile *os.File
 	sync.RWMutex
 }
 
@@ -47,14 +78,25 @@ func New(opts *Options) *NSQD {
 		dataPath = cwd
 	}
 	n := &NSQD{
-		startTime: time.Now(),
-		dl:        dirlock.New(dataPath),
-		topicMap:  make(map[string]*Topic),
-		exitChan:  make(chan int),
+		startTime:   time.Now(),
+		dl:          dirlock.New(dataPath),
+		topicMap:    make(map[string]*Topic),
+		exitChan:    make(chan int),
+		persistChan: make(chan int, 1),
+	}
+	for i := range n.errValues {
+		n.errValues[i].Store(errStore{})
 	}
+	n.logLevels.Store(&logLevels{})
 	// 初始化logger
+	logFormat, logFormatErr := lg.ParseLogFormat(opts.LogFormat)
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		if logFormat == lg.JSON {
+			// JSON格式的日志自带时间，不需要log包的前缀
+			opts.Logger = log.New(os.Stderr, "", 0)
+		} else {
+			opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		}
 	}
 	// 将opts存入（首先将默认值存到原子值里）
 	n.swapOpts(opts)
@@ -66,12 +108,108 @@ func New(opts *Options) *NSQD {
 		n.logf(LOG_FATAL, "%s", err)
 		os.Exit(1)
 	}
+	opts.logFormat = logFormat
+	if logFormatErr != nil {
+		n.logf(LOG_FATAL, "%s", logFormatErr)
+		os.Exit(1)
+	}
+	// 组件的日志等级要用topic名规则校验，等规则生成之后再解析
+	n.logLevels.Store(&logLevels{global: opts.logLevel})
+	if opts.BackendType != BackendTypeDiskQueue && opts.BackendType != BackendTypeSegment {
+		n.logf(LOG_FATAL, "invalid --backend-type=%s", opts.BackendType)
+		os.Exit(1)
+	}
+	// 编译只使用内存队列的topic名正则
+	if opts.MemOnlyTopics != "" {
+		opts.memOnlyTopicsRegex, err = regexp.Compile(opts.MemOnlyTopics)
+		if err != nil {
+			n.logf(LOG_FATAL, "invalid --mem-only-topics=%s - %s", opts.MemOnlyTopics, err)
+			os.Exit(1)
+		}
+	}
+	// 编译需要压缩的topic名正则
+	if opts.CompressTopics != "" {
+		opts.compressTopicsRegex, err = regexp.Compile(opts.CompressTopics)
+		if err != nil {
+			n.logf(LOG_FATAL, "invalid --compress-topics=%s - %s", opts.CompressTopics, err)
+			os.Exit(1)
+		}
+	}
+	if opts.CompressionLevel < flate.HuffmanOnly || opts.CompressionLevel > flate.BestCompression {
+		n.logf(LOG_FATAL, "invalid --compression-level=%d", opts.CompressionLevel)
+		os.Exit(1)
+	}
 	// 锁定目录, 最简单的例子，如果再有nsqd启动目录设置为这个目录就会报错
 	err = n.dl.Lock()
 	if err != nil {
 		n.logf(LOG_FATAL, "--data-path=%s in use (possibly by another instance of nsqd)", dataPath)
 		os.Exit(1)
 	}
+	// 编译超过配额时丢弃数据的topic名正则，只有segment队列能丢弃最旧的数据
+	if opts.QuotaDropTopics != "" {
+		if opts.BackendType != BackendTypeSegment {
+			n.logf(LOG_FATAL, "--quota-drop-topics requires --backend-type=%s", BackendTypeSegment)
+			os.Exit(1)
+		}
+		opts.quotaDropTopicsRegex, err = regexp.Compile(opts.QuotaDropTopics)
+		if err != nil {
+			n.logf(LOG_FATAL, "invalid --quota-drop-topics=%s - %s", opts.QuotaDropTopics, err)
+			os.Exit(1)
+		}
+	}
+	// 生成topic和channel名的校验规则
+	nameCharsetRegex, err := regexp.Compile(opts.NameCharset)
+	if err != nil {
+		n.logf(LOG_FATAL, "invalid --name-charset=%s - %s", opts.NameCharset, err)
+		os.Exit(1)
+	}
+	if opts.NameMaxLength < 1 {
+		n.logf(LOG_FATAL, "invalid --name-max-length=%d", opts.NameMaxLength)
+		os.Exit(1)
+	}
+	opts.topicNamePolicy = &protocol.NamePolicy{
+		MaxLength:        opts.NameMaxLength,
+		Charset:          nameCharsetRegex,
+		RequiredPrefixes: opts.TopicNamePrefixes,
+		ReservedPrefixes: opts.ReservedNamePrefixes,
+	}
+	opts.channelNamePolicy = &protocol.NamePolicy{
+		MaxLength:        opts.NameMaxLength,
+		Charset:          nameCharsetRegex,
+		ReservedPrefixes: opts.ReservedNamePrefixes,
+	}
+	components, err := n.parseComponentLogLevels(opts.ComponentLogLevels)
+	if err != nil {
+		n.logf(LOG_FATAL, "invalid --component-log-levels=%s - %s", opts.ComponentLogLevels, err)
+		os.Exit(1)
+	}
+	n.logLevels.Store(&logLevels{global: opts.logLevel, components: components})
+	if opts.AccessLogPath != "" {
+		n.accessLogFile, err = os.OpenFile(opts.AccessLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			n.logf(LOG_FATAL, "failed to open --access-log-path=%s - %s", opts.AccessLogPath, err)
+			os.Exit(1)
+		}
+		n.accessLog, err = http_api.NewAccessLogger(n.accessLogFile, opts.AccessLogFormat,
+			opts.AccessLogSamplePaths, opts.AccessLogSampleRate)
+		if err != nil {
+			n.logf(LOG_FATAL, "%s", err)
+			os.Exit(1)
+		}
+	}
+	if opts.EncryptionKeyFile != "" {
+		n.keyring, err = loadKeyring(opts.EncryptionKeyFile)
+		if err != nil {
+			n.logf(LOG_FATAL, "failed to load --encryption-key-file - %s", err)
+			os.Exit(1)
+		}
+	}
+	// 已经加密的数据必须有对应的密钥，否则启动后消息都读不出来
+	err = checkEncryptionKeys(dataPath, n.keyring)
+	if err != nil {
+		n.logf(LOG_FATAL, "%s", err)
+		os.Exit(1)
+	}
 	n.logf(LOG_INFO, version.String("nsqd"))
 	n.logf(LOG_INFO, "ID: %d", opts.ID)
 	return n
@@ -80,6 +218,11 @@ func New(opts *Options) *NSQD {
 func (n *NSQD) Main() {
 	var err error
 	ctx := &context{n}
+	n.tcpListener, err = net.Listen("tcp", n.getOpts().TCPAddress)
+	if err != nil {
+		n.logf(LOG_FATAL, "listen tcp (%s) failed - %s", n.getOpts().TCPAddress, err)
+		os.Exit(1)
+	}
 	n.httpListener, err = net.Listen("tcp", n.getOpts().HTTPAddress)
 	if err != nil {
 		n.logf(LOG_FATAL, "listen http (%s) failed - %s", n.getOpts().HTTPAddress, err)
@@ -91,6 +234,29 @@ func (n *NSQD) Main() {
 	n.waitGroup.Wrap(func() {
 		http_api.Serve(n.httpListener, httpServer, "HTTP", n.logf)
 	})
+	// tcp server，客户端的日志使用tcp组件的日志等级
+	n.tcpServer = &tcpServer{ctx: ctx}
+	n.waitGroup.Wrap(func() {
+		protocol.TCPServer(n.tcpListener, n.tcpServer, n.tcpServer.logf)
+	})
+	// 处理in-flight超时和延时消息
+	n.waitGroup.Wrap(n.queueScanLoop)
+	// 合并持久化metadata
+	n.waitGroup.Wrap(n.persistLoop)
+	// 配置了配额时统计磁盘用量，执行配额
+	if n.getOpts().MaxTopicBackendBytes > 0 || n.getOpts().MaxDataPathBytes > 0 {
+		n.waitGroup.Wrap(n.quotaLoop)
+	}
+}
+
+// 实际监听的TCP地址，配置的端口为0时由系统分配
+func (n *NSQD) RealTCPAddr() *net.TCPAddr {
+	return n.tcpListener.Addr().(*net.TCPAddr)
+}
+
+// 实际监听的HTTP地址
+func (n *NSQD) RealHTTPAddr() *net.TCPAddr {
+	return n.httpListener.Addr().(*net.TCPAddr)
 }
 
 func (n *NSQD) swapOpts(opts *Options) {
@@ -101,32 +267,98 @@ func (n *NSQD) getOpts() *Options {
 	return n.opts.Load().(*Options)
 }
 
+// 影响健康状态的错误来源，每个来源只能清除自己的错误
+type healthSource int
+
+const (
+	healthBackend  healthSource = iota // 写持久化队列
+	healthMetadata                     // 持久化metadata
+	numHealthSources
+)
+
+// 写持久化队列失败后拒绝发布的时间，过了这个时间放行发布来重试写入
+const backendRetryInterval = time.Second
+
+// atomic.Value不能存nil，包一层
+type errStore struct {
+	err error
+	ts  time.Time
+}
+
+// 记录来源最近一次操作的结果，err为nil时这个来源恢复为健康
+func (n *NSQD) setHealth(src healthSource, err error) {
+	n.errValues[src].Store(errStore{err: err, ts: time.Now()})
+}
+
+// 操作成功后清除来源自己的错误，已经是健康的就不重复写
+func (n *NSQD) clearHealth(src healthSource) {
+	if n.errValues[src].Load().(errStore).err != nil {
+		n.setHealth(src, nil)
+	}
+}
+
+// 返回第一个不健康来源的错误
+func (n *NSQD) getError() error {
+	for i := range n.errValues {
+		if err := n.errValues[i].Load().(errStore).err; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 是否拒绝发布：metadata写不进去时一直拒绝，同时触发一次持久化来探测磁盘；
+// 写持久化队列失败后拒绝backendRetryInterval，之后放行发布重试写入，写入成功后恢复健康
+func (n *NSQD) rejectPublish(topic *Topic) bool {
+	if n.errValues[healthMetadata].Load().(errStore).err != nil {
+		n.Notify(topic)
+		return true
+	}
+	es := n.errValues[healthBackend].Load().(errStore)
+	return es.err != nil && time.Since(es.ts) < backendRetryInterval
+}
+
 // 获取nsqd进程的健康状况
 func (n *NSQD) getHealth() string {
+	err := n.getError()
+	if err != nil {
+		return fmt.Sprintf("NOK - %s", err)
+	}
 	return "OK"
 }
 
 // 判断nsqd是否健康
 func (n *NSQD) isHealth() bool {
-	return true
+	return n.getError() == nil
 }
 
 // 获取topic，如果没有就创建(线程安全)
 func (n *NSQD) GetTopic(topicName string) *Topic {
+	t, _ := n.getTopic(topicName, false)
+	return t
+}
+
+// failIfExiting为true时，nsqd退出过程中不再创建新的topic，返回errExiting
+// 死信这类nsqd内部的发布使用，Exit已经关闭了所有topic，新创建的topic不会被关闭
+func (n *NSQD) getTopic(topicName string, failIfExiting bool) (*Topic, error) {
 	// 最好的情况，是已经存在，那么添加读锁
 	n.RLock()
 	t, ok := n.topicMap[topicName]
 	n.RUnlock()
 	if ok {
-		return t
+		return t, nil
 	}
 	// 如果没有就创建一个新的topic，添加写锁
 	n.Lock()
 	// 防止并发的情况下，上一个写锁已经成功写入
 	t, ok = n.topicMap[topicName]
 	if ok {
-		n.Lock()
-		return t
+		n.Unlock()
+		return t, nil
+	}
+	if failIfExiting && atomic.LoadInt32(&n.isExiting) == 1 {
+		n.Unlock()
+		return nil, errExiting
 	}
 	// 暂时为无效的
 	deleteCallback := func(t *Topic) {
@@ -141,11 +373,21 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 
 	// 如果正在loading则就不在继续，暂不明意思，待后续处理
 	if atomic.LoadInt32(&n.isLoading) == 1 {
-		return t
+		return t, nil
 	}
 	// TODO: 这里有lookup相关逻辑，先不处理
 	t.Start()
-	return t
+	return t, nil
+}
+
+// 按配置的规则检查topic名，创建topic（GetTopic）之前调用，不合法时返回*protocol.NameError
+func (n *NSQD) validateTopicName(name string) error {
+	return n.getOpts().topicNamePolicy.Validate(name)
+}
+
+// 按配置的规则检查channel名，创建channel之前调用
+func (n *NSQD) validateChannelName(name string) error {
+	return n.getOpts().channelNamePolicy.Validate(name)
 }
 
 // 获取已经存在的topic
@@ -160,28 +402,50 @@ func (n *NSQD) GetExistingTopic(topicName string) (*Topic, error) {
 }
 
 // 触发这个方法，将会持久化metadata(包括channel和topic等数据)
+// 这里只是发一个信号，真正的持久化由persistLoop合并后执行，避免每次创建topic/channel都写一次磁盘
 func (n *NSQD) Notify(v interface{}) {
 	// 判断是否处于loading状态，如果处于loading状态，那么，不用该进行presist metadata
-	persist := atomic.LoadInt32(&n.isLoading) == 0
-	n.waitGroup.Wrap(func() {
+	if atomic.LoadInt32(&n.isLoading) == 1 {
+		return
+	}
+	// persistChan有一个缓冲，已经有信号在等待处理时直接丢弃
+	select {
+	case n.persistChan <- 1:
+	default:
+	}
+}
+
+// 持久化协程，收到第一个通知后等待MetadataPersistWindow，期间的通知合并成一次写入
+func (n *NSQD) persistLoop() {
+	var windowChan <-chan time.Time
+	for {
 		select {
-		// 这里使用exitchan的原因是，原本下面的default是给nsqlookup发消息的通道，会有阻塞的情况，这里去监听exitchan的目的是，假如下面的操作已经在执行了，那么这里的操作不会触发，等下面操作结束后结束这个协程，如果，下面的操作还在阻塞，那么将触发这个选项，结束等待nsqlookup的通信。nsqlookup会在后面实现
-		case <-n.exitChan:
-		// 这个通知与nsqdlookup相关,由于暂时不涉及lookup相关，先使用default
-		// case n.notifyChan <- v:
-		default:
-			if !persist {
-				return
+		case <-n.persistChan:
+			if windowChan == nil {
+				windowChan = time.After(n.getOpts().MetadataPersistWindow)
 			}
+		case <-windowChan:
+			windowChan = nil
 			n.Lock()
-			// 保存元数据
 			err := n.PersistMetadata()
+			n.Unlock()
 			if err != nil {
 				n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
 			}
-			n.Unlock()
+			// 持久化失败时nsqd标记为不健康，下次持久化成功后恢复
+			if err != nil {
+				n.setHealth(healthMetadata, err)
+			} else {
+				n.clearHealth(healthMetadata)
+			}
+		case <-n.exitChan:
+			// Exit时会再持久化一次，这里直接退出
+			goto exit
 		}
-	})
+	}
+
+exit:
+	n.logf(LOG_INFO, "PERSIST: closing")
 }
 
 // 持久化topic和channel等信息，以便重启后能恢复数据
@@ -200,6 +464,13 @@ func (n *NSQD) PersistMetadata() error {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		// 没有设置的配置项不写，保持和旧版本的格式一致
+		if ttl := topic.TTL(); ttl > 0 {
+			topicData["ttl"] = int64(ttl / time.Millisecond)
+		}
+		if retention := topic.Retention(); retention > 0 {
+			topicData["retention"] = int64(retention / time.Millisecond)
+		}
 		channels := []interface{}{}
 		// channel持久化
 		topic.Lock()
@@ -212,6 +483,15 @@ func (n *NSQD) PersistMetadata() error {
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if expr := channel.FilterExpr(); expr != "" {
+				channelData["filter"] = expr
+			}
+			if n := atomic.LoadInt32(&channel.maxAttempts); n != maxAttemptsInherit {
+				channelData["max_attempts"] = n
+			}
+			if channel.IsOrdered() {
+				channelData["ordered"] = true
+			}
 			channels = append(channels, channelData)
 			channel.Unlock()
 		}
@@ -220,6 +500,7 @@ func (n *NSQD) PersistMetadata() error {
 		topics = append(topics, topicData)
 	}
 	js["version"] = version.Binary
+	js["schema_version"] = metadataSchemaVersion
 	js["topics"] = topics
 	// 进行json序列化
 	data, err := json.Marshal(&js)
@@ -231,11 +512,21 @@ func (n *NSQD) PersistMetadata() error {
 	//先创建一个临时文件
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 	err = writeSyncFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+	// 更名前先把上一个版本备份为nsqd.dat.bak，新文件有问题时可以手动恢复
+	err = backupMetadataFile(fileName)
+	if err != nil {
+		return err
+	}
 	// 更名
 	err = os.Rename(tmpFileName, fileName)
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt64(&n.lastPersisted, time.Now().Unix())
+	atomic.AddInt64(&n.persistCount, 1)
 	return nil
 }
 
@@ -255,6 +546,18 @@ func writeSyncFile(fn string, data []byte) error {
 	return err
 }
 
+// 将现有的metadata文件复制一份为.bak，文件不存在时什么都不做
+func backupMetadataFile(fn string) error {
+	data, err := readOrEmpty(fn)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	return writeSyncFile(fn+".bak", data)
+}
+
 // 返回存储metadata file的文件路劲，存在当前datapath目录下的
 func newMetadataFile(opts *Options) string {
 	return path.Join(opts.DataPath, "nsqd.dat")
@@ -273,12 +576,19 @@ func readOrEmpty(fn string) ([]byte, error) {
 }
 
 type meta struct {
-	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
+	Version       string `json:"version"`
+	SchemaVersion int    `json:"schema_version"`
+	Topics        []struct {
+		Name      string `json:"name"`
+		Paused    bool   `json:"paused"`
+		TTL       int64  `json:"ttl,omitempty"`       // 毫秒
+		Retention int64  `json:"retention,omitempty"` // 毫秒
+		Channels  []struct {
+			Name        string `json:"name"`
+			Paused      bool   `json:"paused"`
+			MaxAttempts *int32 `json:"max_attempts,omitempty"` // 没有时使用全局配置
+			Filter      string `json:"filter,omitempty"`
+			Ordered     bool   `json:"ordered,omitempty"`
 		} `json:"channels"`
 	} `json:"topics"`
 }
@@ -295,20 +605,31 @@ func (n *NSQD) LoadMetadata() error {
 	if err != nil {
 		return err
 	}
+	// 没有nsqd.dat时尝试读取官方早期版本的nsqd.<id>.dat，下次持久化时会写成nsqd.dat
+	if data == nil {
+		oldFn := oldMetadataFile(n.getOpts())
+		data, err = readOrEmpty(oldFn)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			n.logf(LOG_INFO, "NSQ: migrating metadata from %s", oldFn)
+			fn = oldFn
+		}
+	}
 	// 如果数据为空，则说明为全新启动的nsqd服务
 	if data == nil {
 		return nil
 	}
-	// 序列化数据
-	var m meta
-	err = json.Unmarshal(data, &m)
+	// 序列化数据，旧格式会在这里升级
+	m, err := decodeMetadata(data)
 	if err != nil {
 		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
 	}
 	for _, t := range m.Topics {
 		// 首先验证是否合法
-		if !protocol.IsValidTopicName(t.Name) {
-			n.logf(LOG_WARN, "skipping creation of invalid topic %s", t.Name)
+		if err := n.validateTopicName(t.Name); err != nil {
+			n.logf(LOG_WARN, "skipping creation of invalid topic %s - %s", t.Name, err)
 			continue
 		}
 		// 创建topic
@@ -316,16 +637,35 @@ func (n *NSQD) LoadMetadata() error {
 		// 暂停topic
 		if t.Paused {
 
+		}
+		if t.TTL > 0 {
+			topic.SetTTL(time.Duration(t.TTL) * time.Millisecond)
+		}
+		if t.Retention > 0 {
+			err := topic.SetRetention(time.Duration(t.Retention) * time.Millisecond)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to set retention of topic %s - %s", t.Name, err)
+			}
 		}
 		for _, c := range t.Channels {
-			if !protocol.IsValidChannelName(c.Name) {
-				n.logf(LOG_WARN, "skipping creation of invalid channel %s", c.Name)
+			if err := n.validateChannelName(c.Name); err != nil {
+				n.logf(LOG_WARN, "skipping creation of invalid channel %s - %s", c.Name, err)
 				continue
 			}
-			topic.GetChannel(c.Name)
+			channelOpts := ChannelOptions{Filter: c.Filter, Ordered: c.Ordered}
+			channel, err := topic.GetChannelWithOptions(c.Name, channelOpts)
+			if err != nil {
+				// 过滤条件解析不了时不过滤，避免channel里已有的消息丢失
+				n.logf(LOG_ERROR, "failed to create channel %s with filter %q - %s", c.Name, c.Filter, err)
+				channelOpts.Filter = ""
+				channel, _ = topic.GetChannelWithOptions(c.Name, channelOpts)
+			}
 			if c.Paused {
 
 			}
+			if c.MaxAttempts != nil {
+				channel.SetMaxAttempts(*c.MaxAttempts)
+			}
 		}
 		// 开启topic
 		topic.Start()
@@ -333,14 +673,59 @@ func (n *NSQD) LoadMetadata() error {
 	return nil
 }
 
+// 获取所有topic下的channel
+func (n *NSQD) channels() []*Channel {
+	var channels []*Channel
+	n.RLock()
+	for _, t := range n.topicMap {
+		t.RLock()
+		for _, c := range t.channelMap {
+			channels = append(channels, c)
+		}
+		t.RUnlock()
+	}
+	n.RUnlock()
+	return channels
+}
+
+// 定时扫描所有channel，将超时的in-flight消息和到期的延时消息放回队列
+// 官方实现用了worker池和随机抽样，这里先简单地每次扫描全部channel
+func (n *NSQD) queueScanLoop() {
+	ticker := time.NewTicker(n.getOpts().QueueScanInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+		now := time.Now().UnixNano()
+		for _, c := range n.channels() {
+			c.processInFlightQueue(now)
+			c.processDeferredQueue(now)
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "QUEUESCAN: closing")
+	ticker.Stop()
+}
+
 // 退出
 func (n *NSQD) Exit() {
+	// 关闭tcp服务和已经建立的连接，不再接收新的消息
+	if n.tcpListener != nil {
+		n.tcpListener.Close()
+	}
+	if n.tcpServer != nil {
+		n.tcpServer.CloseAll()
+	}
 	// 关闭http服务
 	if n.httpListener != nil {
 		n.httpListener.Close()
 	}
 	//保存元数据
 	n.Lock()
+	atomic.StoreInt32(&n.isExiting, 1)
 	err := n.PersistMetadata()
 	// 不能直接退出
 	if err != nil {
@@ -357,6 +742,9 @@ func (n *NSQD) Exit() {
 	close(n.exitChan)
 	// 挂起等待所有协程结束
 	n.waitGroup.Wait()
+	if n.accessLogFile != nil {
+		n.accessLogFile.Close()
+	}
 	//关闭目录所
 	n.dl.Unlock()
 
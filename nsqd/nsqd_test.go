@@ -2,10 +2,17 @@ package nsqd
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"nsq-learn/internal/test"
 	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func getMetadata(n *NSQD) (*meta, error) {
@@ -34,6 +41,7 @@ func TestStartup(t *testing.T) {
 }
 
 func testStartNSQD(opts *Options) *NSQD {
+	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
 	if opts.DataPath == "" {
 		tmpDir, err := ioutil.TempDir("", "nsq-test-")
@@ -46,3 +54,309 @@ func testStartNSQD(opts *Options) *NSQD {
 	nsqd.Main()
 	return nsqd
 }
+
+// 等待条件成立，超时返回false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestRestartRecoversMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 100
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("restart_test")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	// 没有channel的topic，消息会一直留在topic的内存队列里
+	orphan := nsqd.GetTopic("restart_orphan")
+	for i := 0; i < 5; i++ {
+		orphan.PutMessage(NewMessage(orphan.GenerateID(), []byte("orphan body")))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 10 }))
+
+	// 两条in-flight，一条延时消息
+	for i := 0; i < 2; i++ {
+		msg := <-channel.memoryMsgChan
+		assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	}
+	deferredMsg := <-channel.memoryMsgChan
+	assert.Nil(t, channel.StartDeferredTimeout(deferredMsg, time.Hour))
+	deferredTs := channel.deferredMessages[deferredMsg.ID].Priority
+	assert.Equal(t, int64(7), channel.Depth())
+
+	nsqd.Exit()
+
+	// 用同一个DataPath重启
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err := nsqd.GetExistingTopic("restart_test")
+	assert.Nil(t, err)
+	channel = topic.GetChannel("ch")
+	// 内存里的7条加上in-flight的2条
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 9 }))
+	assert.Equal(t, 1, len(channel.deferredMessages))
+	for id, item := range channel.deferredMessages {
+		assert.Equal(t, deferredMsg.ID, id)
+		assert.Equal(t, deferredTs, item.Priority)
+	}
+
+	orphan, err = nsqd.GetExistingTopic("restart_orphan")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), orphan.Depth())
+}
+
+func TestChannelCloseConcurrentPut(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10000
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("close_put_test")
+	channel := topic.GetChannel("ch")
+
+	// exit持有exitMutex期间（正在flush）写入要等待
+	channel.exitMutex.Lock()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}()
+	select {
+	case <-errChan:
+		t.Fatal("PutMessage did not wait for exit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	channel.exitMutex.Unlock()
+	assert.Nil(t, <-errChan)
+	count := int64(1)
+
+	// 关闭的同时不停地写入，写入成功的消息都要保存下来
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&count, 1)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, channel.Close())
+	wg.Wait()
+	nsqd.Exit()
+
+	nsqd = New(opts)
+	assert.Nil(t, nsqd.LoadMetadata())
+	nsqd.Main()
+	defer nsqd.Exit()
+
+	topic, err := nsqd.GetExistingTopic("close_put_test")
+	assert.Nil(t, err)
+	channel = topic.GetChannel("ch")
+	assert.Equal(t, atomic.LoadInt64(&count), channel.Depth())
+}
+
+func TestMetadataBackup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("backup_test")
+	nsqd.Lock()
+	assert.Nil(t, nsqd.PersistMetadata())
+	first, _ := ioutil.ReadFile(newMetadataFile(opts))
+	nsqd.Unlock()
+
+	nsqd.GetTopic("backup_test2")
+	nsqd.Lock()
+	assert.Nil(t, nsqd.PersistMetadata())
+	nsqd.Unlock()
+
+	// .bak是上一次写入的内容
+	bak, err := ioutil.ReadFile(newMetadataFile(opts) + ".bak")
+	assert.Nil(t, err)
+	assert.Equal(t, first, bak)
+
+	m, err := getMetadata(nsqd)
+	assert.Nil(t, err)
+	assert.Equal(t, metadataSchemaVersion, m.SchemaVersion)
+}
+
+func TestLoadLegacyMetadata(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+
+	// 官方早期版本的文件名和格式，没有schema_version
+	legacy := `{"version":"0.3.8","topics":[{"name":"legacy_topic","paused":false,"channels":[{"name":"legacy_channel","paused":false}]},{"name":"no_channels","paused":false}]}`
+	err = ioutil.WriteFile(oldMetadataFile(opts), []byte(legacy), 0600)
+	assert.Nil(t, err)
+
+	nsqd := New(opts)
+	defer nsqd.Exit()
+	assert.Nil(t, nsqd.LoadMetadata())
+
+	topic, err := nsqd.GetExistingTopic("legacy_topic")
+	assert.Nil(t, err)
+	topic.RLock()
+	_, ok := topic.channelMap["legacy_channel"]
+	topic.RUnlock()
+	assert.True(t, ok)
+	_, err = nsqd.GetExistingTopic("no_channels")
+	assert.Nil(t, err)
+}
+
+// 旧版本的metadata依次升级后加载，重新持久化时写成当前版本
+func TestMetadataMigrations(t *testing.T) {
+	tests := []struct {
+		schemaVersion int
+		check         func(t *testing.T, topic *Topic)
+	}{
+		{2, func(t *testing.T, topic *Topic) {
+			assert.Equal(t, time.Duration(0), topic.TTL())
+		}},
+		{3, func(t *testing.T, topic *Topic) {
+			channel, _ := topic.GetExistingChannel("ch")
+			assert.Equal(t, int32(maxAttemptsInherit), channel.maxAttempts)
+		}},
+		{4, func(t *testing.T, topic *Topic) {
+			channel, _ := topic.GetExistingChannel("ch")
+			assert.Equal(t, "", channel.FilterExpr())
+		}},
+		{5, func(t *testing.T, topic *Topic) {
+			channel, _ := topic.GetExistingChannel("ch")
+			assert.False(t, channel.IsOrdered())
+		}},
+		{6, func(t *testing.T, topic *Topic) {
+			assert.Equal(t, time.Duration(0), topic.Retention())
+		}},
+	}
+	for _, tt := range tests {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		tmpDir, err := ioutil.TempDir("", "nsq-test-")
+		assert.Nil(t, err)
+		opts.DataPath = tmpDir
+
+		data := fmt.Sprintf(`{"version":"1.0.0","schema_version":%d,"topics":[{"name":"migrate_topic","paused":false,"channels":[{"name":"ch","paused":false}]}]}`,
+			tt.schemaVersion)
+		assert.Nil(t, ioutil.WriteFile(newMetadataFile(opts), []byte(data), 0600))
+
+		nsqd := New(opts)
+		assert.Nil(t, nsqd.LoadMetadata(), "schema_version %d", tt.schemaVersion)
+		topic, err := nsqd.GetExistingTopic("migrate_topic")
+		assert.Nil(t, err)
+		topic.RLock()
+		_, ok := topic.channelMap["ch"]
+		topic.RUnlock()
+		assert.True(t, ok)
+		tt.check(t, topic)
+
+		nsqd.Lock()
+		assert.Nil(t, nsqd.PersistMetadata())
+		nsqd.Unlock()
+		m, err := getMetadata(nsqd)
+		assert.Nil(t, err)
+		assert.Equal(t, metadataSchemaVersion, m.SchemaVersion)
+		nsqd.Exit()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestLoadNewerMetadataFails(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+
+	newer := fmt.Sprintf(`{"version":"9.9.9","schema_version":%d,"topics":[]}`, metadataSchemaVersion+1)
+	err = ioutil.WriteFile(newMetadataFile(opts), []byte(newer), 0600)
+	assert.Nil(t, err)
+
+	nsqd := New(opts)
+	defer nsqd.Exit()
+	err = nsqd.LoadMetadata()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "newer than supported")
+}
+
+func TestPersistMetadataCoalesced(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MetadataPersistWindow = 50 * time.Millisecond
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("coalesce_test")
+	before := atomic.LoadInt64(&nsqd.persistCount)
+	for i := 0; i < 200; i++ {
+		topic.GetChannel(fmt.Sprintf("ch%d", i))
+	}
+
+	// 所有的通知合并后只需要很少几次写入
+	assert.True(t, waitFor(time.Second, func() bool {
+		m, err := getMetadata(nsqd)
+		return err == nil && len(m.Topics) == 1 && len(m.Topics[0].Channels) == 200
+	}))
+	assert.NotEqual(t, int64(0), atomic.LoadInt64(&nsqd.lastPersisted))
+	writes := atomic.LoadInt64(&nsqd.persistCount) - before
+	assert.True(t, writes >= 1 && writes <= 10, "%d writes", writes)
+	assert.True(t, nsqd.isHealth())
+}
+
+func TestPersistMetadataFailureHealth(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MetadataPersistWindow = 10 * time.Millisecond
+	// 内存队列为0，消息直接写到持久化队列
+	opts.MemQueueSize = 0
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	topic := nsqd.GetTopic("health_test")
+
+	// 指向一个不存在的目录，持久化会失败
+	badOpts := *opts
+	badOpts.DataPath = path.Join(opts.DataPath, "missing")
+	nsqd.swapOpts(&badOpts)
+	nsqd.Notify(nil)
+	assert.True(t, waitFor(time.Second, func() bool { return !nsqd.isHealth() }))
+	assert.Contains(t, nsqd.getHealth(), "NOK - ")
+
+	// 写持久化队列成功不会清除metadata的错误
+	assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	assert.False(t, nsqd.isHealth())
+
+	nsqd.swapOpts(opts)
+	nsqd.Notify(nil)
+	assert.True(t, waitFor(time.Second, func() bool { return nsqd.isHealth() }))
+	assert.Equal(t, "OK", nsqd.getHealth())
+}
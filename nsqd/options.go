@@ -1,12 +1,16 @@
 package nsqd
 
 import (
+	"compress/flate"
 	"crypto/md5"
 	"hash/crc32"
 	"io"
 	"log"
+	"nsq-learn/internal/http_api"
 	"nsq-learn/internal/lg"
+	"nsq-learn/internal/protocol"
 	"os"
+	"regexp"
 	"time"
 )
 
@@ -15,17 +19,72 @@ type Options struct {
 	ID          int64
 	LogLevel    string
 	LogPrefix   string
+	TCPAddress  string
 	HTTPAddress string
 	// 存放数据的路径
 	DataPath string
 
-	logLevel        lg.LogLevel //私有的，原因是需要转换成lg.LogLevel
-	Logger          Logger
-	Verbose         bool          //官方说为了向后兼容，先不管
-	MaxBytesPerFile int64         //当个文件最大容量（用来持久化消息）
-	MaxMsgSize      int64         //消息最大的尺寸
-	SyncEvery       int64         //暂时不明
-	SyncTimeout     time.Duration //持久化，同步超时时间
+	logLevel           lg.LogLevel  //私有的，原因是需要转换成lg.LogLevel
+	LogFormat          string       //日志格式，text或json
+	logFormat          lg.LogFormat //私有的，由LogFormat转换而来
+	ComponentLogLevels string       //按组件设置日志等级，如 http=warn,topic:orders=debug，组件见logger.go，没有设置的使用LogLevel
+	Logger             Logger
+	Verbose            bool          //官方说为了向后兼容，先不管
+	MaxBytesPerFile    int64         //当个文件最大容量（用来持久化消息）
+	MaxMsgSize         int64         //消息最大的尺寸
+	SyncEvery          int64         //暂时不明
+	SyncTimeout        time.Duration //持久化，同步超时时间
+	BackendType        string        //磁盘队列的实现，diskqueue或segment
+
+	MemQueueSize      int64         //内存队列的长度，超过之后消息写到磁盘
+	MsgTimeout        time.Duration //消息投递后等待确认的超时时间
+	MaxReqTimeout     time.Duration //延时消息最长的延时时间
+	QueueScanInterval time.Duration //扫描in-flight和延时消息的间隔
+	MaxMsgTimeout     time.Duration //客户端在IDENTIFY时能设置的最长消息超时时间
+
+	MaxBodySize            int64         //TCP命令（MPUB等）数据的最大长度
+	ClientTimeout          time.Duration //TCP客户端没有任何命令的超时时间，默认心跳间隔为它的一半
+	MaxHeartbeatInterval   time.Duration //客户端在IDENTIFY时能设置的最长心跳间隔
+	MaxRdyCount            int64         //客户端RDY的最大值
+	OutputBufferTimeout    time.Duration //投递消息时缓冲的最长时间，到时间后flush
+	MaxOutputBufferTimeout time.Duration //客户端在IDENTIFY时能设置的最长缓冲时间
+
+	MetadataPersistWindow time.Duration //合并metadata持久化请求的时间窗口
+
+	MemOnlyTopics      string         //只使用内存队列的topic名（正则），为空表示全部写磁盘
+	memOnlyTopicsRegex *regexp.Regexp //私有的，由MemOnlyTopics编译而来
+	MemOnlyMaxDepth    int64          //内存队列最多能存放的消息数
+
+	CompressTopics      string         //消息压缩后再写磁盘的topic名（正则），为空表示都不压缩
+	compressTopicsRegex *regexp.Regexp //私有的，由CompressTopics编译而来
+	CompressionLevel    int            //flate的压缩级别，-2到9
+
+	EncryptionKeyFile string //AES-GCM密钥文件，配置后磁盘上的消息都会加密，格式见encrypted_backend_queue.go
+
+	MaxTopicBackendBytes int64          //每个topic（包括它的channel）在磁盘上最多占用的字节数，0表示不限制
+	MaxDataPathBytes     int64          //DataPath下所有文件最多占用的字节数，0表示不限制
+	QuotaDropTopics      string         //超过配额时丢弃最旧segment的topic名（正则），其它topic拒绝发布，需要segment队列
+	quotaDropTopicsRegex *regexp.Regexp //私有的，由QuotaDropTopics编译而来
+	QuotaCheckInterval   time.Duration  //统计磁盘用量的间隔
+
+	MaxAttempts           uint16 //消息最多投递的次数，超过后放进死信topic，0表示不限制，channel可以单独设置
+	DeadLetterTopicSuffix string //死信topic名的后缀，<topic><suffix>
+
+	DedupeWindow  time.Duration //发布时幂等key的去重时间窗口，0表示不去重
+	DedupeMaxKeys int           //每个topic最多记录的幂等key数，超过后淘汰最早的key
+	DedupePersist bool          //关闭时把去重索引保存到DataPath，重启后继续去重
+
+	NameMaxLength        int                  //topic和channel名的最大长度（包括#ephemeral后缀）
+	NameCharset          string               //topic和channel名允许的字符（正则，不包括#ephemeral后缀）
+	TopicNamePrefixes    []string             //topic名必须以其中一个前缀开头（如按团队划分），为空表示不限制
+	ReservedNamePrefixes []string             //保留的名字前缀，topic和channel都不能使用（如__internal）
+	topicNamePolicy      *protocol.NamePolicy //私有的，由以上配置生成
+	channelNamePolicy    *protocol.NamePolicy //私有的，channel名不要求前缀
+
+	AccessLogPath        string   //HTTP访问日志文件，配置后请求不再写到应用日志里，为空表示不单独记录
+	AccessLogFormat      string   //访问日志格式，common、combined或json
+	AccessLogSamplePaths []string //只按比例记录的请求路径，如健康检查
+	AccessLogSampleRate  float64  //AccessLogSamplePaths中的请求记录的比例，0到1
 }
 
 func NewOptions() *Options {
@@ -34,11 +93,49 @@ func NewOptions() *Options {
 		ID:              defaultID,
 		LogPrefix:       "[nsqd] ",
 		LogLevel:        "info",
+		LogFormat:       "text",
 		Verbose:         false,
+		TCPAddress:      "0.0.0.0:1417",
 		HTTPAddress:     "0.0.0.0:1418",
 		MaxBytesPerFile: 100 * 1024 * 1024,
+		MaxMsgSize:      1024 * 1024,
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
+		BackendType:     BackendTypeDiskQueue,
+
+		MemQueueSize:      10000,
+		MsgTimeout:        60 * time.Second,
+		MaxReqTimeout:     1 * time.Hour,
+		QueueScanInterval: 100 * time.Millisecond,
+		MaxMsgTimeout:     15 * time.Minute,
+
+		MaxBodySize:          5 * 1024 * 1024,
+		ClientTimeout:        60 * time.Second,
+		MaxHeartbeatInterval: 60 * time.Second,
+		MaxRdyCount:          2500,
+
+		OutputBufferTimeout:    250 * time.Millisecond,
+		MaxOutputBufferTimeout: 30 * time.Second,
+
+		MetadataPersistWindow: 200 * time.Millisecond,
+
+		MemOnlyMaxDepth: 100000,
+
+		CompressionLevel: flate.DefaultCompression,
+
+		QuotaCheckInterval: 1 * time.Second,
+
+		DeadLetterTopicSuffix: ".dlq",
+
+		DedupeWindow:  5 * time.Minute,
+		DedupeMaxKeys: 100000,
+
+		NameMaxLength: protocol.DefaultNamePolicy.MaxLength,
+		NameCharset:   protocol.DefaultNamePolicy.Charset.String(),
+
+		AccessLogFormat:      http_api.AccessLogCommon,
+		AccessLogSamplePaths: []string{"/ping", "/stats"},
+		AccessLogSampleRate:  0.01,
 	}
 }
 
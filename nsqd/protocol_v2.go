@@ -0,0 +1,898 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"nsq-learn/internal/protocol"
+	"nsq-learn/internal/version"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	frameTypeResponse int32 = protocol.FrameTypeResponse
+	frameTypeError    int32 = protocol.FrameTypeError
+	frameTypeMessage  int32 = protocol.FrameTypeMessage
+)
+
+var separatorBytes = []byte(" ")
+var heartbeatBytes = []byte("_heartbeat_")
+var okBytes = []byte("OK")
+
+// V2协议，客户端发送以\n结尾的命令行，部分命令后面跟着[4-byte 长度][N-byte 数据]
+// 服务端的响应格式见protocol.SendFramedResponse
+type protocolV2 struct {
+	ctx *context
+}
+
+func (p *protocolV2) IOLoop(conn net.Conn) error {
+	var err error
+	var line []byte
+	var zeroTime time.Time
+
+	clientID := atomic.AddInt64(&p.ctx.nsqd.clientIDSequence, 1)
+	client := newClientV2(clientID, conn, p.ctx)
+
+	// 等messagePump启动后再读命令，保证IDENTIFY的事件不会丢
+	messagePumpStartedChan := make(chan bool)
+	messagePumpExitedChan := make(chan bool)
+	go p.messagePump(client, messagePumpStartedChan, messagePumpExitedChan)
+	<-messagePumpStartedChan
+
+	for {
+		// 两个心跳周期内没有收到任何命令就认为客户端已经断开
+		if client.HeartbeatInterval > 0 {
+			client.SetReadDeadline(time.Now().Add(client.HeartbeatInterval * 2))
+		} else {
+			client.SetReadDeadline(zeroTime)
+		}
+
+		// ReadSlice返回的数据在下次读取时会被覆盖，命令参数要在读消息体之前转换成string
+		line, err = client.Reader.ReadSlice('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("failed to read command - %s", err)
+			}
+			break
+		}
+
+		// 去掉结尾的\n和可能有的\r
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		params := bytes.Split(line, separatorBytes)
+
+		client.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] %s", client, params)
+
+		var response []byte
+		response, err = p.Exec(client, params)
+		if err != nil {
+			ctx := ""
+			if parentErr := err.(protocol.ChildErr).Parent(); parentErr != nil {
+				ctx = " - " + parentErr.Error()
+			}
+			client.logf(LOG_ERROR, "[%s] - %s%s", client, err, ctx)
+
+			sendErr := p.Send(client, frameTypeError, []byte(err.Error()))
+			if sendErr != nil {
+				client.logf(LOG_ERROR, "[%s] - %s%s", client, sendErr, ctx)
+				break
+			}
+
+			// 致命错误发送给客户端后关闭连接
+			if _, ok := err.(*protocol.FatalClientErr); ok {
+				break
+			}
+			continue
+		}
+
+		if response != nil {
+			err = p.Send(client, frameTypeResponse, response)
+			if err != nil {
+				err = fmt.Errorf("failed to send response - %s", err)
+				break
+			}
+		}
+	}
+
+	client.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting ioloop", client)
+	conn.Close()
+	close(client.ExitChan)
+	// 等messagePump退出，nsqd退出时不会还有协程在写日志
+	<-messagePumpExitedChan
+	if client.Channel != nil {
+		client.Channel.RemoveClient(client.ID)
+	}
+
+	return err
+}
+
+// 发送一帧数据，消息帧由messagePump批量flush，其它的立即flush
+func (p *protocolV2) Send(client *clientV2, frameType int32, data []byte) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+
+	_, err := protocol.SendFramedResponse(client.Writer, frameType, data)
+	if err != nil {
+		return err
+	}
+
+	if frameType != frameTypeMessage {
+		err = client.Flush()
+	}
+
+	return err
+}
+
+func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
+	switch {
+	case bytes.Equal(params[0], []byte("FIN")):
+		return p.FIN(client, params)
+	case bytes.Equal(params[0], []byte("RDY")):
+		return p.RDY(client, params)
+	case bytes.Equal(params[0], []byte("REQ")):
+		return p.REQ(client, params)
+	case bytes.Equal(params[0], []byte("TOUCH")):
+		return p.TOUCH(client, params)
+	case bytes.Equal(params[0], []byte("IDENTIFY")):
+		return p.IDENTIFY(client, params)
+	case bytes.Equal(params[0], []byte("PUB")):
+		return p.PUB(client, params)
+	case bytes.Equal(params[0], []byte("MPUB")):
+		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("DPUB")):
+		return p.DPUB(client, params)
+	case bytes.Equal(params[0], []byte("HPUB")):
+		return p.HPUB(client, params)
+	case bytes.Equal(params[0], []byte("NOP")):
+		return p.NOP(client, params)
+	case bytes.Equal(params[0], []byte("SUB")):
+		return p.SUB(client, params)
+	case bytes.Equal(params[0], []byte("CLS")):
+		return p.CLS(client, params)
+	}
+	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
+}
+
+// 负责给客户端发心跳，订阅后按RDY投递消息
+func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool, exitedChan chan bool) {
+	var err error
+	var memoryMsgChan chan *Message
+	var backendMsgChan chan []byte
+	var orderedMsgChan chan *Message
+	var subChannel *Channel
+	// 投递消息后先不flush，攒一批或者到时间再flush
+	var flusherChan <-chan time.Time
+
+	subEventChan := client.SubEventChan
+	identifyEventChan := client.IdentifyEventChan
+	outputBufferTicker := time.NewTicker(client.OutputBufferTimeout)
+	heartbeatTicker := time.NewTicker(client.HeartbeatInterval)
+	heartbeatChan := heartbeatTicker.C
+	msgTimeout := client.MsgTimeout
+	outputBufferTimeout := client.OutputBufferTimeout
+
+	// 缓冲里没有消息
+	flushed := true
+
+	close(startedChan)
+
+	for {
+		if subChannel == nil || !client.IsReadyForMessages() {
+			// 没有订阅或者RDY用完了，不接收消息，把缓冲里的消息发出去
+			memoryMsgChan = nil
+			backendMsgChan = nil
+			orderedMsgChan = nil
+			flusherChan = nil
+			client.writeLock.Lock()
+			err = client.Flush()
+			client.writeLock.Unlock()
+			if err != nil {
+				goto exit
+			}
+			flushed = true
+		} else if flushed {
+			// 缓冲是空的，不需要定时flush
+			memoryMsgChan, backendMsgChan, orderedMsgChan = subChannelMsgChans(subChannel)
+			flusherChan = nil
+		} else {
+			memoryMsgChan, backendMsgChan, orderedMsgChan = subChannelMsgChans(subChannel)
+			flusherChan = outputBufferTicker.C
+		}
+
+		select {
+		case <-flusherChan:
+			client.writeLock.Lock()
+			err = client.Flush()
+			client.writeLock.Unlock()
+			if err != nil {
+				goto exit
+			}
+			flushed = true
+		case <-client.ReadyStateChan:
+		case subChannel = <-subEventChan:
+			// 只能订阅一次
+			subEventChan = nil
+		case identifyData := <-identifyEventChan:
+			// IDENTIFY只能有一次
+			identifyEventChan = nil
+
+			outputBufferTicker.Stop()
+			if identifyData.OutputBufferTimeout > 0 {
+				outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
+			}
+			outputBufferTimeout = identifyData.OutputBufferTimeout
+
+			heartbeatTicker.Stop()
+			heartbeatChan = nil
+			if identifyData.HeartbeatInterval > 0 {
+				heartbeatTicker = time.NewTicker(identifyData.HeartbeatInterval)
+				heartbeatChan = heartbeatTicker.C
+			}
+
+			msgTimeout = identifyData.MsgTimeout
+		case <-heartbeatChan:
+			err = p.Send(client, frameTypeResponse, heartbeatBytes)
+			if err != nil {
+				goto exit
+			}
+		case b := <-backendMsgChan:
+			// 解码失败只丢弃这条消息，不能覆盖外面的err，投递失败时要记录messagePump error
+			msg, decodeErr := decodeMessage(b)
+			if decodeErr != nil {
+				client.logf(LOG_ERROR, "failed to decode message - %s", decodeErr)
+				continue
+			}
+			if subChannel.dropIfExpired(msg) {
+				continue
+			}
+			err = p.deliverMessage(client, subChannel, msg, msgTimeout, outputBufferTimeout)
+			if err != nil {
+				goto exit
+			}
+			flushed = outputBufferTimeout == 0
+		case msg := <-memoryMsgChan:
+			if subChannel.dropIfExpired(msg) {
+				continue
+			}
+			err = p.deliverMessage(client, subChannel, msg, msgTimeout, outputBufferTimeout)
+			if err != nil {
+				goto exit
+			}
+			flushed = outputBufferTimeout == 0
+		case msg := <-orderedMsgChan:
+			// 过期的队头消息直接确认，orderedLoop才会取下一条
+			if subChannel.dropIfExpired(msg) {
+				subChannel.ackOrdered(orderedAck{})
+				continue
+			}
+			err = p.deliverMessage(client, subChannel, msg, msgTimeout, outputBufferTimeout)
+			if err != nil {
+				goto exit
+			}
+			flushed = outputBufferTimeout == 0
+		case <-client.ExitChan:
+			goto exit
+		}
+	}
+
+exit:
+	client.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
+	heartbeatTicker.Stop()
+	outputBufferTicker.Stop()
+	if err != nil {
+		client.logf(LOG_ERROR, "PROTOCOL(V2): [%s] messagePump error - %s", client, err)
+	}
+	close(exitedChan)
+}
+
+// channel的消息来源，顺序投递模式只从orderedMsgChan读取
+func subChannelMsgChans(c *Channel) (chan *Message, chan []byte, chan *Message) {
+	if c.IsOrdered() {
+		return nil, nil, c.orderedMsgChan
+	}
+	return c.memoryMsgChan, c.backend.ReadChan(), nil
+}
+
+// 投递一条消息，开始计算超时时间，outputBufferTimeout为0时立即flush
+func (p *protocolV2) deliverMessage(client *clientV2, c *Channel, msg *Message,
+	msgTimeout time.Duration, outputBufferTimeout time.Duration) error {
+	msg.Attempts++
+
+	// 同样ID的消息已经在投递中时，发出去的这条没法FIN，不再发送
+	err := c.StartInFlightTimeout(msg, client.ID, msgTimeout)
+	if err != nil {
+		client.logf(LOG_ERROR, "PROTOCOL(V2): [%s] failed to deliver msg(%s) on channel(%s) - %s", client, msg.ID, c.name, err)
+		return nil
+	}
+	client.SendingMessage()
+	err = p.SendMessage(client, msg)
+	if err != nil {
+		return err
+	}
+	if outputBufferTimeout == 0 {
+		client.writeLock.Lock()
+		err = client.Flush()
+		client.writeLock.Unlock()
+	}
+	return err
+}
+
+// 按客户端是否支持header写消息帧
+func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
+	client.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
+
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	buf.Reset()
+
+	_, err := msg.writeTo(buf, client.HeadersEnabled())
+	if err != nil {
+		return err
+	}
+
+	return p.Send(client, frameTypeMessage, buf.Bytes())
+}
+
+// IDENTIFY\n[4-byte 长度][JSON数据]
+// 客户端设置了feature_negotiation时返回服务端的配置（JSON），否则返回OK
+func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error) {
+	if atomic.LoadInt32(&client.State) != stateInit {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot IDENTIFY in current state")
+	}
+
+	bodyLen, err := protocol.ReadLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body size")
+	}
+
+	if int64(bodyLen) > p.ctx.nsqd.getOpts().MaxBodySize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("IDENTIFY body too big %d > %d", bodyLen, p.ctx.nsqd.getOpts().MaxBodySize))
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("IDENTIFY invalid body size %d", bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body")
+	}
+
+	var identifyData identifyDataV2
+	err = json.Unmarshal(body, &identifyData)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
+	}
+
+	err = client.Identify(identifyData)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
+	}
+
+	if !identifyData.FeatureNegotiation {
+		return okBytes, nil
+	}
+
+	opts := p.ctx.nsqd.getOpts()
+	resp, err := json.Marshal(struct {
+		Version             string `json:"version"`
+		MaxMsgTimeout       int64  `json:"max_msg_timeout"`
+		MsgTimeout          int64  `json:"msg_timeout"`
+		HeartbeatInterval   int64  `json:"heartbeat_interval"`
+		MaxMsgSize          int64  `json:"max_msg_size"`
+		MaxBodySize         int64  `json:"max_body_size"`
+		MaxRdyCount         int64  `json:"max_rdy_count"`
+		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		Headers             bool   `json:"headers"`
+	}{
+		Version:             version.Binary,
+		MaxMsgTimeout:       int64(opts.MaxMsgTimeout / time.Millisecond),
+		MsgTimeout:          int64(client.MsgTimeout / time.Millisecond),
+		HeartbeatInterval:   int64(client.HeartbeatInterval / time.Millisecond),
+		MaxMsgSize:          opts.MaxMsgSize,
+		MaxBodySize:         opts.MaxBodySize,
+		MaxRdyCount:         opts.MaxRdyCount,
+		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		Headers:             client.HeadersEnabled(),
+	})
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+	}
+
+	return resp, nil
+}
+
+// PUB <topic> [idempotency_key]\n[4-byte 长度][消息体]
+func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
+	if len(params) < 2 || len(params) > 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "PUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	err := p.checkTopicName("PUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	// 可选的幂等key，去重时间窗口内重复发布的消息直接返回OK，不再写入
+	var idempotencyKey string
+	if len(params) == 3 {
+		idempotencyKey = string(params[2])
+		if err := validateIdempotencyKey(idempotencyKey); err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("PUB invalid idempotency key %q", idempotencyKey))
+		}
+	}
+
+	messageBody, err := p.readMessageBody(client, "PUB", p.ctx.nsqd.getOpts().MaxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	err = p.checkHealth(topic, "PUB")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(topic.GenerateID(), messageBody)
+	_, err = topic.PutMessageWithKey(msg, idempotencyKey)
+	if err != nil {
+		return nil, putErr("PUB", err)
+	}
+
+	return okBytes, nil
+}
+
+// MPUB <topic>\n[4-byte 长度][4-byte 消息数][4-byte 长度][消息体]...
+func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	if len(params) != 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "MPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	err := p.checkTopicName("MPUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := p.ctx.nsqd.getOpts()
+	body, err := p.readMessageBody(client, "MPUB", opts.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	messages, err := readMPUB(bytes.NewReader(body), client.lenSlice, topic, opts.MaxMsgSize, int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.checkHealth(topic, "MPUB")
+	if err != nil {
+		return nil, err
+	}
+
+	err = topic.PutMessages(messages)
+	if err != nil {
+		return nil, putErr("MPUB", err)
+	}
+
+	return okBytes, nil
+}
+
+// DPUB <topic> <延时毫秒>\n[4-byte 长度][消息体]
+func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	if len(params) != 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "DPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	err := p.checkTopicName("DPUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	timeoutMs, err := strconv.ParseInt(string(params[2]), 10, 64)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("DPUB could not parse timeout %s", params[2]))
+	}
+	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+
+	maxReqTimeout := p.ctx.nsqd.getOpts().MaxReqTimeout
+	if timeoutDuration < 0 || timeoutDuration > maxReqTimeout {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("DPUB timeout %d out of range 0-%d",
+				timeoutMs, maxReqTimeout/time.Millisecond))
+	}
+
+	messageBody, err := p.readMessageBody(client, "DPUB", p.ctx.nsqd.getOpts().MaxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	err = p.checkHealth(topic, "DPUB")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(topic.GenerateID(), messageBody)
+	msg.deferred = timeoutDuration
+	err = topic.PutMessage(msg)
+	if err != nil {
+		return nil, putErr("DPUB", err)
+	}
+
+	return okBytes, nil
+}
+
+// HPUB <topic>\n[4-byte 长度][header块][消息体]
+// header块的格式和消息里的一样，见message.go
+func (p *protocolV2) HPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	if len(params) != 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "HPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	err := p.checkTopicName("HPUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.readMessageBody(client, "HPUB", p.ctx.nsqd.getOpts().MaxMsgSize+maxMsgHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, n, err := decodeHeaders(body)
+	if err == nil {
+		err = validateHeaders(headers)
+	}
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_HEADERS", "HPUB invalid headers")
+	}
+	messageBody := body[n:]
+	if len(messageBody) == 0 || int64(len(messageBody)) > p.ctx.nsqd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB invalid message body size %d", len(messageBody)))
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	err = p.checkHealth(topic, "HPUB")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(topic.GenerateID(), messageBody)
+	msg.Headers = headers
+	err = topic.PutMessage(msg)
+	if err != nil {
+		return nil, putErr("HPUB", err)
+	}
+
+	return okBytes, nil
+}
+
+// 客户端回复心跳用，没有响应
+func (p *protocolV2) NOP(client *clientV2, params [][]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// SUB <topic> <channel>，每个连接只能订阅一个channel
+func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
+	if atomic.LoadInt32(&client.State) != stateInit {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot SUB in current state")
+	}
+
+	if client.HeartbeatInterval <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot SUB with heartbeats disabled")
+	}
+
+	if len(params) != 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	err := p.checkTopicName("SUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	channelName := string(params[2])
+	if err := p.ctx.nsqd.validateChannelName(channelName); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_CHANNEL",
+			fmt.Sprintf("SUB channel name %q is not valid (%s)", channelName, protocol.NameErrorRule(err)))
+	}
+
+	// 临时channel可能正在因为最后一个客户端断开而删除，重试一次拿到新建的channel
+	var channel *Channel
+	for i := 1; ; i++ {
+		topic := p.ctx.nsqd.GetTopic(topicName)
+		channel = topic.GetChannel(channelName)
+		if err := channel.AddClient(client.ID, client); err != nil {
+			if i < 2 && channel.ephemeral && channel.Exiting() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return nil, protocol.NewFatalClientErr(err, "E_SUB_FAILED", "SUB failed "+err.Error())
+		}
+		break
+	}
+	if client.MaxAttempts != nil {
+		channel.SetMaxAttempts(*client.MaxAttempts)
+	}
+
+	atomic.StoreInt32(&client.State, stateSubscribed)
+	client.Channel = channel
+	// 通知messagePump开始投递
+	client.SubEventChan <- channel
+
+	return okBytes, nil
+}
+
+// RDY <count>，客户端还能接收的消息数
+func (p *protocolV2) RDY(client *clientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+
+	if state == stateClosing {
+		// 客户端已经发了CLS，忽略之后的RDY
+		client.logf(LOG_INFO, "PROTOCOL(V2): [%s] ignoring RDY after CLS in state ClientStateV2Closing", client)
+		return nil, nil
+	}
+
+	if state != stateSubscribed {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot RDY in current state")
+	}
+
+	count := int64(1)
+	if len(params) > 1 {
+		b10, err := strconv.ParseInt(string(params[1]), 10, 64)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+				fmt.Sprintf("RDY could not parse count %s", params[1]))
+		}
+		count = b10
+	}
+
+	maxRdyCount := p.ctx.nsqd.getOpts().MaxRdyCount
+	if count < 0 || count > maxRdyCount {
+		// 客户端应该按IDENTIFY返回的max_rdy_count设置
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("RDY count %d out of range 0-%d", count, maxRdyCount))
+	}
+
+	client.SetReadyCount(count)
+
+	return nil, nil
+}
+
+// FIN <message_id>，消息处理成功
+func (p *protocolV2) FIN(client *clientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot FIN in current state")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "FIN insufficient number of params")
+	}
+
+	id, err := getMessageID(params[1])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+	}
+
+	// 消息可能已经超时被重新投递，不是致命错误
+	err = client.Channel.FinishMessage(client.ID, *id)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_FIN_FAILED",
+			fmt.Sprintf("FIN %s failed %s", *id, err.Error()))
+	}
+
+	client.FinishedMessage()
+
+	return nil, nil
+}
+
+// REQ <message_id> <timeout>，消息重新入队，timeout毫秒后再投递
+func (p *protocolV2) REQ(client *clientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot REQ in current state")
+	}
+
+	if len(params) < 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REQ insufficient number of params")
+	}
+
+	id, err := getMessageID(params[1])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+	}
+
+	timeoutMs, err := strconv.ParseInt(string(params[2]), 10, 64)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("REQ could not parse timeout %s", params[2]))
+	}
+	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+
+	// 超出范围的延时截断，不作为错误
+	maxReqTimeout := p.ctx.nsqd.getOpts().MaxReqTimeout
+	clampedTimeout := timeoutDuration
+	if timeoutDuration < 0 {
+		clampedTimeout = 0
+	} else if timeoutDuration > maxReqTimeout {
+		clampedTimeout = maxReqTimeout
+	}
+	if clampedTimeout != timeoutDuration {
+		client.logf(LOG_INFO, "PROTOCOL(V2): [%s] REQ timeout %d out of range 0-%d. Setting to %d",
+			client, timeoutDuration, maxReqTimeout, clampedTimeout)
+		timeoutDuration = clampedTimeout
+	}
+
+	err = client.Channel.RequeueMessage(client.ID, *id, timeoutDuration)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
+			fmt.Sprintf("REQ %s failed %s", *id, err.Error()))
+	}
+
+	client.RequeuedMessage()
+
+	return nil, nil
+}
+
+// TOUCH <message_id>，重置消息的超时时间
+func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot TOUCH in current state")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "TOUCH insufficient number of params")
+	}
+
+	id, err := getMessageID(params[1])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+	}
+
+	client.metaLock.RLock()
+	msgTimeout := client.MsgTimeout
+	client.metaLock.RUnlock()
+	err = client.Channel.TouchMessage(client.ID, *id, msgTimeout)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_TOUCH_FAILED",
+			fmt.Sprintf("TOUCH %s failed %s", *id, err.Error()))
+	}
+
+	return nil, nil
+}
+
+// CLS，客户端准备断开，不再投递新消息，处理完已投递的消息后由客户端关闭连接
+func (p *protocolV2) CLS(client *clientV2, params [][]byte) ([]byte, error) {
+	if atomic.LoadInt32(&client.State) != stateSubscribed {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot CLS in current state")
+	}
+
+	client.StartClose()
+
+	return []byte("CLOSE_WAIT"), nil
+}
+
+func (p *protocolV2) checkTopicName(cmd string, topicName string) error {
+	if err := p.ctx.nsqd.validateTopicName(topicName); err != nil {
+		return protocol.NewFatalClientErr(err, "E_BAD_TOPIC",
+			fmt.Sprintf("%s topic name %q is not valid (%s)", cmd, topicName, protocol.NameErrorRule(err)))
+	}
+	return nil
+}
+
+// 磁盘写入失败后nsqd处于不健康状态，直接拒绝
+func (p *protocolV2) checkHealth(topic *Topic, cmd string) error {
+	if p.ctx.nsqd.rejectPublish(topic) {
+		return protocol.NewFatalClientErr(p.ctx.nsqd.getError(), "E_PUB_FAILED", cmd+" failed - nsqd is unhealthy")
+	}
+	return nil
+}
+
+// 超过配额不是连接的问题，客户端可以继续发布其它topic
+func putErr(cmd string, err error) error {
+	if err == ErrQuotaExceeded {
+		return protocol.NewClientErr(err, "E_QUOTA_EXCEEDED", cmd+" failed "+err.Error())
+	}
+	return protocol.NewFatalClientErr(err, "E_PUB_FAILED", cmd+" failed "+err.Error())
+}
+
+// 读取[4-byte 长度][N-byte 数据]
+func (p *protocolV2) readMessageBody(client *clientV2, cmd string, maxSize int64) ([]byte, error) {
+	bodyLen, err := protocol.ReadLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", cmd+" failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s invalid message body size %d", cmd, bodyLen))
+	}
+
+	if int64(bodyLen) > maxSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s message too big %d > %d", cmd, bodyLen, maxSize))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", cmd+" failed to read message body")
+	}
+	return body, nil
+}
+
+// 解析MPUB的消息体
+func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBodySize int64) ([]*Message, error) {
+	numMessages, err := protocol.ReadLen(r, tmp)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
+	}
+
+	// 每条消息至少有4字节的长度和1字节的消息体
+	maxMessages := (maxBodySize - 4) / 5
+	if numMessages <= 0 || int64(numMessages) > maxMessages {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MPUB invalid message count %d", numMessages))
+	}
+
+	messages := make([]*Message, 0, numMessages)
+	for i := int32(0); i < numMessages; i++ {
+		messageSize, err := protocol.ReadLen(r, tmp)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
+				fmt.Sprintf("MPUB failed to read message(%d) body size", i))
+		}
+
+		if messageSize <= 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("MPUB invalid message(%d) body size %d", i, messageSize))
+		}
+
+		if int64(messageSize) > maxMessageSize {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
+		}
+
+		msgBody := make([]byte, messageSize)
+		_, err = io.ReadFull(r, msgBody)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
+		}
+
+		messages = append(messages, NewMessage(topic.GenerateID(), msgBody))
+	}
+
+	return messages, nil
+}
+
+func getMessageID(p []byte) (*MessageID, error) {
+	if len(p) != MsgIDLength {
+		return nil, errors.New("invalid message ID")
+	}
+	var id MessageID
+	copy(id[:], p)
+	return &id, nil
+}
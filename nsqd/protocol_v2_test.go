@@ -0,0 +1,291 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"nsq-learn/internal/protocol"
+	"nsq-learn/internal/test"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 连接nsqd并发送协议版本号
+func mustConnectNSQD(t *testing.T, n *NSQD) (net.Conn, *bufio.Reader) {
+	conn, err := net.DialTimeout("tcp", n.RealTCPAddr().String(), time.Second)
+	assert.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("  V2"))
+	assert.Nil(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+// 发送命令行和可选的[4-byte 长度][数据]
+func writeCommand(t *testing.T, conn net.Conn, line string, body []byte) {
+	var buf bytes.Buffer
+	buf.WriteString(line + "\n")
+	if body != nil {
+		binary.Write(&buf, binary.BigEndian, int32(len(body)))
+		buf.Write(body)
+	}
+	_, err := conn.Write(buf.Bytes())
+	assert.Nil(t, err)
+}
+
+func readFrame(t *testing.T, r *bufio.Reader) (int32, []byte) {
+	tmp := make([]byte, 4)
+	size, err := protocol.ReadLen(r, tmp)
+	assert.Nil(t, err)
+	frameType, err := protocol.ReadLen(r, tmp)
+	assert.Nil(t, err)
+	data := make([]byte, size-4)
+	_, err = io.ReadFull(r, data)
+	assert.Nil(t, err)
+	return frameType, data
+}
+
+func TestProtocolV2Publish(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, r := mustConnectNSQD(t, nsqd)
+	defer conn.Close()
+
+	identify, _ := json.Marshal(map[string]interface{}{
+		"client_id":           "test",
+		"heartbeat_interval":  1000,
+		"feature_negotiation": true,
+	})
+	writeCommand(t, conn, "IDENTIFY", identify)
+	frameType, data := readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	var resp struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+		MaxMsgSize        int64 `json:"max_msg_size"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &resp))
+	assert.Equal(t, int64(1000), resp.HeartbeatInterval)
+	assert.Equal(t, opts.MaxMsgSize, resp.MaxMsgSize)
+
+	writeCommand(t, conn, "PUB proto_test", []byte("hello"))
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, okBytes, data)
+
+	var mpub bytes.Buffer
+	binary.Write(&mpub, binary.BigEndian, int32(2))
+	for _, body := range []string{"a", "bc"} {
+		binary.Write(&mpub, binary.BigEndian, int32(len(body)))
+		mpub.WriteString(body)
+	}
+	writeCommand(t, conn, "MPUB proto_test", mpub.Bytes())
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, okBytes, data)
+
+	hdrs, _ := encodeHeaders(map[string]string{"trace-id": "abc"})
+	writeCommand(t, conn, "HPUB proto_test", append(hdrs, []byte("hdr")...))
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, okBytes, data)
+
+	topic, err := nsqd.GetExistingTopic("proto_test")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), topic.Depth())
+
+	// 空闲时收到心跳
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, heartbeatBytes, data)
+	writeCommand(t, conn, "NOP", nil)
+
+	// 延时超出范围是致命错误，之后连接被关闭
+	writeCommand(t, conn, "DPUB proto_test -1", []byte("later"))
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeError, frameType)
+	assert.True(t, bytes.HasPrefix(data, []byte("E_INVALID")), string(data))
+	_, err = r.ReadByte()
+	assert.NotNil(t, err)
+}
+
+func TestProtocolV2BadTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, r := mustConnectNSQD(t, nsqd)
+	defer conn.Close()
+
+	writeCommand(t, conn, "PUB bad!topic", []byte("hello"))
+	frameType, data := readFrame(t, r)
+	assert.Equal(t, frameTypeError, frameType)
+	assert.Contains(t, string(data), "E_BAD_TOPIC")
+	assert.Contains(t, string(data), protocol.NameRuleCharset)
+}
+
+// 读取一条消息帧并解码
+func readMessage(t *testing.T, r *bufio.Reader) *Message {
+	frameType, data := readFrame(t, r)
+	assert.Equal(t, frameTypeMessage, frameType)
+	msg, err := decodeMessage(data)
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestProtocolV2Subscribe(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("sub_test")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("first")))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("second")))
+
+	conn, r := mustConnectNSQD(t, nsqd)
+	defer conn.Close()
+
+	identify, _ := json.Marshal(map[string]interface{}{
+		"feature_negotiation":   true,
+		"output_buffer_timeout": -1,
+	})
+	writeCommand(t, conn, "IDENTIFY", identify)
+	_, data := readFrame(t, r)
+	var resp struct {
+		MaxRdyCount int64 `json:"max_rdy_count"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &resp))
+	assert.Equal(t, opts.MaxRdyCount, resp.MaxRdyCount)
+
+	// 订阅之前不能RDY
+	writeCommand(t, conn, "SUB sub_test ch#ephemeral", nil)
+	frameType, data := readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, okBytes, data)
+
+	writeCommand(t, conn, "RDY 1", nil)
+	msg := readMessage(t, r)
+	assert.Equal(t, []byte("first"), msg.Body)
+	assert.Equal(t, uint16(1), msg.Attempts)
+
+	// RDY 1时FIN之前不会收到下一条
+	writeCommand(t, conn, "TOUCH "+string(msg.ID[:]), nil)
+	writeCommand(t, conn, "FIN "+string(msg.ID[:]), nil)
+	msg = readMessage(t, r)
+	assert.Equal(t, []byte("second"), msg.Body)
+
+	// 重新入队后再投递，尝试次数加1
+	writeCommand(t, conn, "REQ "+string(msg.ID[:])+" 0", nil)
+	msg = readMessage(t, r)
+	assert.Equal(t, []byte("second"), msg.Body)
+	assert.Equal(t, uint16(2), msg.Attempts)
+
+	// 已经确认过的消息FIN失败，但不是致命错误
+	writeCommand(t, conn, "FIN "+string(msg.ID[:]), nil)
+	writeCommand(t, conn, "FIN "+string(msg.ID[:]), nil)
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeError, frameType)
+	assert.True(t, bytes.HasPrefix(data, []byte("E_FIN_FAILED")), string(data))
+
+	channel, err := topic.GetExistingChannel("ch#ephemeral")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, channel.ClientCount())
+
+	writeCommand(t, conn, "CLS", nil)
+	frameType, data = readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+	assert.Equal(t, []byte("CLOSE_WAIT"), data)
+
+	// 最后一个客户端断开后临时channel被删除
+	conn.Close()
+	assert.True(t, waitFor(2*time.Second, func() bool {
+		_, err := topic.GetExistingChannel("ch#ephemeral")
+		return err != nil
+	}))
+}
+
+func TestProtocolV2IdentifyMaxAttempts(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 5
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("attempts_test")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("poison")))
+
+	subscribe := func(identify map[string]interface{}) (net.Conn, *bufio.Reader) {
+		conn, r := mustConnectNSQD(t, nsqd)
+		body, _ := json.Marshal(identify)
+		writeCommand(t, conn, "IDENTIFY", body)
+		_, data := readFrame(t, r)
+		assert.Equal(t, okBytes, data)
+		writeCommand(t, conn, "SUB attempts_test ch", nil)
+		_, data = readFrame(t, r)
+		assert.Equal(t, okBytes, data)
+		return conn, r
+	}
+
+	// SUB时把IDENTIFY的max_attempts设置到channel上，第一次REQ就进死信topic
+	conn, r := subscribe(map[string]interface{}{"max_attempts": 1})
+	defer conn.Close()
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1), channel.MaxAttempts())
+	writeCommand(t, conn, "RDY 1", nil)
+	msg := readMessage(t, r)
+	writeCommand(t, conn, "REQ "+string(msg.ID[:])+" 0", nil)
+	assert.True(t, waitFor(time.Second, func() bool {
+		dlq, err := nsqd.GetExistingTopic("attempts_test.dlq")
+		return err == nil && dlq.Depth() == 1
+	}))
+
+	// 没有max_attempts的客户端不修改channel的设置
+	conn2, _ := subscribe(map[string]interface{}{})
+	defer conn2.Close()
+	assert.Equal(t, uint16(1), channel.MaxAttempts())
+	conn3, _ := subscribe(map[string]interface{}{"max_attempts": -1})
+	defer conn3.Close()
+	assert.Equal(t, uint16(5), channel.MaxAttempts())
+
+	conn4, r4 := mustConnectNSQD(t, nsqd)
+	defer conn4.Close()
+	writeCommand(t, conn4, "IDENTIFY", []byte(`{"max_attempts":-2}`))
+	frameType, data := readFrame(t, r4)
+	assert.Equal(t, frameTypeError, frameType)
+	assert.True(t, bytes.HasPrefix(data, []byte("E_BAD_BODY")), string(data))
+}
+
+func TestProtocolV2RdyOutOfRange(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, r := mustConnectNSQD(t, nsqd)
+	defer conn.Close()
+
+	writeCommand(t, conn, "SUB rdy_test ch", nil)
+	frameType, _ := readFrame(t, r)
+	assert.Equal(t, frameTypeResponse, frameType)
+
+	writeCommand(t, conn, fmt.Sprintf("RDY %d", opts.MaxRdyCount+1), nil)
+	frameType, data := readFrame(t, r)
+	assert.Equal(t, frameTypeError, frameType)
+	assert.True(t, bytes.HasPrefix(data, []byte("E_INVALID")), string(data))
+}
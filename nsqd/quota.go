@@ -0,0 +1,204 @@
+package nsqd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// topic的磁盘用量超过配额，拒绝发布
+var ErrQuotaExceeded = errors.New("E_QUOTA_EXCEEDED")
+
+// 超过配额时丢弃最旧数据（而不是拒绝发布）的topic（由QuotaDropTopics配置）
+func isQuotaDropTopic(opts *Options, topicName string) bool {
+	return opts.quotaDropTopicsRegex != nil && opts.quotaDropTopicsRegex.MatchString(topicName)
+}
+
+// 可以丢弃最旧数据的持久化队列，目前只有segment实现
+type segmentDropper interface {
+	DropOldestSegment() (int64, error)
+}
+
+// 找到被包装在里面的segmentDropper
+func findSegmentDropper(bq BackendQueue) segmentDropper {
+	for bq != nil {
+		if d, ok := bq.(segmentDropper); ok {
+			return d
+		}
+		w, ok := bq.(wrappedBackendQueue)
+		if !ok {
+			return nil
+		}
+		bq = w.Unwrap()
+	}
+	return nil
+}
+
+// 队列的数据文件在磁盘上占用的字节数，diskqueue、segment和topic的保留日志文件都算
+func backendDiskBytes(dataPath string, backendName string) int64 {
+	var total int64
+	for _, pattern := range []string{".diskqueue.*.dat", ".segment.*.dat", ".retention.*.dat"} {
+		files, _ := filepath.Glob(path.Join(dataPath, backendName+pattern))
+		for _, fn := range files {
+			if fi, err := os.Stat(fn); err == nil {
+				total += fi.Size()
+			}
+		}
+	}
+	return total
+}
+
+// DataPath下所有文件的大小
+func dataPathBytes(dataPath string) (int64, error) {
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			total += f.Size()
+		}
+	}
+	return total, nil
+}
+
+// topic和它所有channel的持久化队列，以及队列对应的文件名
+type topicBackend struct {
+	name    string
+	backend BackendQueue
+}
+
+func (t *Topic) diskBackends() []topicBackend {
+	if t.ephemeral || isMemOnlyTopic(t.ctx.nsqd.getOpts(), t.name) {
+		return nil
+	}
+	backends := []topicBackend{{t.name, t.backend}}
+	t.RLock()
+	for _, c := range t.channelMap {
+		if c.ephemeral {
+			continue
+		}
+		backends = append(backends, topicBackend{getBackendName(t.name, c.name), c.backend})
+	}
+	t.RUnlock()
+	return backends
+}
+
+// 定时统计磁盘用量并执行配额
+func (n *NSQD) quotaLoop() {
+	ticker := time.NewTicker(n.getOpts().QuotaCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.checkQuotas()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "QUOTA: closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) checkQuotas() {
+	opts := n.getOpts()
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	total, err := dataPathBytes(opts.DataPath)
+	if err != nil {
+		n.logf(LOG_ERROR, "QUOTA: failed to stat --data-path=%s - %s", opts.DataPath, err)
+		return
+	}
+	atomic.StoreInt64(&n.dataPathBytes, total)
+	globalExceeded := opts.MaxDataPathBytes > 0 && total > opts.MaxDataPathBytes
+
+	for _, t := range topics {
+		backends := t.diskBackends()
+		var sizes []int64
+		var used int64
+		for _, b := range backends {
+			size := backendDiskBytes(opts.DataPath, b.name)
+			sizes = append(sizes, size)
+			used += size
+		}
+		exceeded := len(backends) > 0 &&
+			(globalExceeded || (opts.MaxTopicBackendBytes > 0 && used > opts.MaxTopicBackendBytes))
+
+		if exceeded && isQuotaDropTopic(opts, t.name) {
+			used = n.dropOldest(t, backends, sizes, used, total)
+			exceeded = false
+		}
+		atomic.StoreInt64(&t.backendBytes, used)
+
+		var flag int32
+		if exceeded {
+			flag = 1
+		}
+		if atomic.SwapInt32(&t.quotaExceeded, flag) != flag {
+			if exceeded {
+				n.logf(LOG_WARN, "QUOTA: TOPIC(%s) over quota (%d bytes, data path %d bytes), rejecting publishes",
+					t.name, used, total)
+			} else {
+				n.logf(LOG_INFO, "QUOTA: TOPIC(%s) back under quota (%d bytes)", t.name, used)
+			}
+		}
+	}
+}
+
+// 从最大的队列开始丢弃最旧的segment，直到回到配额以内或者没有可以丢弃的数据，返回丢弃后的用量
+func (n *NSQD) dropOldest(t *Topic, backends []topicBackend, sizes []int64, used int64, total int64) int64 {
+	opts := n.getOpts()
+	skip := make([]bool, len(backends))
+	for {
+		overTopic := opts.MaxTopicBackendBytes > 0 && used > opts.MaxTopicBackendBytes
+		overGlobal := opts.MaxDataPathBytes > 0 && total > opts.MaxDataPathBytes
+		if !overTopic && !overGlobal {
+			return used
+		}
+
+		largest := -1
+		for i := range backends {
+			if !skip[i] && sizes[i] > 0 && (largest == -1 || sizes[i] > sizes[largest]) {
+				largest = i
+			}
+		}
+		if largest == -1 {
+			return used
+		}
+
+		b := backends[largest]
+		d := findSegmentDropper(b.backend)
+		if d == nil {
+			skip[largest] = true
+			continue
+		}
+		count, err := d.DropOldestSegment()
+		if err != nil {
+			n.logf(LOG_ERROR, "QUOTA: TOPIC(%s) failed to drop oldest segment of %s - %s", t.name, b.name, err)
+		}
+		// 没有可以丢弃的数据了（剩下的都已经被读走），不再考虑这个队列
+		if err != nil || count == 0 {
+			skip[largest] = true
+		}
+		if count > 0 {
+			n.logf(LOG_WARN, "QUOTA: TOPIC(%s) dropped %d messages from %s", t.name, count, b.name)
+		}
+		size := backendDiskBytes(opts.DataPath, b.name)
+		freed := sizes[largest] - size
+		used -= freed
+		total -= freed
+		sizes[largest] = size
+	}
+}
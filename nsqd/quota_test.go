@@ -0,0 +1,91 @@
+package nsqd
+
+import (
+	"fmt"
+	"nsq-learn/internal/test"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaRejectsPublish(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxTopicBackendBytes = 1
+	opts.QuotaCheckInterval = 10 * time.Millisecond
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	code, _ := httpPub(t, nsqd, "quota_test", []byte("test message"))
+	assert.Equal(t, 200, code)
+
+	topic, err := nsqd.GetExistingTopic("quota_test")
+	assert.Nil(t, err)
+	assert.True(t, waitFor(time.Second, func() bool { return atomic.LoadInt32(&topic.quotaExceeded) == 1 }))
+
+	code, body := httpPub(t, nsqd, "quota_test", []byte("test message"))
+	assert.Equal(t, 507, code)
+	assert.Contains(t, body, "E_QUOTA_EXCEEDED")
+	assert.Equal(t, ErrQuotaExceeded, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+
+	// 其它topic不受影响
+	code, _ = httpPub(t, nsqd, "other_topic", []byte("test message"))
+	assert.Equal(t, 200, code)
+}
+
+func TestQuotaDropsOldestSegments(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BackendType = BackendTypeSegment
+	opts.MaxBytesPerFile = 256
+	opts.MemQueueSize = 0
+	opts.MaxTopicBackendBytes = 1024
+	opts.QuotaDropTopics = "^drop_"
+	opts.QuotaCheckInterval = 10 * time.Millisecond
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("drop_test")
+	for i := 0; i < 100; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("message-%04d", i)))
+		assert.Nil(t, topic.PutMessage(msg))
+	}
+	assert.True(t, waitFor(time.Second, func() bool {
+		bytes := atomic.LoadInt64(&topic.backendBytes)
+		return bytes > 0 && bytes <= opts.MaxTopicBackendBytes
+	}))
+	assert.True(t, topic.Depth() < 100)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&topic.quotaExceeded))
+	assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("still accepted"))))
+}
+
+func TestQuotaCountsRetentionLog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxTopicBackendBytes = 1024
+	opts.QuotaCheckInterval = 10 * time.Millisecond
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("retention_quota")
+	channel := topic.GetChannel("ch")
+	assert.Nil(t, topic.SetRetention(time.Hour))
+	for i := 0; i < 50; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("message-%04d", i)))
+		assert.Nil(t, topic.PutMessage(msg))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 50 }))
+	// 消息都已经被消费，只剩下保留日志占用磁盘
+	assert.Nil(t, channel.Empty())
+
+	assert.True(t, waitFor(time.Second, func() bool { return atomic.LoadInt32(&topic.quotaExceeded) == 1 }))
+	assert.True(t, atomic.LoadInt64(&topic.backendBytes) > opts.MaxTopicBackendBytes)
+	assert.Equal(t, ErrQuotaExceeded, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+}
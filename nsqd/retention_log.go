@@ -0,0 +1,324 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 保留模式:
+// topic分发给channel的每条消息同时追加到保留日志，超过保留时长后按文件整体删除。
+// 保留期内可以把channel回退到某个时间点，重新投递这个时间点之后的消息（见Topic.RewindChannel）。
+// 保留日志文件 <topic>.retention.<seq>.dat，每条记录:
+// [8-byte 时间戳(纳秒)][4-byte 长度][N-byte 消息(同Message.WriteTo，配置了密钥时是加密后的记录)]
+// 时间戳不加密，启动时扫描文件只需要读记录头
+
+var errRetentionDisabled = errors.New("retention is disabled")
+
+// 顺序投递的channel必须按队列顺序投递，不能插入重放的消息
+var errRewindOrdered = errors.New("rewind is not supported for ordered channels")
+
+type retentionSegment struct {
+	seq    int64
+	lastTS int64
+	size   int64
+}
+
+type retentionLog struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	// 保留时长（纳秒），0表示关闭
+	retention int64
+
+	sync.Mutex
+	ctx  *context
+	name string
+	// 按seq排序，最后一个是正在写入的文件
+	segments  []*retentionSegment
+	writeFile *os.File
+	// 下一个文件的seq，文件删光之后也不会重复使用
+	nextSeq int64
+}
+
+func newRetentionLog(ctx *context, name string) *retentionLog {
+	l := &retentionLog{
+		ctx:  ctx,
+		name: name,
+	}
+	err := l.scan()
+	if err != nil {
+		ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to scan retention log - %s", name, err)
+	}
+	return l
+}
+
+func (l *retentionLog) fileName(seq int64) string {
+	return path.Join(l.ctx.nsqd.getOpts().DataPath, fmt.Sprintf("%s.retention.%06d.dat", l.name, seq))
+}
+
+// 所有保留文件共用一个key ID文件，文件都删光之后一起删除
+func (l *retentionLog) keyIDsFileName() string {
+	return keyIDsFileName(l.ctx.nsqd.getOpts().DataPath, l.name+".retention")
+}
+
+// 启动时扫描已有的文件，重新开始写入时总是用新文件，不追加到旧文件后面
+func (l *retentionLog) scan() error {
+	pattern := path.Join(l.ctx.nsqd.getOpts().DataPath, l.name+".retention.*.dat")
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, fn := range files {
+		var seq int64
+		_, err := fmt.Sscanf(path.Base(fn)[len(l.name):], ".retention.%d.dat", &seq)
+		if err != nil {
+			continue
+		}
+		seg := &retentionSegment{seq: seq}
+		seg.size, err = l.readSegment(seq, -1, func(ts int64, size int64, r *bufio.Reader) error {
+			if ts > seg.lastTS {
+				seg.lastTS = ts
+			}
+			_, err := r.Discard(int(size))
+			return err
+		})
+		if err != nil {
+			l.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to scan retention file %s - %s", l.name, fn, err)
+		}
+		l.segments = append(l.segments, seg)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].seq < l.segments[j].seq })
+	if len(l.segments) > 0 {
+		l.nextSeq = l.segments[len(l.segments)-1].seq + 1
+	}
+	return nil
+}
+
+// 顺序读取文件中的记录，返回读完的字节数，fn需要读完或跳过记录内容
+// limit不小于0时只读到这个位置，文件末尾不完整的记录会被忽略
+func (l *retentionLog) readSegment(seq int64, limit int64, fn func(ts int64, size int64, r *bufio.Reader) error) (int64, error) {
+	f, err := os.Open(l.fileName(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var hdr [12]byte
+	var offset int64
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			break
+		}
+		ts := int64(binary.BigEndian.Uint64(hdr[:8]))
+		size := int64(binary.BigEndian.Uint32(hdr[8:]))
+		if limit >= 0 && offset+int64(len(hdr))+size > limit {
+			break
+		}
+		err = fn(ts, size, r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(hdr)) + size
+	}
+	return offset, nil
+}
+
+func (l *retentionLog) Retention() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.retention))
+}
+
+// 设置保留时长，0表示关闭并删除已经保留的数据
+func (l *retentionLog) setRetention(retention time.Duration) {
+	atomic.StoreInt64(&l.retention, int64(retention))
+	if retention > 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.prune(time.Now().UnixNano() + 1)
+}
+
+// 追加一条消息，没有开启保留模式时什么都不做
+func (l *retentionLog) append(msg *Message) error {
+	retention := atomic.LoadInt64(&l.retention)
+	if retention <= 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 12))
+	_, err := msg.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if l.ctx.nsqd.keyring != nil {
+		sealed, err := l.ctx.nsqd.keyring.seal(data[12:])
+		if err != nil {
+			return err
+		}
+		data = append(data[:12], sealed...)
+	}
+	binary.BigEndian.PutUint64(data[:8], uint64(msg.Timestamp))
+	binary.BigEndian.PutUint32(data[8:12], uint32(len(data)-12))
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune(time.Now().UnixNano() - retention)
+	var seg *retentionSegment
+	if l.writeFile != nil {
+		seg = l.segments[len(l.segments)-1]
+	}
+	if seg == nil || seg.size >= l.ctx.nsqd.getOpts().MaxBytesPerFile {
+		seg, err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.writeFile.Write(data)
+	seg.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if msg.Timestamp > seg.lastTS {
+		seg.lastTS = msg.Timestamp
+	}
+	return nil
+}
+
+// 关闭当前文件，开始写新文件
+func (l *retentionLog) rotate() (*retentionSegment, error) {
+	if l.writeFile != nil {
+		l.writeFile.Close()
+		l.writeFile = nil
+	}
+	// 密钥在启动时加载，每个新文件记录一次就够了
+	if l.ctx.nsqd.keyring != nil {
+		err := recordKeyID(l.keyIDsFileName(), l.ctx.nsqd.keyring.activeID, len(l.segments) == 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	seg := &retentionSegment{seq: l.nextSeq}
+	l.nextSeq++
+	f, err := os.OpenFile(l.fileName(seg.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.writeFile = f
+	l.segments = append(l.segments, seg)
+	return seg, nil
+}
+
+// 删除所有消息都早于cutoff的文件
+func (l *retentionLog) prune(cutoff int64) {
+	for len(l.segments) > 0 && l.segments[0].lastTS < cutoff {
+		if len(l.segments) == 1 && l.writeFile != nil {
+			l.writeFile.Close()
+			l.writeFile = nil
+		}
+		fn := l.fileName(l.segments[0].seq)
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			l.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to remove retention file %s - %s", l.name, fn, err)
+			return
+		}
+		l.segments = l.segments[1:]
+		if len(l.segments) == 0 {
+			err = removeKeyIDs(l.keyIDsFileName())
+			if err != nil {
+				l.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to remove retention key ids - %s", l.name, err)
+			}
+		}
+	}
+}
+
+// 按顺序读出时间戳不早于since的消息
+// 只在开始时加锁取文件列表和当前大小，读文件时不加锁，不会阻塞发布时的append
+// 开始之后追加的消息不会读到，读的过程中过期删除的文件跳过
+func (l *retentionLog) replay(since int64, fn func(*Message)) error {
+	retention := atomic.LoadInt64(&l.retention)
+	if retention <= 0 {
+		return errRetentionDisabled
+	}
+
+	l.Lock()
+	l.prune(time.Now().UnixNano() - retention)
+	var segments []retentionSegment
+	for _, seg := range l.segments {
+		if seg.lastTS >= since {
+			segments = append(segments, *seg)
+		}
+	}
+	l.Unlock()
+
+	for _, seg := range segments {
+		_, err := l.readSegment(seg.seq, seg.size, func(ts int64, size int64, r *bufio.Reader) error {
+			if ts < since {
+				_, err := r.Discard(int(size))
+				return err
+			}
+			data := make([]byte, size)
+			_, err := io.ReadFull(r, data)
+			if err != nil {
+				return err
+			}
+			if l.ctx.nsqd.keyring != nil {
+				data, err = l.ctx.nsqd.keyring.open(data)
+				if err != nil {
+					l.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to open retained message - %s", l.name, err)
+					return nil
+				}
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				l.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to decode retained message - %s", l.name, err)
+				return nil
+			}
+			fn(msg)
+			return nil
+		})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 保留日志占用的字节数
+func (l *retentionLog) bytes() int64 {
+	l.Lock()
+	defer l.Unlock()
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+	return total
+}
+
+func (l *retentionLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.writeFile != nil {
+		l.writeFile.Close()
+		l.writeFile = nil
+	}
+}
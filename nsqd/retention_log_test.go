@@ -0,0 +1,73 @@
+package nsqd
+
+import (
+	"nsq-learn/internal/test"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionLog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// 每个文件只放一条消息
+	opts.MaxBytesPerFile = 1
+	nsqd := testStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	l := newRetentionLog(&context{nsqd}, "retention_test")
+	// 没开启保留模式时不写入
+	assert.Nil(t, l.append(NewMessage(MessageID{}, []byte("ignored"))))
+	assert.Equal(t, errRetentionDisabled, l.replay(0, func(*Message) {}))
+	l.setRetention(time.Hour)
+
+	old := NewMessage(MessageID{}, []byte("old"))
+	old.Timestamp = time.Now().Add(-2 * time.Hour).UnixNano()
+	assert.Nil(t, l.append(old))
+	var since int64
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(MessageID{}, make([]byte, 40))
+		msg.Body[0] = byte(i)
+		if i == 2 {
+			since = msg.Timestamp
+		}
+		assert.Nil(t, l.append(msg))
+	}
+	// 超过保留时长的文件已经删除
+	assert.Equal(t, int64(1), l.segments[0].seq)
+
+	replay := func(l *retentionLog) []byte {
+		var got []byte
+		assert.Nil(t, l.replay(since, func(msg *Message) { got = append(got, msg.Body[0]) }))
+		return got
+	}
+	assert.Equal(t, []byte{2, 3, 4}, replay(l))
+
+	// 读文件时不持有锁，回调里可以继续追加，开始之后追加的消息不会读到
+	var got []byte
+	assert.Nil(t, l.replay(since, func(msg *Message) {
+		got = append(got, msg.Body[0])
+		if msg.Body[0] == 2 {
+			extra := NewMessage(MessageID{}, make([]byte, 40))
+			extra.Body[0] = 5
+			assert.Nil(t, l.append(extra))
+		}
+	}))
+	assert.Equal(t, []byte{2, 3, 4}, got)
+	assert.Equal(t, []byte{2, 3, 4, 5}, replay(l))
+
+	// 重新打开后从文件恢复
+	l.close()
+	l2 := newRetentionLog(&context{nsqd}, "retention_test")
+	l2.setRetention(time.Hour)
+	assert.Equal(t, []byte{2, 3, 4, 5}, replay(l2))
+	assert.Equal(t, l.bytes(), l2.bytes())
+
+	// 关闭保留模式时删除数据
+	l2.setRetention(0)
+	assert.Equal(t, int64(0), l2.bytes())
+	l2.close()
+}
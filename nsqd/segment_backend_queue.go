@@ -0,0 +1,773 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"nsq-learn/internal/lg"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 分段日志格式的消息存储队列，和go-diskqueue的区别是每条记录带有CRC32校验
+//
+// 每个segment文件的格式:
+// [4-byte magic "NSQS"][4-byte 格式版本][记录]...
+// 每条记录的格式:
+// [4-byte 数据长度][4-byte 数据的CRC32][N-byte 数据]
+//
+// 读到校验失败的记录会跳过并计数，长度不合法时整个segment后面的数据都不可信，会跳到下一个segment
+// 启动时会检查正在写入的segment，把没有写完整的尾部截掉
+
+const (
+	segmentMagic         = "NSQS"
+	segmentFormatVersion = uint32(1)
+	segmentHeaderSize    = 8
+	segmentRecordHdrSize = 8
+)
+
+var errSegmentCorrupt = errors.New("segment corrupt")
+var errChecksum = errors.New("checksum mismatch")
+
+type segmentBackendQueue struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	depth        int64
+	corruptCount int64
+
+	sync.RWMutex
+
+	name            string
+	dataPath        string
+	maxBytesPerFile int64
+	minMsgSize      int32
+	maxMsgSize      int32
+	syncEvery       int64
+	syncTimeout     time.Duration
+	exitFlag        int32
+	needSync        bool
+	logf            lg.AppLogFunc
+
+	// 已经被读走的位置
+	readSeg int64
+	readPos int64
+	// 写入的位置
+	writeSeg int64
+	writePos int64
+	// 已经读出来但还没有被取走的记录之后的位置
+	nextReadSeg int64
+	nextReadPos int64
+	peeked      []byte
+
+	readFile  *os.File
+	reader    *bufio.Reader
+	writeFile *os.File
+
+	readChan          chan []byte
+	writeChan         chan []byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	dropChan          chan int
+	dropResponseChan  chan dropResult
+	exitChan          chan int
+	exitSyncChan      chan int
+}
+
+// DropOldestSegment的结果
+type dropResult struct {
+	count int64
+	err   error
+}
+
+func newSegmentBackendQueue(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, logf lg.AppLogFunc) BackendQueue {
+	q := &segmentBackendQueue{
+		name:              name,
+		dataPath:          dataPath,
+		maxBytesPerFile:   maxBytesPerFile,
+		minMsgSize:        minMsgSize,
+		maxMsgSize:        maxMsgSize,
+		syncEvery:         syncEvery,
+		syncTimeout:       syncTimeout,
+		logf:              logf,
+		readChan:          make(chan []byte),
+		writeChan:         make(chan []byte),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		dropChan:          make(chan int),
+		dropResponseChan:  make(chan dropResult),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+	}
+
+	err := q.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to retrieveMetaData - %s", q.name, err)
+	}
+	err = q.recoverWriteSegment()
+	if err != nil {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to recover write segment - %s", q.name, err)
+	}
+	q.nextReadSeg = q.readSeg
+	q.nextReadPos = q.readPos
+
+	go q.ioLoop()
+	return q
+}
+
+func (q *segmentBackendQueue) Put(data []byte) error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.writeChan <- data
+	return <-q.writeResponseChan
+}
+
+func (q *segmentBackendQueue) ReadChan() chan []byte {
+	return q.readChan
+}
+
+func (q *segmentBackendQueue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+// 因为校验失败被跳过的记录数（segment损坏时按一条计）
+func (q *segmentBackendQueue) CorruptCount() int64 {
+	return atomic.LoadInt64(&q.corruptCount)
+}
+
+func (q *segmentBackendQueue) Close() error {
+	err := q.exit(false)
+	if err != nil {
+		return err
+	}
+	err = q.sync()
+	q.closeFiles()
+	return err
+}
+
+func (q *segmentBackendQueue) Delete() error {
+	return q.exit(true)
+}
+
+func (q *segmentBackendQueue) exit(deleted bool) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	q.exitFlag = 1
+
+	if deleted {
+		q.logf(LOG_INFO, "SEGMENTQUEUE(%s): deleting", q.name)
+	} else {
+		q.logf(LOG_INFO, "SEGMENTQUEUE(%s): closing", q.name)
+	}
+
+	close(q.exitChan)
+	<-q.exitSyncChan
+
+	if deleted {
+		q.closeFiles()
+		q.deleteAllFiles()
+		return os.Remove(q.metaDataFileName())
+	}
+	return nil
+}
+
+// 清空队列，删除所有segment文件
+func (q *segmentBackendQueue) Empty() error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.logf(LOG_INFO, "SEGMENTQUEUE(%s): emptying", q.name)
+
+	q.emptyChan <- 1
+	return <-q.emptyResponseChan
+}
+
+// 丢弃最旧的一个segment里还没被读走的记录，返回丢弃的记录数
+// 只剩正在写入的segment时先换一个新的segment再丢弃
+func (q *segmentBackendQueue) DropOldestSegment() (int64, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	q.dropChan <- 1
+	res := <-q.dropResponseChan
+	return res.count, res.err
+}
+
+func (q *segmentBackendQueue) deleteAllFiles() {
+	for seg := q.readSeg; seg <= q.writeSeg; seg++ {
+		err := os.Remove(q.fileName(seg))
+		if err != nil && !os.IsNotExist(err) {
+			q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to remove data file - %s", q.name, err)
+		}
+	}
+}
+
+func (q *segmentBackendQueue) closeFiles() {
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+}
+
+// 丢弃所有数据，从下一个segment重新开始
+func (q *segmentBackendQueue) skipToNextSegment() error {
+	q.closeFiles()
+	q.deleteAllFiles()
+
+	q.writeSeg++
+	q.writePos = 0
+	q.readSeg = q.writeSeg
+	q.readPos = 0
+	q.nextReadSeg = q.writeSeg
+	q.nextReadPos = 0
+	q.peeked = nil
+	atomic.StoreInt64(&q.depth, 0)
+
+	return q.persistMetaData()
+}
+
+func (q *segmentBackendQueue) dropOldestSegment() (int64, error) {
+	if q.readSeg == q.writeSeg && q.readPos == q.writePos {
+		return 0, nil
+	}
+
+	count, err := q.countRecords(q.readSeg, q.readPos)
+	if err != nil {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to count records in %s - %s",
+			q.name, q.fileName(q.readSeg), err)
+	}
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	if q.readSeg == q.writeSeg {
+		if q.writeFile != nil {
+			q.writeFile.Close()
+			q.writeFile = nil
+		}
+		q.writeSeg++
+		q.writePos = 0
+	}
+	err = os.Remove(q.fileName(q.readSeg))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	q.logf(LOG_WARN, "SEGMENTQUEUE(%s) dropped %d records in %s", q.name, count, q.fileName(q.readSeg))
+	q.readSeg++
+	q.readPos = 0
+	q.nextReadSeg = q.readSeg
+	q.nextReadPos = 0
+	q.peeked = nil
+	q.needSync = true
+	q.checkTailCorruption(atomic.AddInt64(&q.depth, -count))
+	return count, nil
+}
+
+// 统计segment从pos开始的完整记录数，遇到损坏的数据就停止
+func (q *segmentBackendQueue) countRecords(seg int64, pos int64) (int64, error) {
+	f, err := os.OpenFile(q.fileName(seg), os.O_RDONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if pos == 0 {
+		err = q.checkSegmentHeader(f)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	reader := bufio.NewReader(f)
+	var count int64
+	for {
+		_, err := q.readRecord(reader)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil && err != errChecksum {
+			return count, err
+		}
+		count++
+	}
+}
+
+func (q *segmentBackendQueue) writeSegmentHeader(w io.Writer) error {
+	var hdr [segmentHeaderSize]byte
+	copy(hdr[:4], segmentMagic)
+	binary.BigEndian.PutUint32(hdr[4:], segmentFormatVersion)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+func (q *segmentBackendQueue) checkSegmentHeader(r io.Reader) error {
+	var hdr [segmentHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return err
+	}
+	if string(hdr[:4]) != segmentMagic {
+		return fmt.Errorf("%w - bad magic %q", errSegmentCorrupt, hdr[:4])
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != segmentFormatVersion {
+		return fmt.Errorf("%w - unsupported version %d", errSegmentCorrupt, v)
+	}
+	return nil
+}
+
+// 按记录格式编码：长度 + CRC32 + 数据
+func encodeSegmentRecord(data []byte) []byte {
+	buf := make([]byte, segmentRecordHdrSize+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[segmentRecordHdrSize:], data)
+	return buf
+}
+
+// 读一条记录，长度不合法或者数据不完整返回errSegmentCorrupt，校验失败返回errChecksum
+func (q *segmentBackendQueue) readRecord(r io.Reader) ([]byte, error) {
+	var hdr [segmentRecordHdrSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	msgSize := int32(binary.BigEndian.Uint32(hdr[:4]))
+	checksum := binary.BigEndian.Uint32(hdr[4:])
+	if msgSize < q.minMsgSize || msgSize > q.maxMsgSize {
+		return nil, fmt.Errorf("%w - invalid message size %d", errSegmentCorrupt, msgSize)
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return data, errChecksum
+	}
+	return data, nil
+}
+
+// 读出下一条记录，不移动readPos，被取走之后才移动
+func (q *segmentBackendQueue) readOne() ([]byte, error) {
+	for {
+		if q.readFile == nil {
+			f, err := os.OpenFile(q.fileName(q.nextReadSeg), os.O_RDONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			q.readFile = f
+			if q.nextReadPos == 0 {
+				err = q.checkSegmentHeader(f)
+				if err != nil {
+					return nil, err
+				}
+				q.nextReadPos = segmentHeaderSize
+			} else {
+				_, err = f.Seek(q.nextReadPos, 0)
+				if err != nil {
+					return nil, err
+				}
+			}
+			q.reader = bufio.NewReader(f)
+		}
+
+		data, err := q.readRecord(q.reader)
+		if err == io.EOF && q.nextReadSeg < q.writeSeg {
+			// 这个segment已经读完了，换到下一个
+			q.readFile.Close()
+			q.readFile = nil
+			q.nextReadSeg++
+			q.nextReadPos = 0
+			continue
+		}
+		if err != nil && err != errChecksum {
+			return nil, err
+		}
+		q.nextReadPos += segmentRecordHdrSize + int64(len(data))
+		return data, err
+	}
+}
+
+// 记录被取走了，移动readPos，读完的segment删除
+func (q *segmentBackendQueue) moveForward() {
+	oldReadSeg := q.readSeg
+	q.readSeg = q.nextReadSeg
+	q.readPos = q.nextReadPos
+	q.peeked = nil
+	depth := atomic.AddInt64(&q.depth, -1)
+
+	if oldReadSeg != q.readSeg {
+		q.needSync = true
+		for seg := oldReadSeg; seg < q.readSeg; seg++ {
+			err := os.Remove(q.fileName(seg))
+			if err != nil {
+				q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to Remove(%s) - %s", q.name, q.fileName(seg), err)
+			}
+		}
+	}
+
+	q.checkTailCorruption(depth)
+}
+
+// 读写位置重合时depth应该是0，不是的话说明之前有数据损坏，重置一下
+func (q *segmentBackendQueue) checkTailCorruption(depth int64) {
+	if q.readSeg < q.writeSeg || q.readPos < q.writePos {
+		return
+	}
+	if depth != 0 {
+		if depth < 0 {
+			q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) negative depth at tail (%d), metadata corruption, resetting 0...", q.name, depth)
+		} else {
+			q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) positive depth at tail (%d), data loss, resetting 0...", q.name, depth)
+		}
+		atomic.StoreInt64(&q.depth, 0)
+		q.needSync = true
+	}
+}
+
+// 处理读出错：校验失败只跳过这条记录，其它错误跳过整个segment
+func (q *segmentBackendQueue) handleReadError(err error) {
+	atomic.AddInt64(&q.corruptCount, 1)
+
+	if err == errChecksum {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) skipping corrupt record at %s:%d - %s",
+			q.name, q.fileName(q.readSeg), q.readPos, err)
+		q.moveForward()
+		return
+	}
+
+	badFn := q.fileName(q.nextReadSeg)
+	q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) reading at %s:%d - %s, skipping segment",
+		q.name, badFn, q.nextReadPos, err)
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	if q.nextReadSeg == q.writeSeg {
+		// 正在写入的segment坏了，后面的写入换到新的segment
+		if q.writeFile != nil {
+			q.writeFile.Close()
+			q.writeFile = nil
+		}
+		q.writeSeg++
+		q.writePos = 0
+	}
+	// 前面已经读完的segment可以删掉了
+	for seg := q.readSeg; seg < q.nextReadSeg; seg++ {
+		os.Remove(q.fileName(seg))
+	}
+	// 保留坏掉的文件，方便排查
+	renameErr := os.Rename(badFn, badFn+".bad")
+	if renameErr != nil {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to rename bad file %s - %s", q.name, badFn, renameErr)
+	}
+	q.readSeg = q.nextReadSeg + 1
+	q.readPos = 0
+	q.nextReadSeg = q.readSeg
+	q.nextReadPos = 0
+	q.peeked = nil
+	q.needSync = true
+	q.checkTailCorruption(atomic.LoadInt64(&q.depth))
+}
+
+func (q *segmentBackendQueue) writeOne(data []byte) error {
+	dataLen := int32(len(data))
+	if dataLen < q.minMsgSize || dataLen > q.maxMsgSize {
+		return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, q.maxMsgSize)
+	}
+
+	recordSize := int64(segmentRecordHdrSize + dataLen)
+	// 当前segment放不下这条记录就换一个新的
+	if q.writePos > segmentHeaderSize && q.writePos+recordSize > q.maxBytesPerFile {
+		q.writeSeg++
+		q.writePos = 0
+		if q.writeFile != nil {
+			q.writeFile.Sync()
+			q.writeFile.Close()
+			q.writeFile = nil
+		}
+		err := q.persistMetaData()
+		if err != nil {
+			q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to sync - %s", q.name, err)
+		}
+	}
+
+	if q.writeFile == nil {
+		f, err := os.OpenFile(q.fileName(q.writeSeg), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		q.writeFile = f
+		if q.writePos == 0 {
+			err = q.writeSegmentHeader(f)
+			if err != nil {
+				q.writeFile.Close()
+				q.writeFile = nil
+				return err
+			}
+			q.writePos = segmentHeaderSize
+		}
+		_, err = f.Seek(q.writePos, 0)
+		if err != nil {
+			q.writeFile.Close()
+			q.writeFile = nil
+			return err
+		}
+	}
+
+	_, err := q.writeFile.Write(encodeSegmentRecord(data))
+	if err != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+		return err
+	}
+
+	q.writePos += recordSize
+	atomic.AddInt64(&q.depth, 1)
+	return nil
+}
+
+// 把写入的数据和元数据刷到磁盘
+func (q *segmentBackendQueue) sync() error {
+	if q.writeFile != nil {
+		err := q.writeFile.Sync()
+		if err != nil {
+			q.writeFile.Close()
+			q.writeFile = nil
+			return err
+		}
+	}
+
+	err := q.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	q.needSync = false
+	return nil
+}
+
+// 启动时检查正在写入的segment，截掉没写完整的尾部，并把元数据之后写入的完整记录算进depth
+func (q *segmentBackendQueue) recoverWriteSegment() error {
+	fn := q.fileName(q.writeSeg)
+	f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+
+	// 文件比元数据记录的短，说明文件被截断过，从头检查，不再累加depth
+	countRecovered := true
+	start := q.writePos
+	if start > size {
+		q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) %s is shorter (%d) than recorded write position (%d)",
+			q.name, fn, size, q.writePos)
+		start = 0
+		countRecovered = false
+	}
+	if start == 0 {
+		if size == 0 {
+			return nil
+		}
+		err = q.checkSegmentHeader(f)
+		if err != nil {
+			return err
+		}
+		start = segmentHeaderSize
+	}
+	_, err = f.Seek(start, 0)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	validEnd := start
+	var recovered int64
+	for {
+		data, err := q.readRecord(reader)
+		if err != nil {
+			break
+		}
+		validEnd += segmentRecordHdrSize + int64(len(data))
+		recovered++
+	}
+
+	if validEnd < size {
+		q.logf(LOG_WARN, "SEGMENTQUEUE(%s) truncating %d torn bytes at %s:%d",
+			q.name, size-validEnd, fn, validEnd)
+		err = f.Truncate(validEnd)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if countRecovered && recovered > 0 {
+		q.logf(LOG_INFO, "SEGMENTQUEUE(%s) recovered %d records written after last sync", q.name, recovered)
+		atomic.AddInt64(&q.depth, recovered)
+	}
+	q.writePos = validEnd
+	if q.readSeg == q.writeSeg && q.readPos > q.writePos {
+		q.readPos = q.writePos
+	}
+	if !countRecovered {
+		q.checkTailCorruption(atomic.LoadInt64(&q.depth))
+	}
+	return q.persistMetaData()
+}
+
+func (q *segmentBackendQueue) retrieveMetaData() error {
+	f, err := os.OpenFile(q.metaDataFileName(), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var depth int64
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&depth,
+		&q.readSeg, &q.readPos,
+		&q.writeSeg, &q.writePos)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&q.depth, depth)
+	return nil
+}
+
+func (q *segmentBackendQueue) persistMetaData() error {
+	fileName := q.metaDataFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	data := fmt.Sprintf("%d\n%d,%d\n%d,%d\n",
+		atomic.LoadInt64(&q.depth),
+		q.readSeg, q.readPos,
+		q.writeSeg, q.writePos)
+	err := writeSyncFile(tmpFileName, []byte(data))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (q *segmentBackendQueue) metaDataFileName() string {
+	return path.Join(q.dataPath, fmt.Sprintf("%s.segment.meta.dat", q.name))
+}
+
+func (q *segmentBackendQueue) fileName(seg int64) string {
+	return path.Join(q.dataPath, fmt.Sprintf("%s.segment.%06d.dat", q.name, seg))
+}
+
+// 所有文件操作都在这个协程里进行
+func (q *segmentBackendQueue) ioLoop() {
+	var err error
+	var count int64
+	var r chan []byte
+
+	syncTicker := time.NewTicker(q.syncTimeout)
+
+	for {
+		// 写入或读取的次数达到syncEvery就刷盘
+		if count == q.syncEvery {
+			q.needSync = true
+		}
+
+		if q.needSync {
+			err = q.sync()
+			if err != nil {
+				q.logf(LOG_ERROR, "SEGMENTQUEUE(%s) failed to sync - %s", q.name, err)
+			}
+			count = 0
+		}
+
+		if q.readSeg < q.writeSeg || q.readPos < q.writePos {
+			if q.peeked == nil {
+				q.peeked, err = q.readOne()
+				if err != nil {
+					q.handleReadError(err)
+					continue
+				}
+			}
+			r = q.readChan
+		} else {
+			r = nil
+		}
+
+		select {
+		case r <- q.peeked:
+			count++
+			q.moveForward()
+		case <-q.emptyChan:
+			q.emptyResponseChan <- q.skipToNextSegment()
+			count = 0
+		case <-q.dropChan:
+			n, err := q.dropOldestSegment()
+			q.dropResponseChan <- dropResult{count: n, err: err}
+		case data := <-q.writeChan:
+			count++
+			q.writeResponseChan <- q.writeOne(data)
+		case <-syncTicker.C:
+			if count == 0 {
+				continue
+			}
+			q.needSync = true
+		case <-q.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	q.logf(LOG_INFO, "SEGMENTQUEUE(%s): closing ... ioLoop", q.name)
+	syncTicker.Stop()
+	q.exitSyncChan <- 1
+}
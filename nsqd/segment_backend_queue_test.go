@@ -0,0 +1,167 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"nsq-learn/internal/lg"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSegmentQueue(t *testing.T, dataPath string, maxBytesPerFile int64) *segmentBackendQueue {
+	logf := func(level lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(level.String()+": "+f, args...)
+	}
+	return newSegmentBackendQueue("test", dataPath, maxBytesPerFile, 4, 1<<10, 1, time.Second, logf).(*segmentBackendQueue)
+}
+
+func segmentTestData(i int) []byte {
+	return []byte(fmt.Sprintf("message-%04d", i))
+}
+
+func TestSegmentBackendQueueRoll(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// 每个segment只能放下几条记录
+	q := newTestSegmentQueue(t, tmpDir, 64)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, q.Put(segmentTestData(i)))
+	}
+	assert.Equal(t, int64(20), q.Depth())
+	assert.True(t, q.writeSeg > 3)
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, segmentTestData(i), <-q.ReadChan())
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return q.Depth() == 0 }))
+	assert.Nil(t, q.Close())
+
+	// 读完的segment都被删除了
+	files, _ := ioutil.ReadDir(tmpDir)
+	for _, f := range files {
+		assert.NotEqual(t, q.fileName(0), f.Name())
+	}
+}
+
+func TestSegmentBackendQueueReopen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	q := newTestSegmentQueue(t, tmpDir, 1<<20)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, q.Put(segmentTestData(i)))
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, segmentTestData(i), <-q.ReadChan())
+	}
+	assert.Nil(t, q.Close())
+
+	q = newTestSegmentQueue(t, tmpDir, 1<<20)
+	defer q.Close()
+	assert.Equal(t, int64(6), q.Depth())
+	for i := 4; i < 10; i++ {
+		assert.Equal(t, segmentTestData(i), <-q.ReadChan())
+	}
+}
+
+func TestSegmentBackendQueueTornTail(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	q := newTestSegmentQueue(t, tmpDir, 1<<20)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, q.Put(segmentTestData(i)))
+	}
+	assert.Nil(t, q.Close())
+	goodSize := q.writePos
+
+	// 模拟写到一半崩溃：一条完整但没有同步元数据的记录，再加半条记录
+	f, err := os.OpenFile(q.fileName(0), os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	rec := encodeSegmentRecord(segmentTestData(5))
+	f.Write(rec)
+	f.Write(rec[:10])
+	f.Close()
+
+	q = newTestSegmentQueue(t, tmpDir, 1<<20)
+	defer q.Close()
+	assert.Equal(t, goodSize+int64(len(rec)), q.writePos)
+	stat, err := os.Stat(q.fileName(0))
+	assert.Nil(t, err)
+	assert.Equal(t, q.writePos, stat.Size())
+	assert.Equal(t, int64(6), q.Depth())
+
+	// 截断之后可以继续正常写入
+	assert.Nil(t, q.Put(segmentTestData(6)))
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, segmentTestData(i), <-q.ReadChan())
+	}
+}
+
+func TestSegmentBackendQueueCorruptRecord(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	q := newTestSegmentQueue(t, tmpDir, 1<<20)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Put(segmentTestData(i)))
+	}
+	assert.Nil(t, q.Close())
+
+	// 改掉第二条记录里的一个字节
+	recordSize := int64(segmentRecordHdrSize + len(segmentTestData(0)))
+	f, err := os.OpenFile(q.fileName(0), os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("X"), segmentHeaderSize+recordSize+segmentRecordHdrSize)
+	assert.Nil(t, err)
+	f.Close()
+
+	q = newTestSegmentQueue(t, tmpDir, 1<<20)
+	defer q.Close()
+	assert.Equal(t, segmentTestData(0), <-q.ReadChan())
+	assert.Equal(t, segmentTestData(2), <-q.ReadChan())
+	assert.Equal(t, int64(1), q.CorruptCount())
+	assert.True(t, waitFor(time.Second, func() bool { return q.Depth() == 0 }))
+}
+
+func TestSegmentBackendQueueDropOldest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	q := newTestSegmentQueue(t, tmpDir, 64)
+	defer q.Close()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, q.Put(segmentTestData(i)))
+	}
+	// 先读走一条，只丢弃第一个segment剩下的记录
+	assert.Equal(t, segmentTestData(0), <-q.ReadChan())
+	assert.True(t, waitFor(time.Second, func() bool { return q.Depth() == 19 }))
+
+	count, err := q.DropOldestSegment()
+	assert.Nil(t, err)
+	assert.True(t, count > 0)
+	assert.Equal(t, int64(19)-count, q.Depth())
+	assert.Equal(t, segmentTestData(int(count)+1), <-q.ReadChan())
+
+	// 一直丢到只剩正在写入的segment，最后会换一个新的segment再丢
+	for q.Depth() > 0 {
+		count, err = q.DropOldestSegment()
+		assert.Nil(t, err)
+		assert.True(t, count > 0)
+	}
+	count, err = q.DropOldestSegment()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	assert.Nil(t, q.Put(segmentTestData(100)))
+	assert.Equal(t, segmentTestData(100), <-q.ReadChan())
+}
@@ -0,0 +1,204 @@
+package nsqd
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type TopicStats struct {
+	TopicName    string         `json:"topic_name"`
+	Channels     []ChannelStats `json:"channels"`
+	Depth        int64          `json:"depth"`
+	BackendDepth int64          `json:"backend_depth"`
+	MessageCount uint64         `json:"message_count"`
+	Paused       bool           `json:"paused"`
+	TTL          int64          `json:"ttl"` // 毫秒
+	// 磁盘用量和是否超过配额
+	BackendBytes  int64 `json:"backend_bytes"`
+	QuotaExceeded bool  `json:"quota_exceeded"`
+	// 重复发布的次数和去重索引中的key数
+	DedupeHits uint64 `json:"dedupe_hits"`
+	DedupeKeys int    `json:"dedupe_keys"`
+	// 保留时长（毫秒）和保留日志占用的字节数
+	Retention      int64 `json:"retention"`
+	RetentionBytes int64 `json:"retention_bytes"`
+	BackendStats
+}
+
+func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	var dedupeKeys int
+	if t.dedupe != nil {
+		dedupeKeys = t.dedupe.len()
+	}
+	var retentionBytes int64
+	if t.retention != nil {
+		retentionBytes = t.retention.bytes()
+	}
+	return TopicStats{
+		TopicName:      t.name,
+		Channels:       channels,
+		Depth:          t.Depth(),
+		BackendDepth:   t.backend.Depth(),
+		MessageCount:   atomic.LoadUint64(&t.messageCount),
+		Paused:         t.IsPaused(),
+		TTL:            int64(t.TTL() / time.Millisecond),
+		BackendBytes:   atomic.LoadInt64(&t.backendBytes),
+		QuotaExceeded:  atomic.LoadInt32(&t.quotaExceeded) == 1,
+		DedupeHits:     atomic.LoadUint64(&t.dedupeHits),
+		DedupeKeys:     dedupeKeys,
+		Retention:      int64(t.Retention() / time.Millisecond),
+		RetentionBytes: retentionBytes,
+		BackendStats:   NewBackendStats(t.backend),
+	}
+}
+
+type ChannelStats struct {
+	ChannelName     string `json:"channel_name"`
+	Depth           int64  `json:"depth"`
+	BackendDepth    int64  `json:"backend_depth"`
+	InFlightCount   int    `json:"in_flight_count"`
+	DeferredCount   int    `json:"deferred_count"`
+	MessageCount    uint64 `json:"message_count"`
+	RequeueCount    uint64 `json:"requeue_count"`
+	TimeoutCount    uint64 `json:"timeout_count"`
+	ExpiredCount    uint64 `json:"expired_count"`
+	MaxAttempts     uint16 `json:"max_attempts"`
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+	Filter          string `json:"filter,omitempty"`
+	FilteredCount   uint64 `json:"filtered_count"`
+	Ordered         bool   `json:"ordered"`
+	Paused          bool   `json:"paused"`
+	ClientCount     int    `json:"client_count"`
+	BackendStats
+}
+
+func NewChannelStats(c *Channel) ChannelStats {
+	c.inFlightMutex.Lock()
+	inflight := len(c.inFlightMessages)
+	c.inFlightMutex.Unlock()
+	c.deferredMutex.Lock()
+	deferred := len(c.deferredMessages)
+	c.deferredMutex.Unlock()
+
+	return ChannelStats{
+		ChannelName:     c.name,
+		Depth:           c.Depth(),
+		BackendDepth:    c.backend.Depth(),
+		InFlightCount:   inflight,
+		DeferredCount:   deferred,
+		MessageCount:    atomic.LoadUint64(&c.messageCount),
+		RequeueCount:    atomic.LoadUint64(&c.requeueCount),
+		TimeoutCount:    atomic.LoadUint64(&c.timeoutCount),
+		ExpiredCount:    atomic.LoadUint64(&c.expiredCount),
+		MaxAttempts:     c.MaxAttempts(),
+		DeadLetterCount: atomic.LoadUint64(&c.deadLetterCount),
+		Filter:          c.FilterExpr(),
+		FilteredCount:   atomic.LoadUint64(&c.filteredCount),
+		Ordered:         c.IsOrdered(),
+		Paused:          c.IsPaused(),
+		ClientCount:     c.ClientCount(),
+		BackendStats:    NewBackendStats(c.backend),
+	}
+}
+
+// 持久化队列相关的统计，队列没有对应功能时为0，json中省略
+type BackendStats struct {
+	UncompressedBytes int64   `json:"uncompressed_bytes,omitempty"`
+	CompressedBytes   int64   `json:"compressed_bytes,omitempty"`
+	CompressionRatio  float64 `json:"compression_ratio,omitempty"`
+	CorruptCount      int64   `json:"corrupt_count,omitempty"`
+}
+
+// 包装了其它队列的持久化队列（压缩等）实现这个接口，统计时逐层展开
+type wrappedBackendQueue interface {
+	Unwrap() BackendQueue
+}
+
+func NewBackendStats(bq BackendQueue) BackendStats {
+	var s BackendStats
+	for bq != nil {
+		switch q := bq.(type) {
+		case *compressedBackendQueue:
+			s.UncompressedBytes, s.CompressedBytes = q.CompressionStats()
+			if s.UncompressedBytes > 0 {
+				s.CompressionRatio = float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+			}
+		case *segmentBackendQueue:
+			s.CorruptCount = q.CorruptCount()
+		}
+		w, ok := bq.(wrappedBackendQueue)
+		if !ok {
+			break
+		}
+		bq = w.Unwrap()
+	}
+	return s
+}
+
+type Topics []*Topic
+
+func (t Topics) Len() int      { return len(t) }
+func (t Topics) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+type TopicsByName struct {
+	Topics
+}
+
+func (t TopicsByName) Less(i, j int) bool { return t.Topics[i].name < t.Topics[j].name }
+
+type Channels []*Channel
+
+func (c Channels) Len() int      { return len(c) }
+func (c Channels) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+type ChannelsByName struct {
+	Channels
+}
+
+func (c ChannelsByName) Less(i, j int) bool { return c.Channels[i].name < c.Channels[j].name }
+
+// 获取topic和channel的统计信息，topic或channel为空时返回全部
+func (n *NSQD) GetStats(topic string, channel string) []TopicStats {
+	n.RLock()
+	var realTopics []*Topic
+	if topic == "" {
+		realTopics = make([]*Topic, 0, len(n.topicMap))
+		for _, t := range n.topicMap {
+			realTopics = append(realTopics, t)
+		}
+	} else if val, exists := n.topicMap[topic]; exists {
+		realTopics = []*Topic{val}
+	} else {
+		n.RUnlock()
+		return []TopicStats{}
+	}
+	n.RUnlock()
+	sort.Sort(TopicsByName{realTopics})
+
+	topics := make([]TopicStats, 0, len(realTopics))
+	for _, t := range realTopics {
+		t.RLock()
+		var realChannels []*Channel
+		if channel == "" {
+			realChannels = make([]*Channel, 0, len(t.channelMap))
+			for _, c := range t.channelMap {
+				realChannels = append(realChannels, c)
+			}
+		} else if val, exists := t.channelMap[channel]; exists {
+			realChannels = []*Channel{val}
+		} else {
+			t.RUnlock()
+			continue
+		}
+		t.RUnlock()
+		sort.Sort(ChannelsByName{realChannels})
+
+		channels := make([]ChannelStats, 0, len(realChannels))
+		for _, c := range realChannels {
+			channels = append(channels, NewChannelStats(c))
+		}
+		topics = append(topics, NewTopicStats(t, channels))
+	}
+	return topics
+}
@@ -0,0 +1,67 @@
+package nsqd
+
+import (
+	"io"
+	"net"
+	"nsq-learn/internal/lg"
+	"nsq-learn/internal/protocol"
+	"sync"
+)
+
+// 处理TCP连接，读出客户端的协议版本后交给对应的协议处理
+type tcpServer struct {
+	ctx   *context
+	conns sync.Map
+}
+
+func (p *tcpServer) Handle(clientConn net.Conn) {
+	p.logf(LOG_INFO, "TCP: new client(%s)", clientConn.RemoteAddr())
+
+	// 客户端连接后先发送4字节的协议版本号，目前只有"  V2"
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(clientConn, buf)
+	if err != nil {
+		p.logf(LOG_ERROR, "failed to read protocol version - %s", err)
+		clientConn.Close()
+		return
+	}
+	protocolMagic := string(buf)
+
+	p.logf(LOG_INFO, "CLIENT(%s): desired protocol magic '%s'",
+		clientConn.RemoteAddr(), protocolMagic)
+
+	var prot protocol.Protocol
+	switch protocolMagic {
+	case "  V2":
+		prot = &protocolV2{ctx: p.ctx}
+	default:
+		protocol.SendFramedResponse(clientConn, frameTypeError, []byte("E_BAD_PROTOCOL"))
+		clientConn.Close()
+		p.logf(LOG_ERROR, "client(%s) bad protocol magic '%s'",
+			clientConn.RemoteAddr(), protocolMagic)
+		return
+	}
+
+	// 记录连接，退出时统一关闭
+	p.conns.Store(clientConn.RemoteAddr(), clientConn)
+
+	err = prot.IOLoop(clientConn)
+	if err != nil {
+		p.logf(LOG_ERROR, "client(%s) - %s", clientConn.RemoteAddr(), err)
+	}
+
+	p.conns.Delete(clientConn.RemoteAddr())
+}
+
+// 关闭所有客户端连接，IOLoop读失败后退出
+func (p *tcpServer) CloseAll() {
+	p.conns.Range(func(k, v interface{}) bool {
+		v.(net.Conn).Close()
+		return true
+	})
+}
+
+// 使用tcp组件的日志等级
+func (p *tcpServer) logf(level lg.LogLevel, f string, args ...interface{}) {
+	p.ctx.nsqd.logfFor([]string{logComponentTCP}, level, nil, f, args...)
+}
@@ -1,94 +1,453 @@
 package nsqd
 
 import (
-	"nsq-learn/internal/lg"
+	"bytes"
+	"errors"
 	"nsq-learn/internal/util"
 	"strings"
 	"sync"
 	"sync/atomic"
-
-	diskqueue "github.com/nsqio/go-diskqueue"
+	"time"
 )
 
 type Topic struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	messageCount uint64
+	// topic和它的channel在磁盘上占用的字节数，由quotaLoop更新，没有配置配额时为0
+	backendBytes int64
+	// 消息的存活时间（纳秒），0表示不过期
+	ttl int64
+	// 重复发布（幂等key已存在）的次数
+	dedupeHits uint64
+
 	sync.RWMutex
-	name      string
-	startChan chan int
-	exitChan  chan int
-	waitGroup util.WaitGroupWrapper
-	ctx       *context
+	name              string
+	startChan         chan int
+	exitChan          chan int
+	channelUpdateChan chan int
+	waitGroup         util.WaitGroupWrapper
+	ctx               *context
+	// 内存消息队列，满了之后写到backend
+	memoryMsgChan chan *Message
 	// 信息存储队列（用来持久化消息）
 	backend   BackendQueue
 	ephemeral bool
 	// 是否暂停
 	paused int32
+	// 是否正在退出
+	exitFlag int32
+	// 是否超过磁盘配额，超过时拒绝发布
+	quotaExceeded int32
 	// channel表
 	channelMap map[string]*Channel
+	// 消息ID生成器
+	idFactory      *guidFactory
+	deleteCallback func(*Topic)
+	// 幂等key的去重索引，没有开启去重时为nil，见dedupe.go
+	dedupe *dedupeIndex
+	// 保留日志，临时topic和只使用内存的topic没有，见retention_log.go
+	retention *retentionLog
 }
 
 func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topic {
 	t := &Topic{
-		name:       topicName,
-		ctx:        ctx,
-		startChan:  make(chan int, 1),
-		exitChan:   make(chan int),
-		channelMap: make(map[string]*Channel),
+		name:              topicName,
+		ctx:               ctx,
+		startChan:         make(chan int, 1),
+		exitChan:          make(chan int),
+		channelUpdateChan: make(chan int),
+		memoryMsgChan:     make(chan *Message, ctx.nsqd.getOpts().MemQueueSize),
+		channelMap:        make(map[string]*Channel),
+		idFactory:         NewGUIDFactory(ctx.nsqd.getOpts().ID),
+		deleteCallback:    deleteCallback,
 	}
 	// 如果topic名后面有#ephemeral则为临时topic
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := ctx.nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.logLevel, lg.LogLevel(level), f, args...)
-		}
-		t.backend = diskqueue.New(
-			topicName,
-			ctx.nsqd.getOpts().DataPath,
-			ctx.nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			ctx.nsqd.getOpts().SyncEvery,
-			ctx.nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		t.backend = newBackendQueue(ctx, topicName, topicName)
+		if !isMemOnlyTopic(ctx.nsqd.getOpts(), topicName) {
+			t.retention = newRetentionLog(ctx, topicName)
+		}
+	}
+	opts := ctx.nsqd.getOpts()
+	if opts.DedupeWindow > 0 {
+		t.dedupe = newDedupeIndex(opts.DedupeWindow, opts.DedupeMaxKeys)
+		if opts.DedupePersist && !t.ephemeral {
+			err := t.dedupe.load(t.dedupeFileName())
+			if err != nil {
+				ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to load dedupe index - %s", t.name, err)
+			}
+		}
 	}
+	// 消息分发协程，Start之后才会真正开始分发
+	t.waitGroup.Wrap(t.messagePump)
 	// 通知nsqd，进行持久化操作
 	t.ctx.nsqd.Notify(t)
 	return t
 }
 
+// 是否正在退出
+func (t *Topic) Exiting() bool {
+	return atomic.LoadInt32(&t.exitFlag) == 1
+}
+
 // 查找或创建channel(线程安全)
 func (t *Topic) GetChannel(channelName string) *Channel {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew := t.getOrCreateChannel(channelName, nil, false)
 	t.Unlock()
-	// 如果是新的channel，需要触发更新channel通知(待做)
 	if isNew {
+		t.notifyChannelUpdate()
 	}
 	return channel
 }
 
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+// 创建channel时的选项，只能在创建时设置
+type ChannelOptions struct {
+	// 过滤条件，为空表示不过滤，见channel_filter.go
+	Filter string
+	// 顺序投递模式，见channel_ordered.go
+	Ordered bool
+}
+
+// 已经存在的channel选项不同
+var (
+	errFilterConflict  = errors.New("channel exists with a different filter")
+	errOrderedConflict = errors.New("channel exists with a different ordered mode")
+)
+
+// 按选项查找或创建channel，已经存在的channel选项不同时返回errFilterConflict或errOrderedConflict
+func (t *Topic) GetChannelWithOptions(channelName string, opts ChannelOptions) (*Channel, error) {
+	var filter *channelFilter
+	if opts.Filter != "" {
+		var err error
+		filter, err = parseChannelFilter(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.Lock()
+	channel, isNew := t.getOrCreateChannel(channelName, filter, opts.Ordered)
+	t.Unlock()
+	if isNew {
+		t.notifyChannelUpdate()
+	} else if channel.FilterExpr() != opts.Filter {
+		return channel, errFilterConflict
+	} else if channel.IsOrdered() != opts.Ordered {
+		return channel, errOrderedConflict
+	}
+	return channel, nil
+}
+
+// 通知messagePump更新channel列表
+func (t *Topic) notifyChannelUpdate() {
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+}
+
+func (t *Topic) getOrCreateChannel(channelName string, filter *channelFilter, ordered bool) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel := NewChannel(t.name, channelName, t.ctx, deleteCallback)
+		channel.setTTL(t.TTL())
+		// 放进channelMap之前设置，messagePump拿到的channel一定带着过滤条件和投递模式
+		channel.filter = filter
+		if ordered {
+			channel.startOrdered()
+		}
 		t.channelMap[channelName] = channel
-		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
+		t.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
 	}
 	return channel, false
 }
 
-// 删除已经存在的channel，需要，移除channel表中的数据，执行channel的删除操作，触发更新channel信息通知等（待做）
+// 获取已经存在的channel
+func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
+	t.RLock()
+	defer t.RUnlock()
+	channel, ok := t.channelMap[channelName]
+	if !ok {
+		return nil, errors.New("channel does not exist")
+	}
+	return channel, nil
+}
+
+// 删除已经存在的channel，消息和持久化队列都会删除
 func (t *Topic) DeleteExistingChannel(channelName string) error {
+	t.Lock()
+	channel, ok := t.channelMap[channelName]
+	if !ok {
+		t.Unlock()
+		return errors.New("channel does not exist")
+	}
+	delete(t.channelMap, channelName)
+	t.Unlock()
+
+	t.logf(LOG_INFO, "TOPIC(%s): deleting channel %s", t.name, channel.name)
+
+	// 先从channelMap中删除，再删除channel，messagePump更新列表前写入的消息会返回exiting
+	channel.Delete()
+
+	t.notifyChannelUpdate()
+	t.ctx.nsqd.Notify(t)
+	return nil
+}
+
+// 发布一条消息到topic
+func (t *Topic) PutMessage(m *Message) error {
+	t.RLock()
+	defer t.RUnlock()
+	if t.Exiting() {
+		return errors.New("exiting")
+	}
+	if atomic.LoadInt32(&t.quotaExceeded) == 1 {
+		return ErrQuotaExceeded
+	}
+	err := t.put(m)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&t.messageCount, 1)
+	return nil
+}
+
+// 发布多条消息到topic，中途失败时已经写入的消息不会撤回
+func (t *Topic) PutMessages(msgs []*Message) error {
+	t.RLock()
+	defer t.RUnlock()
+	if t.Exiting() {
+		return errors.New("exiting")
+	}
+	if atomic.LoadInt32(&t.quotaExceeded) == 1 {
+		return ErrQuotaExceeded
+	}
+	for i, m := range msgs {
+		err := t.put(m)
+		if err != nil {
+			atomic.AddUint64(&t.messageCount, uint64(i))
+			return err
+		}
+	}
+	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
 	return nil
 }
 
+func (t *Topic) put(m *Message) error {
+	select {
+	case t.memoryMsgChan <- m:
+	default:
+		// 内存队列满了，写入持久化队列
+		b := bufferPoolGet()
+		err := writeMessageToBackend(b, m, t.backend)
+		bufferPoolPut(b)
+		if err != nil {
+			t.logf(LOG_ERROR, "TOPIC(%s) ERROR: failed to write message to backend - %s", t.name, err)
+			// 写磁盘失败，标记nsqd为不健康（内存队列满了不算）
+			if err != ErrBackendFull {
+				t.ctx.nsqd.setHealth(healthBackend, err)
+			}
+			return err
+		}
+		t.ctx.nsqd.clearHealth(healthBackend)
+	}
+	return nil
+}
+
+// 生成一个新的消息ID，序列号用完时稍等再重试
+func (t *Topic) GenerateID() MessageID {
+	var i int64 = 0
+	for {
+		id, err := t.idFactory.NewGUID()
+		if err == nil {
+			return id.Hex()
+		}
+		if i%10000 == 0 {
+			t.logf(LOG_ERROR, "TOPIC(%s): failed to create guid - %s", t.name, err)
+		}
+		time.Sleep(time.Millisecond)
+		i++
+	}
+}
+
+// topic的消息数量（内存 + 持久化队列）
+func (t *Topic) Depth() int64 {
+	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
+}
+
+// 将topic的消息分发给所有channel
+func (t *Topic) messagePump() {
+	var msg *Message
+	var buf []byte
+	var err error
+	var chans []*Channel
+	var memoryMsgChan chan *Message
+	var backendChan chan []byte
+
+	// Start之前不分发消息，但也不能阻塞GetChannel
+	for {
+		select {
+		case <-t.channelUpdateChan:
+			continue
+		case <-t.exitChan:
+			goto exit
+		case <-t.startChan:
+		}
+		break
+	}
+	t.RLock()
+	for _, c := range t.channelMap {
+		chans = append(chans, c)
+	}
+	t.RUnlock()
+	// 没有channel的时候不读取消息，消息留在topic里
+	if len(chans) > 0 && !t.IsPaused() {
+		memoryMsgChan = t.memoryMsgChan
+		backendChan = t.backend.ReadChan()
+	}
+
+	for {
+		select {
+		case msg = <-memoryMsgChan:
+		case buf = <-backendChan:
+			msg, err = decodeMessage(buf)
+			if err != nil {
+				t.logf(LOG_ERROR, "failed to decode message - %s", err)
+				continue
+			}
+		case <-t.channelUpdateChan:
+			chans = chans[:0]
+			t.RLock()
+			for _, c := range t.channelMap {
+				chans = append(chans, c)
+			}
+			t.RUnlock()
+			if len(chans) == 0 || t.IsPaused() {
+				memoryMsgChan = nil
+				backendChan = nil
+			} else {
+				memoryMsgChan = t.memoryMsgChan
+				backendChan = t.backend.ReadChan()
+			}
+			continue
+		case <-t.exitChan:
+			goto exit
+		}
+
+		// 保留模式下先写保留日志再分发
+		if t.retention != nil {
+			err := t.retention.append(msg)
+			if err != nil {
+				t.logf(LOG_ERROR, "TOPIC(%s): failed to append msg(%s) to retention log - %s", t.name, msg.ID, err)
+			}
+		}
+
+		for i, channel := range chans {
+			if !channel.matchFilter(msg) {
+				continue
+			}
+			chanMsg := msg
+			// 每个channel需要独立的消息对象，第一个channel直接复用
+			if i > 0 {
+				chanMsg = NewMessage(msg.ID, msg.Body)
+				chanMsg.Timestamp = msg.Timestamp
+				chanMsg.Headers = msg.Headers
+				chanMsg.deferred = msg.deferred
+			}
+			if chanMsg.deferred != 0 {
+				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
+				continue
+			}
+			err := channel.PutMessage(chanMsg)
+			if err != nil {
+				t.logf(LOG_ERROR,
+					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
+					t.name, msg.ID, channel.name, err)
+			}
+		}
+	}
+
+exit:
+	t.logf(LOG_INFO, "TOPIC(%s): closing ... messagePump", t.name)
+}
+
+// 消息的存活时间，0表示不过期
+func (t *Topic) TTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.ttl))
+}
+
+// 设置消息的存活时间，同时更新所有channel，超过存活时间的消息在channel读取时丢弃
+func (t *Topic) SetTTL(ttl time.Duration) {
+	atomic.StoreInt64(&t.ttl, int64(ttl))
+	t.RLock()
+	for _, c := range t.channelMap {
+		c.setTTL(ttl)
+	}
+	t.RUnlock()
+	t.ctx.nsqd.Notify(t)
+}
+
+// 消息的保留时长，0表示没有开启保留模式
+func (t *Topic) Retention() time.Duration {
+	if t.retention == nil {
+		return 0
+	}
+	return t.retention.Retention()
+}
+
+// 设置消息的保留时长，分发给channel的消息会保留这么长时间，期间可以回退channel重新投递
+// 0表示关闭，已经保留的数据会被删除
+func (t *Topic) SetRetention(retention time.Duration) error {
+	if t.retention == nil {
+		return errors.New("retention is not supported for ephemeral or memory only topics")
+	}
+	t.retention.setRetention(retention)
+	t.ctx.nsqd.Notify(t)
+	return nil
+}
+
+// 把channel回退到since，重新投递保留日志中since之后的消息，返回重新投递的消息数
+// channel里还没投递的消息和延时消息保留不动，所以since之后还没消费的消息会重复投递一次
+// 重新投递的消息使用新的消息ID，不会和还在投递中的原消息冲突
+func (t *Topic) RewindChannel(channelName string, since time.Time) (int, error) {
+	if t.retention == nil || t.retention.Retention() <= 0 {
+		return 0, errRetentionDisabled
+	}
+	channel, err := t.GetExistingChannel(channelName)
+	if err != nil {
+		return 0, err
+	}
+	if channel.IsOrdered() {
+		return 0, errRewindOrdered
+	}
+
+	var count int
+	err = t.retention.replay(since.UnixNano(), func(msg *Message) {
+		if !channel.matchFilter(msg) {
+			return
+		}
+		msg.ID = t.GenerateID()
+		err := channel.PutMessage(msg)
+		if err != nil {
+			t.logf(LOG_ERROR, "TOPIC(%s): failed to put msg(%s) to channel(%s) - %s",
+				t.name, msg.ID, channel.name, err)
+			return
+		}
+		count++
+	})
+	t.logf(LOG_INFO, "TOPIC(%s): rewound channel(%s) to %s, %d messages replayed",
+		t.name, channel.name, since, count)
+	return count, err
+}
+
 // 当前topic是否暂停
 func (t *Topic) IsPaused() bool {
 	return atomic.LoadInt32(&t.paused) == 1
@@ -96,11 +455,71 @@ func (t *Topic) IsPaused() bool {
 
 // 开始Topic服务
 func (t *Topic) Start() {
-
+	select {
+	case t.startChan <- 1:
+	default:
+	}
 }
 
-// 关闭Topic
-func (t *Topic) Close() {
+// 关闭Topic，内存中的消息会写入持久化队列，重启后可以恢复
+func (t *Topic) Close() error {
+	if !atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1) {
+		return errors.New("exiting")
+	}
+
+	t.logf(LOG_INFO, "TOPIC(%s): closing", t.name)
+
+	// 停止messagePump
+	close(t.exitChan)
+	t.waitGroup.Wait()
+
+	// 关闭所有channel
+	t.RLock()
+	for _, channel := range t.channelMap {
+		err := channel.Close()
+		if err != nil {
+			t.logf(LOG_ERROR, "channel(%s) close - %s", channel.name, err)
+		}
+	}
+	t.RUnlock()
+
+	// 把内存中的消息写到持久化队列
+	t.flush()
+	if t.retention != nil {
+		t.retention.close()
+	}
+	if t.dedupe != nil && t.ctx.nsqd.getOpts().DedupePersist && !t.ephemeral {
+		err := t.dedupe.persist(t.dedupeFileName())
+		if err != nil {
+			t.logf(LOG_ERROR, "TOPIC(%s): failed to persist dedupe index - %s", t.name, err)
+		}
+	}
 	// 关闭文件系统
-	t.backend.Close()
+	return t.backend.Close()
+}
+
+func (t *Topic) flush() error {
+	var msgBuf bytes.Buffer
+
+	if len(t.memoryMsgChan) > 0 {
+		t.logf(LOG_INFO,
+			"TOPIC(%s): flushing %d memory messages to backend",
+			t.name, len(t.memoryMsgChan))
+	}
+
+	for {
+		select {
+		case msg := <-t.memoryMsgChan:
+			err := writeMessageToBackend(&msgBuf, msg, t.backend)
+			if err != nil {
+				t.logf(LOG_ERROR,
+					"ERROR: failed to write message to backend - %s", err)
+			}
+		default:
+			goto finish
+		}
+	}
+
+finish:
+	return nil
 }
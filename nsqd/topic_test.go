@@ -3,7 +3,9 @@ package nsqd
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,6 +26,7 @@ func TestGetTopic(t *testing.T) {
 }
 
 func topicMustStartNSQD(opts *Options) *NSQD {
+	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
 	if opts.DataPath == "" {
 		tmpDir, err := ioutil.TempDir("", "nsq-test-")
@@ -36,3 +39,102 @@ func topicMustStartNSQD(opts *Options) *NSQD {
 	nsqd.Main()
 	return nsqd
 }
+
+func TestMemOnlyTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.MemOnlyTopics = "^mem_"
+	opts.MemQueueSize = 0
+	nsqd := topicMustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("mem_test")
+	_, ok := topic.backend.(*memoryBackendQueue)
+	assert.True(t, ok)
+	channel := topic.GetChannel("ch")
+	_, ok = channel.backend.(*memoryBackendQueue)
+	assert.True(t, ok)
+
+	diskTopic := nsqd.GetTopic("disk_test")
+	_, ok = diskTopic.backend.(*memoryBackendQueue)
+	assert.False(t, ok)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	// 内存队列大小为0，消息经过topic的内存backend进入channel的内存backend
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 3 }))
+
+	// DataPath下不会有mem_test的队列文件
+	files, err := ioutil.ReadDir(opts.DataPath)
+	assert.Nil(t, err)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), "mem_test"), f.Name())
+	}
+}
+
+func TestTopicFanoutFilter(t *testing.T) {
+	opts := NewOptions()
+	nsqd := topicMustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("filter_test")
+	all := topic.GetChannel("all")
+	orders, err := topic.GetChannelWithOptions("orders", ChannelOptions{Filter: "prefix:order."})
+	assert.Nil(t, err)
+
+	for _, body := range []string{"order.1", "user.1", "order.2"} {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body))))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return all.Depth() == 3 }))
+	assert.True(t, waitFor(time.Second, func() bool { return orders.Depth() == 2 }))
+	stats := nsqd.GetStats("filter_test", "orders")
+	assert.Equal(t, uint64(1), stats[0].Channels[0].FilteredCount)
+
+	// 已经存在的channel不能换过滤条件
+	_, err = topic.GetChannelWithOptions("orders", ChannelOptions{Filter: "prefix:user."})
+	assert.Equal(t, errFilterConflict, err)
+	_, err = topic.GetChannelWithOptions("orders", ChannelOptions{Filter: "prefix:order."})
+	assert.Nil(t, err)
+}
+
+func TestTopicRewindKeepsBacklog(t *testing.T) {
+	opts := NewOptions()
+	nsqd := topicMustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("rewind_keep")
+	channel := topic.GetChannel("ch")
+	assert.Nil(t, topic.SetRetention(time.Hour))
+
+	for _, body := range []string{"a", "b"} {
+		assert.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body))))
+	}
+	assert.True(t, waitFor(time.Second, func() bool { return channel.Depth() == 2 }))
+	// a正在投递中，b还在channel里，另外有一条延迟消息
+	inFlight := <-channel.memoryMsgChan
+	assert.Nil(t, channel.StartInFlightTimeout(inFlight, 1, time.Minute))
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("deferred")), time.Minute)
+
+	count, err := topic.RewindChannel("ch", time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(3), channel.Depth())
+	assert.Equal(t, 1, len(channel.inFlightMessages))
+	assert.Equal(t, 1, len(channel.deferredMessages))
+
+	// 重放的消息使用新的ID，可以和投递中的原消息同时in-flight
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		msg := <-channel.memoryMsgChan
+		bodies = append(bodies, string(msg.Body))
+		if string(msg.Body) == "a" {
+			assert.NotEqual(t, inFlight.ID, msg.ID)
+			assert.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+		}
+	}
+	assert.Equal(t, []string{"b", "a", "b"}, bodies)
+	assert.Equal(t, 2, len(channel.inFlightMessages))
+}
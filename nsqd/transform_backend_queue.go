@@ -0,0 +1,320 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"nsq-learn/internal/lg"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 关闭时还没被取走的消息保存在 <name>.<kind>.held.dat，重新打开时先投递
+// 每条记录: [4-byte 长度][N-byte 记录(encode之后的数据)]
+const heldFileSuffix = ".held.dat"
+
+// 写入前encode、读取时decode的持久化队列包装，压缩和加密都基于它
+// readLoop从底层队列读出记录解码后拿在手上，等readChan被取走
+// 关闭时手上的消息要排在底层队列前面：底层也是这种包装时交给它一起处理，否则写到单独的文件
+type transformBackendQueue struct {
+	// 64位原子操作的变量需要放在最前面保证对齐
+	// 已经从底层队列读出来但还没有被取走的消息数
+	holding int64
+
+	sync.RWMutex
+	name     string
+	kind     string
+	dataPath string
+	backend  BackendQueue
+	encode   func([]byte) ([]byte, error)
+	decode   func([]byte) ([]byte, error)
+	exitFlag int32
+	logf     lg.AppLogFunc
+
+	// 已经读出来（解码后）还没被取走的消息，按顺序排在底层队列前面
+	held [][]byte
+	// held是从文件加载的，全部取走后删除文件
+	heldFromFile bool
+
+	readChan          chan []byte
+	emptyChan         chan int
+	emptyResponseChan chan error
+	exitChan          chan int
+	exitSyncChan      chan int
+}
+
+// 上一层包装关闭时把手上的消息交给下一层，见closeWithHead
+type headCloser interface {
+	closeWithHead(head [][]byte) error
+}
+
+// 加载上次关闭时保存的消息，需要调用start开始读取
+func newTransformBackendQueue(name string, kind string, dataPath string, backend BackendQueue,
+	encode func([]byte) ([]byte, error), decode func([]byte) ([]byte, error), logf lg.AppLogFunc) *transformBackendQueue {
+	q := &transformBackendQueue{
+		name:              name,
+		kind:              kind,
+		dataPath:          dataPath,
+		backend:           backend,
+		encode:            encode,
+		decode:            decode,
+		logf:              logf,
+		readChan:          make(chan []byte),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+	}
+	err := q.loadHeld()
+	if err != nil {
+		q.logError("failed to load held messages - %s", err)
+	}
+	return q
+}
+
+func (q *transformBackendQueue) start() {
+	go q.readLoop()
+}
+
+func (q *transformBackendQueue) logError(f string, args ...interface{}) {
+	q.logf(LOG_ERROR, "%sQUEUE(%s) "+f, append([]interface{}{strings.ToUpper(q.kind), q.name}, args...)...)
+}
+
+func (q *transformBackendQueue) heldFileName() string {
+	return path.Join(q.dataPath, q.name+"."+q.kind+heldFileSuffix)
+}
+
+func (q *transformBackendQueue) loadHeld() error {
+	data, err := ioutil.ReadFile(q.heldFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	r := bytes.NewReader(data)
+	var hdr [4]byte
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt held file - %s", err)
+		}
+		record := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		_, err = io.ReadFull(r, record)
+		if err != nil {
+			return fmt.Errorf("corrupt held file - %s", err)
+		}
+		msg, err := q.decode(record)
+		if err != nil {
+			q.logError("failed to decode held record - %s", err)
+			continue
+		}
+		q.held = append(q.held, msg)
+	}
+	q.heldFromFile = true
+	atomic.StoreInt64(&q.holding, int64(len(q.held)))
+	return nil
+}
+
+func (q *transformBackendQueue) writeHeld(records [][]byte) error {
+	var buf bytes.Buffer
+	var hdr [4]byte
+	for _, record := range records {
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(record)))
+		buf.Write(hdr[:])
+		buf.Write(record)
+	}
+	fileName := q.heldFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err := writeSyncFile(tmpFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (q *transformBackendQueue) removeHeld() error {
+	err := os.Remove(q.heldFileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *transformBackendQueue) Put(data []byte) error {
+	_, err := q.put(data)
+	return err
+}
+
+// 编码后写入底层队列，返回实际写入的数据
+func (q *transformBackendQueue) put(data []byte) ([]byte, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+
+	encoded, err := q.encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return encoded, q.backend.Put(encoded)
+}
+
+func (q *transformBackendQueue) ReadChan() chan []byte {
+	return q.readChan
+}
+
+// 底层队列的消息数加上readLoop手上的
+func (q *transformBackendQueue) Depth() int64 {
+	return q.backend.Depth() + atomic.LoadInt64(&q.holding)
+}
+
+// 被包装的队列
+func (q *transformBackendQueue) Unwrap() BackendQueue {
+	return q.backend
+}
+
+func (q *transformBackendQueue) Empty() error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.emptyChan <- 1
+	return <-q.emptyResponseChan
+}
+
+func (q *transformBackendQueue) Close() error {
+	return q.closeWithHead(nil)
+}
+
+// 关闭队列，head是上一层手上还没被取走的消息（已经是这一层解码后的格式），排在这一层手上的消息前面
+func (q *transformBackendQueue) closeWithHead(head [][]byte) error {
+	err := q.exit()
+	if err != nil {
+		return err
+	}
+
+	head = append(head, q.held...)
+	q.held = nil
+	atomic.StoreInt64(&q.holding, 0)
+
+	var records [][]byte
+	for _, data := range head {
+		record, err := q.encode(data)
+		if err != nil {
+			q.logError("failed to encode held message - %s", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	if inner, ok := q.backend.(headCloser); ok {
+		// 交给下一层一起保存，这一层不再需要文件
+		err = q.removeHeld()
+		if err != nil {
+			q.logError("failed to remove held messages - %s", err)
+		}
+		return inner.closeWithHead(records)
+	}
+	if len(records) > 0 {
+		err = q.writeHeld(records)
+	} else {
+		err = q.removeHeld()
+	}
+	if err != nil {
+		q.logError("failed to persist held messages - %s", err)
+	}
+	return q.backend.Close()
+}
+
+func (q *transformBackendQueue) Delete() error {
+	err := q.exit()
+	if err != nil {
+		return err
+	}
+	err = q.removeHeld()
+	if err != nil {
+		q.logError("failed to remove held messages - %s", err)
+	}
+	return q.backend.Delete()
+}
+
+func (q *transformBackendQueue) exit() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	q.exitFlag = 1
+
+	close(q.exitChan)
+	<-q.exitSyncChan
+	return nil
+}
+
+// 从底层队列读出记录，解码后交给readChan
+func (q *transformBackendQueue) readLoop() {
+	for {
+		var in chan []byte
+		var out chan []byte
+		var next []byte
+		if len(q.held) == 0 {
+			in = q.backend.ReadChan()
+		} else {
+			out = q.readChan
+			next = q.held[0]
+		}
+
+		select {
+		case data := <-in:
+			msg, err := q.decode(data)
+			if err != nil {
+				q.logError("failed to decode record - %s", err)
+				continue
+			}
+			q.held = append(q.held, msg)
+			atomic.StoreInt64(&q.holding, int64(len(q.held)))
+		case out <- next:
+			q.held = q.held[1:]
+			atomic.StoreInt64(&q.holding, int64(len(q.held)))
+			if len(q.held) == 0 && q.heldFromFile {
+				q.heldFromFile = false
+				err := q.removeHeld()
+				if err != nil {
+					q.logError("failed to remove held messages - %s", err)
+				}
+			}
+		case <-q.emptyChan:
+			q.held = nil
+			atomic.StoreInt64(&q.holding, 0)
+			if q.heldFromFile {
+				q.heldFromFile = false
+				err := q.removeHeld()
+				if err != nil {
+					q.logError("failed to remove held messages - %s", err)
+				}
+			}
+			q.emptyResponseChan <- q.backend.Empty()
+		case <-q.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	q.exitSyncChan <- 1
+}